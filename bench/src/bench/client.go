@@ -27,6 +27,14 @@ const (
 	UserAgent     = "Isutrader/0.0.1"
 	TradeTypeSell = "sell"
 	TradeTypeBuy  = "buy"
+
+	// CSRFトークンのcookieとヘッダ (webappのCSRF_PROTECTION)
+	CSRFCookieName = "XSRF-TOKEN"
+	CSRFHeaderName = "X-XSRF-TOKEN"
+
+	// エラーのレスポンスの error_code です (webappの model.ErrorCode*)
+	ErrorCodeCreditInsufficient = "CREDIT_INSUFFICIENT"
+	ErrorCodeIsuInsufficient    = "ISU_INSUFFICIENT"
 )
 
 var (
@@ -49,12 +57,19 @@ func (e *ErrElapsedTimeOverRetire) Error() string {
 
 type ErrorWithStatus struct {
 	StatusCode int
-	Body       string
-	err        error
+	// Code はbodyのerror_codeで、返さない実装の場合は空です
+	Code string
+	Body string
+	err  error
 }
 
 func errorWithStatus(err error, code int, body string) *ErrorWithStatus {
 	body = strings.TrimSpace(body)
+	var res struct {
+		ErrorCode string `json:"error_code"`
+	}
+	// JSONでない場合はCodeが空になる
+	json.Unmarshal([]byte(body), &res)
 	if utf8.RuneCountInString(body) > 200 {
 		if strings.Index(strings.ToLower(body), "<html") > -1 {
 			body = "(html)"
@@ -64,11 +79,24 @@ func errorWithStatus(err error, code int, body string) *ErrorWithStatus {
 	}
 	return &ErrorWithStatus{
 		StatusCode: code,
+		Code:       res.ErrorCode,
 		Body:       body,
 		err:        err,
 	}
 }
 
+// IsInsufficient は残高 (銀行の残高または椅子) が足りないエラーかどうかを返します
+// error_codeを返さない実装の場合はメッセージで判定します
+func (e *ErrorWithStatus) IsInsufficient() bool {
+	if e.StatusCode != 400 {
+		return false
+	}
+	if e.Code != "" {
+		return e.Code == ErrorCodeCreditInsufficient || e.Code == ErrorCodeIsuInsufficient
+	}
+	return strings.Index(e.Body, "残高") > -1
+}
+
 func (e *ErrorWithStatus) Error() string {
 	return fmt.Sprintf("%s [status:%d, body:%s]", e.err.Error(), e.StatusCode, e.Body)
 }
@@ -105,16 +133,25 @@ type Order struct {
 	Trade     *Trade     `json:"trade,omitempty"`
 }
 
+type Position struct {
+	UserID       int64 `json:"user_id"`
+	Isu          int64 `json:"isu"`
+	ReservedIsu  int64 `json:"reserved_isu"`
+	AvailableIsu int64 `json:"available_isu"`
+}
+
 func (o *Order) Removed() bool {
 	return o.ClosedAt != nil && o.TradeID == 0
 }
 
 type CandlestickData struct {
-	Time  time.Time `json:"time"`
-	Open  int64     `json:"open"`
-	Close int64     `json:"close"`
-	High  int64     `json:"high"`
-	Low   int64     `json:"low"`
+	Time   time.Time `json:"time"`
+	Open   int64     `json:"open"`
+	Close  int64     `json:"close"`
+	High   int64     `json:"high"`
+	Low    int64     `json:"low"`
+	Volume int64     `json:"volume"`
+	VWAP   float64   `json:"vwap"`
 }
 
 type InfoResponse struct {
@@ -132,6 +169,45 @@ type OrderActionResponse struct {
 	ID int64 `json:"id"`
 }
 
+// RetryPolicy は通信エラー時のretryの間隔の設定です
+// retryは回数ではなくclientが退役するまで続けます
+// アプリケーションのエラー(レスポンスが返ってきたもの)はretryの対象外です
+type RetryPolicy struct {
+	Backoff    time.Duration // 初回のretry間隔、以降は倍々に伸ばす
+	MaxBackoff time.Duration // retry間隔の上限
+}
+
+func (p RetryPolicy) backoff(n int) time.Duration {
+	d := p.Backoff
+	for i := 0; i < n && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+var (
+	DefaultRetryPolicy = RetryPolicy{
+		Backoff:    RetryBackoff,
+		MaxBackoff: RetryMaxBackoff,
+	}
+
+	getRetryCount  int64
+	postRetryCount int64
+)
+
+// GetRetryCount はGETの通信エラーでretryした回数を返します
+func GetRetryCount() int64 {
+	return atomic.LoadInt64(&getRetryCount)
+}
+
+// PostRetryCount はGET以外の通信エラーでretryした回数を返します
+func PostRetryCount() int64 {
+	return atomic.LoadInt64(&postRetryCount)
+}
+
 type Client struct {
 	base      *url.URL
 	hc        *http.Client
@@ -142,6 +218,7 @@ type Client struct {
 	cache     *urlcache.CacheStore
 	retired   bool
 	retireto  time.Duration
+	retry     RetryPolicy
 	topLoaded int32
 }
 
@@ -171,9 +248,14 @@ func NewClient(base, bankid, name, password string, timeout, retire time.Duratio
 		pass:     password,
 		cache:    urlcache.NewCacheStore(),
 		retireto: retire,
+		retry:    DefaultRetryPolicy,
 	}, nil
 }
 
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retry = p
+}
+
 func (c *Client) IsRetired() bool {
 	return c.retired
 }
@@ -196,7 +278,7 @@ func (c *Client) doRequest(ctx context.Context, req *http.Request) (*ResponseWit
 		}
 	}
 	start := time.Now()
-	for {
+	for retry := 0; ; retry++ {
 		if reqbody != nil {
 			req.Body = ioutil.NopCloser(bytes.NewBuffer(reqbody))
 		}
@@ -219,10 +301,25 @@ func (c *Client) doRequest(ctx context.Context, req *http.Request) (*ResponseWit
 				}
 			}
 			log.Printf("[WARN] err: %s, [%.5f] req.len:%d", err, elapsedTime.Seconds(), req.ContentLength)
-			if elapsedTime < c.retireto {
+			if c.retireto <= elapsedTime {
+				return nil, err
+			}
+			// 一時的な通信エラーは退役するまでbackoffしながらretryする
+			if req.Method == http.MethodGet {
+				atomic.AddInt64(&getRetryCount, 1)
+			} else {
+				atomic.AddInt64(&postRetryCount, 1)
+			}
+			if ctx == nil {
+				time.Sleep(c.retry.backoff(retry))
 				continue
 			}
-			return nil, err
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(c.retry.backoff(retry)):
+			}
+			continue
 		}
 		elapsedTime := time.Now().Sub(start)
 		if c.retireto < elapsedTime {
@@ -302,6 +399,7 @@ func (c *Client) post(ctx context.Context, path string, val url.Values) (*Respon
 		return nil, errors.Wrap(err, "new request failed")
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	c.setCSRFToken(req)
 	return c.doRequest(ctx, req)
 }
 
@@ -318,9 +416,20 @@ func (c *Client) del(ctx context.Context, path string, val url.Values) (*Respons
 	if err != nil {
 		return nil, errors.Wrap(err, "new request failed")
 	}
+	c.setCSRFToken(req)
 	return c.doRequest(ctx, req)
 }
 
+// setCSRFToken はログイン時にcookieで渡されたCSRFトークンをヘッダに設定します (ブラウザのaxiosと同じ動作)
+func (c *Client) setCSRFToken(req *http.Request) {
+	for _, cookie := range c.hc.Jar.Cookies(req.URL) {
+		if cookie.Name == CSRFCookieName {
+			req.Header.Set(CSRFHeaderName, cookie.Value)
+			return
+		}
+	}
+}
+
 func (c *Client) Initialize(ctx context.Context, bankep, bankid, logep, logid string) error {
 	v := url.Values{}
 	v.Set("bank_endpoint", bankep)
@@ -539,6 +648,30 @@ func (c *Client) GetOrders(ctx context.Context) ([]Order, error) {
 	return orders, nil
 }
 
+func (c *Client) Position(ctx context.Context) (*Position, error) {
+	path := "/me/position"
+	res, err := c.get(ctx, path, url.Values{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "GET %s request failed", path)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "GET %s body read failed", path)
+		}
+		return nil, errorWithStatus(errors.Errorf("GET %s failed.", path), res.StatusCode, string(b))
+	}
+	p := &Position{}
+	if err := json.NewDecoder(res.Body).Decode(p); err != nil {
+		return nil, errors.Wrapf(err, "GET %s body decode failed", path)
+	}
+	if p.UserID != c.UserID() {
+		return nil, errors.Errorf("GET %s user_id is not match [got:%d, want:%d]", path, p.UserID, c.UserID())
+	}
+	return p, nil
+}
+
 func (c *Client) DeleteOrders(ctx context.Context, id int64) error {
 	path := fmt.Sprintf("/order/%d", id)
 	//log.Printf("[DEBUG] DELETE %s [user:%d]", path, c.UserID())
@@ -568,16 +701,16 @@ func (c *Client) testMyOrder(path string, orders []Order) error {
 	var tc time.Time
 	for _, order := range orders {
 		if order.UserID != c.userID {
-			return errors.Errorf("GET %s returned not my order [id:%d, user_id:%d]", path, order.ID, c.UserID)
+			return errors.Errorf("GET %s returned not my order [id:%d, user_id:%d]", path, order.ID, c.UserID())
 		}
 		if order.User == nil {
-			return errors.Errorf("GET %s returned not filled user [id:%d, user_id:%d]", path, order.ID, c.UserID)
+			return errors.Errorf("GET %s returned not filled user [id:%d, user_id:%d]", path, order.ID, c.UserID())
 		}
 		if order.User.Name != c.name {
-			return errors.Errorf("GET %s returned filled user.name is not my name [id:%d, user_id:%d]", path, order.ID, c.UserID)
+			return errors.Errorf("GET %s returned filled user.name is not my name [id:%d, user_id:%d]", path, order.ID, c.UserID())
 		}
 		if order.TradeID != 0 && order.Trade == nil {
-			return errors.Errorf("GET %s returned not filled trade [id:%d, user_id:%d]", path, order.ID, c.UserID)
+			return errors.Errorf("GET %s returned not filled trade [id:%d, user_id:%d]", path, order.ID, c.UserID())
 		}
 		if order.CreatedAt.Before(tc) {
 			return errors.Errorf("GET %s sort order is must be created_at desc", path)
@@ -21,6 +21,7 @@ var (
 	logep        = flag.String("logep", "https://compose.isucon8.flying-chair.net:5516", "isulog endpoint")
 	internalbank = flag.String("internalbank", "https://localhost.isucon8.flying-chair.net:5515", "isubank endpoint (for internal)")
 	internallog  = flag.String("internallog", "https://localhost.isucon8.flying-chair.net:5516", "isulog endpoint (for internal)")
+	position     = flag.Bool("position", false, "test GET /me/position and overselling in pretest")
 	jobid        = flag.String("jobid", "", "portal jobid")
 	logoutput    = flag.String("log", "", "output log path (default stderr)")
 	result       = flag.String("result", "", "result json path (default stdout)")
@@ -70,6 +71,9 @@ func run() error {
 		return err
 	}
 	defer mgr.Close()
+	if *position {
+		mgr.EnablePositionTest()
+	}
 	msg := "ok"
 	bm := bench.NewRunner(mgr)
 	if err = bm.Run(context.Background()); err != nil {
@@ -19,6 +19,7 @@ var (
 	logep        = flag.String("logep", "https://compose.isucon8.flying-chair.net:5516", "isulog endpoint")
 	internalbank = flag.String("internalbank", "https://localhost.isucon8.flying-chair.net:5515", "isubank endpoint (for internal)")
 	internallog  = flag.String("internallog", "https://localhost.isucon8.flying-chair.net:5516", "isulog endpoint (for internal)")
+	position     = flag.Bool("position", false, "test GET /me/position and overselling in pretest")
 	log          = bench.NewLogger(os.Stderr)
 )
 
@@ -37,6 +38,9 @@ func run() error {
 		return err
 	}
 	defer mgr.Close()
+	if *position {
+		mgr.EnablePositionTest()
+	}
 	log.Printf("run initialize")
 	if err = mgr.Initialize(ctx); err != nil {
 		return errors.Wrap(err, "Initialize Failed")
@@ -12,6 +12,9 @@ const (
 	RetireTimeout = 10 * time.Second       // clientが退役するタイムアウト時間
 	RetryInterval = 500 * time.Millisecond // 50x系でエラーになったときのretry間隔
 
+	RetryBackoff    = 100 * time.Millisecond // 通信エラー時の初回retry間隔
+	RetryMaxBackoff = 1 * time.Second        // 通信エラー時のretry間隔の上限
+
 	TestTradeTimeout = 5 * time.Second  // testでのtradeは成立までの時間
 	LogAllowedDelay  = 10 * time.Second // logの遅延が許される時間
 
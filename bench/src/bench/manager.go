@@ -41,6 +41,9 @@ type Manager struct {
 	scoreboard *ScoreBoard
 	testusers  []TestUser
 	statefile  string
+
+	// positionTest はPreTestで椅子の保有数 (GET /me/position) と売り注文の制限を確認します
+	positionTest bool
 }
 
 func NewManager(out io.Writer, appep, bankep, logep, internalbank, internallog string, statefile string) (*Manager, error) {
@@ -216,11 +219,18 @@ func (c *Manager) Initialize(ctx context.Context) error {
 	return nil
 }
 
+// EnablePositionTest はPreTestで椅子の保有数と売り注文の制限を確認するようにします
+// GET /me/position を実装していない参考実装もあるため、デフォルトでは確認しません
+func (c *Manager) EnablePositionTest() {
+	c.positionTest = true
+}
+
 func (c *Manager) PreTest(ctx context.Context) error {
 	t := &PreTester{
-		appep:   c.appep,
-		isubank: c.isubank,
-		isulog:  c.isulog,
+		appep:        c.appep,
+		isubank:      c.isubank,
+		isulog:       c.isulog,
+		positionTest: c.positionTest,
 	}
 	return t.Run(ctx)
 }
@@ -37,6 +37,13 @@ func (r *Runner) Result() portal.BenchResult {
 		r.mgr.Logger().Printf("Fail => Score: %d, (level: %d, errors: %d, users: %d/%d, score:%d)", score, level, r.mgr.ErrorCount(), r.mgr.ActiveUsers(), r.mgr.AllUsers(), r.mgr.TotalScore())
 	}
 
+	if retry := GetRetryCount(); retry > 0 {
+		r.mgr.Logger().Printf("GET requests retried on transport errors: %d", retry)
+	}
+	if retry := PostRetryCount(); retry > 0 {
+		r.mgr.Logger().Printf("non-GET requests retried on transport errors: %d", retry)
+	}
+
 	logs, _ := r.mgr.GetLogs()
 	return portal.BenchResult{
 		Pass:      score > 0,
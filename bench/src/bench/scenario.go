@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
-	"strings"
 	"sync"
 	"time"
 
@@ -465,7 +464,7 @@ func (s *normalScenario) tryTrade(ctx context.Context) (ScoreType, error) {
 	order, err := s.c.AddOrder(ctx, ot, amount, price)
 	if err != nil {
 		// 残高不足はOKとする
-		if er, ok := err.(*ErrorWithStatus); ok && er.StatusCode == 400 && strings.Index(err.Error(), "残高") > -1 {
+		if er, ok := err.(*ErrorWithStatus); ok && er.IsInsufficient() {
 			log.Printf("[INFO] 残高不足 [user:%d, price:%d, amount:%d]", s.c.UserID(), price, amount)
 			return ScoreTypePostOrders, nil
 		}
@@ -89,6 +89,8 @@ func (sb *ScoreBoard) Dump() {
 			log.Printf("[INFO] %-16s: score=%d, count=%d", st, count*st.Score(), count)
 		}
 	}
+	log.Printf("[INFO] %-16s: count=%d", "GetRetry", GetRetryCount())
+	log.Printf("[INFO] %-16s: count=%d", "PostRetry", PostRetryCount())
 }
 
 type ScoreMsg struct {
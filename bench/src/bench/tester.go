@@ -17,6 +17,8 @@ type PreTester struct {
 	appep   string
 	isulog  *isulog.Isulog
 	isubank *isubank.Isubank
+
+	positionTest bool
 }
 
 func (t *PreTester) Run(ctx context.Context) error {
@@ -210,6 +212,25 @@ func (t *PreTester) Run(ctx context.Context) error {
 		}
 	}
 
+	if t.positionTest {
+		log.Printf("[INFO] run sell order no isu")
+		p, err := c1.Position(ctx)
+		if err != nil {
+			return err
+		}
+		order, err := c1.AddOrder(ctx, TradeTypeSell, p.AvailableIsu+1, 1000)
+		if err == nil {
+			return errors.Errorf("POST /orders 椅子の保有数が足りない売り注文に成功しました [order_id:%d]", order.ID)
+		}
+		if e, ok := err.(*ErrorWithStatus); ok {
+			if e.StatusCode != 400 {
+				return errors.Errorf("POST /orders statuscodeが正しくありません [%d]", e.StatusCode)
+			}
+		} else {
+			return errors.Wrap(err, "POST /orders に失敗しました")
+		}
+	}
+
 	// 売り注文は成功する
 	{
 		log.Printf("[INFO] run sell order")
@@ -555,7 +576,7 @@ func (t *PostTester) Run(ctx context.Context) error {
 		user := tu
 		eg.Go(func() error {
 			if err := user.FetchOrders(ctx); err != nil {
-				return errors.Wrapf(err, "注文情報の取得に失敗しました [user:%d]", user.UserID)
+				return errors.Wrapf(err, "注文情報の取得に失敗しました [user:%d]", user.UserID())
 			}
 			for _, order := range user.Orders() {
 				if order.ClosedAt == nil {
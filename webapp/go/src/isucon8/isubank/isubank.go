@@ -3,12 +3,20 @@ package isubank
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"path"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -17,15 +25,55 @@ var (
 
 	// 仮決済時または残高チェック時に残高が不足している
 	ErrCreditInsufficient = errors.New("credit is insufficient")
+
+	// 確定または取り消しをしようとした仮決済がすでに確定している
+	ErrReserveAlreadyCommitted = errors.New("reserve is already committed")
+
+	// 確定または取り消しをしようとした仮決済が期限切れか存在しない
+	ErrReserveExpired = errors.New("reserve is expired")
 )
 
+// TemporaryError は再送しても成功しなかった一時的なエラー (5xxやタイムアウト) です
+// 時間をおけば成功する可能性があります
+type TemporaryError struct {
+	Op  string
+	Err error
+}
+
+func (e *TemporaryError) Error() string {
+	return fmt.Sprintf("%s failed temporarily. err: %s", e.Op, e.Err)
+}
+
+// Temporary は常にtrueを返します (net.Errorと同じ)
+func (e *TemporaryError) Temporary() bool {
+	return true
+}
+
+// IsTemporary はerrがTemporaryErrorの場合にtrueを返します
+// github.com/pkg/errorsなどでラップしたエラーはCauseをたどって確認します
+func IsTemporary(err error) bool {
+	for err != nil {
+		if _, ok := err.(*TemporaryError); ok {
+			return true
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
 type isubankResponse interface {
-	setStatus(int)
+	basic() *isubankBasicResponse
 }
 
 type isubankBasicResponse struct {
 	status int
-	Error  string `json:"error"`
+	// retried は再送したリクエストのレスポンスの場合にtrueです
+	retried bool
+	Error   string `json:"error"`
 }
 
 type isubankReserveResponse struct {
@@ -37,30 +85,153 @@ func (r *isubankBasicResponse) success() bool {
 	return r.status == 200
 }
 
-func (r *isubankBasicResponse) setStatus(s int) {
-	r.status = s
+func (r *isubankBasicResponse) basic() *isubankBasicResponse {
+	return r
 }
 
 // Isubank はISUBANK APIクライアントです
 // NewIsubankによって初期化してください
 type Isubank struct {
-	endpoint *url.URL
-	appID    string
+	endpoint  *url.URL
+	appID     string
+	client    *http.Client
+	retries   int
+	retryWait time.Duration
+	requestID string
+}
+
+// 5xxやタイムアウトの場合はDefaultRetries回まで、待ち時間を倍にしながら再送します
+const (
+	DefaultRetries   = 2
+	DefaultRetryWait = 50 * time.Millisecond
+)
+
+// TransportConfig はISUBANK APIへの接続の設定です
+type TransportConfig struct {
+	// MaxIdleConnsPerHost はkeep-aliveで残しておく接続の数です
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	DialTimeout         time.Duration
+	// HTTP2 がfalseの場合はhttpsでもHTTP/1.1で接続します
+	HTTP2 bool
+}
+
+// DefaultTransportConfig はNewTransportのデフォルトです
+// http.DefaultTransportはホストごとに2接続しか残さないので、注文が集中すると毎回接続し直してしまいます
+var DefaultTransportConfig = TransportConfig{
+	MaxIdleConnsPerHost: 256,
+	IdleConnTimeout:     90 * time.Second,
+	DialTimeout:         5 * time.Second,
+	HTTP2:               true,
+}
+
+// NewTransport はISUBANK API用のhttp.Transportを作ります
+// 接続を使い回すため、NewIsubankのたびに作らずに共有してください
+func NewTransport(c TransportConfig) *http.Transport {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   c.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          c.MaxIdleConnsPerHost * 4,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		TLSHandshakeTimeout:   c.DialTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if !c.HTTP2 {
+		// 空のmapにするとHTTP/2を使わない
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
+}
+
+var defaultClient = &http.Client{Transport: NewTransport(DefaultTransportConfig)}
+
+// Option はIsubankの設定です
+type Option func(*Isubank)
+
+// WithTransport はリクエストに使うTransportを設定します
+func WithTransport(t http.RoundTripper) Option {
+	return func(b *Isubank) {
+		b.client = &http.Client{Transport: t, Timeout: b.client.Timeout}
+	}
+}
+
+// WithTimeout はリクエストのタイムアウトを設定します (0の場合はタイムアウトしません)
+func WithTimeout(d time.Duration) Option {
+	return func(b *Isubank) {
+		b.client = &http.Client{Transport: b.client.Transport, Timeout: d}
+	}
+}
+
+// WithRetry は再送の回数と最初の待ち時間を設定します (0回の場合は再送しません)
+func WithRetry(retries int, wait time.Duration) Option {
+	return func(b *Isubank) {
+		b.retries = retries
+		b.retryWait = wait
+	}
+}
+
+// WithRequestID はX-Request-IDヘッダを設定します (空の場合は送りません)
+func WithRequestID(id string) Option {
+	return func(b *Isubank) {
+		b.requestID = id
+	}
 }
 
 // NewIsubank はIsubankを初期化します
 //
 // endpoint: ISUBANK APIを利用するためのエンドポイントURI
 // appID:    ISUBANK APIを利用するためのアプリケーションID
-func NewIsubank(endpoint, appID string) (*Isubank, error) {
+func NewIsubank(endpoint, appID string, opts ...Option) (*Isubank, error) {
 	u, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
 	}
-	return &Isubank{
-		endpoint: u,
-		appID:    appID,
-	}, nil
+	b := &Isubank{
+		endpoint:  u,
+		appID:     appID,
+		client:    defaultClient,
+		retries:   DefaultRetries,
+		retryWait: DefaultRetryWait,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b, nil
+}
+
+// Stats はISUBANK APIへのリクエストの統計です
+type Stats struct {
+	Requests int64 `json:"requests"`
+	// Reused はkeep-aliveの接続を使い回したリクエストの数です
+	Reused    int64   `json:"reused"`
+	ReuseRate float64 `json:"reuse_rate"`
+}
+
+var requests, reused int64
+
+// GetStats はプロセス内のすべてのIsubankのリクエストの統計を返します
+func GetStats() Stats {
+	s := Stats{
+		Requests: atomic.LoadInt64(&requests),
+		Reused:   atomic.LoadInt64(&reused),
+	}
+	if s.Requests > 0 {
+		s.ReuseRate = float64(s.Reused) / float64(s.Requests)
+	}
+	return s
+}
+
+var connTrace = &httptrace.ClientTrace{
+	GotConn: func(info httptrace.GotConnInfo) {
+		atomic.AddInt64(&requests, 1)
+		if info.Reused {
+			atomic.AddInt64(&reused, 1)
+		}
+	},
 }
 
 // Check は残高確認です
@@ -71,8 +242,8 @@ func (b *Isubank) Check(bankID string, price int64) error {
 		"bank_id": bankID,
 		"price":   price,
 	}
-	if err := b.request("/check", v, res); err != nil {
-		return fmt.Errorf("check failed. err: %s", err)
+	if err := b.call("/check", v, res, true); err != nil {
+		return err
 	}
 	if res.success() {
 		return nil
@@ -87,14 +258,16 @@ func (b *Isubank) Check(bankID string, price int64) error {
 }
 
 // Reserve は仮決済(残高の確保)を行います
+// 二重に予約しないように、銀行に届いていないことが確実な接続の失敗の場合だけ再送します
+// 5xxやタイムアウトの場合は届いたかわからないので再送せずにTemporaryErrorを返します
 func (b *Isubank) Reserve(bankID string, price int64) (int64, error) {
 	res := &isubankReserveResponse{}
 	v := map[string]interface{}{
 		"bank_id": bankID,
 		"price":   price,
 	}
-	if err := b.request("/reserve", v, res); err != nil {
-		return 0, fmt.Errorf("reserve failed. err: %s", err)
+	if err := b.call("/reserve", v, res, false); err != nil {
+		return 0, err
 	}
 	if !res.success() {
 		if res.Error == "credit is insufficient" {
@@ -105,20 +278,74 @@ func (b *Isubank) Reserve(bankID string, price int64) (int64, error) {
 	return res.ReserveID, nil
 }
 
+// ReserveRequest はReserveBulkで予約する仮決済です
+type ReserveRequest struct {
+	BankID string
+	Price  int64
+}
+
+// ReserveResult はReserveBulkの結果で、Reserveの戻り値と同じです
+type ReserveResult struct {
+	ReserveID int64
+	Err       error
+}
+
+// MaxReserveConcurrency はReserveBulkで同時に送るリクエストの数です
+const MaxReserveConcurrency = 16
+
+// ReserveBulk は複数の仮決済を行い、reqsと同じ順番で結果を返します
+// ISUBANK APIには複数件をまとめて予約するAPIが無いため、並行してReserveを呼んで1往復分の時間で済ませます
+// 失敗したものがあっても他の予約は取り消さないので、必要な場合は呼び出し側でCancelしてください
+func (b *Isubank) ReserveBulk(reqs []ReserveRequest) []ReserveResult {
+	return ReserveBulk(b.Reserve, reqs)
+}
+
+// ReserveBulk はreserveを並行して呼び、reqsと同じ順番で結果を返します
+func ReserveBulk(reserve func(bankID string, price int64) (int64, error), reqs []ReserveRequest) []ReserveResult {
+	results := make([]ReserveResult, len(reqs))
+	if len(reqs) == 1 {
+		results[0].ReserveID, results[0].Err = reserve(reqs[0].BankID, reqs[0].Price)
+		return results
+	}
+	sem := make(chan struct{}, MaxReserveConcurrency)
+	var wg sync.WaitGroup
+	for i, req := range reqs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, req ReserveRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i].ReserveID, results[i].Err = reserve(req.BankID, req.Price)
+		}(i, req)
+	}
+	wg.Wait()
+	return results
+}
+
 // Commit は決済の確定を行います
+// 同じトレードの仮決済はまとめて1回で確定してください
 // 正常に仮決済処理を行っていればここでエラーになることはありません
 func (b *Isubank) Commit(reserveIDs []int64) error {
 	res := &isubankBasicResponse{}
 	v := map[string]interface{}{
 		"reserve_ids": reserveIDs,
 	}
-	if err := b.request("/commit", v, res); err != nil {
-		return fmt.Errorf("commit failed. err: %s", err)
+	if err := b.call("/commit", v, res, true); err != nil {
+		return err
+	}
+	if !res.success() && res.retried && res.Error == "reserve is already committed" {
+		// 前のリクエストは届いて確定していた
+		return nil
 	}
 	if !res.success() {
 		if res.Error == "credit is insufficient" {
 			return ErrCreditInsufficient
 		}
+		if err := reserveError(res); err != nil {
+			return err
+		}
 		return fmt.Errorf("commit failed. err:%s", res.Error)
 	}
 	return nil
@@ -130,15 +357,57 @@ func (b *Isubank) Cancel(reserveIDs []int64) error {
 	v := map[string]interface{}{
 		"reserve_ids": reserveIDs,
 	}
-	if err := b.request("/cancel", v, res); err != nil {
-		return fmt.Errorf("cancel failed. err: %s", err)
+	if err := b.call("/cancel", v, res, true); err != nil {
+		return err
 	}
 	if !res.success() {
+		if err := reserveError(res); err != nil {
+			return err
+		}
 		return fmt.Errorf("cancel failed. err:%s", res.Error)
 	}
 	return nil
 }
 
+func reserveError(res *isubankBasicResponse) error {
+	switch {
+	case res.Error == "reserve is already committed":
+		return ErrReserveAlreadyCommitted
+	case res.Error == "reserve is already expired" || res.status == http.StatusNotFound:
+		return ErrReserveExpired
+	}
+	return nil
+}
+
+// isDialError はerrが接続の失敗で、リクエストが銀行に届いていない場合にtrueを返します
+func isDialError(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// call はリクエストを送り、5xxかタイムアウトなどで失敗した場合は再送します
+// 再送しても失敗した場合はTemporaryErrorを返します
+// idempotentでないリクエストは、接続できずに送れなかった場合だけ再送します
+func (b *Isubank) call(p string, v interface{}, r isubankResponse, idempotent bool) error {
+	wait := b.retryWait
+	for i := 0; ; i++ {
+		res := r.basic()
+		res.retried = i > 0
+		err := b.request(p, v, r)
+		if err == nil && res.status < 500 {
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("status: %d", res.status)
+		}
+		if i >= b.retries || !idempotent && !isDialError(err) {
+			return &TemporaryError{Op: path.Base(p), Err: err}
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
 func (b *Isubank) request(p string, v interface{}, r isubankResponse) error {
 	u := new(url.URL)
 	*u = *b.endpoint
@@ -154,15 +423,23 @@ func (b *Isubank) request(p string, v interface{}, r isubankResponse) error {
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+b.appID)
+	if b.requestID != "" {
+		req.Header.Set("X-Request-ID", b.requestID)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), connTrace))
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := b.client.Do(req)
 	if err != nil {
-		return fmt.Errorf("isubank request failed. err: %s", err)
+		return fmt.Errorf("isubank request failed. err: %w", err)
 	}
-	defer res.Body.Close()
-	if err = json.NewDecoder(res.Body).Decode(r); err != nil {
+	defer func() {
+		// 最後まで読まないと接続が使い回されない
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+	r.basic().status = res.StatusCode
+	if err = json.NewDecoder(res.Body).Decode(r); err != nil && res.StatusCode < 500 {
 		return fmt.Errorf("isubank decode json failed. err: %s", err)
 	}
-	r.setStatus(res.StatusCode)
 	return nil
 }
@@ -0,0 +1,62 @@
+package isubank
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReserveRetry(t *testing.T) {
+	var calls int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	b, err := NewIsubank(ts.URL, "appid", WithRetry(2, time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewIsubank failed: %s", err)
+	}
+	// 5xxの場合は届いているので予約は再送しない
+	if _, err = b.Reserve("user", -100); !IsTemporary(err) {
+		t.Errorf("reserve 5xx: got:%v expected TemporaryError", err)
+	}
+	if n := atomic.LoadInt64(&calls); n != 1 {
+		t.Errorf("reserve 5xx requests: got:%d expected:1", n)
+	}
+	// 冪等なリクエストは再送する
+	atomic.StoreInt64(&calls, 0)
+	if err = b.Check("user", 100); !IsTemporary(err) {
+		t.Errorf("check 5xx: got:%v expected TemporaryError", err)
+	}
+	if n := atomic.LoadInt64(&calls); n != 3 {
+		t.Errorf("check 5xx requests: got:%d expected:3", n)
+	}
+}
+
+func TestIsDialError(t *testing.T) {
+	// 閉じたポートへの接続は届いていない
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	b, err := NewIsubank("http://"+addr, "appid", WithRetry(2, time.Millisecond))
+	if err != nil {
+		t.Fatalf("NewIsubank failed: %s", err)
+	}
+	_, err = b.Reserve("user", -100)
+	te, ok := err.(*TemporaryError)
+	if !ok {
+		t.Fatalf("reserve refused: got:%v expected TemporaryError", err)
+	}
+	if !isDialError(te.Err) {
+		t.Errorf("reserve refused: %v should be a dial error", te.Err)
+	}
+}
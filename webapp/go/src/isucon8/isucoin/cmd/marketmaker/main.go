@@ -0,0 +1,369 @@
+// marketmaker は設定した銀行アカウントでログインし、最後の約定価格の上下に買い注文と売り注文を出し続けます
+// ベンチマーカーの投資家がいないデモ環境で板が空にならないようにするためのもので、公開のAPIだけを使います
+//
+//	go build -o marketmaker isucon8/isucoin/cmd/marketmaker
+//	ISU_MM_BANK_ID=mm ISU_MM_PASSWORD=xxx ./marketmaker -target http://127.0.0.1:5000
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// csrfCookieName, csrfHeaderName はcontroller.CSRFCookieName, CSRFHeaderNameと同じです
+	csrfCookieName = "XSRF-TOKEN"
+	csrfHeaderName = "X-XSRF-TOKEN"
+
+	requestTimeout = 10 * time.Second
+)
+
+type options struct {
+	Target   string
+	BankID   string
+	Password string
+	// SpreadBps は最後の約定価格から1段目の注文までの幅 (片側, 1/10000単位) です
+	SpreadBps int64
+	// StepBps は2段目以降の注文の間隔 (1/10000単位) です
+	StepBps int64
+	Levels  int
+	Size    int64
+	// InitialPrice はまだトレードが無い場合に基準にする価格です
+	InitialPrice int64
+	Refresh      time.Duration
+}
+
+func envOr(k, def string) string {
+	if v, ok := os.LookupEnv(k); ok {
+		return v
+	}
+	return def
+}
+
+func envInt(k string, def int64) int64 {
+	if v, ok := os.LookupEnv(k); ok {
+		if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return i
+		}
+		log.Printf("[WARN] invalid %s=%s", k, v)
+	}
+	return def
+}
+
+func parseOptions() *options {
+	o := &options{}
+	flag.StringVar(&o.Target, "target", envOr("ISU_MM_TARGET", "http://127.0.0.1:5000"), "isucoinのURL")
+	flag.StringVar(&o.BankID, "bank-id", envOr("ISU_MM_BANK_ID", ""), "ログインする銀行のID")
+	// パスワードはpsで見えないように環境変数 ISU_MM_PASSWORD で渡してください
+	o.Password = os.Getenv("ISU_MM_PASSWORD")
+	flag.Int64Var(&o.SpreadBps, "spread-bps", envInt("ISU_MM_SPREAD_BPS", 50), "最後の約定価格から1段目の注文までの幅 (bps)")
+	flag.Int64Var(&o.StepBps, "step-bps", envInt("ISU_MM_STEP_BPS", 25), "2段目以降の注文の間隔 (bps)")
+	levels := flag.Int64("levels", envInt("ISU_MM_LEVELS", 3), "片側の注文の数")
+	flag.Int64Var(&o.Size, "size", envInt("ISU_MM_SIZE", 1), "1注文の脚数")
+	flag.Int64Var(&o.InitialPrice, "initial-price", envInt("ISU_MM_INITIAL_PRICE", 5000), "トレードが無い場合の基準価格")
+	refresh := flag.Int64("refresh-ms", envInt("ISU_MM_REFRESH_MS", 5000), "注文を出し直す間隔 (ミリ秒)")
+	flag.Parse()
+	o.Levels = int(*levels)
+	o.Refresh = time.Duration(*refresh) * time.Millisecond
+	return o
+}
+
+func (o *options) validate() error {
+	switch {
+	case o.BankID == "" || o.Password == "":
+		return errors.New("ISU_MM_BANK_ID and ISU_MM_PASSWORD are required")
+	case o.SpreadBps <= 0 || o.SpreadBps >= 10000:
+		return errors.New("spread-bps must be between 1 and 9999")
+	case o.StepBps < 0 || o.SpreadBps+o.StepBps*int64(o.Levels) >= 10000:
+		return errors.New("step-bps is too large")
+	case o.Levels <= 0 || o.Size <= 0 || o.InitialPrice <= 0:
+		return errors.New("levels, size and initial-price must be positive")
+	case o.Refresh < 100*time.Millisecond:
+		return errors.New("refresh-ms must be at least 100")
+	}
+	return nil
+}
+
+// apiError はAPIのエラーのレスポンスです
+type apiError struct {
+	Status     int
+	Code       string `json:"error_code"`
+	Message    string `json:"err"`
+	RetryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("status:%d code:%s err:%s", e.Status, e.Code, e.Message)
+}
+
+// client はCookieのセッションとCSRFトークンでisucoinのAPIを呼びます
+type client struct {
+	base *url.URL
+	hc   *http.Client
+}
+
+func newClient(target string) (*client, error) {
+	base, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse target failed")
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &client{base: base, hc: &http.Client{Jar: jar, Timeout: requestTimeout}}, nil
+}
+
+func (c *client) do(ctx context.Context, method, path string, form url.Values, v interface{}) error {
+	u, err := c.base.Parse(path)
+	if err != nil {
+		return errors.Wrapf(err, "parse path failed. %s", path)
+	}
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if method != http.MethodGet {
+		for _, ck := range c.hc.Jar.Cookies(u) {
+			if ck.Name == csrfCookieName {
+				req.Header.Set(csrfHeaderName, ck.Value)
+			}
+		}
+	}
+	res, err := c.hc.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "%s %s failed", method, path)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read response failed. %s %s", method, path)
+	}
+	if res.StatusCode != http.StatusOK {
+		e := &apiError{Status: res.StatusCode}
+		json.Unmarshal(b, e)
+		if sec, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+			e.RetryAfter = time.Duration(sec) * time.Second
+		}
+		return e
+	}
+	if v == nil {
+		return nil
+	}
+	return errors.Wrapf(json.Unmarshal(b, v), "decode response failed. %s %s", method, path)
+}
+
+func (c *client) signin(ctx context.Context, bankID, password string) error {
+	return c.do(ctx, http.MethodPost, "/signin", url.Values{"bank_id": {bankID}, "password": {password}}, nil)
+}
+
+// referencePrice は最後の約定価格を返します。まだトレードが無い場合は0を返します
+func (c *client) referencePrice(ctx context.Context) (int64, error) {
+	var res struct {
+		Data struct {
+			LastPrice *int64 `json:"last_price"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v2/ticker", nil, &res); err != nil {
+		return 0, err
+	}
+	if res.Data.LastPrice == nil {
+		return 0, nil
+	}
+	return *res.Data.LastPrice, nil
+}
+
+func (c *client) openOrderIDs(ctx context.Context) ([]int64, error) {
+	var orders []struct {
+		ID int64 `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/orders?status=open&limit=1000", nil, &orders); err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, len(orders))
+	for _, o := range orders {
+		ids = append(ids, o.ID)
+	}
+	return ids, nil
+}
+
+func (c *client) addOrder(ctx context.Context, ot string, amount, price int64) (int64, error) {
+	var res struct {
+		ID int64 `json:"id"`
+	}
+	err := c.do(ctx, http.MethodPost, "/orders", url.Values{
+		"type":   {ot},
+		"amount": {strconv.FormatInt(amount, 10)},
+		"price":  {strconv.FormatInt(price, 10)},
+	}, &res)
+	return res.ID, err
+}
+
+func (c *client) cancelOrder(ctx context.Context, id int64) error {
+	err := c.do(ctx, http.MethodDelete, "/order/"+strconv.FormatInt(id, 10), nil, nil)
+	if e, ok := err.(*apiError); ok && e.Status == http.StatusNotFound {
+		// 約定済みか取り消し済み
+		return nil
+	}
+	return err
+}
+
+// quoter は前回出した注文を取り消して、基準価格の上下に出し直します
+type quoter struct {
+	o      *options
+	c      *client
+	quotes []int64
+}
+
+// prices はbase価格の上下の買い注文と売り注文の価格を内側から順に返します
+func (q *quoter) prices(base int64) (bids, asks []int64) {
+	for i := 0; i < q.o.Levels; i++ {
+		bps := q.o.SpreadBps + q.o.StepBps*int64(i)
+		bid := base * (10000 - bps) / 10000
+		ask := (base*(10000+bps) + 9999) / 10000
+		if bid <= 0 {
+			break
+		}
+		bids = append(bids, bid)
+		asks = append(asks, ask)
+	}
+	return bids, asks
+}
+
+func (q *quoter) cancelQuotes(ctx context.Context) error {
+	for len(q.quotes) > 0 {
+		if err := q.c.cancelOrder(ctx, q.quotes[0]); err != nil {
+			return err
+		}
+		q.quotes = q.quotes[1:]
+	}
+	return nil
+}
+
+func (q *quoter) refresh(ctx context.Context) error {
+	base, err := q.c.referencePrice(ctx)
+	if err != nil {
+		return err
+	}
+	if base == 0 {
+		base = q.o.InitialPrice
+	}
+	if err = q.cancelQuotes(ctx); err != nil {
+		return err
+	}
+	bids, asks := q.prices(base)
+	for i := range bids {
+		for _, o := range []struct {
+			ot    string
+			price int64
+		}{{"buy", bids[i]}, {"sell", asks[i]}} {
+			id, err := q.c.addOrder(ctx, o.ot, q.o.Size, o.price)
+			if e, ok := err.(*apiError); ok && e.Status == http.StatusBadRequest {
+				// 残高不足や価格の範囲外は片側だけ出さない
+				log.Printf("[WARN] skip %s order. price:%d %s", o.ot, o.price, e)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			q.quotes = append(q.quotes, id)
+		}
+	}
+	log.Printf("[INFO] quoted. base:%d bids:%v asks:%v", base, bids, asks)
+	return nil
+}
+
+func (q *quoter) run(ctx context.Context) error {
+	if err := q.c.signin(ctx, q.o.BankID, q.o.Password); err != nil {
+		return errors.Wrap(err, "signin failed")
+	}
+	// 前回起動したときの注文が残っていれば取り消す
+	ids, err := q.c.openOrderIDs(ctx)
+	if err != nil {
+		return errors.Wrap(err, "get open orders failed")
+	}
+	q.quotes = ids
+	for {
+		wait := q.o.Refresh
+		err := q.refresh(ctx)
+		switch e := errors.Cause(err).(type) {
+		case nil:
+		case *apiError:
+			log.Printf("[WARN] refresh quotes failed. %s", e)
+			if e.Status == http.StatusUnauthorized {
+				if err = q.c.signin(ctx, q.o.BankID, q.o.Password); err != nil {
+					log.Printf("[WARN] signin failed. err:%s", err)
+				}
+			}
+			// 取引停止中やメンテナンス中はRetry-Afterまで待つ
+			if e.RetryAfter > wait {
+				wait = e.RetryAfter
+			}
+		default:
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Printf("[WARN] refresh quotes failed. err:%s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+func main() {
+	o := parseOptions()
+	if err := o.validate(); err != nil {
+		log.Fatalf("invalid options. err:%s", err)
+	}
+	c, err := newClient(o.Target)
+	if err != nil {
+		log.Fatalf("init client failed. err:%s", err)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		stop()
+	}()
+
+	q := &quoter{o: o, c: c}
+	log.Printf("[INFO] start marketmaker. target:%s bank_id:%s", o.Target, o.BankID)
+	if err = q.run(ctx); err != nil {
+		log.Fatalf("marketmaker failed. err:%s", err)
+	}
+	// 終了するときは板に注文を残さない
+	cctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err = q.cancelQuotes(cctx); err != nil {
+		log.Printf("[WARN] cancel quotes failed. err:%s", err)
+	}
+	log.Printf("[INFO] marketmaker stopped")
+}
@@ -0,0 +1,577 @@
+// Package config はappサーバーの設定を環境変数と設定ファイルから読み込みます
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"isucon8/isubank"
+	"isucon8/isucoin/model"
+	"isucon8/isucoin/session"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// EnvPrefix は環境変数の接頭辞です
+	EnvPrefix = "ISU_"
+	// DefaultSessionSecret はセッションの署名鍵のデフォルトです
+	DefaultSessionSecret = "tonymoris"
+)
+
+// Config はappサーバーの設定です
+// 値はデフォルト, ISU_CONFIG_FILE で指定したTOMLファイル, 環境変数 (ISU_ + envタグ) の順に上書きします
+// 0/1 で指定していた環境変数はboolにしています (環境変数では 0/1 と true/false のどちらでも指定できます)
+type Config struct {
+	Port string `env:"APP_PORT" toml:"port"`
+	// PublicDir を指定した場合はバイナリに埋め込んだ公開ファイルの代わりにこのディレクトリのファイルを返します
+	PublicDir string `env:"PUBLIC_DIR" toml:"public_dir"`
+	// DataDir は初期データを置くディレクトリです
+	DataDir           string `env:"DATA_DIR" toml:"data_dir"`
+	ShutdownTimeoutMS int    `env:"SHUTDOWN_TIMEOUT_MS" toml:"shutdown_timeout_ms"`
+	// CSRFProtection をfalseにすると更新系のAPIでCSRFトークンを確認しません
+	CSRFProtection    bool   `env:"CSRF_PROTECTION" toml:"csrf_protection"`
+	ConcurrencyLimits string `env:"CONCURRENCY_LIMITS" toml:"concurrency_limits"`
+	// RouteTimeouts は "GET /info=2000,POST /orders=5000" の形式でルートごとのタイムアウト (ミリ秒) を指定します
+	RouteTimeouts string `env:"ROUTE_TIMEOUTS" toml:"route_timeouts"`
+	// IsuSeed はユーザーが最初から保有している椅子の数です
+	IsuSeed int `env:"ISU_SEED" toml:"isu_seed"`
+	// MFAKey は2段階認証のシークレットを暗号化する鍵です。空の場合はセッションの署名鍵を使います
+	MFAKey string `env:"MFA_KEY" toml:"mfa_key"`
+	// AdminToken は管理API (/admin/*) のトークンです。空の場合は管理APIを使えません
+	AdminToken string `env:"ADMIN_TOKEN" toml:"admin_token"`
+	// JWTSecret はPOST /signinで発行するJWT (HS256) の鍵です。空の場合はJWTを発行しません
+	JWTSecret string `env:"JWT_SECRET" toml:"jwt_secret"`
+
+	Server  ServerConfig  `toml:"server"`
+	DB      DBConfig      `toml:"db"`
+	Session SessionConfig `toml:"session"`
+	Bank    BankConfig    `toml:"bank"`
+	Log     LogConfig     `toml:"log"`
+	Trade   TradeConfig   `toml:"trade"`
+	Shed    ShedConfig    `toml:"shed"`
+	Webhook WebhookConfig `toml:"webhook"`
+	Monitor MonitorConfig `toml:"monitor"`
+	Archive ArchiveConfig `toml:"archive"`
+}
+
+type DBConfig struct {
+	Host     string `env:"DB_HOST" toml:"host"`
+	Port     string `env:"DB_PORT" toml:"port"`
+	User     string `env:"DB_USER" toml:"user"`
+	Password string `env:"DB_PASSWORD" toml:"password"`
+	Name     string `env:"DB_NAME" toml:"name"`
+	// ReplicaHosts はリードレプリカの host:port です。環境変数ではカンマ区切りで指定します
+	ReplicaHosts []string `env:"DB_REPLICA_HOSTS" toml:"replica_hosts"`
+	// MaxOpenConns, MaxIdleConns が0の場合はdatabase/sqlのデフォルトのままにします
+	MaxOpenConns       int  `env:"DB_MAX_OPEN_CONNS" toml:"max_open_conns"`
+	MaxIdleConns       int  `env:"DB_MAX_IDLE_CONNS" toml:"max_idle_conns"`
+	PreparedStatements bool `env:"PREPARED_STATEMENTS" toml:"prepared_statements"`
+	// DeadlockRetries はデッドロックとロック待ちのタイムアウトでトランザクションをやり直す回数です
+	DeadlockRetries     int `env:"DB_DEADLOCK_RETRIES" toml:"deadlock_retries"`
+	DeadlockRetryWaitMS int `env:"DB_DEADLOCK_RETRY_WAIT_MS" toml:"deadlock_retry_wait_ms"`
+	// QueryTimeoutMS はリクエストの中で実行する1つのクエリのタイムアウトです (0の場合はリクエストが終わるまで待ちます)
+	QueryTimeoutMS int `env:"DB_QUERY_TIMEOUT_MS" toml:"query_timeout_ms"`
+	// Migrate を有効にすると、起動時にまだ適用していないマイグレーションを適用します
+	Migrate bool `env:"DB_MIGRATE" toml:"migrate"`
+}
+
+type SessionConfig struct {
+	// Backend は複数台で動かしてcookie以外に保存する場合はredisにしてください
+	Backend string `env:"SESSION_BACKEND" toml:"backend"`
+	// Codec はbackendがcookieの場合のエンコードで、signedにするとリクエストごとのcookieの読み込みが軽くなります
+	Codec string `env:"SESSION_CODEC" toml:"codec"`
+	// Secret は複数台で動かす場合は全台で同じ値にしてください
+	Secret    string `env:"SESSION_SECRET" toml:"secret"`
+	MaxAge    int    `env:"SESSION_MAX_AGE" toml:"max_age"`
+	RedisAddr string `env:"SESSION_REDIS_ADDR" toml:"redis_addr"`
+	LRUSize   int    `env:"SESSION_LRU_SIZE" toml:"lru_size"`
+}
+
+type BankConfig struct {
+	// Endpoint, AppID を指定した場合は/initializeで設定した値より優先します
+	Endpoint string `env:"BANK_ENDPOINT" toml:"endpoint"`
+	AppID    string `env:"BANK_APPID" toml:"app_id"`
+
+	MaxIdleConns int  `env:"BANK_MAX_IDLE_CONNS" toml:"max_idle_conns"`
+	HTTP2        bool `env:"BANK_HTTP2" toml:"http2"`
+	TimeoutMS    int  `env:"BANK_TIMEOUT_MS" toml:"timeout_ms"`
+	Retries      int  `env:"BANK_RETRIES" toml:"retries"`
+	// BreakerFailures が0の場合はサーキットブレーカーを使いません
+	BreakerFailures     int  `env:"BANK_BREAKER_FAILURES" toml:"breaker_failures"`
+	BreakerOpenMS       int  `env:"BANK_BREAKER_OPEN_MS" toml:"breaker_open_ms"`
+	Journal             bool `env:"BANK_JOURNAL" toml:"journal"`
+	ReconcileIntervalMS int  `env:"BANK_RECONCILE_INTERVAL_MS" toml:"reconcile_interval_ms"`
+	// CreditCache を有効にすると、買い注文の残高確認で銀行に問い合わせた結果をCreditCacheTTLMSの間使い回します
+	CreditCache      bool `env:"BANK_CREDIT_CACHE" toml:"credit_cache"`
+	CreditCacheTTLMS int  `env:"BANK_CREDIT_CACHE_TTL_MS" toml:"credit_cache_ttl_ms"`
+}
+
+type LogConfig struct {
+	// Endpoint, AppID を指定した場合は/initializeで設定した値より優先します
+	Endpoint string `env:"LOG_ENDPOINT" toml:"endpoint"`
+	AppID    string `env:"LOG_APPID" toml:"app_id"`
+
+	TimeoutMS int `env:"LOG_TIMEOUT_MS" toml:"timeout_ms"`
+	// Gzip はISULOGがgzipに対応している場合だけtrueにしてください
+	Gzip            bool `env:"LOG_GZIP" toml:"gzip"`
+	Async           bool `env:"ASYNC_LOGGER" toml:"async"`
+	QueueSize       int  `env:"LOG_QUEUE_SIZE" toml:"queue_size"`
+	FlushIntervalMS int  `env:"LOG_FLUSH_INTERVAL_MS" toml:"flush_interval_ms"`
+	// Outbox を有効にすると、ログをlog_outboxに書き込んでからFlushIntervalMSごとに送信します (Asyncより優先)
+	Outbox bool `env:"LOG_OUTBOX" toml:"outbox"`
+}
+
+// TradeConfig は注文とマッチングの設定です。複数台で動かす場合はUserCache, SettingsCache, OrderBookをfalseにして、
+// UserLockStripesを使う場合はUserLockTimeoutSecも指定してください (LockTimeoutSecかLeaderElectionを指定した場合は検証します)
+type TradeConfig struct {
+	LockTimeoutSec int  `env:"TRADE_LOCK_TIMEOUT" toml:"lock_timeout_sec"`
+	HoldingsCheck  bool `env:"HOLDINGS_CHECK" toml:"holdings_check"`
+	// UserLockStripes が0の場合はDBの行ロックを使います
+	UserLockStripes int `env:"USER_LOCK_STRIPES" toml:"user_lock_stripes"`
+	// UserLockTimeoutSec を指定するとGET_LOCKでも排他します (複数台で動かす場合)
+	UserLockTimeoutSec int  `env:"USER_LOCK_TIMEOUT" toml:"user_lock_timeout_sec"`
+	UserCache          bool `env:"USER_CACHE" toml:"user_cache"`
+	SettingsCache      bool `env:"SETTINGS_CACHE" toml:"settings_cache"`
+	OrderBook          bool `env:"ORDER_BOOK" toml:"order_book"`
+	AsyncMatcher       bool `env:"ASYNC_MATCHER" toml:"async_matcher"`
+	ExpireIntervalMS   int  `env:"EXPIRE_INTERVAL_MS" toml:"expire_interval_ms"`
+	// LeaderElection を有効にすると、AsyncMatcherのマッチングをGET_LOCKで選ばれた1台だけで行います
+	LeaderElection        bool   `env:"MATCHER_LEADER_ELECTION" toml:"leader_election"`
+	LeaderCheckIntervalMS int    `env:"LEADER_CHECK_INTERVAL_MS" toml:"leader_check_interval_ms"`
+	NodeID                string `env:"NODE_ID" toml:"node_id"`
+	// IDGenerator を有効にすると、注文とトレードのIDをAUTO_INCREMENTではなくアプリで払い出します
+	// 複数台で動かす場合はIDNodeをサーバーごとに変えてください
+	IDGenerator bool `env:"ID_GENERATOR" toml:"id_generator"`
+	IDNode      int  `env:"ID_NODE" toml:"id_node"`
+}
+
+type ShedConfig struct {
+	DBInUse       int `env:"SHED_DB_IN_USE" toml:"db_in_use"`
+	TradeQueue    int `env:"SHED_TRADE_QUEUE" toml:"trade_queue"`
+	RetryAfterSec int `env:"SHED_RETRY_AFTER" toml:"retry_after_sec"`
+}
+
+// ServerConfig はappサーバーの待ち受けの設定です。TLSCert, TLSKeyを指定するとTLSとHTTP/2で受け付けます
+type ServerConfig struct {
+	TLSCert string `env:"TLS_CERT" toml:"tls_cert"`
+	TLSKey  string `env:"TLS_KEY" toml:"tls_key"`
+	// H2C を有効にするとTLSを使わない場合も平文のHTTP/2で受け付けます
+	H2C                 bool `env:"H2C" toml:"h2c"`
+	ReadHeaderTimeoutMS int  `env:"READ_HEADER_TIMEOUT_MS" toml:"read_header_timeout_ms"`
+	ReadTimeoutMS       int  `env:"READ_TIMEOUT_MS" toml:"read_timeout_ms"`
+	// WriteTimeoutMS はレスポンス全体の期限なので、/streamを使う場合は0 (無制限) にしてください
+	WriteTimeoutMS int `env:"WRITE_TIMEOUT_MS" toml:"write_timeout_ms"`
+	IdleTimeoutMS  int `env:"IDLE_TIMEOUT_MS" toml:"idle_timeout_ms"`
+	// GRPCPort を指定するとそのポートでgRPCのAPIを受け付けます
+	GRPCPort string `env:"GRPC_PORT" toml:"grpc_port"`
+}
+
+// WebhookConfig は約定の通知の設定です。Workersが0の場合は通知しません
+type WebhookConfig struct {
+	Workers   int `env:"WEBHOOK_WORKERS" toml:"workers"`
+	QueueSize int `env:"WEBHOOK_QUEUE_SIZE" toml:"queue_size"`
+	TimeoutMS int `env:"WEBHOOK_TIMEOUT_MS" toml:"timeout_ms"`
+}
+
+type MonitorConfig struct {
+	// AccessLog は json か ltsv です。空の場合は出力しません
+	AccessLog     string `env:"ACCESS_LOG" toml:"access_log"`
+	AccessLogFile string `env:"ACCESS_LOG_FILE" toml:"access_log_file"`
+	MetricsPort   string `env:"METRICS_PORT" toml:"metrics_port"`
+	// SlowRequestMS 以上かかったリクエストを実行したクエリと一緒にログに出力します (0の場合は出力しません)
+	SlowRequestMS int `env:"SLOW_REQUEST_MS" toml:"slow_request_ms"`
+	// Debug は環境変数 ISUCOIN_DEBUG=1 でも有効になります
+	Debug     bool   `env:"DEBUG" toml:"debug"`
+	DebugAddr string `env:"DEBUG_ADDR" toml:"debug_addr"`
+}
+
+// ArchiveConfig は古いトレードと注文を *_archive テーブルに移す設定です
+// ベンチマークでは初期データのトレードが古いので、有効にしないでください
+type ArchiveConfig struct {
+	Enabled    bool `env:"ARCHIVE" toml:"enabled"`
+	AgeHours   int  `env:"ARCHIVE_AGE_HOURS" toml:"age_hours"`
+	IntervalMS int  `env:"ARCHIVE_INTERVAL_MS" toml:"interval_ms"`
+	BatchSize  int  `env:"ARCHIVE_BATCH_SIZE" toml:"batch_size"`
+}
+
+// Default はデフォルトの設定を返します
+func Default() *Config {
+	return &Config{
+		Port:              "5000",
+		DataDir:           "data",
+		ShutdownTimeoutMS: 10000,
+		CSRFProtection:    true,
+		RouteTimeouts:     "GET /info=2000,POST /orders=5000",
+		IsuSeed:           model.DefaultIsuSeed,
+		Server: ServerConfig{
+			ReadHeaderTimeoutMS: 5000,
+			ReadTimeoutMS:       30000,
+			IdleTimeoutMS:       120000,
+		},
+		DB: DBConfig{
+			Host:                "127.0.0.1",
+			Port:                "3306",
+			User:                "root",
+			Name:                "isucoin",
+			PreparedStatements:  true,
+			DeadlockRetries:     model.DefaultTxRetries,
+			Migrate:             true,
+			DeadlockRetryWaitMS: 10,
+			QueryTimeoutMS:      5000,
+		},
+		Session: SessionConfig{
+			Backend:   session.BackendCookie,
+			Codec:     session.CodecSecureCookie,
+			Secret:    DefaultSessionSecret,
+			RedisAddr: "127.0.0.1:6379",
+			LRUSize:   100000,
+		},
+		Bank: BankConfig{
+			MaxIdleConns:        isubank.DefaultTransportConfig.MaxIdleConnsPerHost,
+			HTTP2:               true,
+			Retries:             isubank.DefaultRetries,
+			BreakerFailures:     5,
+			BreakerOpenMS:       5000,
+			Journal:             true,
+			ReconcileIntervalMS: 10000,
+			CreditCacheTTLMS:    int(model.DefaultCreditCacheTTL / time.Millisecond),
+		},
+		Log: LogConfig{
+			TimeoutMS:       5000,
+			Async:           true,
+			QueueSize:       100000,
+			FlushIntervalMS: 100,
+		},
+		Trade: TradeConfig{
+			HoldingsCheck:         true,
+			UserLockStripes:       1024,
+			UserCache:             true,
+			SettingsCache:         true,
+			OrderBook:             true,
+			AsyncMatcher:          true,
+			ExpireIntervalMS:      1000,
+			LeaderCheckIntervalMS: 1000,
+		},
+		Shed: ShedConfig{
+			RetryAfterSec: 1,
+		},
+		Webhook: WebhookConfig{
+			Workers:   4,
+			QueueSize: 10000,
+			TimeoutMS: 5000,
+		},
+		Monitor: MonitorConfig{
+			DebugAddr: "127.0.0.1:6060",
+		},
+		Archive: ArchiveConfig{
+			AgeHours:   int(model.DefaultArchiveAge / time.Hour),
+			IntervalMS: int(model.DefaultArchiveInterval / time.Millisecond),
+			BatchSize:  model.DefaultArchiveBatchSize,
+		},
+	}
+}
+
+// Load はデフォルトの設定に ISU_CONFIG_FILE の設定ファイルと環境変数を反映して、検証した結果を返します
+func Load() (*Config, error) {
+	c := Default()
+	if path := os.Getenv(EnvPrefix + "CONFIG_FILE"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "open config file failed")
+		}
+		vals, err := parseTOML(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse config file failed. %s", path)
+		}
+		if err = c.applyTOML(vals); err != nil {
+			return nil, errors.Wrapf(err, "config file %s", path)
+		}
+	}
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if os.Getenv("ISUCOIN_DEBUG") == "1" {
+		c.Monitor.Debug = true
+	}
+	if c.MFAKey == "" {
+		c.MFAKey = c.Session.Secret
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// field は設定の1項目です
+type field struct {
+	env, key string
+	v        reflect.Value
+}
+
+func (c *Config) fields() []field {
+	var fs []field
+	var walk func(v reflect.Value, section string)
+	walk = func(v reflect.Value, section string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			key := sf.Tag.Get("toml")
+			if section != "" {
+				key = section + "." + key
+			}
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), key)
+				continue
+			}
+			fs = append(fs, field{env: sf.Tag.Get("env"), key: key, v: v.Field(i)})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return fs
+}
+
+func (c *Config) applyTOML(vals map[string]interface{}) error {
+	known := map[string]bool{}
+	for _, f := range c.fields() {
+		known[f.key] = true
+		v, ok := vals[f.key]
+		if !ok {
+			continue
+		}
+		if err := f.setTOML(v); err != nil {
+			return errors.Wrapf(err, "%s", f.key)
+		}
+	}
+	for k := range vals {
+		if !known[k] {
+			return errors.Errorf("unknown key %s", k)
+		}
+	}
+	return nil
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	for _, f := range c.fields() {
+		s, ok := lookup(EnvPrefix + f.env)
+		if !ok {
+			continue
+		}
+		if err := f.setString(s); err != nil {
+			return errors.Wrapf(err, "%s%s", EnvPrefix, f.env)
+		}
+	}
+	return nil
+}
+
+func (f *field) setTOML(v interface{}) error {
+	switch f.v.Kind() {
+	case reflect.String:
+		// ポート番号は数値でも指定できる
+		switch v := v.(type) {
+		case string:
+			f.v.SetString(v)
+		case int64:
+			f.v.SetString(strconv.FormatInt(v, 10))
+		default:
+			return errors.Errorf("expected string, got %v", v)
+		}
+	case reflect.Int:
+		n, ok := v.(int64)
+		if !ok {
+			return errors.Errorf("expected integer, got %v", v)
+		}
+		f.v.SetInt(n)
+	case reflect.Bool:
+		b, ok := v.(bool)
+		if !ok {
+			return errors.Errorf("expected boolean, got %v", v)
+		}
+		f.v.SetBool(b)
+	case reflect.Slice:
+		arr, ok := v.([]interface{})
+		if !ok {
+			return errors.Errorf("expected array, got %v", v)
+		}
+		ss := make([]string, len(arr))
+		for i, e := range arr {
+			if ss[i], ok = e.(string); !ok {
+				return errors.Errorf("expected array of strings, got %v", v)
+			}
+		}
+		f.v.Set(reflect.ValueOf(ss))
+	}
+	return nil
+}
+
+func (f *field) setString(s string) error {
+	switch f.v.Kind() {
+	case reflect.String:
+		f.v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.Errorf("invalid integer %q", s)
+		}
+		f.v.SetInt(int64(n))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return errors.Errorf("invalid boolean %q", s)
+		}
+		f.v.SetBool(b)
+	case reflect.Slice:
+		var ss []string
+		for _, e := range strings.Split(s, ",") {
+			if e = strings.TrimSpace(e); e != "" {
+				ss = append(ss, e)
+			}
+		}
+		f.v.Set(reflect.ValueOf(ss))
+	}
+	return nil
+}
+
+// Validate は設定の値を検証し、すべての問題をまとめて返します
+func (c *Config) Validate() error {
+	var errs []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, args...))
+		}
+	}
+	checkPort := func(name, port string, optional bool) {
+		if optional && port == "" {
+			return
+		}
+		n, err := strconv.Atoi(port)
+		check(err == nil && n > 0 && n < 65536, "%s must be a port number: %q", name, port)
+	}
+	checkPort("port", c.Port, false)
+	checkPort("db.port", c.DB.Port, false)
+	checkPort("monitor.metrics_port", c.Monitor.MetricsPort, true)
+	checkPort("server.grpc_port", c.Server.GRPCPort, true)
+	check(c.ShutdownTimeoutMS > 0, "shutdown_timeout_ms must be positive")
+	check(c.IsuSeed >= 0, "isu_seed must not be negative")
+
+	check((c.Server.TLSCert == "") == (c.Server.TLSKey == ""), "server.tls_cert and server.tls_key must be set together")
+	check(c.Server.ReadHeaderTimeoutMS >= 0 && c.Server.ReadTimeoutMS >= 0 && c.Server.WriteTimeoutMS >= 0 && c.Server.IdleTimeoutMS >= 0, "server timeouts must not be negative")
+
+	check(c.DB.Host != "", "db.host is required")
+	check(c.DB.Name != "", "db.name is required")
+	check(c.DB.User != "", "db.user is required")
+	for _, h := range c.DB.ReplicaHosts {
+		_, _, err := net.SplitHostPort(h)
+		check(err == nil, "db.replica_hosts must be host:port: %q", h)
+	}
+	check(c.DB.MaxOpenConns >= 0 && c.DB.MaxIdleConns >= 0, "db.max_open_conns and db.max_idle_conns must not be negative")
+	check(c.DB.DeadlockRetries >= 0, "db.deadlock_retries must not be negative")
+	check(c.DB.DeadlockRetryWaitMS > 0, "db.deadlock_retry_wait_ms must be positive")
+	check(c.DB.QueryTimeoutMS >= 0, "db.query_timeout_ms must not be negative")
+
+	switch c.Session.Backend {
+	case session.BackendCookie, session.BackendMemory:
+	case session.BackendRedis:
+		check(c.Session.RedisAddr != "", "session.redis_addr is required for redis backend")
+	default:
+		check(false, "session.backend must be cookie, memory or redis: %q", c.Session.Backend)
+	}
+	switch c.Session.Codec {
+	case session.CodecSecureCookie:
+	case session.CodecSigned:
+		check(c.Session.Backend == session.BackendCookie, "session.codec signed is only for cookie backend")
+	default:
+		check(false, "session.codec must be securecookie or signed: %q", c.Session.Codec)
+	}
+	check(c.Session.Secret != "", "session.secret is required")
+	check(c.Session.MaxAge >= 0, "session.max_age must not be negative")
+
+	check((c.Bank.Endpoint == "") == (c.Bank.AppID == ""), "bank.endpoint and bank.app_id must be set together")
+	check(c.Bank.Retries >= 0 && c.Bank.TimeoutMS >= 0 && c.Bank.MaxIdleConns >= 0, "bank.retries, bank.timeout_ms and bank.max_idle_conns must not be negative")
+	check(c.Bank.BreakerFailures <= 0 || c.Bank.BreakerOpenMS > 0, "bank.breaker_open_ms must be positive")
+	check(!c.Bank.Journal || c.Bank.ReconcileIntervalMS > 0, "bank.reconcile_interval_ms must be positive")
+	check(!c.Bank.CreditCache || c.Bank.CreditCacheTTLMS > 0, "bank.credit_cache_ttl_ms must be positive")
+
+	check((c.Log.Endpoint == "") == (c.Log.AppID == ""), "log.endpoint and log.app_id must be set together")
+	check(c.Log.TimeoutMS >= 0, "log.timeout_ms must not be negative")
+	check(!c.Log.Async || c.Log.QueueSize > 0 && c.Log.FlushIntervalMS > 0, "log.queue_size and log.flush_interval_ms must be positive")
+	check(!c.Log.Outbox || c.Log.FlushIntervalMS > 0, "log.flush_interval_ms must be positive")
+
+	check(c.Trade.LockTimeoutSec >= 0 && c.Trade.UserLockTimeoutSec >= 0, "trade.lock_timeout_sec and trade.user_lock_timeout_sec must not be negative")
+	check(c.Trade.UserLockStripes >= 0, "trade.user_lock_stripes must not be negative")
+	check(!c.Trade.LeaderElection || c.Trade.AsyncMatcher, "trade.leader_election requires trade.async_matcher")
+	check(!c.Trade.LeaderElection || c.Trade.LeaderCheckIntervalMS > 0, "trade.leader_check_interval_ms must be positive")
+	// trade.lock_timeout_secとtrade.leader_electionは複数台で動かす場合の設定なので、プロセス内だけの状態は使えない
+	if c.Trade.LockTimeoutSec > 0 || c.Trade.LeaderElection {
+		check(!c.Trade.UserCache && !c.Trade.SettingsCache && !c.Trade.OrderBook, "trade.user_cache, trade.settings_cache and trade.order_book must be false with trade.lock_timeout_sec or trade.leader_election")
+		check(c.Trade.UserLockStripes == 0 || c.Trade.UserLockTimeoutSec > 0, "trade.user_lock_stripes requires trade.user_lock_timeout_sec with trade.lock_timeout_sec or trade.leader_election")
+	}
+	check(c.Trade.IDNode >= 0 && c.Trade.IDNode <= model.MaxIDNode, "trade.id_node must be between 0 and %d", model.MaxIDNode)
+	// 複数台でトレードのIDを順に払い出すには、マッチングを1台ずつ行う必要がある
+	check(!c.Trade.IDGenerator || c.Trade.IDNode == 0 || c.Trade.LockTimeoutSec > 0 || c.Trade.LeaderElection, "trade.id_generator with trade.id_node requires trade.lock_timeout_sec or trade.leader_election")
+	check(c.Webhook.Workers >= 0, "webhook.workers must not be negative")
+	check(c.Webhook.Workers == 0 || c.Webhook.QueueSize > 0 && c.Webhook.TimeoutMS > 0, "webhook.queue_size and webhook.timeout_ms must be positive")
+	check(c.Shed.DBInUse >= 0 && c.Shed.TradeQueue >= 0 && c.Shed.RetryAfterSec >= 0, "shed values must not be negative")
+
+	if c.Archive.Enabled {
+		check(time.Duration(c.Archive.AgeHours)*time.Hour >= model.MinArchiveAge, "archive.age_hours must be at least %d", int(model.MinArchiveAge/time.Hour))
+		check(c.Archive.IntervalMS > 0 && c.Archive.BatchSize > 0, "archive.interval_ms and archive.batch_size must be positive")
+	}
+
+	check(c.Monitor.SlowRequestMS >= 0, "monitor.slow_request_ms must not be negative")
+	switch c.Monitor.AccessLog {
+	case "", "json", "ltsv":
+	default:
+		check(false, "monitor.access_log must be json or ltsv: %q", c.Monitor.AccessLog)
+	}
+	if c.Monitor.Debug {
+		_, _, err := net.SplitHostPort(c.Monitor.DebugAddr)
+		check(err == nil, "monitor.debug_addr must be host:port: %q", c.Monitor.DebugAddr)
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// DSN はaddrのMySQLに接続するDSNです
+func (c *DBConfig) DSN(addr string) string {
+	userpass := c.User
+	if c.Password != "" {
+		userpass += ":" + c.Password
+	}
+	return fmt.Sprintf(`%s@tcp(%s)/%s?parseTime=true&loc=Local&charset=utf8mb4`, userpass, addr, c.Name)
+}
+
+func (c *DBConfig) PrimaryDSN() string {
+	return c.DSN(net.JoinHostPort(c.Host, c.Port))
+}
+
+func (c *DBConfig) ReplicaDSNs() []string {
+	dsns := make([]string, len(c.ReplicaHosts))
+	for i, h := range c.ReplicaHosts {
+		dsns[i] = c.DSN(h)
+	}
+	return dsns
+}
+
+// SettingOverrides は/initializeで設定した値より優先するsettingの値です
+func (c *Config) SettingOverrides() map[string]string {
+	vals := map[string]string{}
+	if c.Bank.Endpoint != "" {
+		vals[model.BankEndpoint] = c.Bank.Endpoint
+		vals[model.BankAppid] = c.Bank.AppID
+	}
+	if c.Log.Endpoint != "" {
+		vals[model.LogEndpoint] = c.Log.Endpoint
+		vals[model.LogAppid] = c.Log.AppID
+	}
+	return vals
+}
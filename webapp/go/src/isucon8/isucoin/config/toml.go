@@ -0,0 +1,150 @@
+package config
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// parseTOML は設定ファイルで使うTOMLのサブセットを読み込み、"section.key" をキーにした値を返します
+// 使えるのは [section] と key = value で、値は文字列, 整数, 真偽値と、それらの1行の配列だけです
+func parseTOML(r io.Reader) (map[string]interface{}, error) {
+	vals := map[string]interface{}{}
+	section := ""
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(stripComment(s.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, errors.Errorf("line %d: invalid section %q", n, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == "" {
+				return nil, errors.Errorf("line %d: empty section", n)
+			}
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, errors.Errorf("line %d: expected key = value", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		if key == "" {
+			return nil, errors.Errorf("line %d: empty key", n)
+		}
+		if section != "" {
+			key = section + "." + key
+		}
+		if _, ok := vals[key]; ok {
+			return nil, errors.Errorf("line %d: duplicate key %s", n, key)
+		}
+		v, err := parseTOMLValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "line %d", n)
+		}
+		vals[key] = v
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return vals, nil
+}
+
+// stripComment は文字列の外の#以降を取り除きます
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTOMLValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, errors.New("missing value")
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	case s[0] == '"':
+		if len(s) < 2 || s[len(s)-1] != '"' {
+			return nil, errors.Errorf("unterminated string %s", s)
+		}
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, errors.Errorf("invalid string %s", s)
+		}
+		return v, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, errors.Errorf("unterminated string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case s[0] == '[':
+		if s[len(s)-1] != ']' {
+			return nil, errors.Errorf("unterminated array %s", s)
+		}
+		var arr []interface{}
+		for _, e := range splitArray(s[1 : len(s)-1]) {
+			if e = strings.TrimSpace(e); e == "" {
+				continue
+			}
+			v, err := parseTOMLValue(e)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	}
+	v, err := strconv.ParseInt(strings.Replace(s, "_", "", -1), 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid value %s", s)
+	}
+	return v, nil
+}
+
+// splitArray は配列の中身を文字列の外のカンマで分けます
+func splitArray(s string) []string {
+	var (
+		res   []string
+		quote byte
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(res, s[start:])
+}
@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	gctx "github.com/gorilla/context"
+	"github.com/pkg/errors"
+)
+
+// アクセスログの形式です
+const (
+	AccessLogJSON = "json"
+	AccessLogLTSV = "ltsv"
+)
+
+type accessLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// accessLogEntry はアクセスログの1行です。時間は秒で出力します
+// bank_timeとlogger_timeはリクエストのトランザクションの中で呼んだ銀行APIとISULOGの時間の合計です
+type accessLogEntry struct {
+	Time       string  `json:"time"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	Size       int     `json:"size"`
+	ReqTime    float64 `json:"reqtime"`
+	UserID     int64   `json:"user_id,omitempty"`
+	RequestID  string  `json:"request_id,omitempty"`
+	BankTime   float64 `json:"bank_time"`
+	LoggerTime float64 `json:"logger_time"`
+	Err        string  `json:"err,omitempty"`
+}
+
+// SetAccessLog はアクセスログをformat (json, ltsv) でwに出力するようにします
+// formatが空の場合は出力せず、エラーはこれまで通りlogに出力します
+func (h *Handler) SetAccessLog(w io.Writer, format string) error {
+	switch format {
+	case "":
+		h.access = nil
+		return nil
+	case AccessLogJSON, AccessLogLTSV:
+	default:
+		return errors.Errorf("unknown access log format: %s", format)
+	}
+	h.access = &accessLogger{w: w, format: format}
+	return nil
+}
+
+// AccessLog はリクエストごとにアクセスログを出力します
+// gctx.ClearHandlerの内側に置いてください
+func (h *Handler) AccessLog(f http.Handler) http.Handler {
+	if h.access == nil {
+		return f
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		aw := &accessLogWriter{ResponseWriter: w, logged: true}
+		trace := &model.UpstreamTrace{}
+		gctx.Set(r, upstreamTraceKey, trace)
+		f.ServeHTTP(aw, r)
+
+		e := &accessLogEntry{
+			Time:       start.Format(time.RFC3339),
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Status:     aw.status,
+			Size:       aw.size,
+			ReqTime:    time.Since(start).Seconds(),
+			BankTime:   trace.Bank().Seconds(),
+			LoggerTime: trace.Logger().Seconds(),
+			RequestID:  requestID(r),
+		}
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		if id, ok := gctx.Get(r, accessUserKey).(int64); ok {
+			e.UserID = id
+		}
+		if aw.err != nil {
+			e.Err = aw.err.Error()
+		}
+		h.access.write(e)
+	})
+}
+
+func (l *accessLogger) write(e *accessLogEntry) {
+	var b []byte
+	if l.format == AccessLogJSON {
+		var err error
+		if b, err = json.Marshal(e); err != nil {
+			log.Printf("[WARN] access log encode failed. err:%s", err)
+			return
+		}
+	} else {
+		b = e.appendLTSV(make([]byte, 0, 256))
+	}
+	b = append(b, '\n')
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.w.Write(b); err != nil {
+		log.Printf("[WARN] write access log failed. err:%s", err)
+	}
+}
+
+// ltsvEscaper はLTSVの区切り文字を置き換えます
+var ltsvEscaper = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+
+func (e *accessLogEntry) appendLTSV(b []byte) []byte {
+	b = append(b, "time:"...)
+	b = append(b, e.Time...)
+	b = append(b, "\tmethod:"...)
+	b = append(b, e.Method...)
+	b = append(b, "\tpath:"...)
+	b = append(b, ltsvEscaper.Replace(e.Path)...)
+	b = append(b, "\tstatus:"...)
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, "\tsize:"...)
+	b = strconv.AppendInt(b, int64(e.Size), 10)
+	b = append(b, "\treqtime:"...)
+	b = strconv.AppendFloat(b, e.ReqTime, 'f', 6, 64)
+	if e.UserID > 0 {
+		b = append(b, "\tuser_id:"...)
+		b = strconv.AppendInt(b, e.UserID, 10)
+	}
+	if e.RequestID != "" {
+		b = append(b, "\trequest_id:"...)
+		b = append(b, e.RequestID...)
+	}
+	b = append(b, "\tbank_time:"...)
+	b = strconv.AppendFloat(b, e.BankTime, 'f', 6, 64)
+	b = append(b, "\tlogger_time:"...)
+	b = strconv.AppendFloat(b, e.LoggerTime, 'f', 6, 64)
+	if e.Err != "" {
+		b = append(b, "\terr:"...)
+		b = append(b, ltsvEscaper.Replace(e.Err)...)
+	}
+	return b
+}
+
+func upstreamTrace(r *http.Request) *model.UpstreamTrace {
+	t, _ := gctx.Get(r, upstreamTraceKey).(*model.UpstreamTrace)
+	return t
+}
+
+// accessLogWriter はステータスとサイズを記録します
+// /streamと/wsのためにFlusherとHijackerも実装します
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+	// err はhandleErrorで返したエラーです
+	err error
+	// logged はアクセスログを出力する場合にtrueです (Measureだけで使う場合はfalse)
+	logged bool
+	// deadline はルートのタイムアウトを設定したctxです (Timeoutで設定します)
+	deadline context.Context
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack unsupported")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
@@ -0,0 +1,298 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultUsersLimit = 100
+	MaxUsersLimit     = 1000
+
+	// DefaultSettlementPeriod は/admin/settlementsでfromを指定しなかった場合の期間です
+	DefaultSettlementPeriod = 24 * time.Hour
+
+	// ReadyzTimeout は/readyzで依存先の確認を待つ時間です
+	ReadyzTimeout = 3 * time.Second
+)
+
+// settingKeys は/initializeと/admin/settingsで変更できる設定です
+var settingKeys = []string{
+	model.BankEndpoint,
+	model.BankAppid,
+	model.LogEndpoint,
+	model.LogAppid,
+	model.SelfTradePrevention,
+	model.MatchingPolicy,
+	model.MarketMode,
+	model.AuctionIntervalSec,
+	model.MakerFeeBps,
+	model.TakerFeeBps,
+	model.CircuitBreakerPercent,
+	model.CircuitBreakerWindowSec,
+	model.CircuitBreakerHaltSec,
+	model.PriceBandPercent,
+	model.RateLimitOrders,
+	model.RateLimitInfo,
+	model.SigninLockThreshold,
+	model.SigninLockSec,
+	model.SigninLockMaxSec,
+	model.EnableShare,
+}
+
+// Admin は管理APIのトークンを確認します
+// トークンは Authorization: Bearer {ISU_ADMIN_TOKEN} で渡します
+func (h *Handler) Admin(f httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !model.CheckAdminToken(given) {
+			h.handleError(w, errors.New("unauthorized"), 401)
+			return
+		}
+		f(w, r, p)
+	}
+}
+
+// tradingHalted は取引が停止中の場合に423を返してtrueを返します
+// サーキットブレーカーによる停止の場合はRetry-Afterで再開までの秒数を返します
+func (h *Handler) tradingHalted(w http.ResponseWriter) bool {
+	t, err := model.GetTradingHalt(h.db)
+	now := time.Now()
+	switch {
+	case err != nil:
+		h.handleError(w, err, 500)
+		return true
+	case t.Halted:
+		h.handleError(w, model.ErrTradingHalted, http.StatusLocked)
+		return true
+	case now.Before(t.Until):
+		retry := int64(t.Until.Sub(now)/time.Second) + 1
+		w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+		h.handleError(w, model.ErrCircuitBreaker, http.StatusLocked)
+		return true
+	}
+	return false
+}
+
+func (h *Handler) AdminStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	t, err := model.GetTradingHalt(h.db)
+	if err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	res := map[string]interface{}{
+		"halted":      t.Halted,
+		"maintenance": maintenanceResponse(model.CurrentMaintenance(h.db)),
+	}
+	if time.Now().Before(t.Until) {
+		res["trading_halted_until"] = t.Until
+	}
+	h.handleSuccess(w, res)
+}
+
+func (h *Handler) AdminHalt(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := model.SetTradingHalted(h.db, true); err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	log.Printf("[INFO] trading halted")
+	h.handleSuccess(w, map[string]interface{}{
+		"halted": true,
+	})
+}
+
+func (h *Handler) AdminResume(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := model.SetTradingHalted(h.db, false); err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	log.Printf("[INFO] trading resumed")
+	// 停止中に成立するようになった注文をマッチングする
+	if !model.SignalMatcher() {
+		if err := model.RunTrade(h.db); err != nil {
+			log.Printf("runTrade err:%s", err)
+		}
+	}
+	model.SignalStopWatcher()
+	h.handleSuccess(w, map[string]interface{}{
+		"halted": false,
+	})
+}
+
+func (h *Handler) AdminDeleteOrder(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
+	err := h.txScope(r, func(tx *sql.Tx) error {
+		return model.CancelOrderByID(tx, id, model.CancelReasonAdmin)
+	})
+	switch {
+	case err == model.ErrOrderNotFound || err == model.ErrOrderAlreadyClosed:
+		h.handleError(w, err, 404)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		model.BookRemoveOrders(id)
+		if order, err := model.GetOrderByID(h.db, id); err == nil {
+			model.PublishOrderEvent(&model.OrderEvent{Event: model.OrderEventCanceled, Reason: model.CancelReasonAdmin, Order: order})
+		}
+		h.handleSuccess(w, map[string]interface{}{
+			"id": id,
+		})
+	}
+}
+
+func (h *Handler) AdminUsers(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var (
+		err    error
+		cursor int64
+		limit  = DefaultUsersLimit
+	)
+	if _cursor := r.URL.Query().Get("cursor"); _cursor != "" {
+		if cursor, err = strconv.ParseInt(_cursor, 10, 64); err != nil || cursor < 0 {
+			h.handleError(w, errors.New("cursor must be non-negative integer"), 400)
+			return
+		}
+	}
+	if _limit := r.URL.Query().Get("limit"); _limit != "" {
+		if limit, err = strconv.Atoi(_limit); err != nil || limit <= 0 {
+			h.handleError(w, errors.New("limit must be positive integer"), 400)
+			return
+		}
+	}
+	if limit > MaxUsersLimit {
+		limit = MaxUsersLimit
+	}
+	users, err := model.GetUsersPage(h.dbFor(r), cursor, limit)
+	if err != nil {
+		h.handleError(w, errors.Wrap(err, "model.GetUsersPage"), 500)
+		return
+	}
+	h.handleSuccess(w, users)
+}
+
+// AdminSettlements はfrom以上to未満に予約した銀行の仮決済をトレードごとと状態ごとに集計します
+// toのデフォルトは現在時刻、fromのデフォルトはtoのDefaultSettlementPeriod前です
+func (h *Handler) AdminSettlements(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	to := time.Now()
+	if s := r.URL.Query().Get("to"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			h.handleError(w, errors.New("to must be RFC3339"), 400)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-DefaultSettlementPeriod)
+	if s := r.URL.Query().Get("from"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			h.handleError(w, errors.New("from must be RFC3339"), 400)
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		h.handleError(w, errors.New("from must be before to"), 400)
+		return
+	}
+	report, err := model.GetSettlementReport(h.dbFor(r), from, to)
+	if err != nil {
+		h.handleError(w, errors.Wrap(err, "model.GetSettlementReport"), 500)
+		return
+	}
+	h.handleSuccess(w, report)
+}
+
+// AdminSettings は指定された設定だけを変更します
+func (h *Handler) AdminSettings(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	updated := []string{}
+	err := h.txScope(r, func(tx *sql.Tx) error {
+		updated = updated[:0]
+		for _, k := range settingKeys {
+			if _, ok := r.PostForm[k]; !ok {
+				continue
+			}
+			if err := model.SetSetting(tx, k, r.PostForm.Get(k)); err != nil {
+				return errors.Wrapf(err, "set setting failed. %s", k)
+			}
+			updated = append(updated, k)
+		}
+		return nil
+	})
+	if err == nil && len(updated) > 0 {
+		err = model.ReloadSettings(h.db)
+	}
+	switch {
+	case err != nil:
+		h.handleError(w, err, 500)
+	case len(updated) == 0:
+		h.handleError(w, model.ErrParameterInvalid, 400)
+	default:
+		log.Printf("[INFO] settings updated. %v", updated)
+		h.handleSuccess(w, map[string]interface{}{
+			"updated": updated,
+		})
+	}
+}
+
+// AdminReloadSettings はsettingテーブルを読み直します
+// 他のappサーバーやDBで直接設定を変更した場合に使います
+func (h *Handler) AdminReloadSettings(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if err := model.ReloadSettings(h.db); err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	log.Printf("[INFO] settings reloaded")
+	h.handleSuccess(w, struct{}{})
+}
+
+// DebugBank はISUBANK APIへの接続の統計 (keep-aliveの接続を使い回した割合など) を返します
+func (h *Handler) DebugBank(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.handleSuccess(w, model.GetBankStatus())
+}
+
+// DebugLeader はこのサーバーと、マッチングを行っている現在のリーダーのサーバーを返します
+func (h *Handler) DebugLeader(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	s, err := model.GetLeaderStatus(h.db)
+	if err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	h.handleSuccess(w, s)
+}
+
+// Healthz はプロセスが動いていれば200を返します
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.handleSuccess(w, map[string]interface{}{
+		"status": "ok",
+	})
+}
+
+// Readyz はDB, 設定, 銀行API, マッチングのワーカーを確認し、すべて使える場合に200を、そうでない場合は503を返します
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx, cancel := context.WithTimeout(r.Context(), ReadyzTimeout)
+	defer cancel()
+	deps := model.CheckReadiness(ctx, h.cluster)
+	status, code := "ok", http.StatusOK
+	for _, d := range deps {
+		if !d.OK {
+			status, code = "unavailable", http.StatusServiceUnavailable
+			break
+		}
+	}
+	if err := writeJSON(w, code, map[string]interface{}{
+		"status":       status,
+		"dependencies": deps,
+	}); err != nil {
+		log.Printf("[WARN] write response json failed. %s", err)
+	}
+}
@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/pkg/errors"
+)
+
+var ErrServiceOverloaded = errors.New("サーバーが混雑しています。しばらくしてから再度お試しください")
+
+// AdmissionConfig は過負荷時に優先度の低いリクエストを503で落とすための閾値です
+// 0を指定した閾値は判定に使いません
+type AdmissionConfig struct {
+	// DBInUse は使用中のDBコネクション数の上限です
+	DBInUse int
+	// TradeQueue は実行中のトレード処理数の上限です
+	TradeQueue int64
+	// RetryAfter はRetry-Afterヘッダで返す待ち時間です
+	RetryAfter time.Duration
+}
+
+func (h *Handler) SetAdmission(c AdmissionConfig) {
+	h.admission = c
+}
+
+// overloaded はDBのコネクションプールが飽和しているかマッチング待ちが溜まっている場合にtrueを返します
+func (h *Handler) overloaded() bool {
+	c := h.admission
+	if c.TradeQueue > 0 && model.TradeQueueDepth() >= c.TradeQueue {
+		return true
+	}
+	if c.DBInUse > 0 && h.db.Stats().InUse >= c.DBInUse {
+		return true
+	}
+	return false
+}
+
+func (h *Handler) handleOverloaded(w http.ResponseWriter) {
+	retry := int64(h.admission.RetryAfter / time.Second)
+	if retry < 1 {
+		retry = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+	h.handleError(w, ErrServiceOverloaded, http.StatusServiceUnavailable)
+}
@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+func (h *Handler) Alerts(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	alerts, err := model.GetAlerts(h.dbFor(r), user.ID, r.URL.Query().Get("status"))
+	switch {
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+	case err != nil:
+		h.handleError(w, errors.Wrap(err, "model.GetAlerts"), 500)
+	default:
+		h.handleSuccess(w, alerts)
+	}
+}
+
+// AddAlert は約定価格がpriceを上回った (direction=above) または下回った (direction=below) ときの通知を登録します
+func (h *Handler) AddAlert(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	price, err := strconv.ParseInt(r.FormValue("price"), 10, 64)
+	if err != nil {
+		h.handleError(w, errors.New("price must be integer"), 400)
+		return
+	}
+	var alert *model.PriceAlert
+	err = h.txScope(r, func(tx *sql.Tx) (err error) {
+		alert, err = model.CreateAlert(tx, user.ID, r.FormValue("direction"), price)
+		return
+	})
+	switch {
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+	case err == model.ErrAlertLimit:
+		h.handleError(w, err, 409)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		h.handleSuccess(w, alert)
+	}
+}
+
+func (h *Handler) DeleteAlert(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
+	err = h.txScope(r, func(tx *sql.Tx) error {
+		return model.DeleteAlert(tx, user.ID, id)
+	})
+	switch {
+	case err == model.ErrAlertNotFound:
+		h.handleError(w, err, 404)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		h.handleSuccess(w, map[string]interface{}{
+			"id": id,
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package controller
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"isucon8/isucoin/model"
+
+	gctx "github.com/gorilla/context"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+const (
+	APIKeyHeader     = "X-API-Key"
+	MaxAPIKeyNameLen = 64
+)
+
+var ErrAPIKeyScope = errors.New("APIキーの権限がありません")
+
+// apiKeyDeniedPaths はAPIキーでは呼べないAPIです (アカウントの操作とキーの管理)
+var apiKeyDeniedPaths = []string{
+	"/me/apikeys",
+	"/me/webhooks",
+	"/me/close",
+	"/me/password",
+	"/me/bank",
+	"/me/2fa",
+	"/me/sessions",
+	"/signout",
+}
+
+func (h *Handler) APIKeys(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	keys, err := model.GetAPIKeys(h.dbFor(r), user.ID)
+	if err != nil {
+		h.handleError(w, errors.Wrap(err, "model.GetAPIKeys"), 500)
+		return
+	}
+	h.handleSuccess(w, keys)
+}
+
+// AddAPIKey はAPIキーを発行します。キーはこのレスポンスでだけ返します
+func (h *Handler) AddAPIKey(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	name := r.FormValue("name")
+	if name == "" || utf8.RuneCountInString(name) > MaxAPIKeyNameLen {
+		h.handleError(w, errors.New("name is required"), 400)
+		return
+	}
+	var (
+		apiKey *model.APIKey
+		key    string
+	)
+	err = h.txScope(r, func(tx *sql.Tx) (err error) {
+		apiKey, key, err = model.CreateAPIKey(tx, user.ID, name, r.FormValue("scope"))
+		return
+	})
+	switch {
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, errors.New("scope must be read or trade"), 400)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		h.handleSuccess(w, struct {
+			*model.APIKey
+			Key string `json:"key"`
+		}{apiKey, key})
+	}
+}
+
+func (h *Handler) DeleteAPIKey(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
+	err = h.txScope(r, func(tx *sql.Tx) error {
+		return model.RevokeAPIKey(tx, user.ID, id)
+	})
+	switch {
+	case err == model.ErrAPIKeyNotFound:
+		h.handleError(w, err, 404)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		h.handleSuccess(w, map[string]interface{}{
+			"id": id,
+		})
+	}
+}
+
+// apiKey はX-API-Keyヘッダで渡されたAPIキーを返します。確認はリクエストごとに1回だけ行います
+// ヘッダがあってキーが無効な場合はnil, trueを返します
+func (h *Handler) apiKey(r *http.Request) (*model.APIKey, bool) {
+	if v, ok := gctx.GetOk(r, apiKeyKey); ok {
+		key, _ := v.(*model.APIKey)
+		return key, true
+	}
+	given := r.Header.Get(APIKeyHeader)
+	if given == "" {
+		return nil, false
+	}
+	key, err := model.AuthenticateAPIKey(h.db, given)
+	if err != nil && err != model.ErrAPIKeyInvalid {
+		log.Printf("[WARN] authenticate api key failed. err:%s", err)
+	}
+	gctx.Set(r, apiKeyKey, key)
+	return key, true
+}
+
+// checkAPIKey はAPIキーで呼ばれたリクエストをキーの権限で制限します
+func (h *Handler) checkAPIKey(w http.ResponseWriter, r *http.Request) bool {
+	key, ok := h.apiKey(r)
+	switch {
+	case !ok:
+		return true
+	case key == nil:
+		h.handleError(w, model.ErrAPIKeyInvalid, 401)
+		return false
+	}
+	for _, p := range apiKeyDeniedPaths {
+		if r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/") {
+			h.handleError(w, ErrAPIKeyScope, 403)
+			return false
+		}
+	}
+	if key.Scope == model.APIKeyScopeRead && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		h.handleError(w, ErrAPIKeyScope, 403)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package controller
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// CSRFトークンはログイン時にセッションに保存し、JavaScriptから読めるcookieにも設定します
+// 更新系のリクエストではヘッダ (またはcsrf_tokenパラメーター) のトークンがセッションと一致する必要があります
+// cookieとヘッダの名前はaxiosのデフォルト (xsrfCookieName, xsrfHeaderName) に合わせています
+const (
+	CSRFCookieName = "XSRF-TOKEN"
+	CSRFHeaderName = "X-XSRF-TOKEN"
+	CSRFParamName  = "csrf_token"
+)
+
+var ErrCSRFTokenInvalid = errors.New("invalid csrf token")
+
+// csrfExemptPaths はログイン前に呼ぶAPIと、別の方法で認証するAPIです
+var csrfExemptPaths = []string{
+	"/initialize",
+	"/signup",
+	"/signin",
+	"/admin/",
+}
+
+// SetCSRFProtection はCSRFトークンの確認を有効にします
+func (h *Handler) SetCSRFProtection(enabled bool) {
+	h.csrf = enabled
+}
+
+// CSRFToken はログインユーザーのCSRFトークンを返します (無い場合は発行します)
+func (h *Handler) CSRFToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if _, ok := h.sessionUserID(r); !ok {
+		h.handleError(w, errors.New("Not authenticated"), 401)
+		return
+	}
+	session, err := h.store.Get(r, SessionName)
+	if err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	token, _ := session.Values["csrf_token"].(string)
+	if token == "" {
+		if token, err = setCSRFToken(w, session); err != nil {
+			h.handleError(w, err, 500)
+			return
+		}
+		if err = session.Save(r, w); err != nil {
+			h.handleError(w, err, 500)
+			return
+		}
+	} else {
+		setCSRFCookie(w, token)
+	}
+	h.handleSuccess(w, map[string]interface{}{
+		"csrf_token": token,
+	})
+}
+
+// setCSRFToken は新しいトークンをセッションとcookieに設定します。セッションの保存は呼び出し側で行ってください
+func setCSRFToken(w http.ResponseWriter, session *sessions.Session) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generate csrf token failed")
+	}
+	token := hex.EncodeToString(b)
+	session.Values["csrf_token"] = token
+	setCSRFCookie(w, token)
+	return token, nil
+}
+
+func setCSRFCookie(w http.ResponseWriter, token string) {
+	c := &http.Cookie{Name: CSRFCookieName, Value: token, Path: "/"}
+	if token == "" {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// checkCSRF は更新系のリクエストのCSRFトークンを確認します
+// ログインしていないリクエストは各ハンドラで401になるので確認しません
+func (h *Handler) checkCSRF(r *http.Request) bool {
+	if !h.csrf {
+		return true
+	}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+	default:
+		return true
+	}
+	for _, p := range csrfExemptPaths {
+		if r.URL.Path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	// JWTとAPIキーはブラウザが自動で送らないので確認しない
+	if _, ok := bearerToken(r); ok {
+		return true
+	}
+	if r.Header.Get(APIKeyHeader) != "" {
+		return true
+	}
+	if _, ok := h.sessionUserID(r); !ok {
+		return true
+	}
+	session, err := h.store.Get(r, SessionName)
+	if err != nil {
+		return false
+	}
+	token, _ := session.Values["csrf_token"].(string)
+	given := r.Header.Get(CSRFHeaderName)
+	if given == "" {
+		given = r.FormValue(CSRFParamName)
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"net/http"
+
+	"isucon8/isucoin/model"
+
+	"github.com/pkg/errors"
+)
+
+// controllerのエラーのコードです。modelのエラーのコードはmodel.ErrorCodeを参照してください
+const (
+	ErrorCodeUnauthenticated    = "UNAUTHENTICATED"
+	ErrorCodeForbidden          = "FORBIDDEN"
+	ErrorCodeNotFound           = "NOT_FOUND"
+	ErrorCodeConflict           = "CONFLICT"
+	ErrorCodeInternal           = "INTERNAL_ERROR"
+	ErrorCodeServiceUnavailable = "SERVICE_UNAVAILABLE"
+	ErrorCodeServiceOverloaded  = "SERVICE_OVERLOADED"
+	ErrorCodeRequestTimeout     = "REQUEST_TIMEOUT"
+	ErrorCodeRateLimited        = "RATE_LIMITED"
+	ErrorCodeCSRFTokenInvalid   = "CSRF_TOKEN_INVALID"
+	ErrorCodeAPIKeyScope        = "API_KEY_SCOPE"
+)
+
+// statusErrorCodes はコードの無いエラーをステータスから分類します
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:         model.ErrorCodeParameterInvalid,
+	http.StatusUnauthorized:       ErrorCodeUnauthenticated,
+	http.StatusForbidden:          ErrorCodeForbidden,
+	http.StatusNotFound:           ErrorCodeNotFound,
+	http.StatusConflict:           ErrorCodeConflict,
+	http.StatusLocked:             model.ErrorCodeTradingHalted,
+	http.StatusTooManyRequests:    ErrorCodeRateLimited,
+	http.StatusServiceUnavailable: ErrorCodeServiceUnavailable,
+}
+
+// errorCode はエラーのレスポンスのerror_codeです
+func errorCode(err error, status int) string {
+	switch errors.Cause(err) {
+	case ErrServiceOverloaded:
+		return ErrorCodeServiceOverloaded
+	case ErrRequestTimeout:
+		return ErrorCodeRequestTimeout
+	case ErrRateLimited:
+		return ErrorCodeRateLimited
+	case ErrCSRFTokenInvalid:
+		return ErrorCodeCSRFTokenInvalid
+	case ErrAPIKeyScope:
+		return ErrorCodeAPIKeyScope
+	}
+	if code := model.ErrorCode(err); code != "" {
+		return code
+	}
+	if code, ok := statusErrorCodes[status]; ok {
+		return code
+	}
+	return ErrorCodeInternal
+}
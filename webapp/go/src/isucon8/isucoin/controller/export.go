@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// exportFlushRows ごとにレスポンスをフラッシュして、クライアントに少しずつ届けます
+const exportFlushRows = 100
+
+// exportCSVHeader はCSVの列です。トレードの列は成立した注文のみ値が入ります
+var exportCSVHeader = []string{
+	"id", "type", "amount", "price", "filled_amount", "remaining_amount", "fee", "created_at", "closed_at",
+	"trade_id", "trade_amount", "trade_price", "trade_created_at",
+}
+
+// ExportOrders はログインユーザーのすべての注文と成立したトレードを format=csv (デフォルト) または ndjson で返します
+// DBから1行ずつ読んで書き出すので、注文が多くてもメモリに載せません
+func (h *Handler) ExportOrders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	var contentType string
+	switch format {
+	case "", "csv":
+		format, contentType = "csv", "text/csv; charset=utf-8"
+	case "ndjson":
+		contentType = "application/x-ndjson"
+	default:
+		h.handleError(w, errors.New("format must be csv or ndjson"), 400)
+		return
+	}
+	it, err := model.IterateOrderHistory(r.Context(), h.cluster.Replica(), user.ID)
+	if err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	defer it.Close()
+
+	filename := fmt.Sprintf("isucoin-orders-%d-%s.%s", user.ID, time.Now().Format("20060102"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(200)
+
+	var write func(*model.Order) error
+	flush := func() error { return nil }
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		if err := cw.Write(exportCSVHeader); err != nil {
+			log.Printf("[WARN] export orders failed. user:%d err:%s", user.ID, err)
+			return
+		}
+		write = func(o *model.Order) error { return cw.Write(exportCSVRecord(o)) }
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	} else {
+		enc := json.NewEncoder(w)
+		write = func(o *model.Order) error { return enc.Encode(o) }
+	}
+	flusher, _ := w.(http.Flusher)
+	n := 0
+	for it.Next() {
+		if err = write(it.Order()); err != nil {
+			break
+		}
+		if n++; n%exportFlushRows == 0 {
+			if err = flush(); err != nil {
+				break
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err == nil {
+		err = it.Err()
+	}
+	if ferr := flush(); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		// ステータスは送信済みなので、途中で終わったことはログにだけ残す
+		log.Printf("[WARN] export orders failed. user:%d rows:%d err:%s", user.ID, n, err)
+	}
+}
+
+func exportCSVRecord(o *model.Order) []string {
+	rec := []string{
+		strconv.FormatInt(o.ID, 10),
+		o.Type,
+		strconv.FormatInt(o.Amount, 10),
+		strconv.FormatInt(o.Price, 10),
+		strconv.FormatInt(o.Filled, 10),
+		strconv.FormatInt(o.Remaining, 10),
+		strconv.FormatInt(o.Fee, 10),
+		o.CreatedAt.Format(time.RFC3339Nano),
+		"",
+		"", "", "", "",
+	}
+	if o.ClosedAt != nil {
+		rec[8] = o.ClosedAt.Format(time.RFC3339Nano)
+	}
+	if t := o.Trade; t != nil {
+		rec[9] = strconv.FormatInt(t.ID, 10)
+		rec[10] = strconv.FormatInt(t.Amount, 10)
+		rec[11] = strconv.FormatInt(t.Price, 10)
+		rec[12] = t.CreatedAt.Format(time.RFC3339Nano)
+	}
+	return rec
+}
@@ -0,0 +1,348 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"isucon8/isucoin/grpcapi"
+	"isucon8/isucoin/metrics"
+	"isucon8/isucoin/model"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCAPIKeyMetadata はTradingサービスのAPIキーを渡すメタデータです
+const GRPCAPIKeyMetadata = "x-api-key"
+
+var (
+	grpcRequests = metrics.NewCounterVec("isucoin_grpc_requests_total",
+		"gRPCのメソッドとステータスごとのリクエスト数", "method", "code")
+	grpcDuration = metrics.NewHistogramVec("isucoin_grpc_request_duration_seconds",
+		"gRPCのメソッドごとの処理時間 (ストリームは接続していた時間)", metrics.DefaultBuckets, "method")
+)
+
+// grpcServer はHTTPのAPIと同じmodelを使ってgRPCのサービスを実装します
+type grpcServer struct {
+	h *Handler
+}
+
+// NewGRPCServer はMarketDataとTradingのサービスを登録したgrpc.Serverを返します
+// ストリームはShutdownで終了するので、GracefulStopの前にShutdownを呼んでください
+func (h *Handler) NewGRPCServer() *grpc.Server {
+	s := grpc.NewServer(
+		grpcapi.ServerCodec(),
+		grpc.ChainUnaryInterceptor(measureUnary, h.maintenanceUnary),
+		grpc.ChainStreamInterceptor(measureStream, h.maintenanceStream),
+	)
+	srv := &grpcServer{h: h}
+	grpcapi.RegisterMarketDataServer(s, srv)
+	grpcapi.RegisterTradingServer(s, srv)
+	return s
+}
+
+func measureUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	res, err := handler(ctx, req)
+	observeGRPC(info.FullMethod, start, err)
+	return res, err
+}
+
+func measureStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeGRPC(info.FullMethod, start, err)
+	return err
+}
+
+func observeGRPC(method string, start time.Time, err error) {
+	grpcDuration.Observe(time.Since(start).Seconds(), method)
+	grpcRequests.Inc(method, status.Code(err).String())
+}
+
+// grpcError はmodelのエラーをgRPCのステータスにします。HTTPのAPIのステータスと対応させています
+func grpcError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == model.ErrParameterInvalid || err == model.ErrCreditInsufficient || err == model.ErrIsuInsufficient || err == model.ErrPriceOutOfBand:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case err == model.ErrOrderNotFound || err == model.ErrOrderAlreadyClosed:
+		return status.Error(codes.NotFound, err.Error())
+	case err == model.ErrTradingHalted || err == model.ErrCircuitBreaker:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case model.IsBankUnavailable(err):
+		return status.Error(codes.Unavailable, err.Error())
+	case err == context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case err == context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// authenticate はメタデータのAPIキーのユーザーを返します
+// writeがtrueの場合はscopeがtradeのキーが必要です
+func (s *grpcServer) authenticate(ctx context.Context, write bool) (*model.User, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	given := md.Get(GRPCAPIKeyMetadata)
+	if len(given) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "Not authenticated")
+	}
+	key, err := model.AuthenticateAPIKey(s.h.db, given[0])
+	switch {
+	case err == model.ErrAPIKeyInvalid:
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case err != nil:
+		return nil, grpcError(err)
+	case write && key.Scope != model.APIKeyScopeTrade:
+		return nil, status.Error(codes.PermissionDenied, ErrAPIKeyScope.Error())
+	}
+	user, err := model.GetUserByID(model.WithContext(ctx, s.h.db), key.UserID)
+	switch {
+	case err == sql.ErrNoRows || err == nil && user.ClosedAt != nil:
+		return nil, status.Error(codes.Unauthenticated, "セッションが切断されました")
+	case err != nil:
+		return nil, grpcError(errors.Wrap(err, "GetUserByID failed"))
+	}
+	return user, nil
+}
+
+func (s *grpcServer) GetTicker(ctx context.Context, _ *grpcapi.TickerRequest) (*grpcapi.Ticker, error) {
+	t, err := model.GetTicker(s.h.db)
+	if err != nil {
+		return nil, grpcError(errors.Wrap(err, "model.GetTicker"))
+	}
+	return grpcTicker(t), nil
+}
+
+func grpcTicker(t *model.Ticker) *grpcapi.Ticker {
+	return &grpcapi.Ticker{
+		LastPrice: t.LastPrice,
+		BestAsk:   t.LowestSellPrice,
+		BestBid:   t.HighestBuyPrice,
+		Volume24h: t.Volume24h,
+		Change24h: t.Change24h,
+	}
+}
+
+func (s *grpcServer) GetOrderBook(ctx context.Context, req *grpcapi.OrderBookRequest) (*grpcapi.OrderBook, error) {
+	depth := int64(req.Depth)
+	switch {
+	case depth < 0:
+		return nil, status.Error(codes.InvalidArgument, "depth must be positive integer")
+	case depth == 0:
+		depth = DefaultOrderBookDepth
+	case depth > MaxOrderBookDepth:
+		depth = MaxOrderBookDepth
+	}
+	book, err := model.GetOrderBook(model.WithContext(ctx, s.h.db), int(depth))
+	if err != nil {
+		return nil, grpcError(errors.Wrap(err, "model.GetOrderBook"))
+	}
+	levels := func(ls []*model.PriceLevel) []*grpcapi.PriceLevel {
+		res := make([]*grpcapi.PriceLevel, 0, len(ls))
+		for _, l := range ls {
+			res = append(res, &grpcapi.PriceLevel{Price: l.Price, Amount: l.Amount, CumulativeAmount: l.CumulativeAmount})
+		}
+		return res
+	}
+	return &grpcapi.OrderBook{Asks: levels(book.Sells), Bids: levels(book.Buys)}, nil
+}
+
+func (s *grpcServer) GetTrades(ctx context.Context, req *grpcapi.TradesRequest) (*grpcapi.TradesResponse, error) {
+	limit := int64(req.Limit)
+	switch {
+	case req.Cursor < 0 || limit < 0:
+		return nil, status.Error(codes.InvalidArgument, "cursor and limit must be positive integer")
+	case limit == 0:
+		limit = DefaultTradesLimit
+	case limit > MaxTradesLimit:
+		limit = MaxTradesLimit
+	}
+	// 続きがあるかを知るために1件多く読む
+	trades, err := model.GetTradesPage(model.WithContext(ctx, s.h.db), req.Cursor, int(limit)+1)
+	if err != nil {
+		return nil, grpcError(errors.Wrap(err, "model.GetTradesPage"))
+	}
+	res := &grpcapi.TradesResponse{}
+	if len(trades) > int(limit) {
+		trades = trades[:limit]
+		res.NextCursor = trades[len(trades)-1].ID
+	}
+	res.Trades = make([]*grpcapi.Trade, 0, len(trades))
+	for _, t := range trades {
+		res.Trades = append(res.Trades, grpcTrade(t))
+	}
+	return res, nil
+}
+
+func grpcTrade(t *model.Trade) *grpcapi.Trade {
+	return &grpcapi.Trade{ID: t.ID, Price: t.Price, Amount: t.Amount, CreatedAt: t.CreatedAt.UnixNano()}
+}
+
+// waitTrades はトレードが成立する (または他のappサーバーの分をポーリングする) まで待ちます
+// ストリームを終了する場合はfalseを返します
+func (s *grpcServer) waitTrades(ctx context.Context, sub <-chan struct{}, poll <-chan time.Time) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-s.h.closing:
+		return false
+	case <-sub:
+	case <-poll:
+	}
+	return true
+}
+
+// StreamTicker は最初に現在の価格情報を送り、その後は変わるたびに送ります
+func (s *grpcServer) StreamTicker(_ *grpcapi.TickerRequest, stream grpcapi.TickerStream) error {
+	sub, unsubscribe := model.SubscribeTrade()
+	defer unsubscribe()
+	poll := time.NewTicker(StreamPollInterval)
+	defer poll.Stop()
+
+	var last grpcapi.Ticker
+	for first := true; first || s.waitTrades(stream.Context(), sub, poll.C); first = false {
+		t, err := model.GetTicker(s.h.db)
+		if err != nil {
+			return grpcError(errors.Wrap(err, "model.GetTicker"))
+		}
+		cur := grpcTicker(t)
+		if !first && *cur == last {
+			continue
+		}
+		if err = stream.Send(cur); err != nil {
+			return err
+		}
+		last = *cur
+	}
+	return nil
+}
+
+// StreamTrades はcursorより後のトレードを古い順に送り続けます
+func (s *grpcServer) StreamTrades(req *grpcapi.StreamTradesRequest, stream grpcapi.TradeStream) error {
+	ctx := stream.Context()
+	cursor := req.Cursor
+	if cursor <= 0 {
+		// cursorがない場合は過去分は送らずに最新のトレードから始める
+		latestTrade, err := model.GetLatestTrade(model.WithContext(ctx, s.h.db))
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return grpcError(errors.Wrap(err, "GetLatestTrade failed"))
+		default:
+			cursor = latestTrade.ID
+		}
+	}
+	sub, unsubscribe := model.SubscribeTrade()
+	defer unsubscribe()
+	poll := time.NewTicker(StreamPollInterval)
+	defer poll.Stop()
+
+	for s.waitTrades(ctx, sub, poll.C) {
+		trades, err := model.GetTradesByLastID(model.WithContext(ctx, s.h.cluster.Replica()), cursor, StreamTradesLimit)
+		if err != nil {
+			return grpcError(errors.Wrap(err, "GetTradesByLastID failed"))
+		}
+		for _, t := range trades {
+			if err = stream.Send(grpcTrade(t)); err != nil {
+				return err
+			}
+			cursor = t.ID
+		}
+	}
+	return nil
+}
+
+// AddOrder はPOST /ordersの指値注文と同じく注文を受け付けます
+func (s *grpcServer) AddOrder(ctx context.Context, req *grpcapi.AddOrderRequest) (*grpcapi.Order, error) {
+	user, err := s.authenticate(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	t, err := model.GetTradingHalt(model.WithContext(ctx, s.h.db))
+	switch {
+	case err != nil:
+		return nil, grpcError(err)
+	case t.Halted:
+		return nil, grpcError(model.ErrTradingHalted)
+	case t.Active(time.Now()):
+		return nil, grpcError(model.ErrCircuitBreaker)
+	}
+	var order *model.Order
+	err = model.WithUserLock(user.ID, func() error {
+		return model.TxScope(ctx, s.h.db, nil, func(tx *sql.Tx) (err error) {
+			if req.PartialFill {
+				order, err = model.AddPartialOrder(tx, req.Type, user.ID, req.Amount, req.Price)
+			} else {
+				order, err = model.AddOrder(tx, req.Type, user.ID, req.Amount, req.Price)
+			}
+			return
+		})
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if err = s.h.ordersPlaced(order); err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcOrder(order), nil
+}
+
+func grpcOrder(o *model.Order) *grpcapi.Order {
+	res := &grpcapi.Order{
+		ID:              o.ID,
+		Type:            o.Type,
+		Amount:          o.Amount,
+		Price:           o.Price,
+		FilledAmount:    o.Filled,
+		RemainingAmount: o.Remaining,
+		TradeID:         o.TradeID,
+		CreatedAt:       o.CreatedAt.UnixNano(),
+	}
+	if o.ClosedAt != nil {
+		res.ClosedAt = o.ClosedAt.UnixNano()
+	}
+	return res
+}
+
+func (s *grpcServer) CancelOrder(ctx context.Context, req *grpcapi.CancelOrderRequest) (*grpcapi.CancelOrderResponse, error) {
+	user, err := s.authenticate(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	err = model.WithUserLock(user.ID, func() error {
+		return model.TxScope(ctx, s.h.db, nil, func(tx *sql.Tx) error {
+			return model.DeleteOrder(tx, user.ID, req.ID, model.CancelReasonCanceled)
+		})
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	model.BookRemoveOrders(req.ID)
+	if order, err := model.GetOrderByID(s.h.db, req.ID); err == nil {
+		model.PublishOrderEvent(&model.OrderEvent{Event: model.OrderEventCanceled, Reason: model.CancelReasonCanceled, Order: order})
+	}
+	return &grpcapi.CancelOrderResponse{ID: req.ID}, nil
+}
+
+func (s *grpcServer) GetOrders(ctx context.Context, _ *grpcapi.GetOrdersRequest) (*grpcapi.OrdersResponse, error) {
+	user, err := s.authenticate(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	orders, err := model.GetOrdersByUserID(model.WithContext(ctx, s.h.cluster.Replica()), user.ID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &grpcapi.OrdersResponse{Orders: make([]*grpcapi.Order, 0, len(orders))}
+	for _, o := range orders {
+		res.Orders = append(res.Orders, grpcOrder(o))
+	}
+	return res, nil
+}
@@ -4,56 +4,133 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"isucon8/isucoin/model"
+	"isucon8/isucoin/session"
 
-	"github.com/gorilla/sessions"
+	gctx "github.com/gorilla/context"
 	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
 )
 
 const (
 	SessionName = "isucoin_session"
+
+	DefaultOrderBookDepth = 20
+	MaxOrderBookDepth     = 100
+
+	DefaultOrdersLimit = 100
+	MaxOrdersLimit     = 1000
+
+	DefaultTradesLimit = 50
+	MaxTradesLimit     = 500
+
+	MaxBatchOrders = 100
+
+	DefaultChartCandles = 300
+	MaxChartCandles     = 1000
 )
 
 var BaseTime time.Time
 
+type contextKey int
+
+const (
+	bearerClaimsKey contextKey = iota
+	apiKeyKey
+	upstreamTraceKey
+	accessUserKey
+	requestIDKey
+)
+
 type Handler struct {
-	db    *sql.DB
-	store sessions.Store
+	db        *sql.DB
+	cluster   *model.DBCluster
+	store     *session.Manager
+	admission AdmissionConfig
+	limits    map[string]chan struct{}
+	timeouts  map[string]time.Duration
+	slow      time.Duration
+	hub       *Hub
+	csrf      bool
+	limiter   *rateLimiter
+	access    *accessLogger
+	charts    *chartCache
+	market    *marketCache
+	// closing はShutdownで閉じます
+	closing      chan struct{}
+	shutdownOnce sync.Once
 }
 
-func NewHandler(db *sql.DB, store sessions.Store) *Handler {
+func NewHandler(cluster *model.DBCluster, store *session.Manager) *Handler {
 	// ISUCON用初期データの基準時間です
 	// この時間以降のデータはInitializeで削除されます
 	BaseTime = time.Date(2018, 10, 16, 10, 0, 0, 0, time.Local)
-	return &Handler{
-		db:    db,
-		store: store,
+	h := &Handler{
+		db:      cluster.Primary,
+		cluster: cluster,
+		store:   store,
+		hub:     newHub(cluster.Primary),
+		limiter: newRateLimiter(),
+		charts:  newChartCache(),
+		market:  newMarketCache(),
+		closing: make(chan struct{}),
 	}
+	model.AddEventPublisher(h.hub)
+	model.AddEventPublisher(h.market)
+	return h
+}
+
+// Shutdown は/streamと/wsの接続を終了させます
+// http.Server.Shutdownはこれらの接続が終わるのを待つので、RegisterOnShutdownで呼んでください
+func (h *Handler) Shutdown() {
+	h.shutdownOnce.Do(func() {
+		close(h.closing)
+	})
 }
 
+// Initialize はデータを初期状態に戻し、キャッシュを温めて準備が整ってから返します
+// warmup (秒またはGoのdurationの書式) で準備を待つ最大の時間を指定でき、0の場合は待ちません
 func (h *Handler) Initialize(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	err := h.txScope(func(tx *sql.Tx) error {
+	warmup, err := parseWarmup(r.FormValue("warmup"))
+	if err != nil {
+		h.handleError(w, err, 400)
+		return
+	}
+	err = h.txScope(r, func(tx *sql.Tx) error {
 		if err := model.InitBenchmark(tx); err != nil {
 			return err
 		}
-		for _, k := range []string{
-			model.BankEndpoint,
-			model.BankAppid,
-			model.LogEndpoint,
-			model.LogAppid,
-		} {
+		for _, k := range settingKeys {
 			if err := model.SetSetting(tx, k, r.FormValue(k)); err != nil {
 				return errors.Wrapf(err, "set setting failed. %s", k)
 			}
 		}
-		return nil
+		return model.SetTradingHalted(tx, false)
 	})
+	if err == nil {
+		model.ResetUserCache()
+		model.ResetBankBreaker()
+		model.ResetCreditCache()
+		h.market.reset()
+		err = model.ReloadSettings(h.db)
+	}
+	if err == nil {
+		err = model.ReloadOrderBook(h.db)
+	}
+	if err == nil {
+		err = model.LoadMarketStats(h.db)
+	}
+	if err == nil && warmup > 0 {
+		h.warmup(r.Context(), warmup)
+	}
 	if err != nil {
 		h.handleError(w, err, 500)
 	} else {
@@ -61,6 +138,38 @@ func (h *Handler) Initialize(w http.ResponseWriter, r *http.Request, _ httproute
 	}
 }
 
+func parseWarmup(v string) (time.Duration, error) {
+	if v == "" {
+		return model.DefaultWarmup, nil
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil && sec >= 0 {
+		return time.Duration(sec) * time.Second, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, errors.Errorf("invalid warmup: %s", v)
+	}
+	return d, nil
+}
+
+// warmup はキャッシュを温めて、/readyzの確認がすべて通るまでmaxWait待ちます
+// 準備が整わなくても/initialize自体は成功させます (銀行APIが後から使えるようになる場合があるため)
+func (h *Handler) warmup(ctx context.Context, maxWait time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+	start := time.Now()
+	if err := model.Warmup(h.cluster, BaseTime); err != nil {
+		log.Printf("[WARN] warmup failed. err:%s", err)
+	}
+	if down := model.WaitReady(ctx, h.cluster); len(down) > 0 {
+		for _, d := range down {
+			log.Printf("[WARN] not ready after warmup. dependency:%s, err:%s", d.Name, d.Error)
+		}
+		return
+	}
+	log.Printf("[INFO] ready after %s", time.Since(start))
+}
+
 func (h *Handler) Signup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	name := r.FormValue("name")
 	bankID := r.FormValue("bank_id")
@@ -69,7 +178,7 @@ func (h *Handler) Signup(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		h.handleError(w, errors.New("all parameters are required"), 400)
 		return
 	}
-	err := h.txScope(func(tx *sql.Tx) error {
+	err := h.txScope(r, func(tx *sql.Tx) error {
 		return model.UserSignup(tx, name, bankID, password)
 	})
 	switch {
@@ -78,6 +187,8 @@ func (h *Handler) Signup(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		h.handleError(w, err, 404)
 	case err == model.ErrBankUserConflict:
 		h.handleError(w, err, 409)
+	case model.IsBankUnavailable(err):
+		h.handleBankUnavailable(w, err)
 	case err != nil:
 		h.handleError(w, err, 500)
 	default:
@@ -92,21 +203,97 @@ func (h *Handler) Signin(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 		h.handleError(w, errors.New("all parameters are required"), 400)
 		return
 	}
-	user, err := model.UserLogin(h.db, bankID, password)
+	user, err := model.UserLogin(h.db, bankID, password, r.FormValue("otp"))
 	switch {
 	case err == model.ErrUserNotFound:
-		// TODO: 失敗が多いときに403を返すBanの仕様に対応
 		h.handleError(w, err, 404)
+	case err == model.ErrSigninLocked:
+		h.handleError(w, err, 403)
+	case err == model.ErrMFARequired || err == model.ErrMFAInvalid:
+		h.handleError(w, err, 401)
 	case err != nil:
 		h.handleError(w, err, 500)
+	case r.FormValue("token") == "1":
+		// cookieを使わないクライアントにはセッションの代わりにJWTを返す
+		token, expiresAt, err := model.IssueToken(user)
+		switch {
+		case err == model.ErrJWTDisabled:
+			h.handleError(w, err, 400)
+		case err != nil:
+			h.handleError(w, err, 500)
+		default:
+			h.handleSuccess(w, struct {
+				*model.User
+				Token     string    `json:"token"`
+				ExpiresAt time.Time `json:"expires_at"`
+			}{user, token, expiresAt})
+		}
 	default:
-		session, err := h.store.Get(r, SessionName)
-		if err != nil {
+		if err = h.saveSession(w, r, user); err != nil {
 			h.handleError(w, err, 500)
 			return
 		}
-		session.Values["user_id"] = user.ID
-		if err = session.Save(r, w); err != nil {
+		h.handleSuccess(w, user)
+	}
+}
+
+// ChangePassword はパスワードを変更します。他の端末のセッションはログインし直す必要があります
+func (h *Handler) ChangePassword(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	oldPassword := r.FormValue("old_password")
+	newPassword := r.FormValue("new_password")
+	if oldPassword == "" || newPassword == "" {
+		h.handleError(w, errors.New("all parameters are required"), 400)
+		return
+	}
+	err = h.userTxScope(r, user.ID, func(tx *sql.Tx) (err error) {
+		user, err = model.ChangePassword(tx, user.ID, oldPassword, newPassword)
+		return
+	})
+	h.credentialsChanged(w, r, user, err)
+}
+
+// ChangeBank は銀行のアカウントを付け替えます。他の端末のセッションはログインし直す必要があります
+func (h *Handler) ChangeBank(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	password := r.FormValue("password")
+	bankID := r.FormValue("bank_id")
+	if password == "" || bankID == "" {
+		h.handleError(w, errors.New("all parameters are required"), 400)
+		return
+	}
+	err = h.userTxScope(r, user.ID, func(tx *sql.Tx) (err error) {
+		user, err = model.ChangeBankID(tx, user.ID, password, bankID)
+		return
+	})
+	h.credentialsChanged(w, r, user, err)
+}
+
+// credentialsChanged はこのリクエストのセッションだけを新しいsession_versionで保存し直します
+func (h *Handler) credentialsChanged(w http.ResponseWriter, r *http.Request, user *model.User, err error) {
+	switch {
+	case err == model.ErrPasswordMismatch:
+		h.handleError(w, err, 403)
+	case err == model.ErrBankUserNotFound:
+		h.handleError(w, err, 404)
+	case err == model.ErrBankUserConflict:
+		h.handleError(w, err, 409)
+	case model.IsBankUnavailable(err):
+		h.handleBankUnavailable(w, err)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		model.ForgetUser(user.ID)
+		model.ForgetUserSessions(user.ID)
+		if err = h.saveSession(w, r, user); err != nil {
 			h.handleError(w, err, 500)
 			return
 		}
@@ -115,18 +302,126 @@ func (h *Handler) Signin(w http.ResponseWriter, r *http.Request, _ httprouter.Pa
 }
 
 func (h *Handler) Signout(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	session, err := h.store.Get(r, SessionName)
+	if err := h.clearSession(w, r); err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	h.handleSuccess(w, struct{}{})
+}
+
+// CloseAccount はログインユーザーの未約定の注文をすべて取り消して退会させます
+func (h *Handler) CloseAccount(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
 	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	var ids []int64
+	err = h.userTxScope(r, user.ID, func(tx *sql.Tx) (err error) {
+		ids, err = model.CloseUser(tx, user.ID)
+		return
+	})
+	switch {
+	case err == model.ErrUserNotFound:
+		h.handleError(w, err, 404)
+		return
+	case err != nil:
 		h.handleError(w, err, 500)
 		return
 	}
-	session.Values["user_id"] = 0
-	session.Options = &sessions.Options{MaxAge: -1}
-	if err = session.Save(r, w); err != nil {
+	model.ForgetUser(user.ID)
+	model.BookRemoveOrders(ids...)
+	for _, id := range ids {
+		if order, err := model.GetOrderByID(h.db, id); err == nil {
+			model.PublishOrderEvent(&model.OrderEvent{Event: model.OrderEventCanceled, Reason: model.CancelReasonUserClosed, Order: order})
+		}
+	}
+	// 他の端末のセッションはuserByRequestで退会済みとして扱う
+	if err = h.clearSession(w, r); err != nil {
 		h.handleError(w, err, 500)
 		return
 	}
-	h.handleSuccess(w, struct{}{})
+	h.handleSuccess(w, map[string]interface{}{
+		"canceled_order_ids": ids,
+	})
+}
+
+func (h *Handler) saveSession(w http.ResponseWriter, r *http.Request, user *model.User) error {
+	session, err := h.store.Get(r, SessionName)
+	if err != nil {
+		return err
+	}
+	// ログイン前のセッションIDを引き継がない
+	if err = h.store.Rotate(session); err != nil {
+		return err
+	}
+	if old, ok := session.Values["session_token"].(string); ok {
+		if err = model.RevokeSessionToken(h.db, old); err != nil {
+			return err
+		}
+	}
+	// GET /me/sessions で一覧し、DELETE /me/sessions/:id で無効にできるように端末ごとに記録する
+	token, err := model.NewSessionToken()
+	if err != nil {
+		return err
+	}
+	if err = model.CreateUserSession(h.db, user.ID, token, r.UserAgent(), remoteIP(r)); err != nil {
+		return err
+	}
+	session.Values["user_id"] = user.ID
+	session.Values["session_version"] = user.SessionVersion
+	session.Values["session_token"] = token
+	// ログインやパスワードの変更ごとにCSRFトークンも作り直す
+	if _, err = setCSRFToken(w, session); err != nil {
+		return err
+	}
+	return session.Save(r, w)
+}
+
+func (h *Handler) clearSession(w http.ResponseWriter, r *http.Request) error {
+	session, err := h.store.Get(r, SessionName)
+	if err != nil {
+		return err
+	}
+	if token, ok := session.Values["session_token"].(string); ok {
+		if err = model.RevokeSessionToken(h.db, token); err != nil {
+			return err
+		}
+	}
+	session.Values["user_id"] = 0
+	delete(session.Values, "csrf_token")
+	delete(session.Values, "session_token")
+	h.store.Expire(session)
+	setCSRFCookie(w, "")
+	return session.Save(r, w)
+}
+
+// InfoResponse はGET /infoのレスポンスです
+// ベンチマーカーは bench/src/bench/client.go の InfoResponse で受け取るので、項目を変える場合は合わせてください
+type InfoResponse struct {
+	Cursor       int64          `json:"cursor"`
+	TradedOrders []*model.Order `json:"traded_orders,omitempty"` // ログインユーザーのみ
+	// ShareURLs はtrade_idをキーにしたシェアのページのURLです (EnableShareの場合のみ)
+	ShareURLs map[string]string `json:"share_urls,omitempty"`
+	// チャートは []*model.CandlestickData をJSONにしたものです (chartCacheで使い回す)
+	ChartBySec         json.RawMessage  `json:"chart_by_sec"`
+	ChartByMin         json.RawMessage  `json:"chart_by_min"`
+	ChartByHour        json.RawMessage  `json:"chart_by_hour"`
+	LowestSellPrice    *int64           `json:"lowest_sell_price,omitempty"`
+	HighestBuyPrice    *int64           `json:"highest_buy_price,omitempty"`
+	EnableShare        bool             `json:"enable_share"`
+	TradingHaltedUntil *time.Time       `json:"trading_halted_until,omitempty"`
+	PriceBand          *model.PriceBand `json:"price_band,omitempty"`
+	// NextAuctionAt は板寄せの間だけ返す次の板寄せの時刻です
+	NextAuctionAt *time.Time `json:"next_auction_at,omitempty"`
+}
+
+// optionalPrice はETagに入れる価格で、無い場合はnilです
+func optionalPrice(p *int64) interface{} {
+	if p == nil {
+		return nil
+	}
+	return *p
 }
 
 func (h *Handler) Info(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
@@ -134,47 +429,85 @@ func (h *Handler) Info(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 		err         error
 		lastTradeID int64
 		lt          = time.Unix(0, 0)
-		res         = make(map[string]interface{}, 10)
+		res         = &InfoResponse{}
 	)
+	userID, signedIn := h.sessionUserID(r)
+	if !signedIn && h.overloaded() {
+		// 未ログインユーザーの/infoは優先度が低いので過負荷時は落とす
+		h.handleOverloaded(w)
+		return
+	}
 	if _cursor := r.URL.Query().Get("cursor"); _cursor != "" {
 		if lastTradeID, _ = strconv.ParseInt(_cursor, 10, 64); lastTradeID > 0 {
-			trade, err := model.GetTradeByID(h.db, lastTradeID)
-			if err != nil && err != sql.ErrNoRows {
+			t, ok, err := h.market.tradeTime(h.dbFor(r), lastTradeID)
+			if err != nil {
 				h.handleError(w, errors.Wrap(err, "getTradeByID failed"), 500)
 				return
 			}
-			if trade != nil {
-				lt = trade.CreatedAt
+			if ok {
+				lt = t
 			}
 		}
 	}
-	latestTrade, err := model.GetLatestTrade(h.db)
+	var mi *marketInfo
+	if signedIn {
+		mi, err = h.loadMarketInfo(h.dbFor(r))
+	} else {
+		// 未ログインユーザーはキャッシュした価格情報とチャートだけで返す
+		mi, err = h.market.get(func() (*marketInfo, error) {
+			return h.loadMarketInfo(h.dbFor(r))
+		})
+	}
 	if err != nil {
-		h.handleError(w, errors.Wrap(err, "GetLatestTrade failed"), 500)
+		h.handleError(w, err, 500)
 		return
 	}
-	res["cursor"] = latestTrade.ID
-	user, _ := h.userByRequest(r)
-	if user != nil {
-		orders, err := model.GetOrdersByUserIDAndLastTradeId(h.db, user.ID, lastTradeID)
-		if err != nil {
-			h.handleError(w, err, 500)
-			return
-		}
-		for _, order := range orders {
-			if err = model.FetchOrderRelation(h.db, order); err != nil {
+	latestTrade := mi.LatestTrade
+	res.Cursor = latestTrade.ID
+	res.LowestSellPrice = mi.LowestSellPrice
+	res.HighestBuyPrice = mi.HighestBuyPrice
+	res.TradingHaltedUntil = mi.TradingHaltedUntil
+	res.PriceBand = mi.PriceBand
+	res.EnableShare = mi.EnableShare
+	res.NextAuctionAt = mi.NextAuctionAt
+	var nextAuction int64
+	if res.NextAuctionAt != nil {
+		nextAuction = res.NextAuctionAt.Unix()
+	}
+
+	// 同じcursorで新しいトレードも最良価格の変化もなければ同じ内容になるので304を返す
+	etag := fmt.Sprintf(`W/"%d-%d-%d-%v-%v-%v-%v-%d"`, userID, lastTradeID, latestTrade.ID, optionalPrice(res.LowestSellPrice), optionalPrice(res.HighestBuyPrice), res.TradingHaltedUntil != nil, res.EnableShare, nextAuction)
+	w.Header().Set("ETag", etag)
+	if matchETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if signedIn {
+		user, _ := h.userByRequest(w, r)
+		if user != nil {
+			orders, err := model.GetTradedOrders(h.dbFor(r), user, lastTradeID)
+			if err != nil {
 				h.handleError(w, err, 500)
 				return
 			}
+			res.TradedOrders = orders
+			if res.EnableShare {
+				// 成立したトレードをシェアするページのURL (キーはtrade_id)
+				urls := map[string]string{}
+				for _, order := range orders {
+					urls[strconv.FormatInt(order.TradeID, 10)] = baseURL(r) + model.SharePath(order.TradeID)
+				}
+				res.ShareURLs = urls
+			}
 		}
-		res["traded_orders"] = orders
 	}
 
 	bySecTime := BaseTime.Add(-300 * time.Second)
 	if lt.After(bySecTime) {
 		bySecTime = time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), lt.Minute(), lt.Second(), 0, lt.Location())
 	}
-	res["chart_by_sec"], err = model.GetCandlestickData(h.db, bySecTime, "%Y-%m-%d %H:%i:%s")
+	res.ChartBySec, err = h.charts.get(h.replicaFor(r), bySecTime, model.CandlestickBySec, latestTrade.ID)
 	if err != nil {
 		h.handleError(w, errors.Wrap(err, "model.GetCandlestickData by sec"), 500)
 		return
@@ -184,7 +517,7 @@ func (h *Handler) Info(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 	if lt.After(byMinTime) {
 		byMinTime = time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), lt.Minute(), 0, 0, lt.Location())
 	}
-	res["chart_by_min"], err = model.GetCandlestickData(h.db, byMinTime, "%Y-%m-%d %H:%i:00")
+	res.ChartByMin, err = h.charts.get(h.replicaFor(r), byMinTime, model.CandlestickByMin, latestTrade.ID)
 	if err != nil {
 		h.handleError(w, errors.Wrap(err, "model.GetCandlestickData by min"), 500)
 		return
@@ -194,86 +527,374 @@ func (h *Handler) Info(w http.ResponseWriter, r *http.Request, _ httprouter.Para
 	if lt.After(byHourTime) {
 		byHourTime = time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), 0, 0, 0, lt.Location())
 	}
-	res["chart_by_hour"], err = model.GetCandlestickData(h.db, byHourTime, "%Y-%m-%d %H:00:00")
+	res.ChartByHour, err = h.charts.get(h.replicaFor(r), byHourTime, model.CandlestickByHour, latestTrade.ID)
 	if err != nil {
 		h.handleError(w, errors.Wrap(err, "model.GetCandlestickData by hour"), 500)
 		return
 	}
 
-	lowestSellOrder, err := model.GetLowestSellOrder(h.db)
-	switch {
-	case err == sql.ErrNoRows:
-	case err != nil:
-		h.handleError(w, errors.Wrap(err, "model.GetLowestSellOrder"), 500)
+	h.handleSuccess(w, res)
+}
+
+func matchETag(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		if v = strings.TrimSpace(v); v == etag || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Ticker は/infoのチャートや注文を含まない最新の価格情報を返します
+func (h *Handler) Ticker(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ticker, err := model.GetTicker(h.db)
+	if err != nil {
+		h.handleError(w, errors.Wrap(err, "model.GetTicker"), 500)
 		return
-	default:
-		res["lowest_sell_price"] = lowestSellOrder.Price
 	}
+	h.handleSuccess(w, ticker)
+}
 
-	highestBuyOrder, err := model.GetHighestBuyOrder(h.db)
-	switch {
-	case err == sql.ErrNoRows:
-	case err != nil:
-		h.handleError(w, errors.Wrap(err, "model.GetHighestBuyOrder"), 500)
+// Chart は指定した長さの足をfrom以上to未満の範囲で返します
+func (h *Handler) Chart(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	resolution := q.Get("resolution")
+	if resolution == "" {
+		resolution = "1m"
+	}
+	step := model.CandlestickStep(resolution)
+	if step == 0 {
+		h.handleError(w, errors.New("resolution must be one of 1s, 1m, 5m, 1h"), 400)
+		return
+	}
+	var from, to time.Time
+	for _, p := range []struct {
+		key string
+		t   *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		s := q.Get(p.key)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v < 0 {
+			h.handleError(w, errors.Errorf("%s must be unix time", p.key), 400)
+			return
+		}
+		*p.t = time.Unix(v, 0)
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-DefaultChartCandles * step)
+	}
+	if !from.Before(to) {
+		h.handleError(w, errors.New("from must be before to"), 400)
+		return
+	}
+	if to.Sub(from) > MaxChartCandles*step {
+		h.handleError(w, errors.Errorf("too many candles (max %d)", MaxChartCandles), 400)
+		return
+	}
+	chart, err := model.GetCandlesticksRange(h.dbFor(r), resolution, from, to)
+	if err != nil {
+		h.handleError(w, errors.Wrap(err, "model.GetCandlesticksRange"), 500)
 		return
-	default:
-		res["highest_buy_price"] = highestBuyOrder.Price
 	}
-	// TODO: trueにするとシェアボタンが有効になるが、アクセスが増えてヤバイので一旦falseにしておく
-	res["enable_share"] = false
+	h.handleSuccess(w, chart)
+}
 
-	h.handleSuccess(w, res)
+func (h *Handler) OrderBook(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	depth := DefaultOrderBookDepth
+	if _depth := r.URL.Query().Get("depth"); _depth != "" {
+		v, err := strconv.Atoi(_depth)
+		if err != nil || v <= 0 {
+			h.handleError(w, errors.New("depth must be positive integer"), 400)
+			return
+		}
+		depth = v
+	}
+	if depth > MaxOrderBookDepth {
+		depth = MaxOrderBookDepth
+	}
+	book, err := model.GetOrderBook(h.dbFor(r), depth)
+	if err != nil {
+		h.handleError(w, errors.Wrap(err, "model.GetOrderBook"), 500)
+		return
+	}
+	h.handleSuccess(w, book)
+}
+
+func (h *Handler) Trades(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var (
+		cursor int64
+		limit  = DefaultTradesLimit
+		err    error
+	)
+	if _cursor := r.URL.Query().Get("cursor"); _cursor != "" {
+		if cursor, err = strconv.ParseInt(_cursor, 10, 64); err != nil || cursor < 0 {
+			h.handleError(w, errors.New("cursor must be non-negative integer"), 400)
+			return
+		}
+	}
+	if _limit := r.URL.Query().Get("limit"); _limit != "" {
+		if limit, err = strconv.Atoi(_limit); err != nil || limit <= 0 {
+			h.handleError(w, errors.New("limit must be positive integer"), 400)
+			return
+		}
+	}
+	if limit > MaxTradesLimit {
+		limit = MaxTradesLimit
+	}
+	trades, err := model.GetTradesPage(h.dbFor(r), cursor, limit)
+	if err != nil {
+		h.handleError(w, errors.Wrap(err, "model.GetTradesPage"), 500)
+		return
+	}
+	h.handleSuccess(w, trades)
 }
 
 func (h *Handler) AddOrders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	user, err := h.userByRequest(r)
+	h.addOrders(w, r, false)
+}
+
+// AddOrdersV2 は指値注文を部分約定を許可する注文として受け付けます
+func (h *Handler) AddOrdersV2(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.addOrders(w, r, true)
+}
+
+func (h *Handler) addOrders(w http.ResponseWriter, r *http.Request, partial bool) {
+	user, err := h.userByRequest(w, r)
 	if err != nil {
 		h.handleError(w, err, 401)
 		return
 	}
+	if h.tradingHalted(w) {
+		return
+	}
 	amount, _ := strconv.ParseInt(r.FormValue("amount"), 10, 64)
 	price, _ := strconv.ParseInt(r.FormValue("price"), 10, 64)
+	var expiresAt time.Time
+	if s := r.FormValue("expires_at"); s != "" {
+		if expiresAt, err = time.Parse(time.RFC3339, s); err != nil {
+			h.handleError(w, model.ErrParameterInvalid, 400)
+			return
+		}
+	}
+	// expire は有効期限が指定されていれば同じトランザクションで設定します
+	expire := func(tx *sql.Tx, order *model.Order) (*model.Order, error) {
+		if expiresAt.IsZero() {
+			return order, nil
+		}
+		return model.SetOrderExpiresAt(tx, order, expiresAt)
+	}
 	var order *model.Order
-	err = h.txScope(func(tx *sql.Tx) (err error) {
-		order, err = model.AddOrder(tx, r.FormValue("type"), user.ID, amount, price)
+	switch ot := r.FormValue("type"); {
+	case ot == model.OrderTypeStopBuy || ot == model.OrderTypeStopSell:
+		// 逆指値注文はトリガーされるまで板に載せない
+		triggerPrice, _ := strconv.ParseInt(r.FormValue("trigger_price"), 10, 64)
+		err = h.userTxScope(r, user.ID, func(tx *sql.Tx) (err error) {
+			if order, err = model.AddStopOrder(tx, ot, user.ID, amount, price, triggerPrice); err != nil {
+				return
+			}
+			order, err = expire(tx, order)
+			return
+		})
+		if err == nil {
+			model.PublishOrderEvent(&model.OrderEvent{Event: model.OrderEventOrdered, Order: order})
+			model.SignalStopWatcher()
+			h.handleSuccess(w, map[string]interface{}{
+				"id": order.ID,
+			})
+			return
+		}
+	case r.FormValue("time_in_force") == model.TimeInForceIOC || r.FormValue("time_in_force") == model.TimeInForceFOK:
+		// 即時にマッチングして残りは取り消すので板には残らない
+		if k := r.FormValue("order_type"); k != "" && k != model.OrderKindLimit {
+			err = model.ErrParameterInvalid
+			break
+		}
+		err = model.WithUserLock(user.ID, func() (err error) {
+			order, err = model.AddImmediateOrder(h.db, r.FormValue("time_in_force"), ot, user.ID, amount, price)
+			return
+		})
+		if err == nil {
+			h.handleSuccess(w, map[string]interface{}{
+				"id": order.ID,
+			})
+			return
+		}
+	case r.FormValue("time_in_force") != "" && r.FormValue("time_in_force") != model.TimeInForceGTC:
+		err = model.ErrParameterInvalid
+	case r.FormValue("order_type") == "" || r.FormValue("order_type") == model.OrderKindLimit:
+		displayAmount, _ := strconv.ParseInt(r.FormValue("display_amount"), 10, 64)
+		err = h.userTxScope(r, user.ID, func(tx *sql.Tx) (err error) {
+			switch {
+			case r.FormValue("display_amount") != "":
+				order, err = model.AddIcebergOrder(tx, ot, user.ID, amount, price, displayAmount)
+			case partial:
+				order, err = model.AddPartialOrder(tx, ot, user.ID, amount, price)
+			default:
+				order, err = model.AddOrder(tx, ot, user.ID, amount, price)
+			}
+			if err != nil {
+				return
+			}
+			order, err = expire(tx, order)
+			return
+		})
+	case r.FormValue("order_type") == model.OrderKindMarket:
+		// 成行注文は即時に約定するので板には残らない
+		err = model.WithUserLock(user.ID, func() (err error) {
+			order, err = model.CrossMarketOrder(h.db, ot, user.ID, amount)
+			return
+		})
+		if err == nil {
+			h.handleSuccess(w, map[string]interface{}{
+				"id": order.ID,
+			})
+			return
+		}
+	default:
+		err = model.ErrParameterInvalid
+	}
+	switch {
+	case err == model.ErrParameterInvalid || err == model.ErrCreditInsufficient || err == model.ErrIsuInsufficient || err == model.ErrMarketOrderUnfilled || err == model.ErrOrderUnfilled || err == model.ErrPriceOutOfBand || err == model.ErrAuctionMode:
+		h.handleError(w, err, 400)
+	case model.IsBankUnavailable(err):
+		h.handleBankUnavailable(w, err)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		if err = h.ordersPlaced(order); err != nil {
+			h.handleError(w, err, 500)
+			return
+		}
+		h.handleSuccess(w, map[string]interface{}{
+			"id": order.ID,
+		})
+	}
+}
+
+func (h *Handler) AddOrderBatch(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	if h.tradingHalted(w) {
+		return
+	}
+	var reqs []*model.OrderRequest
+	if err = json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		h.handleError(w, errors.Wrap(err, "invalid json"), 400)
+		return
+	}
+	if len(reqs) > MaxBatchOrders {
+		h.handleError(w, errors.Errorf("too many orders (max %d)", MaxBatchOrders), 400)
+		return
+	}
+	var orders []*model.Order
+	err = h.userTxScope(r, user.ID, func(tx *sql.Tx) (err error) {
+		orders, err = model.AddOrderBatch(tx, user.ID, reqs)
 		return
 	})
 	switch {
-	case err == model.ErrParameterInvalid || err == model.ErrCreditInsufficient:
+	case err == model.ErrParameterInvalid || err == model.ErrCreditInsufficient || err == model.ErrIsuInsufficient || err == model.ErrPriceOutOfBand:
 		h.handleError(w, err, 400)
+	case model.IsBankUnavailable(err):
+		h.handleBankUnavailable(w, err)
 	case err != nil:
 		h.handleError(w, err, 500)
 	default:
-		tradeChance, err := model.HasTradeChanceByOrder(h.db, order.ID)
-		if err != nil {
+		if err = h.ordersPlaced(orders...); err != nil {
 			h.handleError(w, err, 500)
 			return
 		}
+		ids := make([]int64, 0, len(orders))
+		for _, order := range orders {
+			ids = append(ids, order.ID)
+		}
+		h.handleSuccess(w, map[string]interface{}{
+			"ids": ids,
+		})
+	}
+}
+
+// ordersPlaced はコミットした注文を板と購読者に反映し、マッチングを行います
+func (h *Handler) ordersPlaced(orders ...*model.Order) error {
+	for _, order := range orders {
+		model.BookAddOrder(order)
+		model.PublishOrderEvent(&model.OrderEvent{Event: model.OrderEventOrdered, Order: order})
+	}
+	return h.matchOrders(orders...)
+}
+
+// matchOrders は注文が成立する可能性がある場合にマッチングを行います
+func (h *Handler) matchOrders(orders ...*model.Order) error {
+	if model.SignalMatcher() {
+		return nil
+	}
+	for _, order := range orders {
+		tradeChance, err := model.HasTradeChanceByOrder(h.db, order.ID)
+		if err != nil {
+			return err
+		}
 		if tradeChance {
 			if err := model.RunTrade(h.db); err != nil {
 				// トレードに失敗してもエラーにはしない
 				log.Printf("runTrade err:%s", err)
 			}
+			// RunTradeは成立しなくなるまで続けるので1回でよい
+			break
 		}
-		h.handleSuccess(w, map[string]interface{}{
-			"id": order.ID,
-		})
 	}
+	return nil
 }
 
 func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	user, err := h.userByRequest(r)
+	h.getOrders(w, r, false)
+}
+
+// GetOrdersV2 は注文ごとの約定 (fills) も返します
+func (h *Handler) GetOrdersV2(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.getOrders(w, r, true)
+}
+
+func (h *Handler) getOrders(w http.ResponseWriter, r *http.Request, withFills bool) {
+	user, err := h.userByRequest(w, r)
 	if err != nil {
 		h.handleError(w, err, 401)
 		return
 	}
-	orders, err := model.GetOrdersByUserID(h.db, user.ID)
-	if err != nil {
+	var orders []*model.Order
+	if q, paged, perr := ordersQuery(r); perr != nil {
+		h.handleError(w, perr, 400)
+		return
+	} else if paged {
+		orders, err = model.GetOrdersByUserIDPaged(h.dbFor(r), user.ID, q)
+	} else {
+		orders, err = model.GetOrdersByUserID(h.replicaFor(r), user.ID)
+	}
+	switch {
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+		return
+	case err != nil:
 		h.handleError(w, err, 500)
 		return
 	}
-	for _, order := range orders {
-		if err = model.FetchOrderRelation(h.db, order); err != nil {
+	if err = model.FetchOrderRelations(h.dbFor(r), orders); err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	if err = model.FetchOrdersMeta(h.dbFor(r), orders); err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	if withFills {
+		if err = model.FetchOrdersFills(h.dbFor(r), orders); err != nil {
 			h.handleError(w, err, 500)
 			return
 		}
@@ -281,15 +902,77 @@ func (h *Handler) GetOrders(w http.ResponseWriter, r *http.Request, _ httprouter
 	h.handleSuccess(w, orders)
 }
 
+// ordersQuery はGET /ordersのページングと絞り込みの条件を返します
+// 条件が1つも指定されていない場合は従来どおり全件を返すためにpagedがfalseになります
+func ordersQuery(r *http.Request) (q model.OrdersQuery, paged bool, err error) {
+	v := r.URL.Query()
+	q.Status = v.Get("status")
+	q.Type = v.Get("type")
+	q.Tag = v.Get("tag")
+	q.Limit = DefaultOrdersLimit
+	if s := v.Get("cursor"); s != "" {
+		if q.Cursor, err = strconv.ParseInt(s, 10, 64); err != nil || q.Cursor < 0 {
+			return q, false, errors.New("cursor must be non-negative integer")
+		}
+		paged = true
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, false, errors.New("limit must be positive integer")
+		}
+		if q.Limit > MaxOrdersLimit {
+			q.Limit = MaxOrdersLimit
+		}
+		paged = true
+	}
+	if s := v.Get("watched"); s != "" {
+		if q.Watched, err = strconv.ParseBool(s); err != nil {
+			return q, false, errors.New("watched must be boolean")
+		}
+	}
+	if q.Status != "" || q.Type != "" || q.Tag != "" || q.Watched {
+		paged = true
+	}
+	return q, paged, nil
+}
+
+func (h *Handler) Position(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	position, err := model.GetPosition(h.dbFor(r), user.ID)
+	if err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	h.handleSuccess(w, position)
+}
+
+func (h *Handler) Fees(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	summary, err := model.GetFeeSummary(h.dbFor(r), user.ID)
+	if err != nil {
+		h.handleError(w, err, 500)
+		return
+	}
+	h.handleSuccess(w, summary)
+}
+
 func (h *Handler) DeleteOrders(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	user, err := h.userByRequest(r)
+	user, err := h.userByRequest(w, r)
 	if err != nil {
 		h.handleError(w, err, 401)
 		return
 	}
 	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
-	err = h.txScope(func(tx *sql.Tx) error {
-		return model.DeleteOrder(tx, user.ID, id, "canceled")
+	err = h.userTxScope(r, user.ID, func(tx *sql.Tx) error {
+		return model.DeleteOrder(tx, user.ID, id, model.CancelReasonCanceled)
 	})
 	switch {
 	case err == model.ErrOrderNotFound || err == model.ErrOrderAlreadyClosed:
@@ -297,96 +980,323 @@ func (h *Handler) DeleteOrders(w http.ResponseWriter, r *http.Request, p httprou
 	case err != nil:
 		h.handleError(w, err, 500)
 	default:
+		model.BookRemoveOrders(id)
+		if order, err := model.GetOrderByID(h.db, id); err == nil {
+			model.PublishOrderEvent(&model.OrderEvent{Event: model.OrderEventCanceled, Reason: model.CancelReasonCanceled, Order: order})
+		}
 		h.handleSuccess(w, map[string]interface{}{
 			"id": id,
 		})
 	}
 }
 
+func (h *Handler) ModifyOrder(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
+	amount, _ := strconv.ParseInt(r.FormValue("amount"), 10, 64)
+	price, _ := strconv.ParseInt(r.FormValue("price"), 10, 64)
+	var order *model.Order
+	err = h.userTxScope(r, user.ID, func(tx *sql.Tx) (err error) {
+		order, err = model.ModifyOrder(tx, user.ID, id, amount, price)
+		return
+	})
+	switch {
+	case err == model.ErrOrderNotFound || err == model.ErrOrderAlreadyClosed:
+		h.handleError(w, err, 404)
+	case err == model.ErrParameterInvalid || err == model.ErrCreditInsufficient || err == model.ErrIsuInsufficient || err == model.ErrPriceOutOfBand:
+		h.handleError(w, err, 400)
+	case model.IsBankUnavailable(err):
+		h.handleBankUnavailable(w, err)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		model.BookRemoveOrders(order.ID)
+		model.BookAddOrder(order)
+		model.PublishOrderEvent(&model.OrderEvent{Event: model.OrderEventModified, Order: order})
+		if err = h.matchOrders(order); err != nil {
+			h.handleError(w, err, 500)
+			return
+		}
+		h.handleSuccess(w, order)
+	}
+}
+
+// ModifyOrderMeta は注文のタグ, メモ, ウォッチの印を変更します。指定しなかった項目は変更しません
+func (h *Handler) ModifyOrderMeta(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
+	var patch model.OrderMetaPatch
+	if v, ok := r.PostForm["tag"]; ok {
+		patch.Tag = &v[0]
+	}
+	if v, ok := r.PostForm["note"]; ok {
+		patch.Note = &v[0]
+	}
+	if v, ok := r.PostForm["watched"]; ok {
+		watched, err := strconv.ParseBool(v[0])
+		if err != nil {
+			h.handleError(w, errors.New("watched must be boolean"), 400)
+			return
+		}
+		patch.Watched = &watched
+	}
+	var order *model.Order
+	err = h.txScope(r, func(tx *sql.Tx) error {
+		meta, err := model.SetOrderMeta(tx, user.ID, id, patch)
+		if err != nil {
+			return err
+		}
+		if order, err = model.GetOrderByID(tx, id); err != nil {
+			return errors.Wrapf(err, "model.GetOrderByID failed. id:%d", id)
+		}
+		order.Meta = meta
+		return nil
+	})
+	switch {
+	case err == model.ErrOrderNotFound:
+		h.handleError(w, err, 404)
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		h.handleSuccess(w, order)
+	}
+}
+
+// OrderEvents は注文の受け付けから約定, 取り消しまでの状態変化を古い順に返します
+func (h *Handler) OrderEvents(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
+	events, err := model.GetOrderAudits(h.dbFor(r), user.ID, id)
+	switch {
+	case err == model.ErrOrderNotFound:
+		h.handleError(w, err, 404)
+	case err != nil:
+		h.handleError(w, errors.Wrap(err, "model.GetOrderAudits"), 500)
+	default:
+		h.handleSuccess(w, events)
+	}
+}
+
 func (h *Handler) CommonMiddleware(f http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodPost {
+		setRequestID(w, r)
+		if h.underMaintenance(w, r) {
+			return
+		}
+		if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch {
 			if err := r.ParseForm(); err != nil {
 				h.handleError(w, err, 400)
 				return
 			}
 		}
-		session, err := h.store.Get(r, SessionName)
-		if err != nil {
-			h.handleError(w, err, 500)
+		if !h.checkAPIKey(w, r) {
 			return
 		}
-		if _userID, ok := session.Values["user_id"]; ok {
-			userID := _userID.(int64)
-			user, err := model.GetUserByID(h.db, userID)
-			switch {
-			case err == sql.ErrNoRows:
-				session.Values["user_id"] = 0
-				session.Options = &sessions.Options{MaxAge: -1}
-				if err = session.Save(r, w); err != nil {
-					h.handleError(w, err, 500)
-					return
-				}
-				h.handleError(w, errors.New("セッションが切断されました"), 404)
-				return
-			case err != nil:
-				h.handleError(w, err, 500)
-				return
-			}
-			ctx := context.WithValue(r.Context(), "user_id", user.ID)
-			f.ServeHTTP(w, r.WithContext(ctx))
-		} else {
-			f.ServeHTTP(w, r)
+		if !h.checkCSRF(r) {
+			h.handleError(w, ErrCSRFTokenInvalid, 403)
+			return
+		}
+		if h.rateLimited(w, r, r.Method+" "+r.URL.Path) {
+			return
 		}
+		// 認証はuserByRequestを呼ぶハンドラでのみ行う
+		f.ServeHTTP(w, r)
 	})
 }
 
-func (h *Handler) userByRequest(r *http.Request) (*model.User, error) {
-	v := r.Context().Value("user_id")
-	if id, ok := v.(int64); ok {
-		return model.GetUserByID(h.db, id)
+// bearerToken はAuthorization: Bearer で渡されたJWTを返します
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+	return strings.TrimPrefix(auth, "Bearer "), true
+}
+
+// bearerClaims はJWTを検証した結果を返します。検証はリクエストごとに1回だけ行います
+// JWTが渡された場合はcookieのセッションを見ません
+func (h *Handler) bearerClaims(r *http.Request) (*model.TokenClaims, bool) {
+	if v, ok := gctx.GetOk(r, bearerClaimsKey); ok {
+		claims, _ := v.(*model.TokenClaims)
+		return claims, true
+	}
+	token, ok := bearerToken(r)
+	if !ok {
+		return nil, false
+	}
+	claims, err := model.VerifyToken(token)
+	if err != nil && err != model.ErrJWTInvalid && err != model.ErrJWTDisabled {
+		log.Printf("[WARN] verify token failed. err:%s", err)
+	}
+	gctx.Set(r, bearerClaimsKey, claims)
+	return claims, true
+}
+
+// sessionUserID はセッション (またはAPIキー, JWT) のuser_idを返します
+// DBは参照しないのでユーザーが存在するかどうかはuserByRequestで確認してください
+func (h *Handler) sessionUserID(r *http.Request) (int64, bool) {
+	if key, ok := h.apiKey(r); ok {
+		if key == nil {
+			return 0, false
+		}
+		return key.UserID, true
+	}
+	if claims, ok := h.bearerClaims(r); ok {
+		if claims == nil {
+			return 0, false
+		}
+		return claims.UserID(), true
+	}
+	session, err := h.store.Get(r, SessionName)
+	if err != nil {
+		return 0, false
+	}
+	userID, ok := session.Values["user_id"].(int64)
+	return userID, ok && userID > 0
+}
+
+// sessionVersion はログインしたときのユーザーのsession_versionです
+// パスワードやbank_idを変更すると一致しなくなります
+func (h *Handler) sessionVersion(r *http.Request) int64 {
+	if claims, ok := h.bearerClaims(r); ok {
+		if claims == nil {
+			return 0
+		}
+		return claims.SessionVersion
+	}
+	session, err := h.store.Get(r, SessionName)
+	if err != nil {
+		return 0
+	}
+	v, _ := session.Values["session_version"].(int64)
+	return v
+}
+
+// sessionToken はcookieのセッションのトークンを返します。APIキーとJWTのリクエストは空です
+// トークンを記録する前に発行したセッションも空です
+func (h *Handler) sessionToken(r *http.Request) string {
+	if _, ok := h.apiKey(r); ok {
+		return ""
 	}
-	return nil, errors.New("Not authenticated")
+	if _, ok := h.bearerClaims(r); ok {
+		return ""
+	}
+	session, err := h.store.Get(r, SessionName)
+	if err != nil {
+		return ""
+	}
+	token, _ := session.Values["session_token"].(string)
+	return token
+}
+
+// ErrSessionUserDeleted はcookieのセッションのユーザーが削除されていた場合のエラーです。handleErrorは404で返します
+var ErrSessionUserDeleted = errors.New("セッションが切断されました")
+
+func (h *Handler) userByRequest(w http.ResponseWriter, r *http.Request) (*model.User, error) {
+	userID, ok := h.sessionUserID(r)
+	if !ok {
+		return nil, errors.New("Not authenticated")
+	}
+	// APIキーはパスワードなどを変更しても無効にならない
+	_, byAPIKey := h.apiKey(r)
+	_, byBearer := h.bearerClaims(r)
+	user, err := model.GetUserByID(h.dbFor(r), userID)
+	switch {
+	case err == sql.ErrNoRows && !byAPIKey && !byBearer:
+		// /initialize などでユーザーが削除されたcookieのセッションは破棄する
+		if err = h.clearSession(w, r); err != nil {
+			return nil, errors.Wrap(err, "clearSession failed")
+		}
+		return nil, ErrSessionUserDeleted
+	case err == sql.ErrNoRows || err == nil && (user.ClosedAt != nil || !byAPIKey && user.SessionVersion != h.sessionVersion(r)):
+		return nil, errors.New("セッションが切断されました")
+	case err != nil:
+		return nil, errors.Wrap(err, "GetUserByID failed")
+	}
+	// DELETE /me/sessions/:id で無効にされたセッション。書き込んだ直後に読むのでプライマリで確認する
+	if token := h.sessionToken(r); token != "" {
+		valid, err := model.CheckUserSession(h.dbFor(r), user.ID, token)
+		switch {
+		case err != nil:
+			return nil, errors.Wrap(err, "CheckUserSession failed")
+		case !valid:
+			return nil, errors.New("セッションが切断されました")
+		}
+	}
+	gctx.Set(r, accessUserKey, user.ID)
+	return user, nil
 }
 
 func (h *Handler) handleSuccess(w http.ResponseWriter, data interface{}) {
-	w.WriteHeader(200)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	if err := json.NewEncoder(w).Encode(data); err != nil {
+	if err := writeJSON(w, 200, data); err != nil {
 		log.Printf("[WARN] write response json failed. %s", err)
 	}
 }
 
 func (h *Handler) handleError(w http.ResponseWriter, err error, code int) {
-	w.WriteHeader(code)
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	log.Printf("[WARN] err: %s", err.Error())
-	data := map[string]interface{}{
-		"code": code,
-		"err":  err.Error(),
+	if err == ErrSessionUserDeleted {
+		code = http.StatusNotFound
 	}
-	if err := json.NewEncoder(w).Encode(data); err != nil {
-		log.Printf("[WARN] write error response json failed. %s", err)
+	if timedOut(w, code) {
+		err, code = errors.Wrap(ErrRequestTimeout, err.Error()), http.StatusServiceUnavailable
 	}
+	if aw, ok := w.(*accessLogWriter); ok && aw.logged {
+		// アクセスログに出す
+		aw.err = err
+	} else {
+		log.Printf("[WARN] err: %s", err.Error())
+	}
+	writeJSONError(w, code, err)
 }
 
-func (h *Handler) txScope(f func(*sql.Tx) error) (err error) {
-	var tx *sql.Tx
-	tx, err = h.db.Begin()
-	if err != nil {
-		return errors.Wrap(err, "begin transaction failed")
-	}
-	defer func() {
-		if e := recover(); e != nil {
-			tx.Rollback()
-			err = errors.Errorf("panic in transaction: %s", e)
-		} else if err != nil {
-			tx.Rollback()
-		} else {
-			err = tx.Commit()
-		}
-	}()
-	err = f(tx)
-	return
+// handleBankUnavailable は銀行APIが一時的に使えない場合に503を返します
+// サーキットブレーカーが開いている場合はRetry-Afterで次に試すまでの秒数を返します
+func (h *Handler) handleBankUnavailable(w http.ResponseWriter, err error) {
+	retry := int64(model.BankRetryAfter()/time.Second) + 1
+	w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+	h.handleError(w, err, http.StatusServiceUnavailable)
+}
+
+// dbFor はリクエストのctxでクエリを実行するQueryExecutorを返します。クライアントが切断した場合は実行中のクエリを中断します
+func (h *Handler) dbFor(r *http.Request) model.QueryExecutor {
+	return model.WithContext(r.Context(), h.db)
+}
+
+// replicaFor はdbForと同じくリクエストのctxでレプリカのクエリを実行します
+func (h *Handler) replicaFor(r *http.Request) model.QueryExecutor {
+	return model.WithContext(r.Context(), h.cluster.Replica())
+}
+
+// txScope はリクエストのctxでトランザクションを実行します。クライアントが切断した場合はロールバックします
+func (h *Handler) txScope(r *http.Request, f func(*sql.Tx) error) error {
+	return model.TxScope(r.Context(), h.db, nil, func(tx *sql.Tx) error {
+		if t := upstreamTrace(r); t != nil {
+			// トランザクションの中で呼んだ銀行APIとISULOGにリクエストIDを送り、かかった時間をアクセスログに出す
+			model.TraceTx(tx, t)
+			defer model.UntraceTx(tx)
+		}
+		return f(tx)
+	})
+}
+
+// userTxScope はユーザーのロックを取ってからトランザクションを実行します
+// 同じユーザーの注文や口座の操作はこの中で行ってください
+func (h *Handler) userTxScope(r *http.Request, userID int64, f func(*sql.Tx) error) error {
+	return model.WithUserLock(userID, func() error {
+		return h.txScope(r, f)
+	})
 }
@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+
+	"isucon8/isucoin/model"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	HubMessageInfo  = "info"
+	HubMessageTrade = "trade"
+	HubMessageOrder = "order"
+	HubMessageStats = "stats"
+	HubMessageAlert = "alert"
+
+	hubSendBuffer = 64
+)
+
+type hubMessage struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type hubSubscriber struct {
+	userID int64
+	send   chan *hubMessage
+}
+
+// Hub はWebSocketの接続をユーザーごとに管理し、modelから通知されたイベントを配信します
+// 未ログインの接続はuser_id=0として扱い、全体向けのイベントのみ受け取ります
+type Hub struct {
+	db     *sql.DB
+	mu     sync.RWMutex
+	subs   map[int64]map[*hubSubscriber]struct{}
+	traded chan struct{}
+}
+
+func newHub(db *sql.DB) *Hub {
+	hub := &Hub{
+		db:     db,
+		subs:   map[int64]map[*hubSubscriber]struct{}{},
+		traded: make(chan struct{}, 1),
+	}
+	go hub.runInfo()
+	return hub
+}
+
+func (hub *Hub) subscribe(userID int64) *hubSubscriber {
+	sub := &hubSubscriber{
+		userID: userID,
+		send:   make(chan *hubMessage, hubSendBuffer),
+	}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if _, ok := hub.subs[userID]; !ok {
+		hub.subs[userID] = map[*hubSubscriber]struct{}{}
+	}
+	hub.subs[userID][sub] = struct{}{}
+	return sub
+}
+
+func (hub *Hub) unsubscribe(sub *hubSubscriber) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	delete(hub.subs[sub.userID], sub)
+	if len(hub.subs[sub.userID]) == 0 {
+		delete(hub.subs, sub.userID)
+	}
+}
+
+func (hub *Hub) deliver(sub *hubSubscriber, m *hubMessage) {
+	select {
+	case sub.send <- m:
+	default:
+		// 受信が追いつかない接続のためにトレード処理を止めないように捨てる
+		log.Printf("[WARN] hub message dropped. user_id:%d type:%s", sub.userID, m.Type)
+	}
+}
+
+func (hub *Hub) broadcast(m *hubMessage) {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	for _, subs := range hub.subs {
+		for sub := range subs {
+			hub.deliver(sub, m)
+		}
+	}
+}
+
+func (hub *Hub) sendUser(userID int64, m *hubMessage) {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	for sub := range hub.subs[userID] {
+		hub.deliver(sub, m)
+	}
+}
+
+// PublishTrade は model.EventPublisher の実装です
+func (hub *Hub) PublishTrade(trade *model.Trade) {
+	hub.broadcast(&hubMessage{Type: HubMessageTrade, Data: trade})
+	select {
+	case hub.traded <- struct{}{}:
+	default:
+	}
+}
+
+// PublishOrderEvent は model.EventPublisher の実装です
+func (hub *Hub) PublishOrderEvent(ev *model.OrderEvent) {
+	hub.sendUser(ev.Order.UserID, &hubMessage{Type: HubMessageOrder, Data: ev})
+}
+
+// PublishAlert は model.EventPublisher の実装です
+func (hub *Hub) PublishAlert(alert *model.PriceAlert) {
+	hub.sendUser(alert.UserID, &hubMessage{Type: HubMessageAlert, Data: alert})
+}
+
+// runInfo はトレード成立後の最新価格と直近24時間の集計をまとめて配信します
+// 連続したトレードは1回の配信にまとめます
+func (hub *Hub) runInfo() {
+	for range hub.traded {
+		info, err := hub.info()
+		if err != nil {
+			log.Printf("[WARN] hub info failed. err:%s", err)
+			continue
+		}
+		hub.broadcast(&hubMessage{Type: HubMessageInfo, Data: info})
+		stats, err := model.GetMarketSummary(hub.db)
+		if err != nil {
+			log.Printf("[WARN] hub stats failed. err:%s", err)
+			continue
+		}
+		hub.broadcast(&hubMessage{Type: HubMessageStats, Data: stats})
+	}
+}
+
+func (hub *Hub) info() (map[string]interface{}, error) {
+	res := make(map[string]interface{}, 3)
+	latestTrade, err := model.GetLatestTrade(hub.db)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetLatestTrade failed")
+	}
+	res["cursor"] = latestTrade.ID
+	lowestSellOrder, err := model.GetLowestSellOrder(hub.db)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, errors.Wrap(err, "model.GetLowestSellOrder")
+	default:
+		res["lowest_sell_price"] = lowestSellOrder.Price
+	}
+	highestBuyOrder, err := model.GetHighestBuyOrder(hub.db)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, errors.Wrap(err, "model.GetHighestBuyOrder")
+	default:
+		res["highest_buy_price"] = highestBuyOrder.Price
+	}
+	return res, nil
+}
@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"isucon8/isucoin/model"
+)
+
+const (
+	// maxPooledBuffer より大きくなったバッファはプールに戻しません (大きな/infoの後にメモリを持ち続けないため)
+	maxPooledBuffer = 256 * 1024
+	// chartCacheTTL はチャートのJSONを使い回す時間の上限です
+	// 新しいトレードがあれば作り直しますが、レプリカの遅れで古いデータを返し続けないように期限も付けます
+	chartCacheTTL = time.Second
+)
+
+// emptyJSON は struct{}{} を返すときのレスポンスです
+var emptyJSON = []byte("{}\n")
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// writeJSON はdataをプールのバッファにJSONにしてから書き込みます
+// json.RawMessageは作成済みのJSONとしてそのまま書き込みます
+func writeJSON(w http.ResponseWriter, code int, data interface{}) error {
+	header := w.Header()
+	header.Set("Content-Type", "application/json; charset=utf-8")
+	switch v := data.(type) {
+	case struct{}:
+		return writeBody(w, code, emptyJSON)
+	case json.RawMessage:
+		return writeBody(w, code, v)
+	}
+	buf := bufPool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBuffer {
+			buf.Reset()
+			bufPool.Put(buf)
+		}
+	}()
+	if err := json.NewEncoder(buf).Encode(data); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	return writeBody(w, code, buf.Bytes())
+}
+
+func writeBody(w http.ResponseWriter, code int, body []byte) error {
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(code)
+	_, err := w.Write(body)
+	return err
+}
+
+type chartKey struct {
+	tf string
+	mt time.Time
+}
+
+type chartEntry struct {
+	json      json.RawMessage
+	tradeID   int64
+	expiresAt time.Time
+}
+
+// chartCache は/infoのチャートをJSONにしたものです
+// 同じ時刻からのチャートは新しいトレードが成立するまで変わらないので、最新のトレードのIDが同じ間は使い回します
+type chartCache struct {
+	mu      sync.Mutex
+	entries map[chartKey]*chartEntry
+}
+
+func newChartCache() *chartCache {
+	return &chartCache{entries: map[chartKey]*chartEntry{}}
+}
+
+// get はmtからのtfの足をJSONにして返します。latestTradeIDは呼び出し時点の最新のトレードのIDです
+func (c *chartCache) get(d model.QueryExecutor, mt time.Time, tf string, latestTradeID int64) (json.RawMessage, error) {
+	key := chartKey{tf: tf, mt: mt}
+	now := time.Now()
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && e.tradeID == latestTradeID && now.Before(e.expiresAt) {
+		c.mu.Unlock()
+		return e.json, nil
+	}
+	c.mu.Unlock()
+
+	data, err := model.GetCandlestickData(d, mt, tf)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// 古いトレードのIDのものは二度と使わないので捨てる
+	for k, e := range c.entries {
+		if e.tradeID != latestTradeID || !now.Before(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = &chartEntry{json: b, tradeID: latestTradeID, expiresAt: now.Add(chartCacheTTL)}
+	return b, nil
+}
+
+// writeJSONError はhandleErrorのレスポンスを書き込みます
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if werr := writeJSON(w, code, struct {
+		Code      int    `json:"code"`
+		ErrorCode string `json:"error_code"`
+		Err       string `json:"err"`
+		RequestID string `json:"request_id,omitempty"`
+	}{code, errorCode(err, code), err.Error(), responseRequestID(w)}); werr != nil {
+		log.Printf("[WARN] write error response json failed. %s", werr)
+	}
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultLeaderboardLimit = 10
+	MaxLeaderboardLimit     = 100
+
+	// window の単位は時間です
+	DefaultLeaderboardWindow = 24
+	MaxLeaderboardWindow     = 7 * 24
+)
+
+// LeaderboardResponse はGET /leaderboardのレスポンスです
+type LeaderboardResponse struct {
+	By          string               `json:"by"`
+	WindowHours int                  `json:"window_hours"`
+	Since       time.Time            `json:"since"`
+	Leaders     []*model.TraderStats `json:"leaders"`
+	// Me はログインユーザーの順位です。期間中に約定が無い場合は含めません
+	Me *model.TraderStats `json:"me,omitempty"`
+}
+
+// Leaderboard は直近window時間の約定の量 (by=volume) または確定した損益 (by=pnl) の上位のユーザーを返します
+// ログインしている場合は自分の順位も返します
+func (h *Handler) Leaderboard(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var (
+		q      = r.URL.Query()
+		by     = q.Get("by")
+		limit  = DefaultLeaderboardLimit
+		window = DefaultLeaderboardWindow
+		err    error
+	)
+	switch by {
+	case "":
+		by = model.LeaderboardByVolume
+	case model.LeaderboardByVolume, model.LeaderboardByPnL:
+	default:
+		h.handleError(w, errors.New("by must be volume or pnl"), 400)
+		return
+	}
+	if _limit := q.Get("limit"); _limit != "" {
+		if limit, err = strconv.Atoi(_limit); err != nil || limit <= 0 {
+			h.handleError(w, errors.New("limit must be positive integer"), 400)
+			return
+		}
+	}
+	if limit > MaxLeaderboardLimit {
+		limit = MaxLeaderboardLimit
+	}
+	if _window := q.Get("window"); _window != "" {
+		if window, err = strconv.Atoi(_window); err != nil || window <= 0 {
+			h.handleError(w, errors.New("window must be positive integer"), 400)
+			return
+		}
+	}
+	if window > MaxLeaderboardWindow {
+		window = MaxLeaderboardWindow
+	}
+	res := &LeaderboardResponse{
+		By:          by,
+		WindowHours: window,
+		// 1時間ごとの集計なので、始まりを切り捨てて最大window+1時間分を返す
+		Since: time.Now().Add(-time.Duration(window) * time.Hour).Truncate(time.Hour),
+	}
+	db := h.replicaFor(r)
+	if res.Leaders, err = model.GetLeaderboard(db, by, res.Since, limit); err != nil {
+		h.handleError(w, errors.Wrap(err, "model.GetLeaderboard"), 500)
+		return
+	}
+	if userID, ok := h.sessionUserID(r); ok {
+		if res.Me, err = model.GetTraderRank(db, by, res.Since, userID); err != nil {
+			h.handleError(w, errors.Wrap(err, "model.GetTraderRank"), 500)
+			return
+		}
+	}
+	h.handleSuccess(w, res)
+}
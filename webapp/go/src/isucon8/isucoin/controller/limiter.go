@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// ParseConcurrencyLimits は "POST /initialize=1,GET /orders=20" 形式の文字列をパースします
+func ParseConcurrencyLimits(s string) (map[string]int, error) {
+	return parseRouteValues(s, "concurrency limit")
+}
+
+// parseRouteValues は "METHOD /path=値" をカンマで区切った文字列をパースします。値は0以上の整数です
+func parseRouteValues(s, name string) (map[string]int, error) {
+	values := map[string]int{}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.LastIndex(kv, "=")
+		if i < 0 {
+			return nil, errors.Errorf("invalid %s [%s]", name, kv)
+		}
+		n, err := strconv.Atoi(kv[i+1:])
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid %s [%s]", name, kv)
+		}
+		values[strings.TrimSpace(kv[:i])] = n
+	}
+	return values, nil
+}
+
+// SetConcurrencyLimits はルートごとの同時実行数の上限を設定します
+// keyは "METHOD /path" の形式でルーティングに登録したパスと同じものを指定してください
+func (h *Handler) SetConcurrencyLimits(limits map[string]int) {
+	h.limits = make(map[string]chan struct{}, len(limits))
+	for k, n := range limits {
+		if n > 0 {
+			h.limits[k] = make(chan struct{}, n)
+		}
+	}
+}
+
+// Limit は上限が設定されているルートの同時実行数を制限します
+// 上限に達している場合は空きが出るまで待ち、その前にリクエストが終了した場合は503を返します
+func (h *Handler) Limit(method, path string, f httprouter.Handle) httprouter.Handle {
+	sem, ok := h.limits[method+" "+path]
+	if !ok {
+		return f
+	}
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		select {
+		case sem <- struct{}{}:
+		case <-r.Context().Done():
+			h.handleOverloaded(w)
+			return
+		}
+		defer func() { <-sem }()
+		f(w, r, p)
+	}
+}
@@ -0,0 +1,107 @@
+package controller
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maintenanceExemptPrefixes はメンテナンス中も呼べるAPIです (管理APIとロードバランサーの確認用)
+var maintenanceExemptPrefixes = []string{
+	"/admin/",
+	"/debug/",
+	"/healthz",
+}
+
+// underMaintenance はメンテナンス中の場合に503を返してtrueを返します
+func (h *Handler) underMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	for _, prefix := range maintenanceExemptPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+	m := model.CurrentMaintenance(h.db)
+	if !m.Enabled {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(m.RetryAfter/time.Second), 10))
+	err := model.ErrMaintenance
+	if m.Message != "" {
+		err = errors.Wrap(err, m.Message)
+	}
+	h.handleError(w, err, http.StatusServiceUnavailable)
+	return true
+}
+
+// maintenanceUnary, maintenanceStream はメンテナンス中のgRPCの呼び出しをUnavailableで返します
+func (h *Handler) maintenanceUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if model.CurrentMaintenance(h.db).Enabled {
+		return nil, status.Error(codes.Unavailable, model.ErrMaintenance.Error())
+	}
+	return handler(ctx, req)
+}
+
+func (h *Handler) maintenanceStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if model.CurrentMaintenance(h.db).Enabled {
+		return status.Error(codes.Unavailable, model.ErrMaintenance.Error())
+	}
+	return handler(srv, ss)
+}
+
+// AdminMaintenance はメンテナンスモードを切り替えます
+// 他のappサーバーにはMaintenanceCheckIntervalまでに反映されます
+func (h *Handler) AdminMaintenance(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+	if err != nil {
+		h.handleError(w, errors.New("enabled must be boolean"), 400)
+		return
+	}
+	m := &model.Maintenance{Enabled: enabled, Message: r.FormValue("message")}
+	if v := r.FormValue("retry_after"); v != "" {
+		sec, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || sec <= 0 {
+			h.handleError(w, errors.New("retry_after must be positive integer"), 400)
+			return
+		}
+		m.RetryAfter = time.Duration(sec) * time.Second
+	}
+	err = h.txScope(r, func(tx *sql.Tx) error {
+		return model.SetMaintenance(tx, m)
+	})
+	switch {
+	case err == model.ErrParameterInvalid:
+		h.handleError(w, err, 400)
+		return
+	case err != nil:
+		h.handleError(w, err, 500)
+		return
+	}
+	model.ForgetMaintenance()
+	log.Printf("[INFO] maintenance mode set. enabled:%v", m.Enabled)
+	h.handleSuccess(w, maintenanceResponse(m))
+}
+
+func maintenanceResponse(m *model.Maintenance) map[string]interface{} {
+	res := map[string]interface{}{
+		"enabled": m.Enabled,
+	}
+	if m.Enabled {
+		res["retry_after"] = int64(m.RetryAfter / time.Second)
+		if m.Message != "" {
+			res["message"] = m.Message
+		}
+	}
+	return res
+}
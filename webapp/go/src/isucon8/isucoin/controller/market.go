@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// marketCacheTTL は未ログインユーザーの/infoで価格情報を使い回す時間の上限です
+	// このサーバーでトレードや注文の変化があればすぐに作り直しますが、他のサーバーの変化と設定の変更は期限まで反映されません
+	marketCacheTTL = 500 * time.Millisecond
+	// maxTradeTimes はcursorのトレードの時刻を覚えておく数です
+	maxTradeTimes = 4096
+)
+
+// marketInfo は/infoのうちユーザーによらない価格情報です
+type marketInfo struct {
+	LatestTrade        *model.Trade
+	LowestSellPrice    *int64
+	HighestBuyPrice    *int64
+	TradingHaltedUntil *time.Time
+	PriceBand          *model.PriceBand
+	EnableShare        bool
+	NextAuctionAt      *time.Time
+}
+
+// loadMarketInfo は価格情報をDBと板から読みます
+func (h *Handler) loadMarketInfo(d model.QueryExecutor) (*marketInfo, error) {
+	mi := &marketInfo{}
+	var err error
+	mi.LatestTrade, err = model.GetLatestTrade(d)
+	if err != nil {
+		return nil, errors.Wrap(err, "GetLatestTrade failed")
+	}
+	lowestSellOrder, err := model.GetLowestSellOrder(d)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, errors.Wrap(err, "model.GetLowestSellOrder")
+	default:
+		mi.LowestSellPrice = &lowestSellOrder.Price
+	}
+	highestBuyOrder, err := model.GetHighestBuyOrder(d)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, errors.Wrap(err, "model.GetHighestBuyOrder")
+	default:
+		mi.HighestBuyPrice = &highestBuyOrder.Price
+	}
+	halt, err := model.GetTradingHalt(h.db)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Before(halt.Until) {
+		mi.TradingHaltedUntil = &halt.Until
+	}
+	if mi.PriceBand, err = model.GetPriceBand(h.db); err != nil {
+		return nil, err
+	}
+	if mi.EnableShare, err = model.ShareEnabled(h.db); err != nil {
+		return nil, err
+	}
+	auction, err := model.GetAuctionSchedule(h.db)
+	if err != nil {
+		return nil, err
+	}
+	if auction.Enabled {
+		next := auction.NextAt(time.Now())
+		mi.NextAuctionAt = &next
+	}
+	return mi, nil
+}
+
+// marketCache は未ログインユーザーの/infoの価格情報とcursorのトレードの時刻を使い回します
+// EventPublisherとして登録し、このサーバーでトレードや注文の変化があれば価格情報を捨てます
+type marketCache struct {
+	mu        sync.Mutex
+	info      *marketInfo
+	expiresAt time.Time
+	// tradeTimes はトレードのidと成立した時刻です (トレードは変更されないので、Initializeまで使い回せる)
+	tradeTimes map[int64]time.Time
+}
+
+func newMarketCache() *marketCache {
+	return &marketCache{tradeTimes: map[int64]time.Time{}}
+}
+
+// get はキャッシュした価格情報を返し、期限切れの場合はloadで読み直します
+func (c *marketCache) get(load func() (*marketInfo, error)) (*marketInfo, error) {
+	now := time.Now()
+	c.mu.Lock()
+	if c.info != nil && now.Before(c.expiresAt) {
+		mi := c.info
+		c.mu.Unlock()
+		return mi, nil
+	}
+	c.mu.Unlock()
+
+	mi, err := load()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.info != nil && mi.LatestTrade.ID < c.info.LatestTrade.ID {
+		// 他のサーバーでInitializeされてトレードが消えた
+		c.tradeTimes = map[int64]time.Time{}
+	}
+	c.info, c.expiresAt = mi, now.Add(marketCacheTTL)
+	c.rememberLocked(mi.LatestTrade)
+	return mi, nil
+}
+
+// tradeTime はidのトレードが成立した時刻を返します。見つからない場合はfalseを返します
+func (c *marketCache) tradeTime(d model.QueryExecutor, id int64) (time.Time, bool, error) {
+	c.mu.Lock()
+	t, ok := c.tradeTimes[id]
+	c.mu.Unlock()
+	if ok {
+		return t, true, nil
+	}
+	trade, err := model.GetTradeByID(d, id)
+	switch {
+	case err == sql.ErrNoRows:
+		return time.Time{}, false, nil
+	case err != nil:
+		return time.Time{}, false, err
+	}
+	c.mu.Lock()
+	c.rememberLocked(trade)
+	c.mu.Unlock()
+	return trade.CreatedAt, true, nil
+}
+
+func (c *marketCache) rememberLocked(trade *model.Trade) {
+	if len(c.tradeTimes) >= maxTradeTimes {
+		c.tradeTimes = map[int64]time.Time{}
+	}
+	c.tradeTimes[trade.ID] = trade.CreatedAt
+}
+
+func (c *marketCache) invalidate() {
+	c.mu.Lock()
+	c.info = nil
+	c.mu.Unlock()
+}
+
+// reset はInitializeでトレードが消えた後に呼びます
+func (c *marketCache) reset() {
+	c.mu.Lock()
+	c.info = nil
+	c.tradeTimes = map[int64]time.Time{}
+	c.mu.Unlock()
+}
+
+func (c *marketCache) PublishTrade(*model.Trade) {
+	c.invalidate()
+}
+
+func (c *marketCache) PublishOrderEvent(*model.OrderEvent) {
+	c.invalidate()
+}
+
+func (c *marketCache) PublishAlert(*model.PriceAlert) {}
@@ -0,0 +1,37 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"isucon8/isucoin/metrics"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	httpRequests = metrics.NewCounterVec("isucoin_http_requests_total",
+		"ルートとステータスごとのリクエスト数", "method", "route", "status")
+	httpDuration = metrics.NewHistogramVec("isucoin_http_request_duration_seconds",
+		"ルートごとのリクエストの処理時間", metrics.DefaultBuckets, "method", "route")
+)
+
+// Measure はルートごとのリクエスト数と処理時間をメトリクスに出力します
+// pathはルーターに登録したパス (/order/:id など) をそのまま使います
+func (h *Handler) Measure(method, path string, f httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		start := time.Now()
+		aw, ok := w.(*accessLogWriter)
+		if !ok {
+			aw = &accessLogWriter{ResponseWriter: w}
+		}
+		f(aw, r, p)
+		status := aw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		httpDuration.Observe(time.Since(start).Seconds(), method, path)
+		httpRequests.Inc(method, path, strconv.Itoa(status))
+	}
+}
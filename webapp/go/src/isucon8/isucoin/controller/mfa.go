@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"database/sql"
+	"net/http"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// EnableMFA は2段階認証のシークレットを発行します。POST /me/2fa/verifyでコードを確認すると有効になります
+func (h *Handler) EnableMFA(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	var enrollment *model.MFAEnrollment
+	err = h.txScope(r, func(tx *sql.Tx) (err error) {
+		enrollment, err = model.EnrollMFA(tx, user)
+		return
+	})
+	switch {
+	case err == model.ErrMFAAlreadyEnabled:
+		h.handleError(w, err, 409)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		h.handleSuccess(w, enrollment)
+	}
+}
+
+func (h *Handler) VerifyMFA(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	err = h.txScope(r, func(tx *sql.Tx) error {
+		return model.VerifyMFAEnrollment(tx, user.ID, r.FormValue("otp"))
+	})
+	switch {
+	case err == model.ErrMFAInvalid:
+		h.handleError(w, err, 400)
+	case err == model.ErrMFANotEnrolled:
+		h.handleError(w, err, 404)
+	case err == model.ErrMFAAlreadyEnabled:
+		h.handleError(w, err, 409)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		h.handleSuccess(w, map[string]interface{}{
+			"enabled": true,
+		})
+	}
+}
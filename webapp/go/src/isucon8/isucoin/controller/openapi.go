@@ -0,0 +1,472 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// APIのOpenAPI 3の定義です
+// 同じ定義をValidateでのパラメータの検証にも使うので、ルートやパラメータを追加した場合はここにも追加してください
+
+// apiParam はAPIのパラメータです
+type apiParam struct {
+	Name string
+	// In は path, query, form (application/x-www-form-urlencoded のbody) のいずれかです
+	In string
+	// Type は integer か string で、Formatは date-time (RFC3339) の場合に指定します
+	Type     string
+	Format   string
+	Required bool
+	Enum     []string
+	Minimum  *int64
+}
+
+func pathParam(name string) apiParam {
+	return apiParam{Name: name, In: "path", Type: "integer", Required: true}
+}
+
+func queryParam(name, typ string) apiParam {
+	return apiParam{Name: name, In: "query", Type: typ}
+}
+
+func formParam(name, typ string) apiParam {
+	return apiParam{Name: name, In: "form", Type: typ}
+}
+
+func (p apiParam) required() apiParam {
+	p.Required = true
+	return p
+}
+
+func (p apiParam) enum(values ...string) apiParam {
+	p.Enum = values
+	return p
+}
+
+func (p apiParam) min(n int64) apiParam {
+	p.Minimum = &n
+	return p
+}
+
+func (p apiParam) format(f string) apiParam {
+	p.Format = f
+	return p
+}
+
+// APIの認証の種類です
+const (
+	apiAuthNone  = ""
+	apiAuthUser  = "user"  // セッション, APIキー, JWT
+	apiAuthAdmin = "admin" // 管理APIのトークン
+)
+
+// apiOperation は1つのルートです。Pathはルーターに登録したパス (/order/:id など) です
+type apiOperation struct {
+	Method  string
+	Path    string
+	Tag     string
+	Summary string
+	Auth    string
+	Params  []apiParam
+	// JSONBody はJSONのbodyのスキーマで、bodyの検証はハンドラで行います
+	JSONBody map[string]interface{}
+	// V2 のルートはエラーをv2の形式で返します
+	V2 bool
+}
+
+var orderTypes = []string{model.OrderTypeBuy, model.OrderTypeSell, model.OrderTypeStopBuy, model.OrderTypeStopSell}
+
+func orderParams() []apiParam {
+	return []apiParam{
+		formParam("type", "string").required().enum(orderTypes...),
+		formParam("amount", "integer").required(),
+		formParam("price", "integer"),
+		formParam("order_type", "string").enum(model.OrderKindLimit, model.OrderKindMarket),
+		formParam("time_in_force", "string").enum(model.TimeInForceGTC, model.TimeInForceIOC, model.TimeInForceFOK),
+		formParam("trigger_price", "integer"),
+		formParam("display_amount", "integer"),
+		formParam("expires_at", "string").format("date-time"),
+	}
+}
+
+func settingParams() []apiParam {
+	params := make([]apiParam, 0, len(settingKeys))
+	for _, k := range settingKeys {
+		params = append(params, formParam(k, "string"))
+	}
+	return params
+}
+
+var candleResolutions = []string{"1s", "1m", "5m", "1h"}
+
+var apiOperations = []apiOperation{
+	{Method: "POST", Path: "/initialize", Tag: "admin", Summary: "ベンチマーカー初期化",
+		Params: append(settingParams(), formParam("warmup", "string"))},
+	{Method: "POST", Path: "/signup", Tag: "user", Summary: "登録", Params: []apiParam{
+		formParam("name", "string").required(),
+		formParam("bank_id", "string").required(),
+		formParam("password", "string").required(),
+	}},
+	{Method: "POST", Path: "/signin", Tag: "user", Summary: "ログイン", Params: []apiParam{
+		formParam("bank_id", "string").required(),
+		formParam("password", "string").required(),
+		formParam("otp", "string"),
+		formParam("token", "string"),
+	}},
+	{Method: "POST", Path: "/signout", Tag: "user", Summary: "ログアウト"},
+	{Method: "GET", Path: "/info", Tag: "market", Summary: "更新情報", Params: []apiParam{
+		queryParam("cursor", "integer"),
+	}},
+	{Method: "GET", Path: "/csrf_token", Tag: "user", Summary: "CSRFトークン"},
+	{Method: "GET", Path: "/ticker", Tag: "market", Summary: "価格情報"},
+	{Method: "GET", Path: "/chart", Tag: "market", Summary: "ロウソク足", Params: []apiParam{
+		queryParam("resolution", "string").enum(candleResolutions...),
+		queryParam("from", "integer").min(0),
+		queryParam("to", "integer").min(0),
+	}},
+	{Method: "GET", Path: "/orderbook", Tag: "market", Summary: "板情報", Params: []apiParam{
+		queryParam("depth", "integer").min(1),
+	}},
+	{Method: "GET", Path: "/trades", Tag: "market", Summary: "約定履歴", Params: []apiParam{
+		queryParam("cursor", "integer").min(0),
+		queryParam("limit", "integer").min(1),
+	}},
+	{Method: "GET", Path: "/admin/settlements", Tag: "admin", Summary: "銀行の仮決済の集計", Auth: apiAuthAdmin, Params: []apiParam{
+		queryParam("from", "string").format("date-time"),
+		queryParam("to", "string").format("date-time"),
+	}},
+	{Method: "GET", Path: "/leaderboard", Tag: "market", Summary: "約定の量と損益のランキング", Params: []apiParam{
+		queryParam("by", "string").enum(model.LeaderboardByVolume, model.LeaderboardByPnL),
+		queryParam("window", "integer").min(1),
+		queryParam("limit", "integer").min(1),
+	}},
+	{Method: "GET", Path: "/trade/:file", Tag: "market", Summary: "トレードの共有ページ", Params: []apiParam{
+		{Name: "file", In: "path", Type: "string", Required: true},
+	}},
+	{Method: "GET", Path: "/stream", Tag: "stream", Summary: "Server-Sent Eventsのストリーム", Params: []apiParam{
+		queryParam("cursor", "integer"),
+	}},
+	{Method: "GET", Path: "/ws", Tag: "stream", Summary: "WebSocketのストリーム"},
+	{Method: "POST", Path: "/orders", Tag: "order", Summary: "注文", Auth: apiAuthUser, Params: orderParams()},
+	{Method: "POST", Path: "/orders/validate", Tag: "order", Summary: "注文を作らずに確認", Auth: apiAuthUser, Params: orderParams()},
+	{Method: "POST", Path: "/orders/batch", Tag: "order", Summary: "まとめて注文", Auth: apiAuthUser,
+		JSONBody: map[string]interface{}{
+			"type": "array",
+			"items": map[string]interface{}{
+				"type":     "object",
+				"required": []string{"type", "amount", "price"},
+				"properties": map[string]interface{}{
+					"type":   map[string]interface{}{"type": "string", "enum": []string{model.OrderTypeBuy, model.OrderTypeSell}},
+					"amount": map[string]interface{}{"type": "integer"},
+					"price":  map[string]interface{}{"type": "integer"},
+				},
+			},
+		}},
+	{Method: "GET", Path: "/orders", Tag: "order", Summary: "注文一覧", Auth: apiAuthUser, Params: []apiParam{
+		queryParam("cursor", "integer").min(0),
+		queryParam("limit", "integer").min(1),
+		queryParam("status", "string").enum(model.OrderStatusOpen, model.OrderStatusClosed, model.OrderStatusTraded),
+		queryParam("type", "string").enum(orderTypes...),
+		queryParam("tag", "string"),
+		queryParam("watched", "boolean"),
+	}},
+	{Method: "GET", Path: "/orders/export", Tag: "order", Summary: "注文履歴のダウンロード", Auth: apiAuthUser, Params: []apiParam{
+		queryParam("format", "string").enum("csv", "ndjson"),
+	}},
+	{Method: "PUT", Path: "/order/:id", Tag: "order", Summary: "注文の変更", Auth: apiAuthUser, Params: []apiParam{
+		pathParam("id"),
+		formParam("amount", "integer"),
+		formParam("price", "integer"),
+	}},
+	{Method: "DELETE", Path: "/order/:id", Tag: "order", Summary: "注文の取り消し", Auth: apiAuthUser, Params: []apiParam{
+		pathParam("id"),
+	}},
+	{Method: "PATCH", Path: "/order/:id/meta", Tag: "order", Summary: "注文のタグとメモの変更", Auth: apiAuthUser, Params: []apiParam{
+		pathParam("id"),
+		formParam("tag", "string"),
+		formParam("note", "string"),
+		formParam("watched", "boolean"),
+	}},
+	{Method: "GET", Path: "/order/:id/events", Tag: "order", Summary: "注文の状態変化の履歴", Auth: apiAuthUser, Params: []apiParam{
+		pathParam("id"),
+	}},
+	{Method: "GET", Path: "/me/position", Tag: "user", Summary: "ポジション", Auth: apiAuthUser},
+	{Method: "GET", Path: "/me/fees", Tag: "user", Summary: "手数料", Auth: apiAuthUser},
+	{Method: "POST", Path: "/me/close", Tag: "user", Summary: "退会", Auth: apiAuthUser},
+	{Method: "POST", Path: "/me/password", Tag: "user", Summary: "パスワードの変更", Auth: apiAuthUser, Params: []apiParam{
+		formParam("old_password", "string").required(),
+		formParam("new_password", "string").required(),
+	}},
+	{Method: "POST", Path: "/me/bank", Tag: "user", Summary: "銀行アカウントの変更", Auth: apiAuthUser, Params: []apiParam{
+		formParam("password", "string").required(),
+		formParam("bank_id", "string").required(),
+	}},
+	{Method: "GET", Path: "/me/apikeys", Tag: "user", Summary: "APIキー一覧", Auth: apiAuthUser},
+	{Method: "POST", Path: "/me/apikeys", Tag: "user", Summary: "APIキーの発行", Auth: apiAuthUser, Params: []apiParam{
+		formParam("name", "string").required(),
+		formParam("scope", "string").required().enum(model.APIKeyScopeRead, model.APIKeyScopeTrade),
+	}},
+	{Method: "DELETE", Path: "/me/apikeys/:id", Tag: "user", Summary: "APIキーの無効化", Auth: apiAuthUser, Params: []apiParam{
+		pathParam("id"),
+	}},
+	{Method: "GET", Path: "/me/webhooks", Tag: "user", Summary: "Webhook一覧", Auth: apiAuthUser},
+	{Method: "POST", Path: "/me/webhooks", Tag: "user", Summary: "Webhookの登録", Auth: apiAuthUser, Params: []apiParam{
+		formParam("url", "string").required(),
+	}},
+	{Method: "DELETE", Path: "/me/webhooks/:id", Tag: "user", Summary: "Webhookの削除", Auth: apiAuthUser, Params: []apiParam{
+		pathParam("id"),
+	}},
+	{Method: "GET", Path: "/me/alerts", Tag: "user", Summary: "価格アラート一覧", Auth: apiAuthUser, Params: []apiParam{
+		queryParam("status", "string").enum(model.AlertStatusActive, model.AlertStatusTriggered),
+	}},
+	{Method: "POST", Path: "/me/alerts", Tag: "user", Summary: "価格アラートの登録", Auth: apiAuthUser, Params: []apiParam{
+		formParam("price", "integer").required().min(1),
+		formParam("direction", "string").enum(model.AlertAbove, model.AlertBelow),
+	}},
+	{Method: "DELETE", Path: "/me/alerts/:id", Tag: "user", Summary: "価格アラートの削除", Auth: apiAuthUser, Params: []apiParam{
+		pathParam("id"),
+	}},
+	{Method: "GET", Path: "/me/sessions", Tag: "user", Summary: "ログイン中の端末一覧", Auth: apiAuthUser},
+	{Method: "DELETE", Path: "/me/sessions", Tag: "user", Summary: "すべての端末からログアウト", Auth: apiAuthUser},
+	{Method: "DELETE", Path: "/me/sessions/:id", Tag: "user", Summary: "端末のログアウト", Auth: apiAuthUser, Params: []apiParam{
+		pathParam("id"),
+	}},
+	{Method: "POST", Path: "/me/2fa/enable", Tag: "user", Summary: "2段階認証の開始", Auth: apiAuthUser},
+	{Method: "POST", Path: "/me/2fa/verify", Tag: "user", Summary: "2段階認証の有効化", Auth: apiAuthUser, Params: []apiParam{
+		formParam("otp", "string").required(),
+	}},
+	{Method: "POST", Path: "/v2/orders", Tag: "order", Summary: "部分約定を許可する注文", Auth: apiAuthUser, Params: orderParams()},
+	{Method: "GET", Path: "/v2/orders", Tag: "order", Summary: "約定を含む注文一覧", Auth: apiAuthUser, Params: []apiParam{
+		queryParam("cursor", "integer").min(0),
+		queryParam("limit", "integer").min(1),
+		queryParam("status", "string").enum(model.OrderStatusOpen, model.OrderStatusClosed, model.OrderStatusTraded),
+		queryParam("type", "string").enum(orderTypes...),
+		queryParam("tag", "string"),
+		queryParam("watched", "boolean"),
+	}},
+	{Method: "GET", Path: "/v2/ticker", Tag: "market-v2", Summary: "価格情報", V2: true},
+	{Method: "GET", Path: "/v2/orderbook", Tag: "market-v2", Summary: "板情報", V2: true, Params: []apiParam{
+		queryParam("depth", "integer").min(1),
+	}},
+	{Method: "GET", Path: "/v2/trades", Tag: "market-v2", Summary: "約定履歴", V2: true, Params: []apiParam{
+		queryParam("cursor", "integer").min(1),
+		queryParam("limit", "integer").min(1),
+	}},
+	{Method: "GET", Path: "/v2/candles", Tag: "market-v2", Summary: "ロウソク足", V2: true, Params: []apiParam{
+		queryParam("resolution", "string").enum(candleResolutions...),
+		queryParam("cursor", "integer").min(1),
+		queryParam("from", "integer").min(1),
+		queryParam("limit", "integer").min(1),
+	}},
+	{Method: "GET", Path: "/admin/status", Tag: "admin", Summary: "取引の停止状態", Auth: apiAuthAdmin},
+	{Method: "POST", Path: "/admin/halt", Tag: "admin", Summary: "取引の停止", Auth: apiAuthAdmin},
+	{Method: "POST", Path: "/admin/resume", Tag: "admin", Summary: "取引の再開", Auth: apiAuthAdmin},
+	{Method: "POST", Path: "/admin/maintenance", Tag: "admin", Summary: "メンテナンスモードの切り替え", Auth: apiAuthAdmin, Params: []apiParam{
+		formParam("enabled", "boolean").required(),
+		formParam("retry_after", "integer").min(1),
+		formParam("message", "string"),
+	}},
+	{Method: "DELETE", Path: "/admin/order/:id", Tag: "admin", Summary: "注文の取り消し", Auth: apiAuthAdmin, Params: []apiParam{
+		pathParam("id"),
+	}},
+	{Method: "GET", Path: "/admin/users", Tag: "admin", Summary: "ユーザー一覧", Auth: apiAuthAdmin, Params: []apiParam{
+		queryParam("cursor", "integer").min(0),
+		queryParam("limit", "integer").min(1),
+	}},
+	{Method: "POST", Path: "/admin/settings", Tag: "admin", Summary: "設定の変更", Auth: apiAuthAdmin, Params: settingParams()},
+	{Method: "POST", Path: "/admin/settings/reload", Tag: "admin", Summary: "設定の再読み込み", Auth: apiAuthAdmin},
+	{Method: "GET", Path: "/debug/bank", Tag: "admin", Summary: "銀行APIの状態", Auth: apiAuthAdmin},
+	{Method: "GET", Path: "/debug/leader", Tag: "admin", Summary: "マッチングのリーダー", Auth: apiAuthAdmin},
+	{Method: "GET", Path: "/healthz", Tag: "health", Summary: "死活監視"},
+	{Method: "GET", Path: "/readyz", Tag: "health", Summary: "準備ができているか"},
+	{Method: "GET", Path: "/openapi.json", Tag: "meta", Summary: "このAPIのOpenAPIの定義"},
+}
+
+var apiOperationsByRoute = func() map[string]*apiOperation {
+	m := make(map[string]*apiOperation, len(apiOperations))
+	for i := range apiOperations {
+		op := &apiOperations[i]
+		m[op.Method+" "+op.Path] = op
+	}
+	return m
+}()
+
+var openAPI struct {
+	once sync.Once
+	json json.RawMessage
+}
+
+// OpenAPI はAPIのOpenAPI 3の定義を返します
+func (h *Handler) OpenAPI(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	openAPI.once.Do(func() {
+		b, err := json.Marshal(openAPIDocument())
+		if err != nil {
+			log.Printf("[WARN] marshal openapi failed. %s", err)
+			b = emptyJSON
+		}
+		openAPI.json = b
+	})
+	h.handleSuccess(w, openAPI.json)
+}
+
+func (p apiParam) schema() map[string]interface{} {
+	s := map[string]interface{}{"type": p.Type}
+	if p.Format != "" {
+		s["format"] = p.Format
+	}
+	if len(p.Enum) > 0 {
+		s["enum"] = p.Enum
+	}
+	if p.Minimum != nil {
+		s["minimum"] = *p.Minimum
+	}
+	return s
+}
+
+// openAPIPath は /order/:id を /order/{id} にします
+func openAPIPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") {
+			parts[i] = "{" + p[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{"schema": schema},
+	}
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func openAPIDocument() map[string]interface{} {
+	paths := map[string]map[string]interface{}{}
+	for _, op := range apiOperations {
+		errSchema := schemaRef("Error")
+		if op.V2 {
+			errSchema = schemaRef("V2Error")
+		}
+		o := map[string]interface{}{
+			"tags":        []string{op.Tag},
+			"summary":     op.Summary,
+			"operationId": strings.ToLower(op.Method) + strings.NewReplacer("/", "_", ":", "", ".", "_").Replace(op.Path),
+			"responses": map[string]interface{}{
+				"200":     map[string]interface{}{"description": "成功"},
+				"default": map[string]interface{}{"description": "エラー", "content": jsonContent(errSchema)},
+			},
+		}
+		switch op.Auth {
+		case apiAuthUser:
+			o["security"] = []map[string][]string{{"session": {}}, {"apiKey": {}}, {"bearer": {}}}
+		case apiAuthAdmin:
+			o["security"] = []map[string][]string{{"adminToken": {}}}
+		}
+		var params []map[string]interface{}
+		form := map[string]interface{}{}
+		var formRequired []string
+		for _, p := range op.Params {
+			if p.In == "form" {
+				form[p.Name] = p.schema()
+				if p.Required {
+					formRequired = append(formRequired, p.Name)
+				}
+				continue
+			}
+			params = append(params, map[string]interface{}{
+				"name":     p.Name,
+				"in":       p.In,
+				"required": p.Required,
+				"schema":   p.schema(),
+			})
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+		switch {
+		case op.JSONBody != nil:
+			o["requestBody"] = map[string]interface{}{"required": true, "content": jsonContent(op.JSONBody)}
+		case len(form) > 0:
+			schema := map[string]interface{}{"type": "object", "properties": form}
+			if len(formRequired) > 0 {
+				schema["required"] = formRequired
+			}
+			o["requestBody"] = map[string]interface{}{
+				"required": len(formRequired) > 0,
+				"content": map[string]interface{}{
+					"application/x-www-form-urlencoded": map[string]interface{}{"schema": schema},
+				},
+			}
+		}
+		path := openAPIPath(op.Path)
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(op.Method)] = o
+	}
+
+	paramErrors := map[string]interface{}{
+		"type": "array",
+		"items": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"name":   map[string]interface{}{"type": "string"},
+				"in":     map[string]interface{}{"type": "string"},
+				"reason": map[string]interface{}{"type": "string"},
+			},
+		},
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "ISUCOIN",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"code":       map[string]interface{}{"type": "integer"},
+						"error_code": map[string]interface{}{"type": "string"},
+						"err":        map[string]interface{}{"type": "string"},
+						"errors":     paramErrors,
+						"request_id": map[string]interface{}{"type": "string"},
+					},
+				},
+				"V2Error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"error": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"code":       map[string]interface{}{"type": "string"},
+								"message":    map[string]interface{}{"type": "string"},
+								"details":    paramErrors,
+								"request_id": map[string]interface{}{"type": "string"},
+							},
+						},
+					},
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"session":    map[string]interface{}{"type": "apiKey", "in": "cookie", "name": SessionName},
+				"apiKey":     map[string]interface{}{"type": "apiKey", "in": "header", "name": APIKeyHeader},
+				"bearer":     map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"adminToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// ValidateOrder はPOST /ordersと同じ確認を注文を作らずに行います
+// 受け付けられない注文も200で返し、validをfalseにして理由をerror_codeとerrorで返します
+func (h *Handler) ValidateOrder(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	c, err := orderCheckFromRequest(r)
+	if err == nil {
+		err = checkTradingHalt(h.dbFor(r))
+	}
+	if err == nil {
+		err = model.CheckOrder(h.dbFor(r), user.ID, c)
+	}
+	switch {
+	case err == nil:
+		h.handleSuccess(w, map[string]interface{}{
+			"valid": true,
+			"order": c,
+		})
+	case err == model.ErrParameterInvalid || err == model.ErrCreditInsufficient || err == model.ErrIsuInsufficient || err == model.ErrMarketOrderUnfilled || err == model.ErrPriceOutOfBand || err == model.ErrTradingHalted || err == model.ErrCircuitBreaker || err == model.ErrAuctionMode:
+		h.handleSuccess(w, map[string]interface{}{
+			"valid":      false,
+			"order":      c,
+			"error_code": errorCode(err, 400),
+			"error":      err.Error(),
+		})
+	case model.IsBankUnavailable(err):
+		h.handleBankUnavailable(w, err)
+	default:
+		h.handleError(w, err, 500)
+	}
+}
+
+// checkTradingHalt はtradingHaltedと同じく取引を停止中の場合にエラーを返します
+func checkTradingHalt(d model.QueryExecutor) error {
+	t, err := model.GetTradingHalt(d)
+	switch {
+	case err != nil:
+		return err
+	case t.Halted:
+		return model.ErrTradingHalted
+	case time.Now().Before(t.Until):
+		return model.ErrCircuitBreaker
+	}
+	return nil
+}
+
+// orderCheckFromRequest はPOST /ordersのパラメータを読みます
+// 数値として読めないパラメータは0にするのでCheckOrderで不正になります
+func orderCheckFromRequest(r *http.Request) (*model.OrderCheck, error) {
+	c := &model.OrderCheck{
+		Type:        r.FormValue("type"),
+		OrderType:   r.FormValue("order_type"),
+		TimeInForce: r.FormValue("time_in_force"),
+	}
+	c.Amount, _ = strconv.ParseInt(r.FormValue("amount"), 10, 64)
+	c.Price, _ = strconv.ParseInt(r.FormValue("price"), 10, 64)
+	c.TriggerPrice, _ = strconv.ParseInt(r.FormValue("trigger_price"), 10, 64)
+	if s := r.FormValue("display_amount"); s != "" {
+		// 指定した場合は1以上でなければアイスバーグ注文として受け付けない
+		if c.DisplayAmount, _ = strconv.ParseInt(s, 10, 64); c.DisplayAmount <= 0 {
+			return c, model.ErrParameterInvalid
+		}
+	}
+	if s := r.FormValue("expires_at"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return c, model.ErrParameterInvalid
+		}
+		c.ExpiresAt = &t
+	}
+	return c, nil
+}
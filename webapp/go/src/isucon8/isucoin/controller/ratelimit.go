@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// RateLimitReload は設定を読み直す間隔です
+	RateLimitReload = 1 * time.Second
+	// rateLimitIdle より長く使われていないバケットは満杯なので捨てます
+	rateLimitIdle = 1 * time.Minute
+)
+
+var ErrRateLimited = errors.New("リクエストが多すぎます。しばらくしてから再度お試しください")
+
+// rateLimitRoutes はレート制限の対象のルートと設定です
+var rateLimitRoutes = map[string]string{
+	"POST /orders":       model.RateLimitOrders,
+	"POST /v2/orders":    model.RateLimitOrders,
+	"POST /orders/batch": model.RateLimitOrders,
+	"GET /info":          model.RateLimitInfo,
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter はユーザーごと (未ログインの場合はIPアドレスごと) のトークンバケットです
+type rateLimiter struct {
+	sync.Mutex
+	loadedAt time.Time
+	limits   map[string]*model.RateLimit
+	buckets  map[string]*tokenBucket
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+// allow はkeyのリクエストを受け付ける場合にtrueを返します
+// 受け付けない場合は次のトークンが溜まるまでの時間を返します
+func (rl *rateLimiter) allow(now time.Time, setting, key string, l *model.RateLimit) (bool, time.Duration) {
+	b, ok := rl.buckets[setting+" "+key]
+	if !ok {
+		b = &tokenBucket{tokens: l.Burst, last: now}
+		rl.buckets[setting+" "+key] = b
+	}
+	b.tokens = math.Min(l.Burst, b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// reload は設定を読み直し、使われていないバケットを捨てます
+func (rl *rateLimiter) reload(h *Handler, now time.Time) {
+	rl.loadedAt = now
+	limits, err := model.GetRateLimits(h.db, model.RateLimitOrders, model.RateLimitInfo)
+	if err != nil {
+		// 読めなかった場合は前の設定を使い続ける
+		log.Printf("[WARN] load rate limits failed. err:%s", err)
+		return
+	}
+	rl.limits = limits
+	for k, b := range rl.buckets {
+		if now.Sub(b.last) > rateLimitIdle {
+			delete(rl.buckets, k)
+		}
+	}
+}
+
+// rateLimited はレート制限を超えたリクエストに429を返してtrueを返します
+func (h *Handler) rateLimited(w http.ResponseWriter, r *http.Request, route string) bool {
+	setting, ok := rateLimitRoutes[route]
+	if !ok {
+		return false
+	}
+	rl := h.limiter
+	now := time.Now()
+	rl.Lock()
+	if now.Sub(rl.loadedAt) > RateLimitReload {
+		rl.reload(h, now)
+	}
+	l, ok := rl.limits[setting]
+	if !ok {
+		rl.Unlock()
+		return false
+	}
+	var key string
+	if userID, ok := h.sessionUserID(r); ok {
+		key = "user:" + strconv.FormatInt(userID, 10)
+	} else {
+		key = "ip:" + remoteIP(r)
+	}
+	allowed, wait := rl.allow(now, setting, key, l)
+	rl.Unlock()
+	if allowed {
+		return false
+	}
+	retry := int64(math.Ceil(wait.Seconds()))
+	if retry < 1 {
+		retry = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+	h.handleError(w, ErrRateLimited, http.StatusTooManyRequests)
+	return true
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
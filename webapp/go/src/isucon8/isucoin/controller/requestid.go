@@ -0,0 +1,72 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"isucon8/isucoin/model"
+
+	gctx "github.com/gorilla/context"
+)
+
+// RequestIDHeader はリクエストIDのヘッダです
+// レスポンスと、リクエストの中で呼んだ銀行APIとISULOGのリクエストに付けます
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength より長いX-Request-IDは使わずに作り直します
+const maxRequestIDLength = 64
+
+// setRequestID はリクエストIDを決めてレスポンスのヘッダとgctxに設定します
+// nginxなどが付けたX-Request-IDがあればそれを使うので、フロントのログと突き合わせられます
+func setRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(RequestIDHeader, id)
+	gctx.Set(r, requestIDKey, id)
+
+	// アクセスログを出さない場合もトランザクションの中で呼んだ銀行APIとISULOGにIDを送れるようにする
+	t := upstreamTrace(r)
+	if t == nil {
+		t = &model.UpstreamTrace{}
+		gctx.Set(r, upstreamTraceKey, t)
+	}
+	t.SetRequestID(id)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// validRequestID はヘッダやログに書いても問題ない文字だけのIDの場合にtrueを返します
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func requestID(r *http.Request) string {
+	id, _ := gctx.Get(r, requestIDKey).(string)
+	return id
+}
+
+// responseRequestID はsetRequestIDでレスポンスに設定したリクエストIDを返します (エラーのレスポンスに入れるため)
+func responseRequestID(w http.ResponseWriter) string {
+	return w.Header().Get(RequestIDHeader)
+}
@@ -0,0 +1,136 @@
+package controller
+
+import (
+	"crypto/tls"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ServerConfig はappサーバーの待ち受けの設定です
+type ServerConfig struct {
+	Addr string
+	// CertFile, KeyFile を指定するとTLSを終端し、HTTP/2 (h2) でも受け付けます
+	CertFile string
+	KeyFile  string
+	// H2C を有効にすると平文のHTTP/2 (h2c) でも受け付けます
+	H2C bool
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	// WriteTimeout はレスポンス全体の書き込みの期限なので、/stream を使う場合は0にしてください
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+}
+
+// DefaultServerConfig はタイムアウトのデフォルトです
+// /streamと/wsは長時間の接続になるのでWriteTimeoutは設定しません (/wsはUpgradeで期限を解除します)
+var DefaultServerConfig = ServerConfig{
+	ReadHeaderTimeout: 5 * time.Second,
+	ReadTimeout:       30 * time.Second,
+	IdleTimeout:       120 * time.Second,
+}
+
+// TLS はTLSを終端する場合にtrueです
+func (c ServerConfig) TLS() bool {
+	return c.CertFile != ""
+}
+
+// NewServer はhandlerを設定に従って待ち受けるhttp.Serverを返します
+func NewServer(c ServerConfig, handler http.Handler) (*http.Server, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("cert file and key file must be set together")
+	}
+	handler = negotiateVersion(handler)
+	s := &http.Server{
+		Addr:              c.Addr,
+		Handler:           handler,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+	}
+	if c.TLS() {
+		s.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"h2", "http/1.1"},
+		}
+	}
+	h2 := &http2.Server{IdleTimeout: c.IdleTimeout}
+	if err := http2.ConfigureServer(s, h2); err != nil {
+		return nil, errors.Wrap(err, "configure http2 failed")
+	}
+	if c.H2C && !c.TLS() {
+		// h2cの接続はhijackして処理されるので、Shutdownでは終了を待ちません
+		s.Handler = h2c.NewHandler(handler, h2)
+	}
+	return s, nil
+}
+
+// APIVersionHeader でAPIのバージョンを指定できます
+// Acceptヘッダの application/vnd.isucoin.v2+json でも指定でき、指定しない場合は旧API (1) になります
+const APIVersionHeader = "X-API-Version"
+
+const apiVersionMediaPrefix = "application/vnd.isucoin.v"
+
+// versionedPaths は/v2 のAPIがある旧APIのパスです
+var versionedPaths = map[string]string{
+	"/ticker":    "/v2/ticker",
+	"/orderbook": "/v2/orderbook",
+	"/trades":    "/v2/trades",
+	"/chart":     "/v2/candles",
+}
+
+// requestedVersion はリクエストで指定されたAPIのバージョンで、指定が無い場合は空です
+func requestedVersion(r *http.Request) string {
+	if v := r.Header.Get(APIVersionHeader); v != "" {
+		return strings.TrimSpace(v)
+	}
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if err != nil || !strings.HasPrefix(mt, apiVersionMediaPrefix) {
+			continue
+		}
+		return strings.TrimSuffix(strings.TrimPrefix(mt, apiVersionMediaPrefix), "+json")
+	}
+	return ""
+}
+
+// negotiateVersion はバージョン2を指定したリクエストを旧APIのパスから/v2 のパスに振り替えます
+// 旧APIのクライアント (ベンチマーカー) はバージョンを指定しないので、これまでどおり旧APIが返ります
+func negotiateVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requestedVersion(r) {
+		case "", "1":
+		case "2":
+			if p, ok := versionedPaths[r.URL.Path]; ok {
+				u := *r.URL
+				u.Path = p
+				r2 := new(http.Request)
+				*r2 = *r
+				r2.URL = &u
+				r = r2
+			}
+		default:
+			writeV2Error(w, http.StatusNotAcceptable, v2ErrUnsupportedVersion, "supported api versions are 1 and 2")
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/v2/") {
+			w.Header().Set(APIVersionHeader, "2")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ListenAndServe はNewServerで作ったサーバーを待ち受けます。Shutdownした場合はhttp.ErrServerClosedを返します
+func ListenAndServe(s *http.Server, c ServerConfig) error {
+	if c.TLS() {
+		return s.ListenAndServeTLS(c.CertFile, c.KeyFile)
+	}
+	return s.ListenAndServe()
+}
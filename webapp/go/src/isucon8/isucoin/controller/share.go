@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// ShareMaxAge はシェアされたページをキャッシュしてよい秒数です。成立したトレードは変わらないので長めにします
+const ShareMaxAge = 300
+
+// shareTemplate はいすばたSNSでシェアしたときに表示するOGPのページです
+var shareTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="ja">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<meta property="og:type" content="website">
+<meta property="og:site_name" content="ISUCOIN">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+<meta property="og:url" content="{{.URL}}">
+<meta property="og:image" content="{{.Image}}">
+<meta name="twitter:card" content="summary">
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Description}}</p>
+<p>{{.CreatedAt.Format "2006-01-02 15:04:05"}}</p>
+<p><a href="/">ISUCOINで取引する</a></p>
+</body>
+</html>
+`))
+
+type sharePage struct {
+	Title       string
+	Description string
+	URL         string
+	Image       string
+	CreatedAt   time.Time
+}
+
+// baseURL はリクエストを受けたホストのURLです。TLSを終端するプロキシの後ろではX-Forwarded-Protoを見ます
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// SharedTrade はシェアされたトレードのページ (/trade/{id}.html) を返します
+// シェアが無効の場合は404を返します
+func (h *Handler) SharedTrade(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	file := p.ByName("file")
+	id, err := strconv.ParseInt(strings.TrimSuffix(file, ".html"), 10, 64)
+	if err != nil || !strings.HasSuffix(file, ".html") {
+		http.NotFound(w, r)
+		return
+	}
+	if enabled, err := model.ShareEnabled(h.db); err != nil {
+		h.handleError(w, err, 500)
+		return
+	} else if !enabled {
+		http.NotFound(w, r)
+		return
+	}
+	trade, err := model.GetTradeByID(h.dbFor(r), id)
+	switch {
+	case err == sql.ErrNoRows:
+		http.NotFound(w, r)
+		return
+	case err != nil:
+		h.handleError(w, errors.Wrap(err, "model.GetTradeByID"), 500)
+		return
+	}
+	userID, _ := h.sessionUserID(r)
+	model.LogShareView(h.db, trade, userID, r.Referer())
+
+	base := baseURL(r)
+	page := &sharePage{
+		Title:       "ISUCOIN 取引 #" + strconv.FormatInt(trade.ID, 10),
+		Description: "空気椅子 " + strconv.FormatInt(trade.Amount, 10) + "脚が " + strconv.FormatInt(trade.Price, 10) + " ISUCOIN で取引されました",
+		URL:         base + model.SharePath(trade.ID),
+		Image:       base + "/img/isucoin_logo.png",
+		CreatedAt:   trade.CreatedAt,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(ShareMaxAge))
+	if err := shareTemplate.Execute(w, page); err != nil {
+		log.Printf("[WARN] write share page failed. %s", err)
+	}
+}
@@ -0,0 +1,173 @@
+package controller
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ImmutableCacheControl はファイル名にハッシュを含むファイルのキャッシュの指定です (内容が変わるとファイル名も変わる)
+	ImmutableCacheControl = "public, max-age=31536000, immutable"
+	// RevalidateCacheControl はそれ以外のファイルの指定で、毎回ETagで確認させます
+	RevalidateCacheControl = "no-cache"
+)
+
+// hashedAssetName は app.2be81752.js のようにビルド時のハッシュを含むファイル名です
+var hashedAssetName = regexp.MustCompile(`\.[0-9a-f]{8,}\.[a-z0-9]+$`)
+
+// compressibleTypes はgzipで圧縮するContent-Typeです (画像などは圧縮済みなので除く)
+var compressibleTypes = []string{"text/", "application/javascript", "application/json", "image/svg+xml"}
+
+// asset は起動時に読み込んだ公開ファイルです
+type asset struct {
+	body         []byte
+	gzip         []byte // 圧縮しても小さくならない場合はnil
+	br           []byte // ビルド時に作った .br のファイルがある場合だけ
+	etag         string
+	contentType  string
+	cacheControl string
+	modTime      time.Time
+}
+
+// AssetHandler はpublicのファイルを圧縮済みのデータとETag, Cache-Controlを付けて返します
+// ファイルは起動時にすべて読み込むので、起動後に追加・変更したファイルは返しません
+type AssetHandler struct {
+	assets map[string]*asset
+}
+
+// NewAssetHandler はdirのファイルを読み込んで圧縮します
+func NewAssetHandler(dir string) (*AssetHandler, error) {
+	return NewAssetHandlerFS(os.DirFS(dir))
+}
+
+// NewAssetHandlerFS はfsysのファイルを読み込んで圧縮します (バイナリに埋め込んだファイルなど)
+// 名前が . で始まるファイルは返しません
+func NewAssetHandlerFS(fsys fs.FS) (*AssetHandler, error) {
+	h := &AssetHandler{assets: map[string]*asset{}}
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") || strings.HasSuffix(p, ".br") || strings.HasSuffix(p, ".gz") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		a, err := loadAsset(fsys, p, info)
+		if err != nil {
+			return errors.Wrapf(err, "load asset failed. %s", p)
+		}
+		h.assets["/"+p] = a
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func loadAsset(fsys fs.FS, p string, info fs.FileInfo) (*asset, error) {
+	body, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	ctype := mime.TypeByExtension(path.Ext(p))
+	if ctype == "" {
+		ctype = http.DetectContentType(body)
+	}
+	sum := sha256.Sum256(body)
+	a := &asset{
+		body:         body,
+		etag:         `"` + hex.EncodeToString(sum[:16]) + `"`,
+		contentType:  ctype,
+		cacheControl: RevalidateCacheControl,
+		modTime:      info.ModTime(),
+	}
+	if hashedAssetName.MatchString(path.Base(p)) {
+		a.cacheControl = ImmutableCacheControl
+	}
+	for _, t := range compressibleTypes {
+		if strings.HasPrefix(ctype, t) {
+			var buf bytes.Buffer
+			zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+			if _, err := zw.Write(body); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			if buf.Len() < len(body) {
+				a.gzip = buf.Bytes()
+			}
+			break
+		}
+	}
+	if br, err := fs.ReadFile(fsys, p+".br"); err == nil {
+		a.br = br
+	}
+	return a, nil
+}
+
+// acceptsEncoding はAccept-Encodingにencが含まれているかを返します (q=0 は受け付けない)
+func acceptsEncoding(r *http.Request, enc string) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		v = strings.TrimSpace(v)
+		name, params := v, ""
+		if i := strings.IndexByte(v, ';'); i >= 0 {
+			name, params = strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:])
+		}
+		if name == enc || name == "*" {
+			return params != "q=0" && params != "q=0.0"
+		}
+	}
+	return false
+}
+
+func (h *AssetHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.NotFound(w, r)
+		return
+	}
+	name := path.Clean("/" + r.URL.Path)
+	if strings.HasSuffix(name, "/") {
+		name += "index.html"
+	}
+	a, ok := h.assets[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	header := w.Header()
+	header.Set("Content-Type", a.contentType)
+	header.Set("Cache-Control", a.cacheControl)
+	body, etag := a.body, a.etag
+	if a.gzip != nil || a.br != nil {
+		header.Set("Vary", "Accept-Encoding")
+	}
+	// 圧縮したデータは別の表現なので、ETagとRangeも圧縮したデータに対して扱う
+	switch {
+	case a.br != nil && acceptsEncoding(r, "br"):
+		header.Set("Content-Encoding", "br")
+		body, etag = a.br, strings.TrimSuffix(etag, `"`)+`-br"`
+	case a.gzip != nil && acceptsEncoding(r, "gzip"):
+		header.Set("Content-Encoding", "gzip")
+		body, etag = a.gzip, strings.TrimSuffix(etag, `"`)+`-gzip"`
+	}
+	header.Set("ETag", etag)
+	// ServeContentがIf-None-Match, If-Range, Rangeを処理する
+	http.ServeContent(w, r, name, a.modTime, bytes.NewReader(body))
+}
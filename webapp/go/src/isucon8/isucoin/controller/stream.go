@@ -0,0 +1,198 @@
+package controller
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StreamPollInterval は他のappサーバーで成立したトレードを拾うためのポーリング間隔です
+	StreamPollInterval = 1 * time.Second
+	// StreamHeartbeatInterval は接続維持のためにコメントを送る間隔です
+	StreamHeartbeatInterval = 15 * time.Second
+	// StreamTradesLimit は1回のイベントで送るトレードの最大数です
+	StreamTradesLimit = 100
+)
+
+// Stream はServer-Sent Eventsで新しいトレードとチャートの差分、ログインユーザーの成立した注文と発動した価格アラートを送ります
+// ?cursor= またはLast-Event-IDヘッダで指定したトレード以降から再開できます (価格アラートは接続してから発動したものだけを送ります)
+func (h *Handler) Stream(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.handleError(w, errors.New("streaming unsupported"), 500)
+		return
+	}
+	cursor, _ := strconv.ParseInt(r.URL.Query().Get("cursor"), 10, 64)
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		cursor, _ = strconv.ParseInt(id, 10, 64)
+	}
+	if cursor <= 0 {
+		// cursorがない場合は過去分は送らずに最新のトレードから始める
+		latestTrade, err := model.GetLatestTrade(h.db)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			h.handleError(w, errors.Wrap(err, "GetLatestTrade failed"), 500)
+			return
+		default:
+			cursor = latestTrade.ID
+		}
+	}
+	user, _ := h.userByRequest(w, r)
+	alertsSince := time.Now()
+
+	sub, unsubscribe := model.SubscribeTrade()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	poll := time.NewTicker(StreamPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(StreamHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-h.closing:
+			// クライアントはLast-Event-IDで他のappサーバーに繋ぎ直せる
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+			continue
+		case <-sub:
+		case <-poll.C:
+		}
+		next, err := h.pushStreamEvents(w, user, cursor)
+		if err != nil {
+			h.writeStreamEvent(w, "error", 0, map[string]interface{}{
+				"err": err.Error(),
+			})
+			flusher.Flush()
+			return
+		}
+		if next != cursor {
+			cursor = next
+			flusher.Flush()
+		}
+		if user != nil {
+			// アラートはトレードの後に他のappサーバーで発動することもあるので、トレードとは別にDBから拾う
+			since, err := h.pushStreamAlerts(w, user, alertsSince)
+			if err != nil {
+				h.writeStreamEvent(w, "error", 0, map[string]interface{}{
+					"err": err.Error(),
+				})
+				flusher.Flush()
+				return
+			}
+			if !since.Equal(alertsSince) {
+				alertsSince = since
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func (h *Handler) pushStreamEvents(w http.ResponseWriter, user *model.User, cursor int64) (int64, error) {
+	trades, err := model.GetTradesByLastID(h.cluster.Replica(), cursor, StreamTradesLimit)
+	if err != nil {
+		return cursor, errors.Wrap(err, "GetTradesByLastID failed")
+	}
+	if len(trades) == 0 {
+		return cursor, nil
+	}
+	next := trades[len(trades)-1].ID
+	if err = h.writeStreamEvent(w, "trades", next, trades); err != nil {
+		return cursor, err
+	}
+
+	lt := trades[0].CreatedAt
+	charts := make(map[string]interface{}, 3)
+	for _, c := range []struct {
+		key  string
+		from time.Time
+		tf   string
+	}{
+		{"chart_by_sec", lt.Truncate(time.Second), model.CandlestickBySec},
+		{"chart_by_min", time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), lt.Minute(), 0, 0, lt.Location()), model.CandlestickByMin},
+		{"chart_by_hour", time.Date(lt.Year(), lt.Month(), lt.Day(), lt.Hour(), 0, 0, 0, lt.Location()), model.CandlestickByHour},
+	} {
+		if charts[c.key], err = model.GetCandlestickData(h.cluster.Replica(), c.from, c.tf); err != nil {
+			return cursor, errors.Wrapf(err, "model.GetCandlestickData %s", c.key)
+		}
+	}
+	if err = h.writeStreamEvent(w, "chart", next, charts); err != nil {
+		return cursor, err
+	}
+	stats, err := model.GetMarketSummary(h.db)
+	if err != nil {
+		return cursor, errors.Wrap(err, "model.GetMarketSummary")
+	}
+	if err = h.writeStreamEvent(w, "stats", next, stats); err != nil {
+		return cursor, err
+	}
+
+	if user != nil {
+		orders, err := model.GetTradedOrders(h.db, user, cursor)
+		if err != nil {
+			return cursor, errors.Wrap(err, "GetTradedOrders failed")
+		}
+		traded := make([]*model.Order, 0, len(orders))
+		for _, order := range orders {
+			if order.TradeID > next {
+				// 次のイベントで送る
+				continue
+			}
+			traded = append(traded, order)
+		}
+		if len(traded) > 0 {
+			if err = h.writeStreamEvent(w, "traded_orders", next, traded); err != nil {
+				return cursor, err
+			}
+		}
+	}
+	return next, nil
+}
+
+// pushStreamAlerts はsinceより後に発動したユーザーの価格アラートを送り、送った最後のアラートの発動時刻を返します
+func (h *Handler) pushStreamAlerts(w http.ResponseWriter, user *model.User, since time.Time) (time.Time, error) {
+	alerts, err := model.GetTriggeredAlerts(h.db, user.ID, since)
+	if err != nil {
+		return since, errors.Wrap(err, "model.GetTriggeredAlerts")
+	}
+	if len(alerts) == 0 {
+		return since, nil
+	}
+	if err = h.writeStreamEvent(w, "alerts", 0, alerts); err != nil {
+		return since, err
+	}
+	return *alerts[len(alerts)-1].TriggeredAt, nil
+}
+
+func (h *Handler) writeStreamEvent(w http.ResponseWriter, event string, id int64, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "marshal stream event failed")
+	}
+	if id > 0 {
+		_, err = fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", event, id, b)
+	} else {
+		_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// ErrRequestTimeout はルートのタイムアウトまでに処理が終わらなかった場合のエラーです
+var ErrRequestTimeout = errors.New("処理がタイムアウトしました。しばらくしてから再度お試しください")
+
+// slowQueryTextLimit より長いクエリは遅いリクエストのログで切り詰めます
+const slowQueryTextLimit = 200
+
+// longRunningRoutes は接続している間ずっと続くので、遅いリクエストのログに出力しないルートです
+var longRunningRoutes = map[string]bool{
+	"GET /stream":        true,
+	"GET /ws":            true,
+	"GET /orders/export": true,
+}
+
+// ParseRouteTimeouts は "GET /info=2000,POST /orders=5000" 形式 (ミリ秒) の文字列をパースします
+func ParseRouteTimeouts(s string) (map[string]time.Duration, error) {
+	values, err := parseRouteValues(s, "route timeout")
+	if err != nil {
+		return nil, err
+	}
+	timeouts := make(map[string]time.Duration, len(values))
+	for k, ms := range values {
+		timeouts[k] = time.Duration(ms) * time.Millisecond
+	}
+	return timeouts, nil
+}
+
+// SetRouteTimeouts はルートごとのタイムアウトを設定します
+// keyはSetConcurrencyLimitsと同じく "METHOD /path" の形式です
+func (h *Handler) SetRouteTimeouts(timeouts map[string]time.Duration) {
+	h.timeouts = make(map[string]time.Duration, len(timeouts))
+	for k, d := range timeouts {
+		if d > 0 {
+			h.timeouts[k] = d
+		}
+	}
+}
+
+// SetSlowRequestLog はthreshold以上かかったリクエストを実行したクエリと一緒にログに出力するようにします (0の場合は出力しません)
+func (h *Handler) SetSlowRequestLog(threshold time.Duration) {
+	h.slow = threshold
+}
+
+// Timeout はタイムアウトが設定されているルートのctxに期限を付けます
+// 期限を過ぎると実行中のクエリを中断してトランザクションをロールバックし、500番台のエラーは503 (REQUEST_TIMEOUT) で返します
+// 銀行APIの呼び出しなどctxを見ない処理は中断しないので、期限を過ぎても処理が終わった場合はそのまま返します
+func (h *Handler) Timeout(method, path string, f httprouter.Handle) httprouter.Handle {
+	timeout := h.timeouts[method+" "+path]
+	slow := h.slow
+	if longRunningRoutes[method+" "+path] {
+		slow = 0
+	}
+	if timeout <= 0 && slow <= 0 {
+		return f
+	}
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		start := time.Now()
+		parent := r.Context()
+		ctx := parent
+		var trace *model.QueryTrace
+		if slow > 0 {
+			trace = &model.QueryTrace{}
+			ctx = model.WithQueryTrace(ctx, trace)
+		}
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+			if aw, ok := w.(*accessLogWriter); ok {
+				aw.deadline = ctx
+			}
+		}
+		// gctxはリクエストのポインタごとに値を持つので、WithContextで作ったリクエストを渡さずにctxだけ差し替える
+		*r = *r.WithContext(ctx)
+		defer func() { *r = *r.WithContext(parent) }()
+		f(w, r, p)
+
+		if elapsed := time.Since(start); trace != nil && elapsed >= slow {
+			logSlowRequest(r, method, path, elapsed, trace)
+		}
+	}
+}
+
+// timedOut はルートのタイムアウトを過ぎた後に500番台のエラーを返そうとしている場合にtrueを返します
+// 中断したクエリのエラーはcontext.DeadlineExceededなどになるので、タイムアウトとして返し直します
+func timedOut(w http.ResponseWriter, status int) bool {
+	aw, ok := w.(*accessLogWriter)
+	return ok && aw.deadline != nil && status >= 500 && aw.deadline.Err() == context.DeadlineExceeded
+}
+
+// logSlowRequest は遅いリクエストとそのクエリを1つのログにまとめて出力します
+func logSlowRequest(r *http.Request, method, path string, elapsed time.Duration, trace *model.QueryTrace) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[WARN] slow request. method:%s route:%s reqtime:%.6f request_id:%s queries:%d sql_time:%.6f",
+		method, path, elapsed.Seconds(), requestID(r), trace.Count(), trace.Total().Seconds())
+	queries := trace.Queries()
+	for _, q := range queries {
+		text := strings.Join(strings.Fields(q.Query), " ")
+		if len(text) > slowQueryTextLimit {
+			text = text[:slowQueryTextLimit] + "..."
+		}
+		fmt.Fprintf(&b, "\n\t%.6f %s", q.Duration.Seconds(), text)
+	}
+	if n := trace.Count() - len(queries); n > 0 {
+		fmt.Fprintf(&b, "\n\t... %d more queries", n)
+	}
+	log.Print(b.String())
+}
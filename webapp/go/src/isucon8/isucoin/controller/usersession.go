@@ -0,0 +1,76 @@
+package controller
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// Sessions はログイン中の端末の一覧を返します。このリクエストのセッションはcurrentがtrueです
+func (h *Handler) Sessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	sessions, err := model.GetUserSessions(h.dbFor(r), user.ID, h.sessionToken(r))
+	if err != nil {
+		h.handleError(w, errors.Wrap(err, "model.GetUserSessions"), 500)
+		return
+	}
+	h.handleSuccess(w, sessions)
+}
+
+// RevokeSession は端末のセッションを無効にします。このリクエストのセッションの場合はログアウトします
+func (h *Handler) RevokeSession(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
+	err = h.txScope(r, func(tx *sql.Tx) error {
+		return model.RevokeUserSession(tx, user.ID, id)
+	})
+	switch {
+	case err == model.ErrSessionNotFound:
+		h.handleError(w, err, 404)
+		return
+	case err != nil:
+		h.handleError(w, err, 500)
+		return
+	}
+	model.ForgetUserSessions(user.ID)
+	// 無効にしたのがこの端末かどうかは無効にした後で確認する
+	if token := h.sessionToken(r); token != "" {
+		if valid, err := model.CheckUserSession(h.dbFor(r), user.ID, token); err == nil && !valid {
+			if err = h.clearSession(w, r); err != nil {
+				h.handleError(w, err, 500)
+				return
+			}
+		}
+	}
+	h.handleSuccess(w, map[string]interface{}{
+		"id": id,
+	})
+}
+
+// RevokeSessions はすべての端末をログアウトさせます
+// session_versionも上げるのでJWTと記録する前のセッションも無効になり、このリクエストのセッションだけを保存し直します
+func (h *Handler) RevokeSessions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	err = h.userTxScope(r, user.ID, func(tx *sql.Tx) (err error) {
+		user, err = model.RevokeUserSessions(tx, user.ID)
+		return
+	})
+	h.credentialsChanged(w, r, user, err)
+}
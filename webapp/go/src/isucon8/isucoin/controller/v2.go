@@ -0,0 +1,272 @@
+package controller
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// /v2 のマーケットデータAPIです
+// 旧APIはベンチマーカーが使うのでそのまま残し、/v2 ではフィールド名を固定したレスポンス用の型を使います (modelのjsonタグを変えても変わりません)
+
+// v2のエラーのcodeです
+const (
+	v2ErrInvalidParameter   = "invalid_parameter"
+	v2ErrInternal           = "internal_error"
+	v2ErrUnsupportedVersion = "unsupported_version"
+	v2ErrTimeout            = "timeout"
+)
+
+// v2Error はv2のエラーのレスポンスです
+type v2Error struct {
+	Error v2ErrorBody `json:"error"`
+}
+
+type v2ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Details はパラメータの検証で見つかったエラーです
+	Details []paramError `json:"details,omitempty"`
+	// RequestID はX-Request-IDヘッダと同じ値です
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// v2Data は1件のレスポンスです
+type v2Data struct {
+	Data interface{} `json:"data"`
+}
+
+// v2Page は一覧のレスポンスです。NextCursorを次のリクエストのcursorに渡すと続きを返します
+type v2Page struct {
+	Data       interface{}  `json:"data"`
+	Pagination v2Pagination `json:"pagination"`
+}
+
+type v2Pagination struct {
+	Limit      int     `json:"limit"`
+	HasMore    bool    `json:"has_more"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+type v2Ticker struct {
+	LastPrice *int64 `json:"last_price"`
+	BestAsk   *int64 `json:"best_ask"`
+	BestBid   *int64 `json:"best_bid"`
+	Volume24h int64  `json:"volume_24h"`
+	Change24h int64  `json:"change_24h"`
+	Open24h   *int64 `json:"open_24h"`
+	High24h   *int64 `json:"high_24h"`
+	Low24h    *int64 `json:"low_24h"`
+	Trades24h int64  `json:"trades_24h"`
+}
+
+type v2PriceLevel struct {
+	Price            int64 `json:"price"`
+	Amount           int64 `json:"amount"`
+	CumulativeAmount int64 `json:"cumulative_amount"`
+}
+
+type v2OrderBook struct {
+	Asks []v2PriceLevel `json:"asks"`
+	Bids []v2PriceLevel `json:"bids"`
+}
+
+type v2Trade struct {
+	ID        int64     `json:"id"`
+	Price     int64     `json:"price"`
+	Amount    int64     `json:"amount"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type v2Candle struct {
+	Time   time.Time `json:"time"`
+	Open   int64     `json:"open"`
+	High   int64     `json:"high"`
+	Low    int64     `json:"low"`
+	Close  int64     `json:"close"`
+	Volume int64     `json:"volume"`
+	VWAP   float64   `json:"vwap"`
+}
+
+func (h *Handler) handleErrorV2(w http.ResponseWriter, status int, code string, err error) {
+	if timedOut(w, status) {
+		status, code, err = http.StatusServiceUnavailable, v2ErrTimeout, errors.Wrap(ErrRequestTimeout, err.Error())
+	}
+	if aw, ok := w.(*accessLogWriter); ok && aw.logged {
+		aw.err = err
+	} else {
+		log.Printf("[WARN] err: %s", err.Error())
+	}
+	writeV2Error(w, status, code, err.Error())
+}
+
+func writeV2Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if werr := writeJSON(w, status, v2Error{v2ErrorBody{Code: code, Message: message, RequestID: responseRequestID(w)}}); werr != nil {
+		log.Printf("[WARN] write error response json failed. %s", werr)
+	}
+}
+
+// v2Int はクエリの正の整数を返します。指定が無い場合はdefを返します
+func v2Int(r *http.Request, key string, def int64) (int64, error) {
+	s := r.URL.Query().Get(key)
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, errors.Errorf("%s must be positive integer", key)
+	}
+	return v, nil
+}
+
+func optionalInt64(v int64) *int64 {
+	if v == 0 {
+		return nil
+	}
+	return &v
+}
+
+// TickerV2 は最新の価格と直近24時間の集計を返します
+func (h *Handler) TickerV2(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	t, err := model.GetTicker(h.db)
+	if err != nil {
+		h.handleErrorV2(w, 500, v2ErrInternal, errors.Wrap(err, "model.GetTicker"))
+		return
+	}
+	h.handleSuccess(w, v2Data{v2Ticker{
+		LastPrice: optionalInt64(t.LastPrice),
+		BestAsk:   optionalInt64(t.LowestSellPrice),
+		BestBid:   optionalInt64(t.HighestBuyPrice),
+		Volume24h: t.Volume24h,
+		Change24h: t.Change24h,
+		Open24h:   optionalInt64(t.Open24h),
+		High24h:   optionalInt64(t.High24h),
+		Low24h:    optionalInt64(t.Low24h),
+		Trades24h: t.Trades24h,
+	}})
+}
+
+// OrderBookV2 は価格ごとに集計した板を返します
+func (h *Handler) OrderBookV2(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	depth, err := v2Int(r, "depth", DefaultOrderBookDepth)
+	if err != nil {
+		h.handleErrorV2(w, 400, v2ErrInvalidParameter, err)
+		return
+	}
+	if depth > MaxOrderBookDepth {
+		depth = MaxOrderBookDepth
+	}
+	book, err := model.GetOrderBook(h.dbFor(r), int(depth))
+	if err != nil {
+		h.handleErrorV2(w, 500, v2ErrInternal, errors.Wrap(err, "model.GetOrderBook"))
+		return
+	}
+	levels := func(ls []*model.PriceLevel) []v2PriceLevel {
+		res := make([]v2PriceLevel, 0, len(ls))
+		for _, l := range ls {
+			res = append(res, v2PriceLevel{Price: l.Price, Amount: l.Amount, CumulativeAmount: l.CumulativeAmount})
+		}
+		return res
+	}
+	h.handleSuccess(w, v2Data{v2OrderBook{Asks: levels(book.Sells), Bids: levels(book.Buys)}})
+}
+
+// TradesV2 は新しい順にトレードを返します。cursorを指定した場合はそのidより古いトレードを返します
+func (h *Handler) TradesV2(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	cursor, err := v2Int(r, "cursor", 0)
+	if err != nil {
+		h.handleErrorV2(w, 400, v2ErrInvalidParameter, err)
+		return
+	}
+	limit, err := v2Int(r, "limit", DefaultTradesLimit)
+	if err != nil {
+		h.handleErrorV2(w, 400, v2ErrInvalidParameter, err)
+		return
+	}
+	if limit > MaxTradesLimit {
+		limit = MaxTradesLimit
+	}
+	// 続きがあるかを知るために1件多く読む
+	trades, err := model.GetTradesPage(h.dbFor(r), cursor, int(limit)+1)
+	if err != nil {
+		h.handleErrorV2(w, 500, v2ErrInternal, errors.Wrap(err, "model.GetTradesPage"))
+		return
+	}
+	page := v2Pagination{Limit: int(limit)}
+	if len(trades) > int(limit) {
+		trades = trades[:limit]
+		next := strconv.FormatInt(trades[len(trades)-1].ID, 10)
+		page.HasMore, page.NextCursor = true, &next
+	}
+	data := make([]v2Trade, 0, len(trades))
+	for _, t := range trades {
+		data = append(data, v2Trade{ID: t.ID, Price: t.Price, Amount: t.Amount, CreatedAt: t.CreatedAt})
+	}
+	h.handleSuccess(w, v2Page{Data: data, Pagination: page})
+}
+
+// CandlesV2 はresolutionの足を古い順に返します
+// cursor (unix時間) から limit本分の期間を返し、現在まで達していなければnext_cursorに次の期間の始まりを返します
+func (h *Handler) CandlesV2(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	resolution := r.URL.Query().Get("resolution")
+	if resolution == "" {
+		resolution = "1m"
+	}
+	step := model.CandlestickStep(resolution)
+	if step == 0 {
+		h.handleErrorV2(w, 400, v2ErrInvalidParameter, errors.New("resolution must be one of 1s, 1m, 5m, 1h"))
+		return
+	}
+	limit, err := v2Int(r, "limit", DefaultChartCandles)
+	if err != nil {
+		h.handleErrorV2(w, 400, v2ErrInvalidParameter, err)
+		return
+	}
+	if limit > MaxChartCandles {
+		limit = MaxChartCandles
+	}
+	now := time.Now()
+	span := time.Duration(limit) * step
+	from := now.Add(-span)
+	// GET /chart から切り替えた場合のためにfromも受け付ける
+	key := "cursor"
+	if r.URL.Query().Get(key) == "" {
+		key = "from"
+	}
+	cursor, err := v2Int(r, key, 0)
+	if err != nil {
+		h.handleErrorV2(w, 400, v2ErrInvalidParameter, err)
+		return
+	}
+	if cursor > 0 {
+		from = time.Unix(cursor, 0)
+	}
+	from = from.Truncate(step)
+	if !from.Before(now) {
+		h.handleErrorV2(w, 400, v2ErrInvalidParameter, errors.New("cursor must be in the past"))
+		return
+	}
+	to := from.Add(span)
+	page := v2Pagination{Limit: int(limit)}
+	if to.Before(now) {
+		next := strconv.FormatInt(to.Unix(), 10)
+		page.HasMore, page.NextCursor = true, &next
+	}
+	candles, err := model.GetCandlesticksRange(h.dbFor(r), resolution, from, to)
+	if err != nil {
+		h.handleErrorV2(w, 500, v2ErrInternal, errors.Wrap(err, "model.GetCandlesticksRange"))
+		return
+	}
+	data := make([]v2Candle, 0, len(candles))
+	for _, c := range candles {
+		data = append(data, v2Candle{Time: c.Time, Open: c.Open, High: c.High, Low: c.Low, Close: c.Close, Volume: c.Volume, VWAP: c.VWAP})
+	}
+	h.handleSuccess(w, v2Page{Data: data, Pagination: page})
+}
@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// paramError は不正なパラメータ1つ分のエラーです
+type paramError struct {
+	Name   string `json:"name"`
+	In     string `json:"in"`
+	Reason string `json:"reason"`
+}
+
+// invalidParamsError はValidateで見つかったエラーをまとめたものです
+type invalidParamsError []paramError
+
+func (e invalidParamsError) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, p := range e {
+		msgs = append(msgs, p.Name+" "+p.Reason)
+	}
+	return "invalid parameters: " + strings.Join(msgs, ", ")
+}
+
+// Validate はapiOperationsの定義でパラメータを検証し、不正な場合はハンドラを呼ばずに400を返します
+// 型と必須かどうかだけを見て、値の範囲などの業務的な確認はこれまでどおりハンドラで行います
+func (h *Handler) Validate(method, path string, f httprouter.Handle) httprouter.Handle {
+	op, ok := apiOperationsByRoute[method+" "+path]
+	if !ok || len(op.Params) == 0 {
+		return f
+	}
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		if errs := op.validate(r, p); len(errs) > 0 {
+			h.handleInvalidParams(w, op.V2, errs)
+			return
+		}
+		f(w, r, p)
+	}
+}
+
+func (op *apiOperation) validate(r *http.Request, ps httprouter.Params) invalidParamsError {
+	var errs invalidParamsError
+	for _, p := range op.Params {
+		var v string
+		switch p.In {
+		case "path":
+			v = ps.ByName(p.Name)
+		case "query":
+			v = r.URL.Query().Get(p.Name)
+		case "form":
+			v = r.FormValue(p.Name)
+		}
+		if reason := p.check(v); reason != "" {
+			errs = append(errs, paramError{Name: p.Name, In: p.In, Reason: reason})
+		}
+	}
+	return errs
+}
+
+// check はvが不正な場合に理由を返します。ハンドラと同じく空の値は指定されていないものとして扱います
+func (p apiParam) check(v string) string {
+	if v == "" {
+		if p.Required {
+			return "is required"
+		}
+		return ""
+	}
+	if p.Type == "integer" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "must be an integer"
+		}
+		if p.Minimum != nil && n < *p.Minimum {
+			return fmt.Sprintf("must be greater than or equal to %d", *p.Minimum)
+		}
+	}
+	if p.Format == "date-time" {
+		if _, err := time.Parse(time.RFC3339, v); err != nil {
+			return "must be an RFC3339 date-time"
+		}
+	}
+	if len(p.Enum) > 0 {
+		for _, e := range p.Enum {
+			if v == e {
+				return ""
+			}
+		}
+		return "must be one of " + strings.Join(p.Enum, ", ")
+	}
+	return ""
+}
+
+// handleInvalidParams はhandleError (v2のルートはhandleErrorV2) と同じ形式に、パラメータごとのエラーを付けて400を返します
+func (h *Handler) handleInvalidParams(w http.ResponseWriter, v2 bool, errs invalidParamsError) {
+	if aw, ok := w.(*accessLogWriter); ok && aw.logged {
+		aw.err = errs
+	} else {
+		log.Printf("[WARN] err: %s", errs.Error())
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	var body interface{}
+	if v2 {
+		body = v2Error{v2ErrorBody{Code: v2ErrInvalidParameter, Message: errs.Error(), Details: errs, RequestID: responseRequestID(w)}}
+	} else {
+		body = struct {
+			Code      int          `json:"code"`
+			ErrorCode string       `json:"error_code"`
+			Err       string       `json:"err"`
+			Errors    []paramError `json:"errors"`
+			RequestID string       `json:"request_id,omitempty"`
+		}{400, model.ErrorCodeParameterInvalid, errs.Error(), errs, responseRequestID(w)}
+	}
+	if werr := writeJSON(w, 400, body); werr != nil {
+		log.Printf("[WARN] write error response json failed. %s", werr)
+	}
+}
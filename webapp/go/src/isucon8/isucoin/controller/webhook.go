@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"isucon8/isucoin/model"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+func (h *Handler) Webhooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	hooks, err := model.GetWebhooks(h.dbFor(r), user.ID)
+	if err != nil {
+		h.handleError(w, errors.Wrap(err, "model.GetWebhooks"), 500)
+		return
+	}
+	h.handleSuccess(w, hooks)
+}
+
+// AddWebhook はWebhookを登録します。署名の鍵はこのレスポンスでだけ返します
+func (h *Handler) AddWebhook(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	var wh *model.Webhook
+	err = h.txScope(r, func(tx *sql.Tx) (err error) {
+		wh, err = model.CreateWebhook(tx, user.ID, r.FormValue("url"))
+		return
+	})
+	switch {
+	case err == model.ErrWebhookURLInvalid:
+		h.handleError(w, err, 400)
+	case err == model.ErrWebhookLimit:
+		h.handleError(w, err, 409)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		h.handleSuccess(w, struct {
+			*model.Webhook
+			Secret string `json:"secret"`
+		}{wh, wh.Secret})
+	}
+}
+
+func (h *Handler) DeleteWebhook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	user, err := h.userByRequest(w, r)
+	if err != nil {
+		h.handleError(w, err, 401)
+		return
+	}
+	id, _ := strconv.ParseInt(p.ByName("id"), 10, 64)
+	err = h.txScope(r, func(tx *sql.Tx) error {
+		return model.DeleteWebhook(tx, user.ID, id)
+	})
+	switch {
+	case err == model.ErrWebhookNotFound:
+		h.handleError(w, err, 404)
+	case err != nil:
+		h.handleError(w, err, 500)
+	default:
+		h.handleSuccess(w, map[string]interface{}{
+			"id": id,
+		})
+	}
+}
@@ -0,0 +1,403 @@
+package grpcapi
+
+// isucoin.proto のメッセージです。フィールドの番号はprotoファイルと合わせてください
+
+type TickerRequest struct {
+}
+
+func (*TickerRequest) appendTo(b []byte) []byte {
+	return b
+}
+
+func (m *TickerRequest) readFrom(b []byte) error {
+	*m = TickerRequest{}
+	return readFields(b, func(field) error { return nil })
+}
+
+type Ticker struct {
+	LastPrice int64
+	BestAsk   int64
+	BestBid   int64
+	Volume24h int64
+	Change24h int64
+}
+
+func (m *Ticker) appendTo(b []byte) []byte {
+	b = appendInt(b, 1, m.LastPrice)
+	b = appendInt(b, 2, m.BestAsk)
+	b = appendInt(b, 3, m.BestBid)
+	b = appendInt(b, 4, m.Volume24h)
+	b = appendInt(b, 5, m.Change24h)
+	return b
+}
+
+func (m *Ticker) readFrom(b []byte) error {
+	*m = Ticker{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.LastPrice = f.int()
+		case 2:
+			m.BestAsk = f.int()
+		case 3:
+			m.BestBid = f.int()
+		case 4:
+			m.Volume24h = f.int()
+		case 5:
+			m.Change24h = f.int()
+		}
+		return nil
+	})
+}
+
+type OrderBookRequest struct {
+	Depth int32
+}
+
+func (m *OrderBookRequest) appendTo(b []byte) []byte {
+	b = appendInt(b, 1, int64(m.Depth))
+	return b
+}
+
+func (m *OrderBookRequest) readFrom(b []byte) error {
+	*m = OrderBookRequest{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Depth = int32(f.int())
+		}
+		return nil
+	})
+}
+
+type PriceLevel struct {
+	Price            int64
+	Amount           int64
+	CumulativeAmount int64
+}
+
+func (m *PriceLevel) appendTo(b []byte) []byte {
+	b = appendInt(b, 1, m.Price)
+	b = appendInt(b, 2, m.Amount)
+	b = appendInt(b, 3, m.CumulativeAmount)
+	return b
+}
+
+func (m *PriceLevel) readFrom(b []byte) error {
+	*m = PriceLevel{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Price = f.int()
+		case 2:
+			m.Amount = f.int()
+		case 3:
+			m.CumulativeAmount = f.int()
+		}
+		return nil
+	})
+}
+
+type OrderBook struct {
+	Asks []*PriceLevel
+	Bids []*PriceLevel
+}
+
+func (m *OrderBook) appendTo(b []byte) []byte {
+	for _, v := range m.Asks {
+		b = appendMessage(b, 1, v)
+	}
+	for _, v := range m.Bids {
+		b = appendMessage(b, 2, v)
+	}
+	return b
+}
+
+func (m *OrderBook) readFrom(b []byte) error {
+	*m = OrderBook{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			v := &PriceLevel{}
+			if err := f.message(v); err != nil {
+				return err
+			}
+			m.Asks = append(m.Asks, v)
+		case 2:
+			v := &PriceLevel{}
+			if err := f.message(v); err != nil {
+				return err
+			}
+			m.Bids = append(m.Bids, v)
+		}
+		return nil
+	})
+}
+
+type TradesRequest struct {
+	Cursor int64
+	Limit  int32
+}
+
+func (m *TradesRequest) appendTo(b []byte) []byte {
+	b = appendInt(b, 1, m.Cursor)
+	b = appendInt(b, 2, int64(m.Limit))
+	return b
+}
+
+func (m *TradesRequest) readFrom(b []byte) error {
+	*m = TradesRequest{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Cursor = f.int()
+		case 2:
+			m.Limit = int32(f.int())
+		}
+		return nil
+	})
+}
+
+type Trade struct {
+	ID        int64
+	Price     int64
+	Amount    int64
+	CreatedAt int64
+}
+
+func (m *Trade) appendTo(b []byte) []byte {
+	b = appendInt(b, 1, m.ID)
+	b = appendInt(b, 2, m.Price)
+	b = appendInt(b, 3, m.Amount)
+	b = appendInt(b, 4, m.CreatedAt)
+	return b
+}
+
+func (m *Trade) readFrom(b []byte) error {
+	*m = Trade{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.ID = f.int()
+		case 2:
+			m.Price = f.int()
+		case 3:
+			m.Amount = f.int()
+		case 4:
+			m.CreatedAt = f.int()
+		}
+		return nil
+	})
+}
+
+type TradesResponse struct {
+	Trades     []*Trade
+	NextCursor int64
+}
+
+func (m *TradesResponse) appendTo(b []byte) []byte {
+	for _, v := range m.Trades {
+		b = appendMessage(b, 1, v)
+	}
+	b = appendInt(b, 2, m.NextCursor)
+	return b
+}
+
+func (m *TradesResponse) readFrom(b []byte) error {
+	*m = TradesResponse{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			v := &Trade{}
+			if err := f.message(v); err != nil {
+				return err
+			}
+			m.Trades = append(m.Trades, v)
+		case 2:
+			m.NextCursor = f.int()
+		}
+		return nil
+	})
+}
+
+type StreamTradesRequest struct {
+	Cursor int64
+}
+
+func (m *StreamTradesRequest) appendTo(b []byte) []byte {
+	b = appendInt(b, 1, m.Cursor)
+	return b
+}
+
+func (m *StreamTradesRequest) readFrom(b []byte) error {
+	*m = StreamTradesRequest{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Cursor = f.int()
+		}
+		return nil
+	})
+}
+
+type AddOrderRequest struct {
+	Type        string
+	Amount      int64
+	Price       int64
+	PartialFill bool
+}
+
+func (m *AddOrderRequest) appendTo(b []byte) []byte {
+	b = appendString(b, 1, m.Type)
+	b = appendInt(b, 2, m.Amount)
+	b = appendInt(b, 3, m.Price)
+	b = appendBool(b, 4, m.PartialFill)
+	return b
+}
+
+func (m *AddOrderRequest) readFrom(b []byte) error {
+	*m = AddOrderRequest{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.Type = f.string()
+		case 2:
+			m.Amount = f.int()
+		case 3:
+			m.Price = f.int()
+		case 4:
+			m.PartialFill = f.bool()
+		}
+		return nil
+	})
+}
+
+type Order struct {
+	ID              int64
+	Type            string
+	Amount          int64
+	Price           int64
+	FilledAmount    int64
+	RemainingAmount int64
+	TradeID         int64
+	CreatedAt       int64
+	ClosedAt        int64
+}
+
+func (m *Order) appendTo(b []byte) []byte {
+	b = appendInt(b, 1, m.ID)
+	b = appendString(b, 2, m.Type)
+	b = appendInt(b, 3, m.Amount)
+	b = appendInt(b, 4, m.Price)
+	b = appendInt(b, 5, m.FilledAmount)
+	b = appendInt(b, 6, m.RemainingAmount)
+	b = appendInt(b, 7, m.TradeID)
+	b = appendInt(b, 8, m.CreatedAt)
+	b = appendInt(b, 9, m.ClosedAt)
+	return b
+}
+
+func (m *Order) readFrom(b []byte) error {
+	*m = Order{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.ID = f.int()
+		case 2:
+			m.Type = f.string()
+		case 3:
+			m.Amount = f.int()
+		case 4:
+			m.Price = f.int()
+		case 5:
+			m.FilledAmount = f.int()
+		case 6:
+			m.RemainingAmount = f.int()
+		case 7:
+			m.TradeID = f.int()
+		case 8:
+			m.CreatedAt = f.int()
+		case 9:
+			m.ClosedAt = f.int()
+		}
+		return nil
+	})
+}
+
+type CancelOrderRequest struct {
+	ID int64
+}
+
+func (m *CancelOrderRequest) appendTo(b []byte) []byte {
+	b = appendInt(b, 1, m.ID)
+	return b
+}
+
+func (m *CancelOrderRequest) readFrom(b []byte) error {
+	*m = CancelOrderRequest{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.ID = f.int()
+		}
+		return nil
+	})
+}
+
+type CancelOrderResponse struct {
+	ID int64
+}
+
+func (m *CancelOrderResponse) appendTo(b []byte) []byte {
+	b = appendInt(b, 1, m.ID)
+	return b
+}
+
+func (m *CancelOrderResponse) readFrom(b []byte) error {
+	*m = CancelOrderResponse{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			m.ID = f.int()
+		}
+		return nil
+	})
+}
+
+type GetOrdersRequest struct {
+}
+
+func (*GetOrdersRequest) appendTo(b []byte) []byte {
+	return b
+}
+
+func (m *GetOrdersRequest) readFrom(b []byte) error {
+	*m = GetOrdersRequest{}
+	return readFields(b, func(field) error { return nil })
+}
+
+type OrdersResponse struct {
+	Orders []*Order
+}
+
+func (m *OrdersResponse) appendTo(b []byte) []byte {
+	for _, v := range m.Orders {
+		b = appendMessage(b, 1, v)
+	}
+	return b
+}
+
+func (m *OrdersResponse) readFrom(b []byte) error {
+	*m = OrdersResponse{}
+	return readFields(b, func(f field) error {
+		switch f.num {
+		case 1:
+			v := &Order{}
+			if err := f.message(v); err != nil {
+				return err
+			}
+			m.Orders = append(m.Orders, v)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,138 @@
+package grpcapi
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+)
+
+// MarketDataServer はisucoin.MarketDataサービスの実装です
+type MarketDataServer interface {
+	GetTicker(context.Context, *TickerRequest) (*Ticker, error)
+	GetOrderBook(context.Context, *OrderBookRequest) (*OrderBook, error)
+	GetTrades(context.Context, *TradesRequest) (*TradesResponse, error)
+	StreamTicker(*TickerRequest, TickerStream) error
+	StreamTrades(*StreamTradesRequest, TradeStream) error
+}
+
+// TradingServer はisucoin.Tradingサービスの実装です
+type TradingServer interface {
+	AddOrder(context.Context, *AddOrderRequest) (*Order, error)
+	CancelOrder(context.Context, *CancelOrderRequest) (*CancelOrderResponse, error)
+	GetOrders(context.Context, *GetOrdersRequest) (*OrdersResponse, error)
+}
+
+// TickerStream はStreamTickerのレスポンスのストリームです
+type TickerStream interface {
+	Send(*Ticker) error
+	grpc.ServerStream
+}
+
+// TradeStream はStreamTradesのレスポンスのストリームです
+type TradeStream interface {
+	Send(*Trade) error
+	grpc.ServerStream
+}
+
+type tickerStream struct {
+	grpc.ServerStream
+}
+
+func (s tickerStream) Send(m *Ticker) error {
+	return s.SendMsg(m)
+}
+
+type tradeStream struct {
+	grpc.ServerStream
+}
+
+func (s tradeStream) Send(m *Trade) error {
+	return s.SendMsg(m)
+}
+
+// unary はreqにリクエストを読み込んでcallを呼ぶハンドラを返します
+func unary(service, method string, req func() Message, call func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error)) grpc.MethodDesc {
+	fullMethod := "/" + service + "/" + method
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := req()
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv, ctx, in)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}
+			return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv, ctx, req)
+			})
+		},
+	}
+}
+
+var marketDataServiceDesc = grpc.ServiceDesc{
+	ServiceName: "isucoin.MarketData",
+	HandlerType: (*MarketDataServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("isucoin.MarketData", "GetTicker", func() Message { return &TickerRequest{} }, func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.(MarketDataServer).GetTicker(ctx, req.(*TickerRequest))
+		}),
+		unary("isucoin.MarketData", "GetOrderBook", func() Message { return &OrderBookRequest{} }, func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.(MarketDataServer).GetOrderBook(ctx, req.(*OrderBookRequest))
+		}),
+		unary("isucoin.MarketData", "GetTrades", func() Message { return &TradesRequest{} }, func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.(MarketDataServer).GetTrades(ctx, req.(*TradesRequest))
+		}),
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "StreamTicker",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				in := &TickerRequest{}
+				if err := stream.RecvMsg(in); err != nil {
+					return err
+				}
+				return srv.(MarketDataServer).StreamTicker(in, tickerStream{stream})
+			},
+			ServerStreams: true,
+		},
+		{
+			StreamName: "StreamTrades",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				in := &StreamTradesRequest{}
+				if err := stream.RecvMsg(in); err != nil {
+					return err
+				}
+				return srv.(MarketDataServer).StreamTrades(in, tradeStream{stream})
+			},
+			ServerStreams: true,
+		},
+	},
+	Metadata: "isucoin.proto",
+}
+
+var tradingServiceDesc = grpc.ServiceDesc{
+	ServiceName: "isucoin.Trading",
+	HandlerType: (*TradingServer)(nil),
+	Methods: []grpc.MethodDesc{
+		unary("isucoin.Trading", "AddOrder", func() Message { return &AddOrderRequest{} }, func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.(TradingServer).AddOrder(ctx, req.(*AddOrderRequest))
+		}),
+		unary("isucoin.Trading", "CancelOrder", func() Message { return &CancelOrderRequest{} }, func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.(TradingServer).CancelOrder(ctx, req.(*CancelOrderRequest))
+		}),
+		unary("isucoin.Trading", "GetOrders", func() Message { return &GetOrdersRequest{} }, func(srv interface{}, ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.(TradingServer).GetOrders(ctx, req.(*GetOrdersRequest))
+		}),
+	},
+	Metadata: "isucoin.proto",
+}
+
+func RegisterMarketDataServer(s *grpc.Server, srv MarketDataServer) {
+	s.RegisterService(&marketDataServiceDesc, srv)
+}
+
+func RegisterTradingServer(s *grpc.Server, srv TradingServer) {
+	s.RegisterService(&tradingServiceDesc, srv)
+}
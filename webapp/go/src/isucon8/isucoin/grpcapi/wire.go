@@ -0,0 +1,137 @@
+// Package grpcapi はisucoin.protoのメッセージとサービスの定義です
+// protocで生成する代わりに、protowireで同じワイヤ形式を読み書きする最小限の実装を持ちます
+// (生成したクライアントとそのまま通信できます)
+package grpcapi
+
+import (
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Message はこのパッケージのメッセージです
+type Message interface {
+	appendTo(b []byte) []byte
+	readFrom(b []byte) error
+}
+
+// codec はMessageをprotobufのワイヤ形式で読み書きします
+type codec struct{}
+
+func (codec) Name() string {
+	return "proto"
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(Message)
+	if !ok {
+		return nil, errors.Errorf("grpcapi: unsupported message type %T", v)
+	}
+	return m.appendTo(nil), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(Message)
+	if !ok {
+		return errors.Errorf("grpcapi: unsupported message type %T", v)
+	}
+	return m.readFrom(data)
+}
+
+// ServerCodec はこのパッケージのメッセージを使うgrpc.Serverに指定してください
+func ServerCodec() grpc.ServerOption {
+	return grpc.ForceServerCodec(codec{})
+}
+
+// proto3なのでデフォルト値 (0, false, "") のフィールドは書き込みません
+
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+func appendMessage(b []byte, num protowire.Number, m Message) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, m.appendTo(nil))
+}
+
+// field は読み込んだ1つのフィールドです。型が違う場合はゼロ値として扱います
+type field struct {
+	num protowire.Number
+	typ protowire.Type
+	v   uint64
+	raw []byte
+}
+
+func (f field) int() int64 {
+	if f.typ != protowire.VarintType {
+		return 0
+	}
+	return int64(f.v)
+}
+
+func (f field) bool() bool {
+	return f.typ == protowire.VarintType && f.v != 0
+}
+
+func (f field) string() string {
+	if f.typ != protowire.BytesType {
+		return ""
+	}
+	return string(f.raw)
+}
+
+// message はfが埋め込みメッセージの場合にmに読み込みます
+func (f field) message(m Message) error {
+	if f.typ != protowire.BytesType {
+		return errors.Errorf("grpcapi: field %d is not a message", f.num)
+	}
+	return m.readFrom(f.raw)
+}
+
+// readFields はbのフィールドを順にfnに渡します。知らない型のフィールドは読み飛ばします
+func readFields(b []byte, fn func(field) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		f := field{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			f.raw, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package grpcapi
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		title string
+		in    Message
+		out   Message
+	}{
+		{"TickerRequest", &TickerRequest{}, &TickerRequest{}},
+		{"Ticker", &Ticker{LastPrice: 5000, BestAsk: 5001, BestBid: 4999, Volume24h: 120, Change24h: -300}, &Ticker{}},
+		{"OrderBookRequest", &OrderBookRequest{Depth: 20}, &OrderBookRequest{}},
+		{"OrderBook", &OrderBook{
+			Asks: []*PriceLevel{{Price: 5001, Amount: 2, CumulativeAmount: 2}, {Price: 5002, Amount: 3, CumulativeAmount: 5}},
+			Bids: []*PriceLevel{{Price: 4999, Amount: 1, CumulativeAmount: 1}},
+		}, &OrderBook{}},
+		{"TradesRequest", &TradesRequest{Cursor: 100, Limit: 50}, &TradesRequest{}},
+		{"TradesResponse", &TradesResponse{
+			Trades:     []*Trade{{ID: 101, Price: 5000, Amount: 1, CreatedAt: 1538000000000000000}, {ID: 102, Price: 5001, Amount: 2}},
+			NextCursor: 102,
+		}, &TradesResponse{}},
+		{"StreamTradesRequest", &StreamTradesRequest{Cursor: 10}, &StreamTradesRequest{}},
+		{"AddOrderRequest", &AddOrderRequest{Type: "buy", Amount: 2, Price: 100, PartialFill: true}, &AddOrderRequest{}},
+		{"Order", &Order{ID: 1, Type: "sell", Amount: 5, Price: 100, FilledAmount: 2, RemainingAmount: 3, TradeID: 9, CreatedAt: 1, ClosedAt: 2}, &Order{}},
+		{"CancelOrderRequest", &CancelOrderRequest{ID: 3}, &CancelOrderRequest{}},
+		{"CancelOrderResponse", &CancelOrderResponse{ID: 3}, &CancelOrderResponse{}},
+		{"GetOrdersRequest", &GetOrdersRequest{}, &GetOrdersRequest{}},
+		{"OrdersResponse", &OrdersResponse{Orders: []*Order{{ID: 1, Type: "buy", Amount: 1}, {ID: 2, Type: "sell", Price: 10}}}, &OrdersResponse{}},
+	}
+	c := codec{}
+	for _, tt := range tests {
+		b, err := c.Marshal(tt.in)
+		if err != nil {
+			t.Errorf("%s: marshal failed: %s", tt.title, err)
+			continue
+		}
+		if err = c.Unmarshal(b, tt.out); err != nil {
+			t.Errorf("%s: unmarshal failed: %s", tt.title, err)
+			continue
+		}
+		if !reflect.DeepEqual(tt.in, tt.out) {
+			t.Errorf("%s: got:%+v expected:%+v", tt.title, tt.out, tt.in)
+		}
+	}
+}
+
+func TestCodecWireFormat(t *testing.T) {
+	tests := []struct {
+		title    string
+		in       Message
+		expected []byte
+	}{
+		{
+			title:    "default values are not written",
+			in:       &AddOrderRequest{},
+			expected: []byte{},
+		},
+		{
+			title:    "scalar fields",
+			in:       &AddOrderRequest{Type: "buy", Amount: 2, Price: 100, PartialFill: true},
+			expected: []byte{0x0a, 0x03, 'b', 'u', 'y', 0x10, 0x02, 0x18, 0x64, 0x20, 0x01},
+		},
+		{
+			title:    "negative int64 is a 10 byte varint",
+			in:       &Ticker{Change24h: -1},
+			expected: []byte{0x28, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		},
+		{
+			title:    "repeated messages",
+			in:       &OrderBook{Bids: []*PriceLevel{{Price: 1}, {}}},
+			expected: []byte{0x12, 0x02, 0x08, 0x01, 0x12, 0x00},
+		},
+	}
+	for _, tt := range tests {
+		b, err := codec{}.Marshal(tt.in)
+		if err != nil {
+			t.Errorf("%s: marshal failed: %s", tt.title, err)
+			continue
+		}
+		if !bytes.Equal(b, tt.expected) {
+			t.Errorf("%s: got:%x expected:%x", tt.title, b, tt.expected)
+		}
+	}
+}
+
+func TestCodecUnknownFields(t *testing.T) {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, 7)
+	// 知らない番号のフィールドと、型の違うフィールドは読み飛ばす
+	b = protowire.AppendTag(b, 15, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, 1)
+	b = protowire.AppendTag(b, 16, protowire.BytesType)
+	b = protowire.AppendString(b, "unknown")
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, "not a varint")
+	b = protowire.AppendTag(b, 3, protowire.Fixed32Type)
+	b = protowire.AppendFixed32(b, 1)
+
+	m := &Ticker{}
+	if err := (codec{}).Unmarshal(b, m); err != nil {
+		t.Fatalf("unmarshal failed: %s", err)
+	}
+	if expected := (&Ticker{LastPrice: 7}); !reflect.DeepEqual(m, expected) {
+		t.Errorf("got:%+v expected:%+v", m, expected)
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	c := codec{}
+	if _, err := c.Marshal(struct{}{}); err == nil {
+		t.Errorf("marshal unsupported type should fail")
+	}
+	if err := c.Unmarshal(nil, &struct{}{}); err == nil {
+		t.Errorf("unmarshal unsupported type should fail")
+	}
+	// 途中で切れたデータ
+	b, _ := c.Marshal(&AddOrderRequest{Type: "buy"})
+	if err := c.Unmarshal(b[:len(b)-1], &AddOrderRequest{}); err == nil {
+		t.Errorf("unmarshal truncated message should fail")
+	}
+	// 埋め込みメッセージの番号にvarintが入っている
+	var bad []byte
+	bad = protowire.AppendTag(bad, 1, protowire.VarintType)
+	bad = protowire.AppendVarint(bad, 1)
+	if err := c.Unmarshal(bad, &OrderBook{}); err == nil {
+		t.Errorf("unmarshal scalar as message should fail")
+	}
+	// 前に読み込んだ値は残さない
+	m := &Ticker{LastPrice: 1, BestAsk: 2}
+	if err := c.Unmarshal(nil, m); err != nil || m.LastPrice != 0 || m.BestAsk != 0 {
+		t.Errorf("unmarshal empty message: got:%+v err:%v", m, err)
+	}
+}
@@ -0,0 +1,258 @@
+// Package metrics はPrometheusのテキスト形式でメトリクスを出力します
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets はレイテンシのヒストグラムの境界 (秒) です
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+var (
+	mu      sync.Mutex
+	metrics []metric
+)
+
+func register(m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, o := range metrics {
+		if o.name() == m.name() {
+			panic("metrics: duplicate metric " + m.name())
+		}
+	}
+	metrics = append(metrics, m)
+}
+
+// Handler は登録したメトリクスを出力するハンドラです
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ms := append([]metric(nil), metrics...)
+		mu.Unlock()
+		sort.Slice(ms, func(i, j int) bool { return ms[i].name() < ms[j].name() })
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, m := range ms {
+			m.write(bw)
+		}
+		bw.Flush()
+	})
+}
+
+type desc struct {
+	n, help, typ string
+	labels       []string
+}
+
+func (d *desc) name() string {
+	return d.n
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	w.WriteString("# HELP " + d.n + " " + d.help + "\n")
+	w.WriteString("# TYPE " + d.n + " " + d.typ + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeSample は name{labels} value の1行を出力します。extraはヒストグラムのle用です
+func writeSample(w *bufio.Writer, name string, labels, values []string, extra string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extra != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(l + `="` + labelEscaper.Replace(values[i]) + `"`)
+		}
+		if extra != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// CounterVec はラベルごとのカウンタです
+type CounterVec struct {
+	desc
+	mu   sync.Mutex
+	vals map[string]*counterValue
+}
+
+type counterValue struct {
+	values []string
+	v      float64
+}
+
+// NewCounterVec はカウンタを登録します
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc: desc{n: name, help: help, typ: "counter", labels: labels},
+		vals: map[string]*counterValue{},
+	}
+	register(c)
+	return c
+}
+
+// Add はvaluesのラベルのカウンタにvを足します。valuesはNewCounterVecのlabelsと同じ順番で渡してください
+func (c *CounterVec) Add(v float64, values ...string) {
+	k := labelKey(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cv, ok := c.vals[k]
+	if !ok {
+		cv = &counterValue{values: append([]string(nil), values...)}
+		c.vals[k] = cv
+	}
+	cv.v += v
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w)
+	keys := make([]string, 0, len(c.vals))
+	for k := range c.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cv := c.vals[k]
+		writeSample(w, c.n, c.labels, cv.values, "", cv.v)
+	}
+}
+
+// HistogramVec はラベルごとのヒストグラムです
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	vals    map[string]*histogramValue
+}
+
+type histogramValue struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec はヒストグラムを登録します。bucketsは昇順で渡してください
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{n: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		vals:    map[string]*histogramValue{},
+	}
+	register(h)
+	return h
+}
+
+// Observe はvaluesのラベルのヒストグラムにvを記録します
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	k := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hv, ok := h.vals[k]
+	if !ok {
+		hv = &histogramValue{values: append([]string(nil), values...), counts: make([]uint64, len(h.buckets))}
+		h.vals[k] = hv
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	keys := make([]string, 0, len(h.vals))
+	for k := range h.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hv := h.vals[k]
+		var cum uint64
+		for i, b := range h.buckets {
+			cum += hv.counts[i]
+			writeSample(w, h.n+"_bucket", h.labels, hv.values, `le="`+formatFloat(b)+`"`, float64(cum))
+		}
+		writeSample(w, h.n+"_bucket", h.labels, hv.values, `le="+Inf"`, float64(hv.count))
+		writeSample(w, h.n+"_sum", h.labels, hv.values, "", hv.sum)
+		writeSample(w, h.n+"_count", h.labels, hv.values, "", float64(hv.count))
+	}
+}
+
+// Collector は出力するときに値を集めるメトリクスです (DBの接続数など)
+type Collector struct {
+	desc
+	collect func(emit func(v float64, values ...string))
+}
+
+// NewGaugeFunc は出力するときにcollectで値を集めるゲージを登録します
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(v float64, values ...string))) *Collector {
+	return newCollector("gauge", name, help, labels, collect)
+}
+
+// NewCounterFunc は出力するときにcollectで値を集めるカウンタを登録します
+func NewCounterFunc(name, help string, labels []string, collect func(emit func(v float64, values ...string))) *Collector {
+	return newCollector("counter", name, help, labels, collect)
+}
+
+func newCollector(typ, name, help string, labels []string, collect func(emit func(v float64, values ...string))) *Collector {
+	c := &Collector{
+		desc:    desc{n: name, help: help, typ: typ, labels: labels},
+		collect: collect,
+	}
+	register(c)
+	return c
+}
+
+func (c *Collector) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.collect(func(v float64, values ...string) {
+		writeSample(w, c.n, c.labels, values, "", v)
+	})
+}
@@ -0,0 +1,141 @@
+// Package migrate はDBのスキーマの変更をバージョン順に適用します
+// 適用したバージョンはschema_migrationsテーブルに記録するので、同じ変更を2回適用することはありません
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// 複数のappサーバーが同時に起動しても1台ずつ適用するためのロック
+	migrateLock = "isucoin.migrate"
+	// DefaultLockTimeout は他のサーバーが適用し終わるのを待つ時間です
+	DefaultLockTimeout = 60 * time.Second
+)
+
+// Migration は1つのスキーマの変更です
+// MySQLのDDLはトランザクションにできないので、途中で失敗した場合に備えてStatementsは1つずつ分けて書いてください
+type Migration struct {
+	Version int64
+	Name    string
+	// Statements は順番に実行するSQLです。空の場合は記録だけします
+	Statements []string
+}
+
+// Status はマイグレーションと適用した時間です (適用していない場合はAppliedAtがnil)
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrations はこのappが必要とするマイグレーションです。バージョン順に並べてください
+func Migrations() []Migration {
+	ms := make([]Migration, len(migrations))
+	copy(ms, migrations)
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms
+}
+
+func ensureTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version BIGINT NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    applied_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (version)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4`)
+	return errors.Wrap(err, "create schema_migrations failed")
+}
+
+func appliedVersions(ctx context.Context, conn *sql.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, errors.Wrap(err, "select schema_migrations failed")
+	}
+	defer rows.Close()
+	applied := map[int64]time.Time{}
+	for rows.Next() {
+		var v int64
+		var at time.Time
+		if err := rows.Scan(&v, &at); err != nil {
+			return nil, errors.Wrap(err, "scan schema_migrations failed")
+		}
+		applied[v] = at
+	}
+	return applied, rows.Err()
+}
+
+// Run はまだ適用していないマイグレーションをバージョン順に適用し、適用したマイグレーションを返します
+// 他のサーバーが適用中の場合はGET_LOCKで終わるのを待ちます
+func Run(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get connection failed")
+	}
+	defer conn.Close()
+
+	var locked sql.NullBool
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, migrateLock, int(DefaultLockTimeout/time.Second)).Scan(&locked); err != nil {
+		return nil, errors.Wrap(err, "get lock failed")
+	}
+	if !locked.Valid || !locked.Bool {
+		return nil, errors.Errorf("migration lock timeout. lock:%s", migrateLock)
+	}
+	defer conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, migrateLock)
+
+	if err := ensureTable(ctx, conn); err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	var done []Migration
+	for _, m := range Migrations() {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		for i, q := range m.Statements {
+			if _, err := conn.ExecContext(ctx, q); err != nil {
+				return done, errors.Wrapf(err, "migration %d (%s) failed at statement %d", m.Version, m.Name, i+1)
+			}
+		}
+		if _, err := conn.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, NOW(6))`, m.Version, m.Name); err != nil {
+			return done, errors.Wrapf(err, "record migration %d failed", m.Version)
+		}
+		log.Printf("[INFO] migration applied. version:%d name:%s", m.Version, m.Name)
+		done = append(done, m)
+	}
+	return done, nil
+}
+
+// List はすべてのマイグレーションと適用済みかどうかを返します
+func List(ctx context.Context, db *sql.DB) ([]Status, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get connection failed")
+	}
+	defer conn.Close()
+	if err := ensureTable(ctx, conn); err != nil {
+		return nil, err
+	}
+	applied, err := appliedVersions(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	ms := Migrations()
+	ss := make([]Status, 0, len(ms))
+	for _, m := range ms {
+		s := Status{Migration: m}
+		if at, ok := applied[m.Version]; ok {
+			s.AppliedAt = &at
+		}
+		ss = append(ss, s)
+	}
+	return ss, nil
+}
@@ -0,0 +1,143 @@
+package migrate
+
+// migrations はスキーマの変更の一覧です
+// 新しいテーブルやカラムが必要になった場合は、sql/ のファイルを変更せずにここに次のバージョンで追加してください
+// 適用済みのマイグレーションは変更しないでください (schema_migrationsに記録済みのDBでは実行されません)
+var migrations = []Migration{
+	{
+		// sql/isucoin.sql と sql/zz_alter_*.sql で作ったスキーマ
+		Version: 1,
+		Name:    "baseline",
+	},
+	{
+		// GET /leaderboard のためのユーザーごと1時間ごとの約定の集計
+		Version: 2,
+		Name:    "user_trade_stats",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS user_trade_stats (
+    t DATETIME NOT NULL,
+    user_id BIGINT NOT NULL,
+    volume BIGINT NOT NULL DEFAULT 0,
+    turnover BIGINT NOT NULL DEFAULT 0,
+    realized_pnl BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (t, user_id),
+    INDEX user_id_idx (user_id, t)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4`,
+		},
+	},
+	{
+		// 古いトレードと注文を移すテーブル (model.StartArchiver)
+		// 元のテーブルにカラムを追加する場合は *_archive にも同じALTERを追加してください
+		Version: 3,
+		Name:    "archive_tables",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS trade_archive LIKE trade`,
+			`CREATE TABLE IF NOT EXISTS orders_archive LIKE orders`,
+			`CREATE TABLE IF NOT EXISTS fills_archive LIKE fills`,
+		},
+	},
+	{
+		// /me/alerts の価格アラート。status, direction, price のインデックスで新しいトレードの価格から判定するアラートを探す
+		Version: 4,
+		Name:    "price_alert",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS price_alert (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    direction VARCHAR(8) NOT NULL,
+    price BIGINT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    after_trade_id BIGINT NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    trade_id BIGINT NULL,
+    trade_price BIGINT NULL,
+    triggered_at DATETIME(6) NULL,
+    delivered_at DATETIME(6) NULL,
+    delivery_failures INT NOT NULL DEFAULT 0,
+    INDEX status_direction_price_idx (status, direction, price),
+    INDEX user_id_status_idx (user_id, status),
+    INDEX user_id_triggered_at_idx (user_id, triggered_at)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4`,
+		},
+	},
+	{
+		// PATCH /order/:id/meta で注文に付けるタグ, メモ, ウォッチの印。GET /orders?tag= は user_id, tag のインデックスで探す
+		Version: 5,
+		Name:    "order_meta",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS order_meta (
+    order_id BIGINT NOT NULL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    tag VARCHAR(64) NOT NULL DEFAULT '',
+    note VARCHAR(255) NOT NULL DEFAULT '',
+    watched TINYINT(1) NOT NULL DEFAULT 0,
+    updated_at DATETIME(6) NOT NULL,
+    INDEX user_id_tag_idx (user_id, tag),
+    INDEX user_id_watched_idx (user_id, watched)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4`,
+		},
+	},
+	{
+		// GET /me/sessions で一覧するログイン中の端末。cookieのトークンは token_hash で照合する
+		Version: 6,
+		Name:    "user_session",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS user_session (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    token_hash CHAR(64) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL DEFAULT '',
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    created_at DATETIME(6) NOT NULL,
+    last_seen_at DATETIME(6) NOT NULL,
+    revoked_at DATETIME(6) NULL,
+    UNIQUE KEY token_hash_idx (token_hash),
+    INDEX user_id_idx (user_id, revoked_at)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4`,
+		},
+	},
+	{
+		// GET /order/:id/events で返す注文の状態変化の記録。古い注文の移動では移動しない
+		Version: 7,
+		Name:    "order_events",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS order_events (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    order_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    event VARCHAR(16) NOT NULL,
+    actor VARCHAR(16) NOT NULL,
+    reason VARCHAR(32) NOT NULL DEFAULT '',
+    amount BIGINT NOT NULL,
+    price BIGINT NOT NULL,
+    trade_id BIGINT NOT NULL DEFAULT 0,
+    created_at DATETIME(6) NOT NULL,
+    INDEX order_id_idx (order_id, id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4`,
+		},
+	},
+	{
+		// GET /admin/settlements でトレードごとに集計するため、確定した仮決済にトレードのIDを記録する
+		Version: 8,
+		Name:    "bank_transaction_trade",
+		Statements: []string{
+			`ALTER TABLE bank_transaction ADD COLUMN trade_id BIGINT NULL`,
+			`ALTER TABLE bank_transaction ADD INDEX trade_id_idx (trade_id), ADD INDEX created_at_idx (created_at)`,
+		},
+	},
+	{
+		// 板寄せ (market_mode=auction) の実行記録。scheduled_atごとに1回だけ行うために複数のサーバーで共有する
+		Version: 9,
+		Name:    "auction",
+		Statements: []string{
+			`CREATE TABLE IF NOT EXISTS auction (
+    scheduled_at DATETIME(6) NOT NULL PRIMARY KEY,
+    price BIGINT NOT NULL DEFAULT 0,
+    volume BIGINT NOT NULL DEFAULT 0,
+    trades INT NOT NULL DEFAULT 0,
+    created_at DATETIME(6) NOT NULL,
+    cleared_at DATETIME(6) NULL
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4`,
+		},
+	},
+}
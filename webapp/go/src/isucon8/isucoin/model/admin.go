@@ -0,0 +1,76 @@
+package model
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// TradingHalted が"1"の間はマッチングと注文の受付を停止します
+	TradingHalted = "trading_halted"
+)
+
+var ErrTradingHalted = errors.New("取引は停止中です")
+
+// adminToken は/admin/*のAPIで使うトークンです。空の場合は管理APIを使えません
+var adminToken string
+
+// SetAdminToken は管理APIのトークンを設定します
+// /initializeで変更できないように、設定ファイルか環境変数で渡してください
+func SetAdminToken(token string) {
+	adminToken = token
+}
+
+// CheckAdminToken はgivenが管理APIのトークンと一致する場合にtrueを返します
+func CheckAdminToken(given string) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(given), []byte(adminToken)) == 1
+}
+
+// IsTradingHalted は管理APIまたはサーキットブレーカーで取引が停止されているかを返します
+func IsTradingHalted(d QueryExecutor) (bool, error) {
+	t, err := GetTradingHalt(d)
+	if err != nil {
+		return false, err
+	}
+	return t.Active(time.Now()), nil
+}
+
+// SetTradingHalted は管理APIでの停止状態を変更します
+// 再開した場合はサーキットブレーカーによる停止も解除します
+func SetTradingHalted(d QueryExecutor, halted bool) error {
+	v := ""
+	if halted {
+		v = "1"
+	}
+	if err := SetSetting(d, TradingHalted, v); err != nil {
+		return errors.Wrapf(err, "set setting failed. %s", TradingHalted)
+	}
+	if !halted {
+		if err := SetSetting(d, TradingHaltedUntil, ""); err != nil {
+			return errors.Wrapf(err, "set setting failed. %s", TradingHaltedUntil)
+		}
+	}
+	return nil
+}
+
+// CancelOrderByID はユーザーに関係なく注文を取り消します
+func CancelOrderByID(tx *sql.Tx, orderID int64, reason string) error {
+	order, err := getOrderByIDWithLock(tx, orderID)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrOrderNotFound
+	case err != nil:
+		return errors.Wrapf(err, "getOrderByIDWithLock failed. id:%d", orderID)
+	case order.ClosedAt != nil:
+		return ErrOrderAlreadyClosed
+	}
+	return cancelOrder(tx, order, reason)
+}
+
+// GetUsersPage はcursorより大きいidのユーザーをid順にlimit件返します
+func GetUsersPage(d QueryExecutor, cursor int64, limit int) ([]*User, error) {
+	return scanUsers(dbQuery(d, `SELECT * FROM user WHERE id > ? ORDER BY id ASC LIMIT ?`, cursor, limit))
+}
@@ -0,0 +1,293 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	AlertAbove = "above"
+	AlertBelow = "below"
+
+	AlertStatusActive    = "active"
+	AlertStatusTriggered = "triggered"
+	AlertStatusDeleted   = "deleted"
+
+	// MaxActiveAlertsPerUser は1ユーザーが同時に登録できる未発動のアラートの数です
+	MaxActiveAlertsPerUser = 20
+	// MaxAlertsListed はGetAlertsで返す数です
+	MaxAlertsListed = 100
+
+	// AlertWatchInterval は他のappサーバーで成立したトレードを拾うためのポーリング間隔です
+	AlertWatchInterval = 1 * time.Second
+	// alertTradesLimit は発動したトレードを探す時に1回に読むトレードの数です
+	alertTradesLimit = 1000
+)
+
+var (
+	ErrAlertNotFound = errors.New("アラートが見つかりません")
+	ErrAlertLimit    = errors.New("アラートの登録数の上限です")
+)
+
+// PriceAlert は約定価格がPriceを上回った (above) または下回った (below) ときの通知です
+//
+//go:generate scanner
+type PriceAlert struct {
+	ID        int64  `json:"id"`
+	UserID    int64  `json:"-"`
+	Direction string `json:"direction"`
+	Price     int64  `json:"price"`
+	Status    string `json:"status"`
+	// AfterTradeID は登録したときの最新のトレードで、これより後のトレードで判定します
+	AfterTradeID int64     `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	// TradeID, TradePrice は発動したトレードです
+	TradeID     int64      `json:"trade_id,omitempty"`
+	TradePrice  int64      `json:"trade_price,omitempty"`
+	TriggeredAt *time.Time `json:"triggered_at,omitempty"`
+	// DeliveredAt はWebhookへの通知が終わった時刻です。DeliveryFailures はそのうち失敗したWebhookの数です
+	DeliveredAt      *time.Time `json:"delivered_at,omitempty"`
+	DeliveryFailures int        `json:"delivery_failures"`
+}
+
+// crossedBy はトレードの価格でアラートが発動する場合にtrueを返します
+func (a *PriceAlert) crossedBy(t *Trade) bool {
+	if t.ID <= a.AfterTradeID {
+		return false
+	}
+	if a.Direction == AlertAbove {
+		return t.Price >= a.Price
+	}
+	return t.Price <= a.Price
+}
+
+// CreateAlert はアラートを登録します
+// directionが空の場合は最新の約定価格よりpriceが高ければabove、そうでなければbelowにします
+func CreateAlert(tx *sql.Tx, userID int64, direction string, price int64) (*PriceAlert, error) {
+	if price <= 0 {
+		return nil, ErrParameterInvalid
+	}
+	switch direction {
+	case "", AlertAbove, AlertBelow:
+	default:
+		return nil, ErrParameterInvalid
+	}
+	// 同じユーザーの登録を直列にするためにユーザーの行をロックする
+	if _, err := getUserByIDWithLock(tx, userID); err != nil {
+		return nil, errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
+	}
+	var n int64
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM price_alert WHERE user_id = ? AND status = ?`, userID, AlertStatusActive).Scan(&n); err != nil {
+		return nil, errors.Wrap(err, "count price_alert failed")
+	}
+	if n >= MaxActiveAlertsPerUser {
+		return nil, ErrAlertLimit
+	}
+	var afterID, lastPrice int64
+	latest, err := GetLatestTrade(tx)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, errors.Wrap(err, "GetLatestTrade failed")
+	default:
+		afterID, lastPrice = latest.ID, latest.Price
+	}
+	if direction == "" {
+		direction = AlertBelow
+		if price > lastPrice {
+			direction = AlertAbove
+		}
+	}
+	res, err := dbExec(tx, `INSERT INTO price_alert (user_id, direction, price, status, after_trade_id, created_at) VALUES (?, ?, ?, ?, ?, NOW(6))`,
+		userID, direction, price, AlertStatusActive, afterID)
+	if err != nil {
+		return nil, errors.Wrap(err, "insert price_alert failed")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, errors.Wrap(err, "get price_alert id failed")
+	}
+	sendLog(tx, "alert.create", map[string]interface{}{
+		"user_id":   userID,
+		"alert_id":  id,
+		"direction": direction,
+		"price":     price,
+	})
+	return getAlertByID(tx, id)
+}
+
+func getAlertByID(d QueryExecutor, id int64) (*PriceAlert, error) {
+	return scanPriceAlert(dbQuery(d, `SELECT * FROM price_alert WHERE id = ?`, id))
+}
+
+// GetAlerts はユーザーの削除されていないアラートを新しい順に返します。statusを指定した場合はその状態のものだけを返します
+func GetAlerts(d QueryExecutor, userID int64, status string) ([]*PriceAlert, error) {
+	switch status {
+	case "":
+		return scanPriceAlerts(dbQuery(d, `SELECT * FROM price_alert WHERE user_id = ? AND status <> ? ORDER BY id DESC LIMIT ?`,
+			userID, AlertStatusDeleted, MaxAlertsListed))
+	case AlertStatusActive, AlertStatusTriggered:
+		return scanPriceAlerts(dbQuery(d, `SELECT * FROM price_alert WHERE user_id = ? AND status = ? ORDER BY id DESC LIMIT ?`,
+			userID, status, MaxAlertsListed))
+	}
+	return nil, ErrParameterInvalid
+}
+
+// GetTriggeredAlerts はsinceより後に発動したユーザーのアラートを発動した順に返します
+func GetTriggeredAlerts(d QueryExecutor, userID int64, since time.Time) ([]*PriceAlert, error) {
+	return scanPriceAlerts(dbQuery(d, `SELECT * FROM price_alert WHERE user_id = ? AND triggered_at > ? ORDER BY triggered_at ASC, id ASC LIMIT ?`,
+		userID, since, MaxAlertsListed))
+}
+
+// DeleteAlert はアラートを削除します。発動したアラートも一覧から消すために削除できます
+func DeleteAlert(tx *sql.Tx, userID, id int64) error {
+	res, err := dbExec(tx, `UPDATE price_alert SET status = ? WHERE id = ? AND user_id = ? AND status <> ?`,
+		AlertStatusDeleted, id, userID, AlertStatusDeleted)
+	if err != nil {
+		return errors.Wrapf(err, "update price_alert failed. id:%d", id)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "get rows affected failed")
+	} else if n == 0 {
+		return ErrAlertNotFound
+	}
+	sendLog(tx, "alert.delete", map[string]interface{}{
+		"user_id":  userID,
+		"alert_id": id,
+	})
+	return nil
+}
+
+// StartAlertWatcher は新しいトレードでアラートを判定して、発動したアラートを通知するワーカーを起動します
+// 複数台で動かした場合は全台で判定しますが、状態を更新できた1台だけが通知します。ctxが終了するとワーカーは停止します
+func StartAlertWatcher(ctx context.Context, db *sql.DB) {
+	traded, unsubscribe := SubscribeTrade()
+	startWorker(func() {
+		defer unsubscribe()
+		// 起動する前のトレードでは判定しない
+		var cursor int64
+		if latest, err := GetLatestTrade(db); err == nil {
+			cursor = latest.ID
+		}
+		poll := time.NewTicker(AlertWatchInterval)
+		defer poll.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-traded:
+			case <-poll.C:
+			}
+			next, err := evaluateAlerts(db, cursor)
+			if err != nil {
+				log.Printf("[WARN] evaluate alerts failed. err:%s", err)
+				continue
+			}
+			cursor = next
+		}
+	})
+}
+
+// evaluateAlerts はcursorより後のトレードで発動したアラートを発動済みにして通知し、判定したトレードの最後のIDを返します
+// トレードの最高値と最安値でprice_alertのstatus, direction, priceのインデックスから候補を探すので、候補が無い場合はトレードを読みません
+func evaluateAlerts(db *sql.DB, cursor int64) (int64, error) {
+	var maxID, high, low sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(id), MAX(price), MIN(price) FROM trade WHERE id > ?`, cursor).Scan(&maxID, &high, &low); err != nil {
+		return cursor, errors.Wrap(err, "select trade range failed")
+	}
+	if !maxID.Valid {
+		return cursor, nil
+	}
+	above, err := scanPriceAlerts(dbQuery(db, `SELECT * FROM price_alert WHERE status = ? AND direction = ? AND price <= ? AND after_trade_id < ?`,
+		AlertStatusActive, AlertAbove, high.Int64, maxID.Int64))
+	if err != nil {
+		return cursor, errors.Wrap(err, "select price_alert failed")
+	}
+	below, err := scanPriceAlerts(dbQuery(db, `SELECT * FROM price_alert WHERE status = ? AND direction = ? AND price >= ? AND after_trade_id < ?`,
+		AlertStatusActive, AlertBelow, low.Int64, maxID.Int64))
+	if err != nil {
+		return cursor, errors.Wrap(err, "select price_alert failed")
+	}
+	alerts := append(above, below...)
+	if len(alerts) == 0 {
+		return maxID.Int64, nil
+	}
+	// 最初に条件を満たしたトレードで発動する
+	triggered := make(map[*PriceAlert]*Trade, len(alerts))
+	for last := cursor; last < maxID.Int64 && len(triggered) < len(alerts); {
+		trades, err := GetTradesByLastID(db, last, alertTradesLimit)
+		if err != nil {
+			return cursor, errors.Wrap(err, "GetTradesByLastID failed")
+		}
+		if len(trades) == 0 {
+			break
+		}
+		for _, t := range trades {
+			if t.ID > maxID.Int64 {
+				break
+			}
+			for _, a := range alerts {
+				if triggered[a] == nil && a.crossedBy(t) {
+					triggered[a] = t
+				}
+			}
+		}
+		last = trades[len(trades)-1].ID
+	}
+	for _, a := range alerts {
+		t := triggered[a]
+		if t == nil {
+			continue
+		}
+		if err := triggerAlert(db, a, t); err != nil {
+			return cursor, err
+		}
+	}
+	return maxID.Int64, nil
+}
+
+// triggerAlert はアラートを発動済みにして通知します。他のappサーバーが先に発動させていた場合は通知しません
+func triggerAlert(db *sql.DB, a *PriceAlert, t *Trade) error {
+	var ok bool
+	err := TxScope(context.Background(), db, nil, func(tx *sql.Tx) error {
+		res, err := dbExec(tx, `UPDATE price_alert SET status = ?, trade_id = ?, trade_price = ?, triggered_at = NOW(6) WHERE id = ? AND status = ?`,
+			AlertStatusTriggered, t.ID, t.Price, a.ID, AlertStatusActive)
+		if err != nil {
+			return errors.Wrapf(err, "update price_alert failed. id:%d", a.ID)
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "get rows affected failed")
+		}
+		if ok = n > 0; !ok {
+			return nil
+		}
+		sendLog(tx, "alert.trigger", map[string]interface{}{
+			"user_id":   a.UserID,
+			"alert_id":  a.ID,
+			"direction": a.Direction,
+			"price":     a.Price,
+			"trade_id":  t.ID,
+		})
+		return nil
+	})
+	if err != nil || !ok {
+		return err
+	}
+	alert, err := getAlertByID(db, a.ID)
+	if err != nil {
+		return errors.Wrapf(err, "getAlertByID failed. id:%d", a.ID)
+	}
+	PublishAlert(alert)
+	return nil
+}
+
+// markAlertDelivered はWebhookへの通知が終わったことを記録します
+func markAlertDelivered(d QueryExecutor, id int64, failures int) error {
+	_, err := dbExec(d, `UPDATE price_alert SET delivered_at = NOW(6), delivery_failures = ? WHERE id = ?`, failures, id)
+	return errors.Wrapf(err, "update price_alert failed. id:%d", id)
+}
@@ -0,0 +1,124 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// APIキーの権限です
+const (
+	APIKeyScopeRead  = "read"  // GETのAPIだけ
+	APIKeyScopeTrade = "trade" // 注文もできる
+
+	APIKeyPrefix = "isu_"
+	// APIKeyTouchInterval より短い間隔ではlast_used_atを更新しません
+	APIKeyTouchInterval = 1 * time.Minute
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("APIキーが見つかりません")
+	ErrAPIKeyInvalid  = errors.New("invalid api key")
+)
+
+//go:generate scanner
+type APIKey struct {
+	ID     int64  `json:"id"`
+	UserID int64  `json:"-"`
+	Name   string `json:"name"`
+	Scope  string `json:"scope"`
+	// Prefix はキーの先頭で、一覧でキーを見分けるために返します
+	Prefix     string     `json:"prefix"`
+	KeyHash    string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey はAPIキーを発行します
+// キーはハッシュだけを保存するので、返したキーは二度と取得できません
+func CreateAPIKey(tx *sql.Tx, userID int64, name, scope string) (*APIKey, string, error) {
+	if scope != APIKeyScopeRead && scope != APIKeyScopeTrade {
+		return nil, "", ErrParameterInvalid
+	}
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", errors.Wrap(err, "generate api key failed")
+	}
+	key := APIKeyPrefix + hex.EncodeToString(b)
+	prefix := key[:len(APIKeyPrefix)+8]
+	res, err := dbExec(tx, `INSERT INTO api_key (user_id, name, scope, prefix, key_hash, created_at) VALUES (?, ?, ?, ?, ?, NOW(6))`,
+		userID, name, scope, prefix, hashAPIKey(key))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "insert api_key failed")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "get api_key id failed")
+	}
+	sendLog(tx, "apikey.create", map[string]interface{}{
+		"user_id":    userID,
+		"api_key_id": id,
+		"scope":      scope,
+	})
+	k, err := scanAPIKey(dbQuery(tx, `SELECT * FROM api_key WHERE id = ?`, id))
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "select api_key failed. id:%d", id)
+	}
+	return k, key, nil
+}
+
+// GetAPIKeys はユーザーのAPIキーを無効にしたものも含めて返します
+func GetAPIKeys(d QueryExecutor, userID int64) ([]*APIKey, error) {
+	return scanAPIKeys(dbQuery(d, `SELECT * FROM api_key WHERE user_id = ? ORDER BY id ASC`, userID))
+}
+
+// RevokeAPIKey はAPIキーを無効にします
+func RevokeAPIKey(tx *sql.Tx, userID, id int64) error {
+	res, err := dbExec(tx, `UPDATE api_key SET revoked_at = NOW(6) WHERE id = ? AND user_id = ? AND revoked_at IS NULL`, id, userID)
+	if err != nil {
+		return errors.Wrapf(err, "update api_key failed. id:%d", id)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "get rows affected failed")
+	} else if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	sendLog(tx, "apikey.revoke", map[string]interface{}{
+		"user_id":    userID,
+		"api_key_id": id,
+	})
+	return nil
+}
+
+// AuthenticateAPIKey は有効なAPIキーを返し、last_used_atを更新します
+func AuthenticateAPIKey(d QueryExecutor, key string) (*APIKey, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, ErrAPIKeyInvalid
+	}
+	k, err := scanAPIKey(dbQuery(d, `SELECT * FROM api_key WHERE key_hash = ? AND revoked_at IS NULL`, hashAPIKey(key)))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrAPIKeyInvalid
+	case err != nil:
+		return nil, errors.Wrap(err, "select api_key failed")
+	}
+	now := time.Now()
+	if k.LastUsedAt == nil || now.Sub(*k.LastUsedAt) >= APIKeyTouchInterval {
+		if _, err = dbExec(d, `UPDATE api_key SET last_used_at = ? WHERE id = ?`, now, k.ID); err != nil {
+			return nil, errors.Wrapf(err, "update api_key failed. id:%d", k.ID)
+		}
+		k.LastUsedAt = &now
+	}
+	return k, nil
+}
@@ -0,0 +1,233 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"strings"
+	"time"
+
+	"isucon8/isucoin/metrics"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultArchiveAge より古いトレードと注文を *_archive テーブルに移します
+	DefaultArchiveAge = 7 * 24 * time.Hour
+	// MinArchiveAge は/infoのチャートと直近24時間の集計に使うトレードを移さないための下限です
+	MinArchiveAge = 48 * time.Hour
+	// DefaultArchiveInterval は古いトレードと注文を探す間隔です
+	DefaultArchiveInterval = 1 * time.Minute
+	// DefaultArchiveBatchSize は1回のトランザクションで移す行数です。大きくするとロックを持つ時間が長くなります
+	DefaultArchiveBatchSize = 1000
+
+	archiveLock = "isucoin.archive"
+)
+
+var (
+	archiveEnabled bool
+
+	archivedRows = metrics.NewCounterVec("isucoin_archived_rows_total",
+		"*_archive テーブルに移した行数", "table")
+)
+
+// ArchiveResult はArchiveOnceで移した行数です
+type ArchiveResult struct {
+	Orders int64
+	Fills  int64
+	Trades int64
+}
+
+// StartArchiver はage より古いトレードと注文をinterval毎に *_archive テーブルに移すワーカーを起動します
+// 複数台で動かしてもGET_LOCKで選ばれた1台だけが移します。ctxが終了するとワーカーは停止します
+//
+// ロウソク足の集計テーブルとuser_position, user_trade_statsはそのまま残すので、チャートと保有状況は変わりません
+// 移した注文はGET /ordersで返さず、移したトレードはGET /trade/:fileで404になります
+func StartArchiver(ctx context.Context, db *sql.DB, node string, age, interval time.Duration, batchSize int) {
+	if age < MinArchiveAge {
+		age = MinArchiveAge
+	}
+	if interval <= 0 {
+		interval = DefaultArchiveInterval
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultArchiveBatchSize
+	}
+	archiveEnabled = true
+	e := newLeaderElector(db, archiveLock, node, interval)
+	startWorker(func() {
+		defer e.resign()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				e.tick(ctx)
+				if !e.IsLeader() {
+					continue
+				}
+				res, err := ArchiveOnce(ctx, db, time.Now().Add(-age), batchSize)
+				if err != nil {
+					log.Printf("[WARN] archive failed. err:%s", err)
+				}
+				if res.Orders+res.Fills+res.Trades > 0 {
+					log.Printf("[INFO] archived orders:%d fills:%d trades:%d", res.Orders, res.Fills, res.Trades)
+				}
+			}
+		}
+	})
+}
+
+// ArchiveOnce はcutoffより前に終わった注文とその約定、cutoffより前のトレードを移せるだけ移します
+// 最新のトレードは/infoと/tickerのために移しません
+func ArchiveOnce(ctx context.Context, db *sql.DB, cutoff time.Time, batchSize int) (ArchiveResult, error) {
+	var res ArchiveResult
+	for ctx.Err() == nil {
+		var n, fills int64
+		err := TxScope(ctx, db, nil, func(tx *sql.Tx) (err error) {
+			n, fills, err = archiveOrders(tx, cutoff, batchSize)
+			return err
+		})
+		if err != nil {
+			return res, err
+		}
+		res.Orders += n
+		res.Fills += fills
+		archivedRows.Add(float64(n), "orders")
+		archivedRows.Add(float64(fills), "fills")
+		if n < int64(batchSize) {
+			break
+		}
+	}
+	for ctx.Err() == nil {
+		var n int64
+		err := TxScope(ctx, db, nil, func(tx *sql.Tx) (err error) {
+			n, err = archiveTrades(tx, cutoff, batchSize)
+			return err
+		})
+		if err != nil {
+			return res, err
+		}
+		res.Trades += n
+		archivedRows.Add(float64(n), "trade")
+		if n < int64(batchSize) {
+			break
+		}
+	}
+	return res, nil
+}
+
+// archiveOrders はcutoffより前に約定または取り消しで終わった注文と、その注文の約定を移します
+func archiveOrders(tx *sql.Tx, cutoff time.Time, batchSize int) (int64, int64, error) {
+	ids, err := selectIDs(tx, `SELECT id FROM orders WHERE closed_at < ? ORDER BY id ASC LIMIT ?`, cutoff, batchSize)
+	if err != nil || len(ids) == 0 {
+		return 0, 0, errors.Wrap(err, "select orders to archive failed")
+	}
+	fills, err := moveRows(tx, "fills", "order_id", ids)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := moveRows(tx, "orders", "id", ids)
+	if err != nil {
+		return 0, 0, err
+	}
+	return n, fills, nil
+}
+
+// archiveTrades はcutoffより前のトレードを移します
+func archiveTrades(tx *sql.Tx, cutoff time.Time, batchSize int) (int64, error) {
+	latest, err := GetLatestTrade(tx)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, nil
+	case err != nil:
+		return 0, errors.Wrap(err, "GetLatestTrade failed")
+	}
+	ids, err := selectIDs(tx, `SELECT id FROM trade WHERE created_at < ? AND id < ? ORDER BY id ASC LIMIT ?`, cutoff, latest.ID, batchSize)
+	if err != nil || len(ids) == 0 {
+		return 0, errors.Wrap(err, "select trade to archive failed")
+	}
+	return moveRows(tx, "trade", "id", ids)
+}
+
+func selectIDs(tx *sql.Tx, query string, args ...interface{}) ([]interface{}, error) {
+	rows, err := dbQuery(tx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []interface{}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// moveRows はtableのcolumnがidsの行を table_archive に移します
+func moveRows(tx *sql.Tx, table, column string, ids []interface{}) (int64, error) {
+	in := `IN (?` + strings.Repeat(`, ?`, len(ids)-1) + `)`
+	if _, err := dbExec(tx, `INSERT INTO `+table+`_archive SELECT * FROM `+table+` WHERE `+column+` `+in, ids...); err != nil {
+		return 0, errors.Wrapf(err, "insert %s_archive failed", table)
+	}
+	r, err := dbExec(tx, `DELETE FROM `+table+` WHERE `+column+` `+in, ids...)
+	if err != nil {
+		return 0, errors.Wrapf(err, "delete %s failed", table)
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrapf(err, "delete %s failed", table)
+	}
+	return n, nil
+}
+
+// archivedTrades はtradesに無いトレードをtrade_archiveから読んで足します
+func archivedTrades(d QueryExecutor, tradeIDs []interface{}, trades map[int64]*Trade) error {
+	if !archiveEnabled {
+		return nil
+	}
+	var ids []interface{}
+	for _, id := range tradeIDs {
+		if trades[id.(int64)] == nil {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	ts, err := scanTrades(dbQuery(d, `SELECT * FROM trade_archive WHERE id IN (?`+strings.Repeat(`, ?`, len(ids)-1)+`)`, ids...))
+	if err != nil {
+		return errors.Wrap(err, "select trade_archive failed")
+	}
+	for _, t := range ts {
+		trades[t.ID] = t
+	}
+	return nil
+}
+
+func getArchivedTradeByID(d QueryExecutor, id int64) (*Trade, error) {
+	return scanTrade(dbQuery(d, "SELECT * FROM trade_archive WHERE id = ?", id))
+}
+
+// restoreArchive はInitBenchmarkで初期データを作り直せるように、移したトレードと注文を戻します
+// StartArchiverを呼んでいない場合は何もしません
+func restoreArchive(d QueryExecutor) error {
+	if !archiveEnabled {
+		return nil
+	}
+	for _, table := range []string{"orders", "fills", "trade"} {
+		if _, err := dbExec(d, `INSERT INTO `+table+` SELECT * FROM `+table+`_archive WHERE created_at < '2018-10-16 10:00:00'`); err != nil {
+			return errors.Wrapf(err, "restore %s_archive failed", table)
+		}
+		if _, err := dbExec(d, `DELETE FROM `+table+`_archive`); err != nil {
+			return errors.Wrapf(err, "delete %s_archive failed", table)
+		}
+	}
+	return nil
+}
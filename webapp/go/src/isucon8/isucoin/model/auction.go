@@ -0,0 +1,354 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"isucon8/isubank"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MarketMode は取引の方式の設定です。空の場合は従来どおりザラ場 (continuous) です
+	MarketMode = "market_mode"
+	// AuctionIntervalSec は板寄せを行う間隔 (秒) です
+	AuctionIntervalSec = "auction_interval_sec"
+)
+
+const (
+	// MarketModeContinuous は注文を受け付けるたびにマッチングします
+	MarketModeContinuous = "continuous"
+	// MarketModeAuction は注文を溜めておき、AuctionIntervalSecごとに1つの清算価格でまとめて約定させます (板寄せ)
+	MarketModeAuction = "auction"
+)
+
+const (
+	// DefaultAuctionInterval はAuctionIntervalSecを設定していない場合の板寄せの間隔です
+	DefaultAuctionInterval = 10 * time.Second
+
+	// auctionCheckInterval は板寄せの時刻になったかを確認する間隔です
+	auctionCheckInterval = 100 * time.Millisecond
+)
+
+var ErrAuctionMode = errors.New("板寄せの間は成行注文と即時執行の注文 (IOC, FOK) は受け付けません")
+
+// AuctionSchedule は板寄せの設定です
+type AuctionSchedule struct {
+	Enabled  bool
+	Interval time.Duration
+}
+
+// NextAt はtより後の最初の板寄せの時刻です
+// 全サーバーで同じ時刻になるように、時刻をIntervalで区切ります
+func (s *AuctionSchedule) NextAt(t time.Time) time.Time {
+	return t.Truncate(s.Interval).Add(s.Interval)
+}
+
+// GetAuctionSchedule は板寄せの設定を返します
+func GetAuctionSchedule(d QueryExecutor) (*AuctionSchedule, error) {
+	settings, err := getSettings(d, MarketMode, AuctionIntervalSec)
+	if err != nil {
+		return nil, errors.Wrap(err, "get auction settings failed")
+	}
+	s := &AuctionSchedule{Interval: DefaultAuctionInterval}
+	for _, st := range settings {
+		switch {
+		case st.Val == "":
+		case st.Name == MarketMode:
+			s.Enabled = st.Val == MarketModeAuction
+		case st.Name == AuctionIntervalSec:
+			v, err := strconv.ParseInt(st.Val, 10, 64)
+			if err != nil || v <= 0 {
+				return nil, errors.Errorf("invalid auction setting. %s=%s", st.Name, st.Val)
+			}
+			s.Interval = time.Duration(v) * time.Second
+		}
+	}
+	return s, nil
+}
+
+func isAuctionMode(d QueryExecutor) (bool, error) {
+	mode, err := GetSetting(d, MarketMode)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, errors.Wrapf(err, "getSetting failed. %s", MarketMode)
+	}
+	return mode == MarketModeAuction, nil
+}
+
+// checkContinuousMarket は板寄せの間にErrAuctionModeを返します
+// 成行注文とIOC, FOKの注文は即時に約定させる注文なので、板寄せの間は受け付けません
+func checkContinuousMarket(d QueryExecutor) error {
+	auction, err := isAuctionMode(d)
+	if err != nil {
+		return err
+	}
+	if auction {
+		return ErrAuctionMode
+	}
+	return nil
+}
+
+// StartAuctionScheduler は板寄せの間、AuctionIntervalSecごとにRunAuctionを実行するワーカーを起動します
+// ctxが終了するとワーカーは停止します。EnableMatcherLeaderElectionを呼んでいる場合はリーダーのサーバーだけが実行します
+func StartAuctionScheduler(ctx context.Context, db *sql.DB) {
+	e := matcherElector
+	startWorker(func() {
+		t := time.NewTicker(auctionCheckInterval)
+		defer t.Stop()
+		// last は最後に確認した板寄せの時刻です (ザラ場の間はゼロ)
+		var last time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-t.C:
+				s, err := GetAuctionSchedule(db)
+				if err != nil {
+					log.Printf("[WARN] get auction schedule failed. err:%s", err)
+					continue
+				}
+				if !s.Enabled {
+					if !last.IsZero() {
+						// ザラ場に戻ったので板寄せの間に溜まった注文をマッチングする
+						last = time.Time{}
+						if !SignalMatcher() {
+							if err = RunTrade(db); err != nil {
+								log.Printf("runTrade err:%s", err)
+							}
+						}
+					}
+					continue
+				}
+				slot := now.Truncate(s.Interval)
+				if last.IsZero() {
+					// 板寄せに切り替えた直後は次の時刻まで注文を溜める
+					last = slot
+					continue
+				}
+				if !slot.After(last) {
+					continue
+				}
+				last = slot
+				if e != nil && !e.IsLeader() {
+					continue
+				}
+				res, err := RunAuction(db, slot)
+				switch {
+				case err != nil:
+					log.Printf("[WARN] run auction failed. scheduled_at:%s err:%s", slot.Format(time.RFC3339), err)
+				case res != nil:
+					log.Printf("[INFO] auction cleared. scheduled_at:%s price:%d volume:%d trades:%d", slot.Format(time.RFC3339), res.Price, res.Volume, res.Trades)
+				}
+			}
+		}
+	})
+}
+
+// AuctionResult は1回の板寄せの結果です
+type AuctionResult struct {
+	ScheduledAt time.Time `json:"scheduled_at"`
+	// Price は清算価格で、約定できる注文が無かった場合は0です
+	Price int64 `json:"price"`
+	// Volume は清算価格で約定できる脚数で、部分約定を許可しない注文が約定できずに実際の脚数より少なくなることがあります
+	Volume int64 `json:"volume"`
+	Trades int   `json:"trades"`
+}
+
+// RunAuction はscheduledAtの板寄せを行います
+// 同じ時刻の板寄せはauctionテーブルで1回だけ行うので、複数のサーバーで呼んでも二重には約定しません (既に行われていた場合はnilを返します)
+func RunAuction(db *sql.DB, scheduledAt time.Time) (*AuctionResult, error) {
+	atomic.AddInt64(&tradeQueueDepth, 1)
+	defer atomic.AddInt64(&tradeQueueDepth, -1)
+
+	var res *AuctionResult
+	err := withTradeLock(db, func() (err error) {
+		res, err = runAuction(db, scheduledAt)
+		return
+	})
+	return res, err
+}
+
+func runAuction(db *sql.DB, scheduledAt time.Time) (*AuctionResult, error) {
+	if halted, err := IsTradingHalted(db); err != nil || halted {
+		// 停止中は板寄せを行わずに次の時刻まで注文を溜めておく
+		return nil, err
+	}
+	r, err := dbExec(db, `INSERT IGNORE INTO auction (scheduled_at, created_at) VALUES (?, NOW(6))`, scheduledAt)
+	if err != nil {
+		return nil, errors.Wrap(err, "insert auction failed")
+	}
+	if n, err := r.RowsAffected(); err != nil || n == 0 {
+		// 他のサーバーで行った
+		return nil, errors.Wrap(err, "insert auction failed")
+	}
+
+	buys, err := auctionLevels(db, OrderTypeBuy)
+	if err != nil {
+		return nil, err
+	}
+	sells, err := auctionLevels(db, OrderTypeSell)
+	if err != nil {
+		return nil, err
+	}
+	var last int64
+	lastTrade, err := GetLatestTrade(db)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, errors.Wrap(err, "GetLatestTrade failed")
+	default:
+		last = lastTrade.Price
+	}
+
+	res := &AuctionResult{ScheduledAt: scheduledAt}
+	price, demand, supply := clearingPrice(buys, sells, last)
+	if price > 0 {
+		// 脚数の少ない方の注文をtakerにして、反対側の注文と清算価格で約定させる
+		taker := OrderTypeBuy
+		res.Price, res.Volume = price, demand
+		if supply < demand {
+			taker, res.Volume = OrderTypeSell, supply
+		}
+		ids, err := auctionTakers(db, taker, price)
+		if err != nil {
+			return nil, err
+		}
+	takers:
+		for _, id := range ids {
+			result, err := tradeOrder(db, id, price)
+			switch err {
+			case nil:
+				res.Trades++
+			case ErrNoOrderForTrade, ErrOrderAlreadyClosed, isubank.ErrCreditInsufficient, errSelfTradeCanceled:
+				// 約定できなかった注文は板に残して次の注文を約定させる
+			default:
+				return nil, err
+			}
+			if result != nil && !result.haltedUntil.IsZero() {
+				// サーキットブレーカーが発動したので残りは次の板寄せで約定させる
+				break takers
+			}
+		}
+		if res.Trades > 0 {
+			notifyTrade()
+		}
+	}
+	if _, err = dbExec(db, `UPDATE auction SET price = ?, volume = ?, trades = ?, cleared_at = NOW(6) WHERE scheduled_at = ?`, res.Price, res.Volume, res.Trades, scheduledAt); err != nil {
+		return nil, errors.Wrap(err, "update auction failed")
+	}
+	return res, nil
+}
+
+// auctionLevel は価格ごとの未約定の脚数です
+type auctionLevel struct {
+	price  int64
+	amount int64
+}
+
+func auctionLevels(d QueryExecutor, ot string) ([]*auctionLevel, error) {
+	rows, err := dbQuery(d, `SELECT price, SUM(amount - filled) FROM orders WHERE type = ? AND closed_at IS NULL GROUP BY price`, ot)
+	if err != nil {
+		return nil, errors.Wrapf(err, "select %s levels failed", ot)
+	}
+	defer rows.Close()
+	levels := []*auctionLevel{}
+	for rows.Next() {
+		l := &auctionLevel{}
+		if err = rows.Scan(&l.price, &l.amount); err != nil {
+			return nil, errors.Wrapf(err, "scan %s levels failed", ot)
+		}
+		levels = append(levels, l)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrapf(err, "select %s levels failed", ot)
+	}
+	return levels, nil
+}
+
+// clearingPrice は約定できる脚数が最も多くなる価格を清算価格として、その価格での買いと売りの脚数と一緒に返します
+// 脚数が同じ価格が複数ある場合は、買いと売りの脚数の差が小さい価格、最後の約定価格lastに近い価格、安い価格の順に選びます
+// 約定できる注文が無い場合は0を返します
+func clearingPrice(buys, sells []*auctionLevel, last int64) (price, demand, supply int64) {
+	var volume, imbalance, distance int64
+	candidates := make([]int64, 0, len(buys)+len(sells))
+	for _, l := range buys {
+		candidates = append(candidates, l.price)
+	}
+	for _, l := range sells {
+		candidates = append(candidates, l.price)
+	}
+	for _, p := range candidates {
+		var d, s int64
+		for _, l := range buys {
+			if l.price >= p {
+				d += l.amount
+			}
+		}
+		for _, l := range sells {
+			if l.price <= p {
+				s += l.amount
+			}
+		}
+		v, imb := d, s-d
+		if s < d {
+			v, imb = s, d-s
+		}
+		if v == 0 {
+			continue
+		}
+		dist := p - last
+		if dist < 0 {
+			dist = -dist
+		}
+		switch {
+		case price == 0, v > volume:
+		case v < volume:
+			continue
+		case imb != imbalance:
+			if imb > imbalance {
+				continue
+			}
+		case last > 0 && dist != distance:
+			if dist > distance {
+				continue
+			}
+		case p >= price:
+			continue
+		}
+		price, demand, supply = p, d, s
+		volume, imbalance, distance = v, imb, dist
+	}
+	return price, demand, supply
+}
+
+// auctionTakers は清算価格で約定できるotの注文を優先順に返します
+func auctionTakers(d QueryExecutor, ot string, price int64) ([]int64, error) {
+	q := `SELECT id FROM orders WHERE type = ? AND closed_at IS NULL AND price >= ? ORDER BY price DESC, created_at ASC, id ASC`
+	if ot == OrderTypeSell {
+		q = `SELECT id FROM orders WHERE type = ? AND closed_at IS NULL AND price <= ? ORDER BY price ASC, created_at ASC, id ASC`
+	}
+	rows, err := dbQuery(d, q, ot, price)
+	if err != nil {
+		return nil, errors.Wrap(err, "select auction takers failed")
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, errors.Wrap(err, "scan auction takers failed")
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select auction takers failed")
+	}
+	return ids, nil
+}
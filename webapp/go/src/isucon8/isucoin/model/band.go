@@ -0,0 +1,68 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// PriceBandPercent は指値を受け付ける範囲の設定で、最後の約定価格から上下何%までかです
+// 空または0の場合は範囲を確認しません
+const PriceBandPercent = "price_band_percent"
+
+var ErrPriceOutOfBand = errors.New("注文価格が受け付けられる範囲外です")
+
+// PriceBand は指値を受け付ける価格の範囲です (Lower, Upperを含む)
+type PriceBand struct {
+	Base  int64 `json:"base"`
+	Lower int64 `json:"lower"`
+	Upper int64 `json:"upper"`
+}
+
+// GetPriceBand は現在の指値を受け付ける範囲を返します
+// 設定が無い場合とトレードが無い場合はnilを返します
+func GetPriceBand(d QueryExecutor) (*PriceBand, error) {
+	v, err := GetSetting(d, PriceBandPercent)
+	switch {
+	case err == sql.ErrNoRows || err == nil && v == "":
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrapf(err, "getSetting failed. %s", PriceBandPercent)
+	}
+	percent, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || percent < 0 {
+		return nil, errors.Errorf("invalid setting. %s=%s", PriceBandPercent, v)
+	}
+	if percent == 0 {
+		return nil, nil
+	}
+	trade, err := GetLatestTrade(d)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "GetLatestTrade failed")
+	}
+	band := &PriceBand{
+		Base:  trade.Price,
+		Lower: (trade.Price*(100-percent) + 99) / 100,
+		Upper: trade.Price * (100 + percent) / 100,
+	}
+	if band.Lower < 1 {
+		band.Lower = 1
+	}
+	return band, nil
+}
+
+// checkPriceBand は指値が受け付けられる範囲にあるかを確認します
+func checkPriceBand(d QueryExecutor, price int64) error {
+	band, err := GetPriceBand(d)
+	if err != nil || band == nil {
+		return err
+	}
+	if price < band.Lower || price > band.Upper {
+		return ErrPriceOutOfBand
+	}
+	return nil
+}
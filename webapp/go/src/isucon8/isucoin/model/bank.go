@@ -0,0 +1,223 @@
+package model
+
+import (
+	"isucon8/isubank"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Bank は決済に利用する銀行APIです
+// 残高不足の場合は isubank.ErrCreditInsufficient を、一時的に使えない場合は *isubank.TemporaryError を返してください
+type Bank interface {
+	// Check は残高確認です
+	Check(bankID string, price int64) error
+	// Reserve は仮決済を行い予約IDを返します
+	Reserve(bankID string, price int64) (int64, error)
+	// Commit は仮決済を確定します
+	Commit(reserveIDs []int64) error
+	// Cancel は仮決済を取り消します
+	Cancel(reserveIDs []int64) error
+}
+
+// BankFactory は設定されたエンドポイントとappidからBankを生成します
+type BankFactory func(endpoint, appID string) (Bank, error)
+
+// newBank はSetBankFactoryで差し替えた場合だけ設定します
+var newBank BankFactory
+
+var bankOptions []isubank.Option
+
+// SetBankOptions はISUBANK APIのクライアントの設定 (Transportやタイムアウト) をします
+func SetBankOptions(opts ...isubank.Option) {
+	bankOptions = opts
+}
+
+// SetBankFactory はBankの生成方法を差し替えます
+// テスト用のインプロセス実装やHTTP以外のプロトコルの銀行を利用する場合に使います
+func SetBankFactory(f BankFactory) {
+	newBank = f
+}
+
+// openBank はBankを生成します。isubankの場合はreqIDをX-Request-IDヘッダで送ります
+func openBank(endpoint, appID, reqID string) (Bank, error) {
+	if newBank != nil {
+		return newBank(endpoint, appID)
+	}
+	opts := bankOptions
+	if reqID != "" {
+		// bankOptionsを書き換えないようにコピーしてから追加します
+		opts = append(opts[:len(opts):len(opts)], isubank.WithRequestID(reqID))
+	}
+	return isubank.NewIsubank(endpoint, appID, opts...)
+}
+
+// IsBankUnavailable は銀行APIが一時的に使えない (再送しても5xxやタイムアウトだった、サーキットブレーカーが開いている) 場合にtrueを返します
+func IsBankUnavailable(err error) bool {
+	return isubank.IsTemporary(err) || errors.Cause(err) == ErrBankBreakerOpen
+}
+
+// BankStatus はISUBANK APIの状態です
+type BankStatus struct {
+	Transport   isubank.Stats      `json:"transport"`
+	Breaker     *BankBreakerStatus `json:"breaker,omitempty"`
+	CreditCache *CreditCacheStatus `json:"credit_cache,omitempty"`
+}
+
+// GetBankStatus はISUBANK APIへの接続の統計とサーキットブレーカー, 残高確認のキャッシュの状態を返します
+func GetBankStatus() *BankStatus {
+	s := &BankStatus{
+		Transport: isubank.GetStats(),
+	}
+	if bankCircuit != nil {
+		s.Breaker = bankCircuit.status()
+	}
+	if credits != nil {
+		s.CreditCache = credits.status()
+	}
+	return s
+}
+
+// FakeBank はテスト用のインプロセスの銀行です
+// SetBankFactoryでこの銀行を返すようにすると、ISUBANK APIを起動せずに決済を行えます
+type FakeBank struct {
+	mu       sync.Mutex
+	credits  map[string]int64
+	reserves map[int64]*fakeReserve
+	errs     map[string]error
+	lastID   int64
+}
+
+type fakeReserve struct {
+	bankID string
+	price  int64
+}
+
+// NewFakeBank はユーザーのいないFakeBankを作ります
+func NewFakeBank() *FakeBank {
+	return &FakeBank{
+		credits:  map[string]int64{},
+		reserves: map[int64]*fakeReserve{},
+		errs:     map[string]error{},
+	}
+}
+
+// Factory はSetBankFactoryに渡すBankFactoryで、常にこの銀行を返します
+func (b *FakeBank) Factory() BankFactory {
+	return func(endpoint, appID string) (Bank, error) {
+		return b, nil
+	}
+}
+
+// SetCredit はbankIDのユーザーの残高を設定します
+func (b *FakeBank) SetCredit(bankID string, credit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.credits[bankID] = credit
+}
+
+// Credit はbankIDのユーザーの確定した残高を返します
+func (b *FakeBank) Credit(bankID string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.credits[bankID]
+}
+
+// SetError はbankIDのユーザーの残高確認と仮決済でerrを返すようにします (nilの場合は元に戻します)
+func (b *FakeBank) SetError(bankID string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.errs, bankID)
+		return
+	}
+	b.errs[bankID] = err
+}
+
+// Reserved は確定も取り消しもされていない仮決済の数を返します
+func (b *FakeBank) Reserved() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.reserves)
+}
+
+// available は仮決済で確保した分を除いた残高です
+func (b *FakeBank) available(bankID string) (int64, error) {
+	if err := b.errs[bankID]; err != nil {
+		return 0, err
+	}
+	credit, ok := b.credits[bankID]
+	if !ok {
+		return 0, isubank.ErrNoUser
+	}
+	for _, r := range b.reserves {
+		if r.bankID == bankID && r.price < 0 {
+			credit += r.price
+		}
+	}
+	return credit, nil
+}
+
+func (b *FakeBank) Check(bankID string, price int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	credit, err := b.available(bankID)
+	if err != nil {
+		return err
+	}
+	if credit < price {
+		return isubank.ErrCreditInsufficient
+	}
+	return nil
+}
+
+func (b *FakeBank) Reserve(bankID string, price int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	credit, err := b.available(bankID)
+	if err != nil {
+		return 0, err
+	}
+	if credit+price < 0 {
+		return 0, isubank.ErrCreditInsufficient
+	}
+	b.lastID++
+	b.reserves[b.lastID] = &fakeReserve{bankID: bankID, price: price}
+	return b.lastID, nil
+}
+
+func (b *FakeBank) Commit(reserveIDs []int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.findReserves(reserveIDs); err != nil {
+		return err
+	}
+	for _, id := range reserveIDs {
+		r := b.reserves[id]
+		b.credits[r.bankID] += r.price
+		delete(b.reserves, id)
+	}
+	return nil
+}
+
+func (b *FakeBank) Cancel(reserveIDs []int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.findReserves(reserveIDs); err != nil {
+		return err
+	}
+	for _, id := range reserveIDs {
+		delete(b.reserves, id)
+	}
+	return nil
+}
+
+// findReserves はreserveIDsがすべて未確定の仮決済であることを確認します
+func (b *FakeBank) findReserves(reserveIDs []int64) error {
+	for _, id := range reserveIDs {
+		if _, ok := b.reserves[id]; !ok {
+			return errors.Errorf("reserve not found. id:%d", id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package model
+
+import (
+	"errors"
+	"isucon8/isubank"
+	"testing"
+)
+
+func TestFakeBank(t *testing.T) {
+	bank := NewFakeBank()
+	bank.SetCredit("buyer", 1000)
+	bank.SetCredit("seller", 0)
+
+	if err := bank.Check("buyer", 1000); err != nil {
+		t.Fatalf("check failed: %s", err)
+	}
+	if err := bank.Check("buyer", 1001); err != isubank.ErrCreditInsufficient {
+		t.Fatalf("check over credit: got:%v expected:%v", err, isubank.ErrCreditInsufficient)
+	}
+	if err := bank.Check("nobody", 1); err != isubank.ErrNoUser {
+		t.Fatalf("check unknown user: got:%v expected:%v", err, isubank.ErrNoUser)
+	}
+
+	buy, err := bank.Reserve("buyer", -600)
+	if err != nil {
+		t.Fatalf("reserve buy failed: %s", err)
+	}
+	// 仮決済で確保した分は残高確認と次の仮決済で使えない
+	if err = bank.Check("buyer", 500); err != isubank.ErrCreditInsufficient {
+		t.Fatalf("check after reserve: got:%v expected:%v", err, isubank.ErrCreditInsufficient)
+	}
+	if _, err = bank.Reserve("buyer", -500); err != isubank.ErrCreditInsufficient {
+		t.Fatalf("reserve over credit: got:%v expected:%v", err, isubank.ErrCreditInsufficient)
+	}
+	sell, err := bank.Reserve("seller", 600)
+	if err != nil {
+		t.Fatalf("reserve sell failed: %s", err)
+	}
+	if err = bank.Commit([]int64{buy, sell}); err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+	if got := bank.Credit("buyer"); got != 400 {
+		t.Errorf("buyer credit: got:%d expected:400", got)
+	}
+	if got := bank.Credit("seller"); got != 600 {
+		t.Errorf("seller credit: got:%d expected:600", got)
+	}
+	if err = bank.Commit([]int64{buy}); err == nil {
+		t.Errorf("commit twice should fail")
+	}
+
+	canceled, err := bank.Reserve("buyer", -400)
+	if err != nil {
+		t.Fatalf("reserve failed: %s", err)
+	}
+	if err = bank.Cancel([]int64{canceled}); err != nil {
+		t.Fatalf("cancel failed: %s", err)
+	}
+	if err = bank.Check("buyer", 400); err != nil {
+		t.Errorf("check after cancel failed: %s", err)
+	}
+	if n := bank.Reserved(); n != 0 {
+		t.Errorf("reserved: got:%d expected:0", n)
+	}
+
+	bank.SetError("buyer", &isubank.TemporaryError{Op: "reserve", Err: errors.New("timeout")})
+	if _, err = bank.Reserve("buyer", -1); !isubank.IsTemporary(err) {
+		t.Errorf("reserve with error: got:%v", err)
+	}
+	bank.SetError("buyer", nil)
+	if _, err = bank.Reserve("buyer", -1); err != nil {
+		t.Errorf("reserve after clearing error failed: %s", err)
+	}
+}
+
+func TestFakeBankFactory(t *testing.T) {
+	fake := NewFakeBank()
+	fake.SetCredit("user", 100)
+	SetBankFactory(fake.Factory())
+	defer SetBankFactory(nil)
+
+	bank, err := openBank("http://localhost", "appid", "")
+	if err != nil {
+		t.Fatalf("openBank failed: %s", err)
+	}
+	results := isubank.ReserveBulk(bank.Reserve, []isubank.ReserveRequest{
+		{BankID: "user", Price: -60},
+		{BankID: "user", Price: -60},
+	})
+	var ok, insufficient int
+	for _, r := range results {
+		switch r.Err {
+		case nil:
+			ok++
+		case isubank.ErrCreditInsufficient:
+			insufficient++
+		default:
+			t.Errorf("unexpected reserve error: %s", r.Err)
+		}
+	}
+	if ok != 1 || insufficient != 1 {
+		t.Errorf("reserve bulk: got ok:%d insufficient:%d expected 1 and 1", ok, insufficient)
+	}
+}
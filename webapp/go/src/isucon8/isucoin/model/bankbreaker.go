@@ -0,0 +1,176 @@
+package model
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// 銀行APIのサーキットブレーカーの状態です
+const (
+	BankBreakerClosed   = "closed"
+	BankBreakerOpen     = "open"
+	BankBreakerHalfOpen = "half-open"
+)
+
+var ErrBankBreakerOpen = errors.New("銀行APIが応答しないため一時的に受け付けを停止しています")
+
+// bankBreaker は銀行APIが続けて一時的なエラーを返した場合に、しばらく呼ばずに失敗させます
+// 開いてからopen経過した後の最初の呼び出しだけを試し (half-open)、成功すれば閉じて失敗すればまた開きます
+// 開いている間もCommitとCancelは呼びます (予約済みの決済を確定、取り消しできなくなるため)
+type bankBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	open      time.Duration
+
+	state     string
+	failures  int
+	openUntil time.Time
+	// probing はhalf-openで試している呼び出しがある場合にtrueです
+	probing bool
+}
+
+var bankCircuit *bankBreaker
+
+// EnableBankBreaker は銀行APIがthreshold回続けて一時的なエラーを返した場合に、open の間は呼ばずに失敗させるようにします
+func EnableBankBreaker(threshold int, open time.Duration) {
+	if threshold <= 0 {
+		bankCircuit = nil
+		return
+	}
+	bankCircuit = &bankBreaker{threshold: threshold, open: open, state: BankBreakerClosed}
+}
+
+// ResetBankBreaker はサーキットブレーカーを閉じます
+func ResetBankBreaker() {
+	if b := bankCircuit; b != nil {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.state = BankBreakerClosed
+		b.failures = 0
+		b.probing = false
+	}
+}
+
+// allow は呼び出してよい場合にtrueを返します。trueの場合は結果をdoneで記録してください
+func (b *bankBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BankBreakerOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.state = BankBreakerHalfOpen
+		b.probing = true
+		return true
+	case BankBreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *bankBreaker) done(err error, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !IsBankUnavailable(err) {
+		b.state = BankBreakerClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+	b.failures++
+	if b.state == BankBreakerHalfOpen || b.failures >= b.threshold {
+		if b.state != BankBreakerOpen {
+			log.Printf("[WARN] bank circuit breaker opened. failures:%d, err:%s", b.failures, err)
+		}
+		b.state = BankBreakerOpen
+		b.openUntil = now.Add(b.open)
+		b.probing = false
+	}
+}
+
+// retryAfter は開いている場合に次に試すまでの時間を返します
+func (b *bankBreaker) retryAfter(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != BankBreakerOpen || !now.Before(b.openUntil) {
+		return 0
+	}
+	return b.openUntil.Sub(now)
+}
+
+// BankBreakerStatus は銀行APIのサーキットブレーカーの状態です
+type BankBreakerStatus struct {
+	State     string     `json:"state"`
+	Failures  int        `json:"failures"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+}
+
+func (b *bankBreaker) status() *BankBreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := &BankBreakerStatus{State: b.state, Failures: b.failures}
+	if b.state == BankBreakerOpen {
+		t := b.openUntil
+		s.OpenUntil = &t
+	}
+	return s
+}
+
+// BankRetryAfter は銀行APIのサーキットブレーカーが開いている場合に次に試すまでの時間を返します
+func BankRetryAfter() time.Duration {
+	if bankCircuit == nil {
+		return 0
+	}
+	return bankCircuit.retryAfter(time.Now())
+}
+
+// breakerBank はCheckとReserveをサーキットブレーカーで止めるBankです
+type breakerBank struct {
+	Bank
+	b *bankBreaker
+}
+
+func withBankBreaker(bank Bank) Bank {
+	if bankCircuit == nil {
+		return bank
+	}
+	return &breakerBank{Bank: bank, b: bankCircuit}
+}
+
+func (bb *breakerBank) Check(bankID string, price int64) error {
+	if !bb.b.allow(time.Now()) {
+		return ErrBankBreakerOpen
+	}
+	err := bb.Bank.Check(bankID, price)
+	bb.b.done(err, time.Now())
+	return err
+}
+
+func (bb *breakerBank) Reserve(bankID string, price int64) (int64, error) {
+	if !bb.b.allow(time.Now()) {
+		return 0, ErrBankBreakerOpen
+	}
+	id, err := bb.Bank.Reserve(bankID, price)
+	bb.b.done(err, time.Now())
+	return id, err
+}
+
+func (bb *breakerBank) Commit(reserveIDs []int64) error {
+	err := bb.Bank.Commit(reserveIDs)
+	bb.b.done(err, time.Now())
+	return err
+}
+
+func (bb *breakerBank) Cancel(reserveIDs []int64) error {
+	err := bb.Bank.Cancel(reserveIDs)
+	bb.b.done(err, time.Now())
+	return err
+}
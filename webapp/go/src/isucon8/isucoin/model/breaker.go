@@ -0,0 +1,130 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// サーキットブレーカーの設定です
+// 最後の約定価格がwindow秒以内のトレードの価格からpercent%を超えて動いた場合に、halt秒間取引を停止します
+// percentが空または0の場合は発動しません
+const (
+	CircuitBreakerPercent   = "circuit_breaker_percent"
+	CircuitBreakerWindowSec = "circuit_breaker_window_sec"
+	CircuitBreakerHaltSec   = "circuit_breaker_halt_sec"
+	// TradingHaltedUntil はサーキットブレーカーで停止している期限です (RFC3339Nano)
+	TradingHaltedUntil = "trading_halted_until"
+
+	DefaultCircuitBreakerWindow = 60 * time.Second
+	DefaultCircuitBreakerHalt   = 30 * time.Second
+)
+
+var ErrCircuitBreaker = errors.New("価格の急変により取引を一時停止しています")
+
+// TradingHalt は取引の停止状態です
+type TradingHalt struct {
+	// Halted は管理APIで停止しているかどうかです
+	Halted bool
+	// Until はサーキットブレーカーで停止している期限です
+	Until time.Time
+}
+
+// Active は停止中の場合にtrueを返します
+func (t *TradingHalt) Active(now time.Time) bool {
+	return t.Halted || now.Before(t.Until)
+}
+
+// GetTradingHalt は取引の停止状態を返します
+// 複数台で動かす場合も同じ状態になるように毎回DBを参照します
+func GetTradingHalt(d QueryExecutor) (*TradingHalt, error) {
+	settings, err := scanSettings(dbQuery(d, `SELECT * FROM setting WHERE name IN (?, ?)`, TradingHalted, TradingHaltedUntil))
+	if err != nil {
+		return nil, errors.Wrap(err, "get trading halt settings failed")
+	}
+	t := &TradingHalt{}
+	for _, s := range settings {
+		switch {
+		case s.Val == "":
+		case s.Name == TradingHalted:
+			t.Halted = s.Val == "1"
+		case s.Name == TradingHaltedUntil:
+			if t.Until, err = time.Parse(time.RFC3339Nano, s.Val); err != nil {
+				return nil, errors.Wrapf(err, "invalid setting. %s=%s", s.Name, s.Val)
+			}
+		}
+	}
+	return t, nil
+}
+
+type circuitBreaker struct {
+	percent int64
+	window  time.Duration
+	halt    time.Duration
+}
+
+func getCircuitBreaker(d QueryExecutor) (*circuitBreaker, error) {
+	settings, err := getSettings(d, CircuitBreakerPercent, CircuitBreakerWindowSec, CircuitBreakerHaltSec)
+	if err != nil {
+		return nil, errors.Wrap(err, "get circuit breaker settings failed")
+	}
+	cb := &circuitBreaker{window: DefaultCircuitBreakerWindow, halt: DefaultCircuitBreakerHalt}
+	for _, s := range settings {
+		if s.Val == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(s.Val, 10, 64)
+		if err != nil || v <= 0 {
+			return nil, errors.Errorf("invalid circuit breaker setting. %s=%s", s.Name, s.Val)
+		}
+		switch s.Name {
+		case CircuitBreakerPercent:
+			cb.percent = v
+		case CircuitBreakerWindowSec:
+			cb.window = time.Duration(v) * time.Second
+		case CircuitBreakerHaltSec:
+			cb.halt = time.Duration(v) * time.Second
+		}
+	}
+	return cb, nil
+}
+
+// checkCircuitBreaker は約定価格priceのトレードを記録した後に呼び、価格が急変していれば取引を停止します
+// 停止した場合は期限を返します
+func checkCircuitBreaker(tx *sql.Tx, price int64) (time.Time, error) {
+	cb, err := getCircuitBreaker(tx)
+	if err != nil || cb.percent == 0 {
+		return time.Time{}, err
+	}
+	var min, max int64
+	err = tx.QueryRow(`SELECT MIN(price), MAX(price) FROM trade WHERE created_at >= NOW(6) - INTERVAL ? MICROSECOND`,
+		int64(cb.window/time.Microsecond)).Scan(&min, &max)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "select trade price range failed")
+	}
+	if (price-min)*100 <= cb.percent*min && (max-price)*100 <= cb.percent*max {
+		return time.Time{}, nil
+	}
+	until := time.Now().Add(cb.halt)
+	if err = SetSetting(tx, TradingHaltedUntil, until.Format(time.RFC3339Nano)); err != nil {
+		return time.Time{}, errors.Wrapf(err, "set setting failed. %s", TradingHaltedUntil)
+	}
+	sendLog(tx, "circuit_breaker", map[string]interface{}{
+		"price": price,
+		"min":   min,
+		"max":   max,
+		"until": until,
+	})
+	return until, nil
+}
+
+// resumeAfterCircuitBreaker は停止の期限が来たら停止中に成立するようになった注文のマッチングを依頼します
+// マッチングのワーカーが起動していない場合は次の注文のときにマッチングします
+func resumeAfterCircuitBreaker(until time.Time) {
+	time.AfterFunc(time.Until(until), func() {
+		SignalMatcher()
+		SignalStopWatcher()
+	})
+}
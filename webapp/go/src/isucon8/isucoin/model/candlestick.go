@@ -0,0 +1,163 @@
+package model
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GetCandlestickData の足の単位です。値は集計に使うDATE_FORMATの書式です
+const (
+	CandlestickBySec  = "%Y-%m-%d %H:%i:%s"
+	CandlestickByMin  = "%Y-%m-%d %H:%i:00"
+	CandlestickByHour = "%Y-%m-%d %H:00:00"
+)
+
+// candlestickTables は足ごとの集計テーブルです
+// トレード成立時にcommitReservedOrderで同じトランザクション内で更新します
+var candlestickTables = []struct {
+	tf    string
+	table string
+}{
+	{CandlestickBySec, "candlestick_sec"},
+	{CandlestickByMin, "candlestick_min"},
+	{CandlestickByHour, "candlestick_hour"},
+}
+
+// candlestickColumns はCandlestickDataの順に並べた列です
+const candlestickColumns = `t, open, close, high, low, volume, IF(volume > 0, turnover / volume, 0)`
+
+func candlestickTable(tf string) (string, error) {
+	for _, c := range candlestickTables {
+		if c.tf == tf {
+			return c.table, nil
+		}
+	}
+	return "", errors.Errorf("unknown candlestick format [%s]", tf)
+}
+
+func GetCandlestickData(d QueryExecutor, mt time.Time, tf string) ([]*CandlestickData, error) {
+	table, err := candlestickTable(tf)
+	if err != nil {
+		return nil, err
+	}
+	return scanCandlestickDatas(stmtQuery(d, candlestickQuery(table), mt))
+}
+
+// candlestickResolutions はGetCandlesticksRangeで指定できる足の長さです
+// 集計テーブルの無い長さは短い足から作ります
+var candlestickResolutions = map[string]struct {
+	tf   string
+	step time.Duration
+}{
+	"1s": {CandlestickBySec, time.Second},
+	"1m": {CandlestickByMin, time.Minute},
+	"5m": {CandlestickByMin, 5 * time.Minute},
+	"1h": {CandlestickByHour, time.Hour},
+}
+
+// CandlestickStep は足の長さを返します。指定できない場合は0を返します
+func CandlestickStep(resolution string) time.Duration {
+	return candlestickResolutions[resolution].step
+}
+
+// GetCandlesticksRange はfrom以上to未満の足を返します
+func GetCandlesticksRange(d QueryExecutor, resolution string, from, to time.Time) ([]*CandlestickData, error) {
+	r, ok := candlestickResolutions[resolution]
+	if !ok || !from.Before(to) {
+		return nil, ErrParameterInvalid
+	}
+	table, err := candlestickTable(r.tf)
+	if err != nil {
+		return nil, err
+	}
+	from = from.Truncate(r.step)
+	rows, err := scanCandlestickDatas(dbQuery(d, `SELECT `+candlestickColumns+` FROM `+table+` WHERE t >= ? AND t < ? ORDER BY t`, from, to))
+	if err != nil {
+		return nil, errors.Wrapf(err, "select %s failed", table)
+	}
+	// 短い足をstepごとにまとめる (行は時間順なので始値は最初、終値は最後の足になる)
+	res := make([]*CandlestickData, 0, len(rows))
+	var (
+		cur      *CandlestickData
+		turnover float64
+	)
+	for _, c := range rows {
+		t := c.Time.Truncate(r.step)
+		if cur == nil || !cur.Time.Equal(t) {
+			cur = &CandlestickData{Time: t, Open: c.Open, High: c.High, Low: c.Low}
+			turnover = 0
+			res = append(res, cur)
+		}
+		cur.Close = c.Close
+		cur.Volume += c.Volume
+		turnover += c.VWAP * float64(c.Volume)
+		if cur.Volume > 0 {
+			cur.VWAP = turnover / float64(cur.Volume)
+		}
+		if c.High > cur.High {
+			cur.High = c.High
+		}
+		if c.Low < cur.Low {
+			cur.Low = c.Low
+		}
+	}
+	return res, nil
+}
+
+// addCandlestick は成立したトレードを各足に反映します
+// open_id, close_idで比較するので、トレードの反映順が前後しても始値と終値は正しくなります
+func addCandlestick(d QueryExecutor, tradeID int64) error {
+	for _, c := range candlestickTables {
+		query := fmt.Sprintf(`
+			INSERT INTO %s (t, open, close, high, low, volume, turnover, open_id, close_id)
+			SELECT STR_TO_DATE(DATE_FORMAT(created_at, '%s'), '%s'), price, price, price, price, amount, amount * price, id, id
+			FROM trade WHERE id = ?
+			ON DUPLICATE KEY UPDATE
+				open = IF(VALUES(open_id) < open_id, VALUES(open), open),
+				open_id = LEAST(open_id, VALUES(open_id)),
+				close = IF(VALUES(close_id) > close_id, VALUES(close), close),
+				close_id = GREATEST(close_id, VALUES(close_id)),
+				high = GREATEST(high, VALUES(high)),
+				low = LEAST(low, VALUES(low)),
+				volume = volume + VALUES(volume),
+				turnover = turnover + VALUES(turnover)
+		`, c.table, c.tf, "%Y-%m-%d %H:%i:%s")
+		if _, err := dbExec(d, query, tradeID); err != nil {
+			return errors.Wrapf(err, "update %s failed", c.table)
+		}
+	}
+	return nil
+}
+
+// rebuildCandlestick はtradeテーブルから各足を作り直します
+func rebuildCandlestick(d QueryExecutor) error {
+	for _, c := range candlestickTables {
+		if _, err := dbExec(d, `DELETE FROM `+c.table); err != nil {
+			return errors.Wrapf(err, "delete %s failed", c.table)
+		}
+		query := fmt.Sprintf(`
+			INSERT INTO %s (t, open, close, high, low, volume, turnover, open_id, close_id)
+			SELECT m.t, a.price, b.price, m.h, m.l, m.v, m.tv, m.min_id, m.max_id
+			FROM (
+				SELECT
+					STR_TO_DATE(DATE_FORMAT(created_at, '%s'), '%s') AS t,
+					MIN(id) AS min_id,
+					MAX(id) AS max_id,
+					MAX(price) AS h,
+					MIN(price) AS l,
+					SUM(amount) AS v,
+					SUM(amount * price) AS tv
+				FROM trade
+				GROUP BY t
+			) m
+			JOIN trade a ON a.id = m.min_id
+			JOIN trade b ON b.id = m.max_id
+		`, c.table, c.tf, "%Y-%m-%d %H:%i:%s")
+		if _, err := dbExec(d, query); err != nil {
+			return errors.Wrapf(err, "rebuild %s failed", c.table)
+		}
+	}
+	return nil
+}
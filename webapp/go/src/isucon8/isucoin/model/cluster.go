@@ -0,0 +1,76 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// DBCluster はプライマリとリードレプリカの接続です
+// 更新とロックを取る読み込みはPrimaryで、遅れてもよい読み込みだけをReplicaで行います
+type DBCluster struct {
+	Primary  *sql.DB
+	replicas []*sql.DB
+	next     uint32
+}
+
+// NewDBCluster はプライマリとレプリカに接続します。レプリカが無い場合はすべてプライマリで行います
+func NewDBCluster(primaryDSN string, replicaDSNs ...string) (*DBCluster, error) {
+	primary, err := sql.Open("mysql", primaryDSN)
+	if err != nil {
+		return nil, errors.Wrap(err, "open primary failed")
+	}
+	c := &DBCluster{Primary: primary}
+	for _, dsn := range replicaDSNs {
+		replica, err := sql.Open("mysql", dsn)
+		if err != nil {
+			c.Close()
+			return nil, errors.Wrap(err, "open replica failed")
+		}
+		c.replicas = append(c.replicas, replica)
+	}
+	return c, nil
+}
+
+// Replica は読み込み専用のクエリを実行する接続をラウンドロビンで返します
+func (c *DBCluster) Replica() *sql.DB {
+	if len(c.replicas) == 0 {
+		return c.Primary
+	}
+	n := atomic.AddUint32(&c.next, 1)
+	return c.replicas[n%uint32(len(c.replicas))]
+}
+
+// SetMaxConns はプライマリとレプリカそれぞれの最大接続数と最大アイドル接続数を設定します。0の場合は変更しません
+func (c *DBCluster) SetMaxConns(open, idle int) {
+	for _, db := range append([]*sql.DB{c.Primary}, c.replicas...) {
+		if open > 0 {
+			db.SetMaxOpenConns(open)
+		}
+		if idle > 0 {
+			db.SetMaxIdleConns(idle)
+		}
+	}
+}
+
+// Stats は接続の統計を返します。キーは primary, replica0, replica1... です
+func (c *DBCluster) Stats() map[string]sql.DBStats {
+	s := make(map[string]sql.DBStats, len(c.replicas)+1)
+	s["primary"] = c.Primary.Stats()
+	for i, r := range c.replicas {
+		s["replica"+strconv.Itoa(i)] = r.Stats()
+	}
+	return s
+}
+
+func (c *DBCluster) Close() error {
+	err := c.Primary.Close()
+	for _, r := range c.replicas {
+		if e := r.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
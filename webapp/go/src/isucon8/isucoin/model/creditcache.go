@@ -0,0 +1,288 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"isucon8/isubank"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultCreditCacheTTL は銀行で確認した残高を使い回す時間です
+const DefaultCreditCacheTTL = 5 * time.Second
+
+// creditCache は銀行で確認した利用できる残高の下限をユーザーごとに覚えておき、それ以下の残高確認を銀行に問い合わせずに済ませます
+// 銀行APIは残高そのものを返さないので、Checkが成功した金額を下限とし、このサーバーで予約した買い注文の仮決済の分だけ減らします
+// 他のサーバーでの予約や銀行での出金は反映されないため、通った注文も約定時の仮決済で残高不足になれば取り消されます
+type creditCache struct {
+	mu  sync.Mutex
+	ttl time.Duration
+
+	users map[string]*creditEntry
+	// reserves はこのサーバーで予約した買い注文の仮決済で、取り消した場合に下限を戻します
+	reserves map[int64]*creditReserve
+
+	hits   int64
+	misses int64
+}
+
+type creditEntry struct {
+	// floor は利用できる残高の下限です
+	floor     int64
+	checkedAt time.Time
+	usedAt    time.Time
+}
+
+type creditReserve struct {
+	bankID     string
+	amount     int64
+	reservedAt time.Time
+}
+
+var credits *creditCache
+
+// EnableCreditCache は買い注文の残高確認で銀行に問い合わせた結果をttlの間使い回すようにします (0以下の場合は使いません)
+// StartCreditCacheReconcilerで使われているユーザーの残高を定期的に確認し直してください
+func EnableCreditCache(ttl time.Duration) {
+	if ttl <= 0 {
+		credits = nil
+		return
+	}
+	credits = &creditCache{
+		ttl:      ttl,
+		users:    map[string]*creditEntry{},
+		reserves: map[int64]*creditReserve{},
+	}
+}
+
+// ResetCreditCache は覚えている残高をすべて捨てます
+func ResetCreditCache() {
+	if c := credits; c != nil {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.users = map[string]*creditEntry{}
+		c.reserves = map[int64]*creditReserve{}
+	}
+}
+
+// check はpriceが確認済みの下限以下の場合にtrueを返します
+func (c *creditCache) check(bankID string, price int64, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.users[bankID]
+	if !ok || now.Sub(e.checkedAt) >= c.ttl || price > e.floor {
+		c.misses++
+		return false
+	}
+	e.usedAt = now
+	c.hits++
+	return true
+}
+
+// confirmed は銀行でpriceの残高確認が成功したことを記録します
+func (c *creditCache) confirmed(bankID string, price int64, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.users[bankID]; ok && now.Sub(e.checkedAt) < c.ttl && e.floor >= price {
+		e.usedAt = now
+		return
+	}
+	c.users[bankID] = &creditEntry{floor: price, checkedAt: now, usedAt: now}
+}
+
+// forget は残高不足だったユーザーの下限を捨てます
+func (c *creditCache) forget(bankID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, bankID)
+}
+
+// reserved は予約した仮決済を記録します。買い注文 (priceが負) の場合は下限を減らします
+func (c *creditCache) reserved(bankID string, price, reserveID int64, now time.Time) {
+	if price >= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.users[bankID]; ok {
+		e.floor += price
+	}
+	c.reserves[reserveID] = &creditReserve{bankID: bankID, amount: -price, reservedAt: now}
+}
+
+// released は確定または取り消した仮決済の記録を消し、取り消した場合は下限を戻します
+func (c *creditCache) released(reserveIDs []int64, canceled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range reserveIDs {
+		r, ok := c.reserves[id]
+		if !ok {
+			continue
+		}
+		delete(c.reserves, id)
+		if e, ok := c.users[r.bankID]; ok && canceled {
+			e.floor += r.amount
+		}
+	}
+}
+
+// stale は最近使われていて、確認してからintervalを過ぎたユーザーの下限を返します
+// 使われなくなったユーザーと、期限切れになった仮決済の記録はここで捨てます
+func (c *creditCache) stale(now time.Time, interval time.Duration) map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	floors := map[string]int64{}
+	for bankID, e := range c.users {
+		switch {
+		case now.Sub(e.usedAt) >= c.ttl:
+			delete(c.users, bankID)
+		case now.Sub(e.checkedAt) >= interval:
+			floors[bankID] = e.floor
+		}
+	}
+	for id, r := range c.reserves {
+		if now.Sub(r.reservedAt) >= BankReserveExpire {
+			delete(c.reserves, id)
+		}
+	}
+	return floors
+}
+
+// refreshed は確認し直した結果を記録します。確認している間に下限が変わった場合は次の確認に任せます
+func (c *creditCache) refreshed(bankID string, floor int64, ok bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.users[bankID]
+	switch {
+	case !found || e.floor != floor:
+	case ok:
+		e.checkedAt = now
+	default:
+		delete(c.users, bankID)
+	}
+}
+
+// CreditCacheStatus は残高確認のキャッシュの状態です
+type CreditCacheStatus struct {
+	Users    int   `json:"users"`
+	Reserves int   `json:"reserves"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+}
+
+func (c *creditCache) status() *CreditCacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &CreditCacheStatus{Users: len(c.users), Reserves: len(c.reserves), Hits: c.hits, Misses: c.misses}
+}
+
+// StartCreditCacheReconciler は使われているユーザーの残高をttlの半分ごとに銀行で確認し直すワーカーを起動します
+// 確認できたユーザーは引き続き銀行に問い合わせずに残高確認を行い、残高不足になったユーザーは次の注文で銀行に問い合わせます
+// ctxが終了すると停止します
+func StartCreditCacheReconciler(ctx context.Context, db *sql.DB) {
+	c := credits
+	if c == nil {
+		return
+	}
+	interval := c.ttl / 2
+	startWorker(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := reconcileCredits(db, c, interval); err != nil {
+					log.Printf("[WARN] reconcile credit cache failed. err:%s", err)
+				}
+			}
+		}
+	})
+}
+
+func reconcileCredits(db *sql.DB, c *creditCache, interval time.Duration) error {
+	floors := c.stale(time.Now(), interval)
+	if len(floors) == 0 {
+		return nil
+	}
+	bank, err := plainIsubank(db)
+	if err != nil {
+		return errors.Wrap(err, "isubank init failed")
+	}
+	bank = withBankBreaker(bank)
+	for bankID, floor := range floors {
+		check := floor
+		if check < 0 {
+			check = 0
+		}
+		err := bank.Check(bankID, check)
+		switch {
+		case err == nil:
+			c.refreshed(bankID, floor, true, time.Now())
+		case err == isubank.ErrCreditInsufficient || err == isubank.ErrNoUser:
+			c.refreshed(bankID, floor, false, time.Now())
+		default:
+			// 確認できなかったユーザーはttlを過ぎれば注文のときに銀行に問い合わせる
+			return errors.Wrapf(err, "isubank check failed. bank_id:%s", bankID)
+		}
+	}
+	return nil
+}
+
+// cachedCreditBank はCheckをcreditCacheで済ませ、予約と取り消しを下限に反映するBankです
+type cachedCreditBank struct {
+	Bank
+	c *creditCache
+}
+
+func withCreditCache(bank Bank) Bank {
+	if credits == nil {
+		return bank
+	}
+	return &cachedCreditBank{Bank: bank, c: credits}
+}
+
+func (cb *cachedCreditBank) Check(bankID string, price int64) error {
+	if cb.c.check(bankID, price, time.Now()) {
+		return nil
+	}
+	err := cb.Bank.Check(bankID, price)
+	switch {
+	case err == nil:
+		cb.c.confirmed(bankID, price, time.Now())
+	case err == isubank.ErrCreditInsufficient:
+		cb.c.forget(bankID)
+	}
+	return err
+}
+
+func (cb *cachedCreditBank) Reserve(bankID string, price int64) (int64, error) {
+	id, err := cb.Bank.Reserve(bankID, price)
+	switch {
+	case err == nil:
+		cb.c.reserved(bankID, price, id, time.Now())
+	case err == isubank.ErrCreditInsufficient:
+		cb.c.forget(bankID)
+	}
+	return id, err
+}
+
+func (cb *cachedCreditBank) Commit(reserveIDs []int64) error {
+	err := cb.Bank.Commit(reserveIDs)
+	if err == nil {
+		cb.c.released(reserveIDs, false)
+	}
+	return err
+}
+
+func (cb *cachedCreditBank) Cancel(reserveIDs []int64) error {
+	err := cb.Bank.Cancel(reserveIDs)
+	if err == nil {
+		cb.c.released(reserveIDs, true)
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// DefaultQueryTimeout はリクエストの中で実行する1つのクエリを待つ時間の上限です
+const DefaultQueryTimeout = 5 * time.Second
+
+var queryTimeout = DefaultQueryTimeout
+
+// SetQueryTimeout はリクエストの中で実行する1つのクエリのタイムアウトを設定します (0の場合はリクエストが終わるまで待ちます)
+func SetQueryTimeout(d time.Duration) {
+	queryTimeout = d
+}
+
+type contextExecutor interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}
+
+// ctxDB はクエリをctxで実行するQueryExecutorです
+type ctxDB struct {
+	ctx context.Context
+	db  *sql.DB
+}
+
+// WithContext はdbのクエリをctxで実行するQueryExecutorを返します
+// ctxが終了した場合 (クライアントが切断した場合など) は実行中のクエリを中断します
+// クエリごとにSetQueryTimeoutのタイムアウトを付け、ctxの期限の方が早い場合はctxの期限までにします
+func WithContext(ctx context.Context, db *sql.DB) QueryExecutor {
+	if ctx.Done() == nil {
+		return db
+	}
+	return &ctxDB{ctx: ctx, db: db}
+}
+
+func (c *ctxDB) Exec(q string, args ...interface{}) (sql.Result, error) {
+	return dbExec(c, q, args...)
+}
+
+func (c *ctxDB) Query(q string, args ...interface{}) (*sql.Rows, error) {
+	return dbQuery(c, q, args...)
+}
+
+// baseDB はdが*sql.DBまたはWithContextで作ったものの場合に元の*sql.DBを返します
+func baseDB(d QueryExecutor) (*sql.DB, bool) {
+	switch d := d.(type) {
+	case *sql.DB:
+		return d, true
+	case *ctxDB:
+		return d.db, true
+	}
+	return nil, false
+}
+
+// contextOf はdでクエリを実行するctxと、ctxを渡して実行する先を返します
+// WithContextで作ったものとTxScopeのトランザクション以外や、終了しないctx (バックグラウンドの処理) の場合はnilを返します
+func contextOf(d QueryExecutor) (context.Context, contextExecutor) {
+	switch d := d.(type) {
+	case *ctxDB:
+		return d.ctx, d.db
+	case *sql.Tx:
+		if s := txStateOf(d); s != nil && s.ctx.Done() != nil {
+			return s.ctx, d
+		}
+	}
+	return nil, nil
+}
+
+// queryContext はparentから1つのクエリを実行するctxを作ります
+func queryContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if queryTimeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, queryTimeout)
+}
+
+// dbExec はdのctxとクエリのタイムアウトでExecします
+func dbExec(d QueryExecutor, q string, args ...interface{}) (sql.Result, error) {
+	parent, ce := contextOf(d)
+	if parent == nil {
+		return d.Exec(q, args...)
+	}
+	defer traceQuery(parent, q, time.Now())
+	ctx, cancel := queryContext(parent)
+	defer cancel()
+	return ce.ExecContext(ctx, q, args...)
+}
+
+// dbQuery はdのctxとクエリのタイムアウトでQueryします
+func dbQuery(d QueryExecutor, q string, args ...interface{}) (*sql.Rows, error) {
+	parent, ce := contextOf(d)
+	if parent == nil {
+		return d.Query(q, args...)
+	}
+	defer traceQuery(parent, q, time.Now())
+	ctx, cancel := queryContext(parent)
+	rows, err := ce.QueryContext(ctx, q, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// Rowsは読み終わるまでctxを使うので、ここではcancelしない
+	// タイムアウトしたときかparent (リクエストまたはトランザクション) が終了したときに解放される
+	_ = cancel
+	return rows, nil
+}
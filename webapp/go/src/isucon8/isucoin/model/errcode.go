@@ -0,0 +1,96 @@
+package model
+
+import (
+	"github.com/pkg/errors"
+)
+
+// エラーのコードです。エラーのレスポンスの error_code で返します
+// メッセージは変わることがあるので、クライアントはメッセージではなくコードで判定してください (コードは変えません)
+const (
+	ErrorCodeParameterInvalid    = "PARAMETER_INVALID"
+	ErrorCodeCreditInsufficient  = "CREDIT_INSUFFICIENT"
+	ErrorCodeIsuInsufficient     = "ISU_INSUFFICIENT"
+	ErrorCodePriceOutOfBand      = "PRICE_OUT_OF_BAND"
+	ErrorCodeOrderNotFound       = "ORDER_NOT_FOUND"
+	ErrorCodeOrderAlreadyClosed  = "ORDER_ALREADY_CLOSED"
+	ErrorCodeMarketOrderUnfilled = "MARKET_ORDER_UNFILLED"
+	ErrorCodeOrderUnfilled       = "ORDER_UNFILLED"
+	ErrorCodeTradingHalted       = "TRADING_HALTED"
+	ErrorCodeCircuitBreaker      = "CIRCUIT_BREAKER"
+	ErrorCodeAuctionMode         = "AUCTION_MODE"
+	ErrorCodeBankUnavailable     = "BANK_UNAVAILABLE"
+	ErrorCodeBankUserNotFound    = "BANK_USER_NOT_FOUND"
+	ErrorCodeBankUserConflict    = "BANK_USER_CONFLICT"
+	ErrorCodeUserNotFound        = "USER_NOT_FOUND"
+	ErrorCodePasswordMismatch    = "PASSWORD_MISMATCH"
+	ErrorCodeSigninLocked        = "SIGNIN_LOCKED"
+	ErrorCodeMFARequired         = "MFA_REQUIRED"
+	ErrorCodeMFAInvalid          = "MFA_INVALID"
+	ErrorCodeMFAAlreadyEnabled   = "MFA_ALREADY_ENABLED"
+	ErrorCodeMFANotEnrolled      = "MFA_NOT_ENROLLED"
+	ErrorCodeAPIKeyNotFound      = "API_KEY_NOT_FOUND"
+	ErrorCodeAPIKeyInvalid       = "API_KEY_INVALID"
+	ErrorCodeJWTDisabled         = "JWT_DISABLED"
+	ErrorCodeJWTInvalid          = "JWT_INVALID"
+	ErrorCodeWebhookNotFound     = "WEBHOOK_NOT_FOUND"
+	ErrorCodeWebhookURLInvalid   = "WEBHOOK_URL_INVALID"
+	ErrorCodeWebhookLimit        = "WEBHOOK_LIMIT"
+	ErrorCodeAlertNotFound       = "ALERT_NOT_FOUND"
+	ErrorCodeAlertLimit          = "ALERT_LIMIT"
+	ErrorCodeSessionNotFound     = "SESSION_NOT_FOUND"
+	ErrorCodeMaintenance         = "MAINTENANCE"
+	ErrorCodeLockTimeout         = "LOCK_TIMEOUT"
+)
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{ErrParameterInvalid, ErrorCodeParameterInvalid},
+	{ErrCreditInsufficient, ErrorCodeCreditInsufficient},
+	{ErrIsuInsufficient, ErrorCodeIsuInsufficient},
+	{ErrPriceOutOfBand, ErrorCodePriceOutOfBand},
+	{ErrOrderNotFound, ErrorCodeOrderNotFound},
+	{ErrOrderAlreadyClosed, ErrorCodeOrderAlreadyClosed},
+	{ErrMarketOrderUnfilled, ErrorCodeMarketOrderUnfilled},
+	{ErrOrderUnfilled, ErrorCodeOrderUnfilled},
+	{ErrTradingHalted, ErrorCodeTradingHalted},
+	{ErrCircuitBreaker, ErrorCodeCircuitBreaker},
+	{ErrAuctionMode, ErrorCodeAuctionMode},
+	{ErrBankUserNotFound, ErrorCodeBankUserNotFound},
+	{ErrBankUserConflict, ErrorCodeBankUserConflict},
+	{ErrUserNotFound, ErrorCodeUserNotFound},
+	{ErrPasswordMismatch, ErrorCodePasswordMismatch},
+	{ErrSigninLocked, ErrorCodeSigninLocked},
+	{ErrMFARequired, ErrorCodeMFARequired},
+	{ErrMFAInvalid, ErrorCodeMFAInvalid},
+	{ErrMFAAlreadyEnabled, ErrorCodeMFAAlreadyEnabled},
+	{ErrMFANotEnrolled, ErrorCodeMFANotEnrolled},
+	{ErrAPIKeyNotFound, ErrorCodeAPIKeyNotFound},
+	{ErrAPIKeyInvalid, ErrorCodeAPIKeyInvalid},
+	{ErrJWTDisabled, ErrorCodeJWTDisabled},
+	{ErrJWTInvalid, ErrorCodeJWTInvalid},
+	{ErrWebhookNotFound, ErrorCodeWebhookNotFound},
+	{ErrWebhookURLInvalid, ErrorCodeWebhookURLInvalid},
+	{ErrWebhookLimit, ErrorCodeWebhookLimit},
+	{ErrAlertNotFound, ErrorCodeAlertNotFound},
+	{ErrAlertLimit, ErrorCodeAlertLimit},
+	{ErrSessionNotFound, ErrorCodeSessionNotFound},
+	{ErrMaintenance, ErrorCodeMaintenance},
+	{ErrTradeLockTimeout, ErrorCodeLockTimeout},
+	{ErrUserLockTimeout, ErrorCodeLockTimeout},
+}
+
+// ErrorCode はerrのコードを返します。modelのエラーでない場合は空文字列を返します
+func ErrorCode(err error) string {
+	if IsBankUnavailable(err) {
+		return ErrorCodeBankUnavailable
+	}
+	cause := errors.Cause(err)
+	for _, c := range errorCodes {
+		if cause == c.err {
+			return c.code
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultExpireInterval は有効期限を過ぎた注文を探す間隔です
+const DefaultExpireInterval = 1 * time.Second
+
+// SetOrderExpiresAt は同じトランザクションで受け付けた注文に有効期限を設定します
+func SetOrderExpiresAt(tx *sql.Tx, order *Order, expiresAt time.Time) (*Order, error) {
+	if !expiresAt.After(time.Now()) {
+		return nil, ErrParameterInvalid
+	}
+	if _, err := dbExec(tx, `UPDATE orders SET expires_at = ? WHERE id = ?`, expiresAt, order.ID); err != nil {
+		return nil, errors.Wrap(err, "update orders for expires_at")
+	}
+	return GetOrderByID(tx, order.ID)
+}
+
+// StartOrderExpirer はExpireOrdersを定期的に実行するワーカーを起動します
+// ctxが終了するとワーカーは停止します
+func StartOrderExpirer(ctx context.Context, db *sql.DB, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultExpireInterval
+	}
+	startWorker(func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				if _, err := ExpireOrders(db); err != nil {
+					log.Printf("[WARN] expire orders failed. err:%s", err)
+				}
+			}
+		}
+	})
+}
+
+// ExpireOrders は有効期限を過ぎた未約定の注文を取り消し、取り消した件数を返します
+func ExpireOrders(db *sql.DB) (int, error) {
+	orders, err := scanOrders(db.Query(`SELECT * FROM orders WHERE closed_at IS NULL AND expires_at <= NOW(6) ORDER BY expires_at ASC, id ASC`))
+	if err != nil {
+		return 0, errors.Wrap(err, "find expired orders failed")
+	}
+	n := 0
+	for _, o := range orders {
+		expired, err := expireOrder(db, o.ID)
+		if err != nil {
+			return n, err
+		}
+		if expired {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func expireOrder(db *sql.DB, id int64) (bool, error) {
+	var expired bool
+	err := TxScope(context.Background(), db, nil, func(tx *sql.Tx) error {
+		order, err := getOrderByIDWithLock(tx, id)
+		if err != nil {
+			return errors.Wrapf(err, "getOrderByIDWithLock failed. id:%d", id)
+		}
+		// 期限までに約定または取り消しされていた場合は何もしない
+		if expired = order.ClosedAt == nil; !expired {
+			return nil
+		}
+		return cancelOrder(tx, order, CancelReasonExpired)
+	})
+	if err != nil || !expired {
+		return false, err
+	}
+	BookRemoveOrders(id)
+	order, err := GetOrderByID(db, id)
+	if err != nil {
+		return true, errors.Wrapf(err, "GetOrderByID failed. id:%d", id)
+	}
+	PublishOrderEvent(&OrderEvent{Event: OrderEventCanceled, Reason: CancelReasonExpired, Order: order})
+	return true, nil
+}
@@ -0,0 +1,52 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// OrderIterator は注文を1行ずつ読みます。全件をメモリに載せないので、件数の多いエクスポートに使います
+// 使い終わったら必ずCloseを呼んでください
+type OrderIterator struct {
+	rows  *sql.Rows
+	order *Order
+	err   error
+}
+
+// IterateOrderHistory はユーザーのすべての注文を、成立したトレードを埋めてid順に読むOrderIteratorを返します
+// 読み終わるまで時間がかかるので、SetQueryTimeoutのタイムアウトは付けずにctxが終了するまで読みます
+func IterateOrderHistory(ctx context.Context, db *sql.DB, userID int64) (*OrderIterator, error) {
+	rows, err := db.QueryContext(ctx, `SELECT o.*, t.* FROM orders o LEFT JOIN trade t ON t.id = o.trade_id WHERE o.user_id = ? ORDER BY o.id ASC`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "select order history failed")
+	}
+	return &OrderIterator{rows: rows}, nil
+}
+
+// Next は次の注文を読みます。終わりに達したかエラーの場合はfalseを返します
+func (it *OrderIterator) Next() bool {
+	if it.err != nil || !it.rows.Next() {
+		return false
+	}
+	it.order, it.err = scanOrderWithTrade(it.rows)
+	return it.err == nil
+}
+
+// Order はNextで読んだ注文です
+func (it *OrderIterator) Order() *Order {
+	return it.order
+}
+
+// Err は読み込み中に起きたエラーを返します
+func (it *OrderIterator) Err() error {
+	if it.err != nil {
+		return errors.Wrap(it.err, "scan order history failed")
+	}
+	return it.rows.Err()
+}
+
+func (it *OrderIterator) Close() error {
+	return it.rows.Close()
+}
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// 手数料率の設定で、約定代金に対するベーシスポイント (1/10000) です
+// 板にあった注文がmaker、マッチングを行った注文がtakerになります。空の場合は手数料を取りません
+const (
+	MakerFeeBps = "maker_fee_bps"
+	TakerFeeBps = "taker_fee_bps"
+
+	FeeRoleMaker = "maker"
+	FeeRoleTaker = "taker"
+)
+
+// FeeRates はmakerとtakerの手数料率です
+type FeeRates struct {
+	Maker int64
+	Taker int64
+}
+
+// FeeSummary はユーザーが払った手数料の集計です
+type FeeSummary struct {
+	UserID     int64 `json:"user_id"`
+	MakerFee   int64 `json:"maker_fee"`
+	TakerFee   int64 `json:"taker_fee"`
+	TotalFee   int64 `json:"total_fee"`
+	MakerCount int64 `json:"maker_count"`
+	TakerCount int64 `json:"taker_count"`
+}
+
+func getFeeRates(d QueryExecutor) (*FeeRates, error) {
+	settings, err := getSettings(d, MakerFeeBps, TakerFeeBps)
+	if err != nil {
+		return nil, errors.Wrap(err, "get fee settings failed")
+	}
+	rates := &FeeRates{}
+	for _, s := range settings {
+		if s.Val == "" {
+			continue
+		}
+		bps, err := strconv.ParseInt(s.Val, 10, 64)
+		if err != nil || bps < 0 || bps > 10000 {
+			return nil, errors.Errorf("invalid fee setting. %s=%s", s.Name, s.Val)
+		}
+		switch s.Name {
+		case MakerFeeBps:
+			rates.Maker = bps
+		case TakerFeeBps:
+			rates.Taker = bps
+		}
+	}
+	return rates, nil
+}
+
+// fee は約定代金に対する手数料です (1円未満は切り捨て)
+func (r *FeeRates) fee(role string, amount, price int64) int64 {
+	bps := r.Maker
+	if role == FeeRoleTaker {
+		bps = r.Taker
+	}
+	return amount * price * bps / 10000
+}
+
+// reservePrice は銀行で予約する金額です
+// 買いは代金と手数料を払い、売りは代金から手数料を引いた額を受け取ります
+func reservePrice(ot string, amount, price, fee int64) int64 {
+	if ot == OrderTypeBuy {
+		return -(amount*price + fee)
+	}
+	return amount*price - fee
+}
+
+func recordFee(tx *sql.Tx, tradeID int64, f *orderFill) error {
+	if f.fee == 0 {
+		return nil
+	}
+	if _, err := dbExec(tx, `INSERT INTO trade_fee (trade_id, order_id, user_id, role, amount, created_at) VALUES (?, ?, ?, ?, ?, NOW(6))`,
+		tradeID, f.order.ID, f.order.UserID, f.role, f.fee); err != nil {
+		return errors.Wrap(err, "insert trade_fee failed")
+	}
+	return nil
+}
+
+// GetFeeSummary はユーザーが払った手数料をmakerとtakerに分けて集計します
+func GetFeeSummary(d QueryExecutor, userID int64) (*FeeSummary, error) {
+	rows, err := dbQuery(d, `SELECT role, SUM(amount), COUNT(*) FROM trade_fee WHERE user_id = ? GROUP BY role`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "select trade_fee failed")
+	}
+	defer rows.Close()
+	s := &FeeSummary{UserID: userID}
+	for rows.Next() {
+		var (
+			role       string
+			fee, count int64
+		)
+		if err = rows.Scan(&role, &fee, &count); err != nil {
+			return nil, errors.Wrap(err, "scan trade_fee failed")
+		}
+		switch role {
+		case FeeRoleMaker:
+			s.MakerFee, s.MakerCount = fee, count
+		case FeeRoleTaker:
+			s.TakerFee, s.TakerCount = fee, count
+		}
+		s.TotalFee += fee
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select trade_fee failed")
+	}
+	return s, nil
+}
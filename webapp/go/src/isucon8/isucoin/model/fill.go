@@ -0,0 +1,99 @@
+package model
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//go:generate scanner
+type Fill struct {
+	ID        int64     `json:"id"`
+	OrderID   int64     `json:"order_id"`
+	TradeID   int64     `json:"trade_id"`
+	Amount    int64     `json:"amount"`
+	Price     int64     `json:"price"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// orderFill はトレードで注文を埋める脚数と、その約定で払う手数料です
+type orderFill struct {
+	order  *Order
+	amount int64
+	role   string
+	fee    int64
+}
+
+// restAmount は未約定の脚数です
+func (o *Order) restAmount() int64 {
+	return o.Amount - o.Filled
+}
+
+// AddPartialOrder は部分約定を許可する指値注文を受け付けます
+// 約定できる相手の注文が足りない場合も約定できる分だけ約定し、残りは板に残ります
+func AddPartialOrder(tx *sql.Tx, ot string, userID, amount, price int64) (*Order, error) {
+	return addOrder(tx, ot, userID, amount, price, true)
+}
+
+func GetFillsByOrderID(d QueryExecutor, orderID int64) ([]*Fill, error) {
+	return scanFills(dbQuery(d, `SELECT * FROM fills WHERE order_id = ? ORDER BY id ASC`, orderID))
+}
+
+func FetchOrderFills(d QueryExecutor, order *Order) error {
+	var err error
+	order.Fills, err = GetFillsByOrderID(d, order.ID)
+	if err != nil {
+		return errors.Wrapf(err, "GetFillsByOrderID failed. id:%d", order.ID)
+	}
+	return nil
+}
+
+// fillOrder は注文をf.amountだけ約定させます。未約定の分が無くなった場合は注文を閉じてtrueを返します
+func fillOrder(tx *sql.Tx, f *orderFill, tradeID, price int64) (bool, error) {
+	o := f.order
+	if _, err := dbExec(tx, `INSERT INTO fills (order_id, trade_id, amount, price, created_at) VALUES (?, ?, ?, ?, NOW(6))`, o.ID, tradeID, f.amount, price); err != nil {
+		return false, errors.Wrap(err, "insert fills")
+	}
+	if err := recordFee(tx, tradeID, f); err != nil {
+		return false, err
+	}
+	if err := recordOrderAudit(tx, &OrderAudit{OrderID: o.ID, UserID: o.UserID, Event: OrderAuditTraded, Actor: OrderActorSystem, Amount: f.amount, Price: price, TradeID: tradeID}); err != nil {
+		return false, err
+	}
+	if f.amount < o.restAmount() {
+		if _, err := dbExec(tx, `UPDATE orders SET filled = filled + ?, trade_id = ?, fee = fee + ? WHERE id = ?`, f.amount, tradeID, f.fee, o.ID); err != nil {
+			return false, errors.Wrap(err, "update order for fill")
+		}
+		return false, nil
+	}
+	if _, err := dbExec(tx, `UPDATE orders SET filled = filled + ?, trade_id = ?, fee = fee + ?, closed_at = NOW(6) WHERE id = ?`, f.amount, tradeID, f.fee, o.ID); err != nil {
+		return false, errors.Wrap(err, "update order for trade")
+	}
+	return true, nil
+}
+
+// FetchOrdersFills はordersのFillsを1回のクエリでまとめて埋めます
+func FetchOrdersFills(d QueryExecutor, orders []*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	ids := make([]interface{}, 0, len(orders))
+	byID := make(map[int64]*Order, len(orders))
+	for _, order := range orders {
+		ids = append(ids, order.ID)
+		byID[order.ID] = order
+		order.Fills = []*Fill{}
+	}
+	fills, err := scanFills(dbQuery(d, `SELECT * FROM fills WHERE order_id IN (?`+strings.Repeat(`, ?`, len(ids)-1)+`) ORDER BY id ASC`, ids...))
+	if err != nil {
+		return errors.Wrap(err, "select fills failed")
+	}
+	for _, f := range fills {
+		if order, ok := byID[f.OrderID]; ok {
+			order.Fills = append(order.Fills, f)
+		}
+	}
+	return nil
+}
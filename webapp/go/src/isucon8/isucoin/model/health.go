@@ -0,0 +1,138 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// matcherRunning はStartMatcherのワーカーが動いている場合に1です
+var matcherRunning int32
+
+// DependencyStatus は/readyzで返す依存先の状態です
+type DependencyStatus struct {
+	Name    string  `json:"name"`
+	OK      bool    `json:"ok"`
+	Latency float64 `json:"latency"`
+	Detail  string  `json:"detail,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// CheckReadiness はDB, 設定, 銀行API, マッチングのワーカーを確認します
+// 銀行APIはエンドポイントにTCPで接続できるかだけを確認します (ISUBANKには確認用のAPIが無いため)
+func CheckReadiness(ctx context.Context, cluster *DBCluster) []*DependencyStatus {
+	res := []*DependencyStatus{
+		checkDependency("db", func() (string, error) {
+			return "", cluster.Primary.PingContext(ctx)
+		}),
+	}
+	for i, r := range cluster.replicas {
+		r := r
+		res = append(res, checkDependency("db_replica"+strconv.Itoa(i), func() (string, error) {
+			return "", r.PingContext(ctx)
+		}))
+	}
+	res = append(res,
+		checkDependency("settings", func() (string, error) {
+			return checkSettings(cluster.Primary)
+		}),
+		checkDependency("bank", func() (string, error) {
+			return checkBankReachable(ctx, cluster.Primary)
+		}),
+		checkDependency("matcher", checkMatcher),
+	)
+	return res
+}
+
+func checkDependency(name string, f func() (string, error)) *DependencyStatus {
+	start := time.Now()
+	detail, err := f()
+	s := &DependencyStatus{
+		Name:    name,
+		OK:      err == nil,
+		Latency: time.Since(start).Seconds(),
+		Detail:  detail,
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// checkSettings は/initializeで銀行APIとISULOGの設定が済んでいるかを確認します
+func checkSettings(d QueryExecutor) (string, error) {
+	if settings != nil {
+		settings.RLock()
+		loaded := settings.loaded
+		settings.RUnlock()
+		if !loaded {
+			return "", errors.New("settings cache is not loaded")
+		}
+	}
+	for _, k := range []string{BankEndpoint, BankAppid, LogEndpoint, LogAppid} {
+		if _, err := GetSetting(d, k); err != nil {
+			if err == sql.ErrNoRows {
+				return "", errors.Errorf("%s is not set", k)
+			}
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+func checkBankReachable(ctx context.Context, d QueryExecutor) (string, error) {
+	if b := bankCircuit; b != nil {
+		if s := b.status(); s.State == BankBreakerOpen {
+			return s.State, ErrBankBreakerOpen
+		}
+	}
+	ep, err := GetSetting(d, BankEndpoint)
+	if err != nil {
+		return "", errors.Wrap(err, "bank_endpoint")
+	}
+	u, err := url.Parse(ep)
+	if err != nil {
+		return "", errors.Wrap(err, "parse bank_endpoint failed")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return host, err
+	}
+	conn.Close()
+	return host, nil
+}
+
+func checkMatcher() (string, error) {
+	if matcherSignal == nil {
+		// リクエストの中でマッチングする
+		return "sync", nil
+	}
+	if atomic.LoadInt32(&matcherRunning) == 0 {
+		return "async", errors.New("matcher is not running")
+	}
+	if e := matcherElector; e != nil {
+		// リーダーでないサーバーもマッチング以外のリクエストは処理できる
+		if e.IsLeader() {
+			return "async leader", nil
+		}
+		return "async follower", nil
+	}
+	return "async", nil
+}
@@ -0,0 +1,119 @@
+package model
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// AddIcebergOrder はamountのうちdisplayAmountずつを板に出す指値注文を受け付けます
+// 板に出した分が約定すると、同じ価格で残りから次の分を新しい注文として補充します (時間優先は補充した時間から)
+// 残高の確認と椅子の確保は注文全体に対して行います
+func AddIcebergOrder(tx *sql.Tx, ot string, userID, amount, price, displayAmount int64) (*Order, error) {
+	if amount <= 0 || price <= 0 || displayAmount <= 0 {
+		return nil, ErrParameterInvalid
+	}
+	if displayAmount >= amount {
+		return AddOrder(tx, ot, userID, amount, price)
+	}
+	if err := checkPriceBand(tx, price); err != nil {
+		return nil, err
+	}
+	user, err := lockUser(tx, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lockUser failed. id:%d", userID)
+	}
+	switch ot {
+	case OrderTypeBuy:
+		err = checkBuyCredit(tx, user, amount, price)
+	case OrderTypeSell:
+		err = reserveSellIsu(tx, user, amount, price)
+	default:
+		return nil, ErrParameterInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	id, err := insertIcebergSlice(tx, &Order{
+		Type:          ot,
+		UserID:        user.ID,
+		Amount:        displayAmount,
+		Price:         price,
+		DisplayAmount: displayAmount,
+		HiddenAmount:  amount - displayAmount,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return GetOrderByID(tx, id)
+}
+
+// refillIceberg は約定したアイスバーグ注文の残りから次の注文を作ります
+func refillIceberg(tx *sql.Tx, o *Order) (int64, error) {
+	amount := o.DisplayAmount
+	if amount > o.HiddenAmount {
+		amount = o.HiddenAmount
+	}
+	parentID := o.ParentID
+	if parentID == 0 {
+		parentID = o.ID
+	}
+	id, err := insertIcebergSlice(tx, &Order{
+		Type:          o.Type,
+		UserID:        o.UserID,
+		Amount:        amount,
+		Price:         o.Price,
+		DisplayAmount: o.DisplayAmount,
+		HiddenAmount:  o.HiddenAmount - amount,
+		ParentID:      parentID,
+		ExpiresAt:     o.ExpiresAt,
+	})
+	if err != nil {
+		return 0, err
+	}
+	// 残りは新しい注文に移す
+	if _, err = dbExec(tx, `UPDATE orders SET hidden_amount = 0 WHERE id = ?`, o.ID); err != nil {
+		return 0, errors.Wrap(err, "update orders for refill")
+	}
+	return id, nil
+}
+
+func insertIcebergSlice(tx *sql.Tx, o *Order) (int64, error) {
+	var parentID interface{}
+	if o.ParentID > 0 {
+		parentID = o.ParentID
+	}
+	var expiresAt interface{}
+	if o.ExpiresAt != nil {
+		expiresAt = *o.ExpiresAt
+	}
+	newID := newID()
+	res, err := dbExec(tx, `INSERT INTO orders (id, type, user_id, amount, price, created_at, display_amount, hidden_amount, parent_id, expires_at) VALUES (?, ?, ?, ?, ?, NOW(6), ?, ?, ?, ?)`,
+		newID, o.Type, o.UserID, o.Amount, o.Price, o.DisplayAmount, o.HiddenAmount, parentID, expiresAt)
+	if err != nil {
+		return 0, errors.Wrap(err, "insert order failed")
+	}
+	id, err := insertedID(res, newID)
+	if err != nil {
+		return 0, errors.Wrap(err, "get order_id failed")
+	}
+	audit := &OrderAudit{OrderID: id, UserID: o.UserID, Event: OrderAuditCreated, Actor: OrderActorUser, Amount: o.Amount, Price: o.Price}
+	if o.ParentID > 0 {
+		audit.Actor, audit.Reason = OrderActorSystem, "iceberg_refill"
+	}
+	if err = recordOrderAudit(tx, audit); err != nil {
+		return 0, err
+	}
+	data := map[string]interface{}{
+		"order_id":      id,
+		"user_id":       o.UserID,
+		"amount":        o.Amount,
+		"price":         o.Price,
+		"hidden_amount": o.HiddenAmount,
+	}
+	if o.ParentID > 0 {
+		data["parent_id"] = o.ParentID
+	}
+	sendLog(tx, o.Type+".order", data)
+	return id, nil
+}
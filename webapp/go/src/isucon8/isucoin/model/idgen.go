@@ -0,0 +1,117 @@
+package model
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IDのビットの割り当てです。JavaScriptのNumberで正確に扱えるように53ビットに収めます
+// 上位からエポックからのミリ秒 (41ビット, 約69年), ノード番号, ミリ秒の中の連番の順なので、IDは時刻順になります
+const (
+	idNodeBits = 5
+	idSeqBits  = 7
+
+	// MaxIDNode はノード番号の最大値です
+	MaxIDNode = 1<<idNodeBits - 1
+	maxIDSeq  = 1<<idSeqBits - 1
+)
+
+// idEpoch はIDの時刻の基準です
+var idEpoch = time.Date(2018, 10, 16, 0, 0, 0, 0, time.UTC)
+
+// IDGenerator は注文とトレードのIDを払い出します
+// AUTO_INCREMENTと違いDBに聞かずに採番できるので、将来ユーザーごとにDBを分けても重複しません
+type IDGenerator struct {
+	mu   sync.Mutex
+	node int64
+	// last は最後に払い出したIDのミリ秒で、時計が戻った場合もこれより前には戻しません
+	last int64
+	seq  int64
+}
+
+func NewIDGenerator(node int64) (*IDGenerator, error) {
+	if node < 0 || node > MaxIDNode {
+		return nil, errors.Errorf("id node must be between 0 and %d", MaxIDNode)
+	}
+	return &IDGenerator{node: node}, nil
+}
+
+// Next は新しいIDを返します
+// 1ミリ秒に払い出せる数を超えた場合は次のミリ秒のIDを前借りします (待たない)
+func (g *IDGenerator) Next() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ms := int64(time.Since(idEpoch) / time.Millisecond)
+	if ms > g.last {
+		g.last, g.seq = ms, 0
+	} else if g.seq < maxIDSeq {
+		g.seq++
+	} else {
+		g.last, g.seq = g.last+1, 0
+	}
+	return g.last<<(idNodeBits+idSeqBits) | g.node<<idSeqBits | g.seq
+}
+
+// observe はidより大きいIDだけを払い出すようにします
+func (g *IDGenerator) observe(id int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if ms := id >> (idNodeBits + idSeqBits); ms > g.last {
+		g.last, g.seq = ms, maxIDSeq
+	}
+}
+
+var idgen *IDGenerator
+
+// EnableIDGenerator は注文とトレードのIDをAUTO_INCREMENTの代わりにIDGeneratorで払い出すようにします
+// nodeは複数台で動かす場合にappサーバーごとに変えてください
+// 再起動で時計が戻った場合もトレードのIDが小さくならないように、既存の最大のIDより後から払い出します
+func EnableIDGenerator(db *sql.DB, node int64) error {
+	g, err := NewIDGenerator(node)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"orders", "trade"} {
+		var max sql.NullInt64
+		if err := db.QueryRow(`SELECT MAX(id) FROM ` + table).Scan(&max); err != nil {
+			return errors.Wrapf(err, "select max id failed. table:%s", table)
+		}
+		g.observe(max.Int64)
+	}
+	idgen = g
+	return nil
+}
+
+// newID はINSERTで使うIDです。EnableIDGeneratorを呼んでいない場合はNULLになり、AUTO_INCREMENTで採番します
+func newID() sql.NullInt64 {
+	if idgen == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: idgen.Next(), Valid: true}
+}
+
+// newTradeID はトレードのIDです
+// /infoのcursorはトレードのIDの順に読むので、複数台で時計がずれていても前のトレードより小さくならないように、記録済みの最大のIDより後から払い出します
+// トレードはマッチングのロック (trade.lock_timeout_secまたはtrade.leader_election) の中で記録するので、最大のIDには他のサーバーの分も含まれます
+func newTradeID(tx *sql.Tx) (sql.NullInt64, error) {
+	if idgen == nil {
+		return sql.NullInt64{}, nil
+	}
+	var max sql.NullInt64
+	if err := tx.QueryRow(`SELECT MAX(id) FROM trade`).Scan(&max); err != nil {
+		return sql.NullInt64{}, errors.Wrap(err, "select max trade id failed")
+	}
+	idgen.observe(max.Int64)
+	return sql.NullInt64{Int64: idgen.Next(), Valid: true}, nil
+}
+
+// insertedID はnewIDで指定したIDか、AUTO_INCREMENTで採番したIDを返します
+func insertedID(res sql.Result, id sql.NullInt64) (int64, error) {
+	if id.Valid {
+		return id.Int64, nil
+	}
+	return res.LastInsertId()
+}
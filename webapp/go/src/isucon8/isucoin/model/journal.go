@@ -0,0 +1,206 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"isucon8/isubank"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// bank_transactionの状態です
+const (
+	BankTxReserving = "reserving" // Reserveを呼ぶ前
+	BankTxReserved  = "reserved"
+	BankTxCommitted = "committed"
+	BankTxCanceled  = "canceled"
+	BankTxFailed    = "failed"  // Reserveが失敗した
+	BankTxExpired   = "expired" // 銀行で期限切れになった
+
+	// BankReserveExpire は銀行の仮決済の有効期限です
+	BankReserveExpire = 5 * time.Minute
+	// DefaultBankReconcileAge より前に予約して確定も取り消しもしていない仮決済を取り消します
+	DefaultBankReconcileAge = 30 * time.Second
+)
+
+//go:generate scanner
+type BankTransaction struct {
+	ID        int64
+	BankID    string
+	Price     int64
+	ReserveID *int64
+	Status    string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// TradeID は確定した仮決済のトレードです
+	TradeID *int64
+}
+
+var journalDB *sql.DB
+
+// EnableBankJournal は仮決済をbank_transactionに記録するようにします
+func EnableBankJournal(db *sql.DB) {
+	journalDB = db
+}
+
+// journalBank はReserveの前にbank_transactionに書き、CommitとCancelの後に状態を更新するBankです
+// 取引のトランザクションの外で書くので、予約した後にプロセスが落ちても記録が残ります
+type journalBank struct {
+	Bank
+	db *sql.DB
+}
+
+func withBankJournal(bank Bank) Bank {
+	if journalDB == nil {
+		return bank
+	}
+	return &journalBank{Bank: bank, db: journalDB}
+}
+
+func (jb *journalBank) Reserve(bankID string, price int64) (int64, error) {
+	res, err := jb.db.Exec(`INSERT INTO bank_transaction (bank_id, price, status, created_at, updated_at) VALUES (?, ?, ?, NOW(6), NOW(6))`,
+		bankID, price, BankTxReserving)
+	if err != nil {
+		return 0, errors.Wrap(err, "insert bank_transaction failed")
+	}
+	txID, err := res.LastInsertId()
+	if err != nil {
+		return 0, errors.Wrap(err, "get bank_transaction id failed")
+	}
+	id, err := jb.Bank.Reserve(bankID, price)
+	if err != nil {
+		if _, uerr := jb.db.Exec(`UPDATE bank_transaction SET status = ?, updated_at = NOW(6) WHERE id = ?`, BankTxFailed, txID); uerr != nil {
+			log.Printf("[WARN] update bank_transaction failed. id:%d, err:%s", txID, uerr)
+		}
+		return 0, err
+	}
+	if _, err = jb.db.Exec(`UPDATE bank_transaction SET reserve_id = ?, status = ?, updated_at = NOW(6) WHERE id = ?`, id, BankTxReserved, txID); err != nil {
+		// 記録できなかった予約は使わずに取り消す
+		if cerr := jb.Bank.Cancel([]int64{id}); cerr != nil {
+			log.Printf("[WARN] isubank cancel failed. reserve_id:%d, err:%s", id, cerr)
+		}
+		return 0, errors.Wrap(err, "update bank_transaction failed")
+	}
+	return id, nil
+}
+
+func (jb *journalBank) Commit(reserveIDs []int64) error {
+	err := jb.Bank.Commit(reserveIDs)
+	if err == nil {
+		setBankTxStatus(jb.db, reserveIDs, BankTxCommitted)
+	}
+	return err
+}
+
+func (jb *journalBank) Cancel(reserveIDs []int64) error {
+	err := jb.Bank.Cancel(reserveIDs)
+	if err == nil {
+		setBankTxStatus(jb.db, reserveIDs, BankTxCanceled)
+	}
+	return err
+}
+
+// setBankTxStatus は状態を更新します。失敗した場合は後でreconcileBankTransactionsが銀行に確認します
+func setBankTxStatus(db *sql.DB, reserveIDs []int64, status string) {
+	if len(reserveIDs) == 0 {
+		return
+	}
+	args := make([]interface{}, 0, len(reserveIDs)+1)
+	args = append(args, status)
+	for _, id := range reserveIDs {
+		args = append(args, id)
+	}
+	q := `UPDATE bank_transaction SET status = ?, updated_at = NOW(6) WHERE reserve_id IN (?` + strings.Repeat(`, ?`, len(reserveIDs)-1) + `)`
+	if _, err := db.Exec(q, args...); err != nil {
+		log.Printf("[WARN] update bank_transaction failed. reserve_ids:%v, err:%s", reserveIDs, err)
+	}
+}
+
+// journalTrade は確定した仮決済にトレードのIDを記録します (GET /admin/settlements で使います)
+// 状態と同じく取引のトランザクションの外で書きます
+func journalTrade(tradeID int64, reserveIDs []int64) {
+	if journalDB == nil || len(reserveIDs) == 0 {
+		return
+	}
+	args := make([]interface{}, 0, len(reserveIDs)+1)
+	args = append(args, tradeID)
+	for _, id := range reserveIDs {
+		args = append(args, id)
+	}
+	q := `UPDATE bank_transaction SET trade_id = ? WHERE reserve_id IN (?` + strings.Repeat(`, ?`, len(reserveIDs)-1) + `)`
+	if _, err := journalDB.Exec(q, args...); err != nil {
+		log.Printf("[WARN] update bank_transaction trade_id failed. trade_id:%d, reserve_ids:%v, err:%s", tradeID, reserveIDs, err)
+	}
+}
+
+// StartBankReconciler は確定も取り消しもされずに残った仮決済を取り消すワーカーを起動します
+// 起動時に1回実行し、その後はinterval毎に実行します。ctxが終了すると停止します
+func StartBankReconciler(ctx context.Context, db *sql.DB, interval, age time.Duration) {
+	startWorker(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := reconcileBankTransactions(db, age); err != nil {
+				log.Printf("[WARN] reconcile bank transactions failed. err:%s", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+// reconcileBankTransactions はage以上前に予約して、確定も取り消しもされていない仮決済を取り消します
+// 銀行ですでに確定していた場合はcommittedにします
+func reconcileBankTransactions(db *sql.DB, age time.Duration) error {
+	now := time.Now()
+	txs, err := scanBankTransactions(db.Query(`SELECT * FROM bank_transaction WHERE status IN (?, ?) AND created_at < ? ORDER BY id`,
+		BankTxReserving, BankTxReserved, now.Add(-age)))
+	if err != nil {
+		return errors.Wrap(err, "select bank_transaction failed")
+	}
+	if len(txs) == 0 {
+		return nil
+	}
+	var bank Bank
+	for _, t := range txs {
+		status := ""
+		switch {
+		case t.ReserveID == nil:
+			// Reserveの途中で落ちた。予約できていたとしても期限切れになる
+			status = BankTxFailed
+		case now.Sub(t.CreatedAt) >= BankReserveExpire:
+			status = BankTxExpired
+		default:
+			if bank == nil {
+				// 記録し直さないようにjournalBankを通さない
+				if bank, err = plainIsubank(db); err != nil {
+					return errors.Wrap(err, "isubank init failed")
+				}
+			}
+			err = bank.Cancel([]int64{*t.ReserveID})
+			switch {
+			case err == nil:
+				status = BankTxCanceled
+				log.Printf("[INFO] orphaned reserve canceled. reserve_id:%d, bank_id:%s, price:%d", *t.ReserveID, t.BankID, t.Price)
+			case err == isubank.ErrReserveAlreadyCommitted:
+				status = BankTxCommitted
+			case err == isubank.ErrReserveExpired:
+				status = BankTxExpired
+			default:
+				// 次の実行で再度試す
+				log.Printf("[WARN] isubank cancel failed. reserve_id:%d, err:%s", *t.ReserveID, err)
+				continue
+			}
+		}
+		if _, err = db.Exec(`UPDATE bank_transaction SET status = ?, updated_at = NOW(6) WHERE id = ? AND status = ?`, status, t.ID, t.Status); err != nil {
+			return errors.Wrapf(err, "update bank_transaction failed. id:%d", t.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// JWTExpire はJWTの有効期限です
+const JWTExpire = 24 * time.Hour
+
+var (
+	ErrJWTDisabled = errors.New("jwt is not enabled")
+	ErrJWTInvalid  = errors.New("invalid token")
+
+	jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+	// jwtSecret はPOST /signinで発行するJWT (HS256) の鍵です。空の場合は発行しません
+	jwtSecret []byte
+)
+
+// SetJWTSecret はJWTの鍵を設定します。複数台で動かす場合は全台で同じ値にしてください
+func SetJWTSecret(secret string) {
+	jwtSecret = []byte(secret)
+}
+
+// TokenClaims はJWTのペイロードです
+// SessionVersionはcookieのセッションと同じく、パスワードなどを変更すると無効になります
+type TokenClaims struct {
+	Subject        string `json:"sub"`
+	SessionVersion int64  `json:"sv"`
+	IssuedAt       int64  `json:"iat"`
+	ExpiresAt      int64  `json:"exp"`
+}
+
+func (c *TokenClaims) UserID() int64 {
+	id, _ := strconv.ParseInt(c.Subject, 10, 64)
+	return id
+}
+
+func getJWTSecret() ([]byte, error) {
+	if len(jwtSecret) == 0 {
+		return nil, ErrJWTDisabled
+	}
+	return jwtSecret, nil
+}
+
+// IssueToken はユーザーのJWTを発行します
+func IssueToken(user *User) (string, time.Time, error) {
+	secret, err := getJWTSecret()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	exp := now.Add(JWTExpire)
+	payload, err := json.Marshal(&TokenClaims{
+		Subject:        strconv.FormatInt(user.ID, 10),
+		SessionVersion: user.SessionVersion,
+		IssuedAt:       now.Unix(),
+		ExpiresAt:      exp.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "marshal claims failed")
+	}
+	input := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return input + "." + base64.RawURLEncoding.EncodeToString(signJWT(secret, input)), exp, nil
+}
+
+// VerifyToken はJWTの署名と有効期限を確認します
+// ユーザーが存在するかどうかは確認しません
+func VerifyToken(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrJWTInvalid
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrJWTInvalid
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	// alg:noneなどHS256以外は受け付けない
+	if err = json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return nil, ErrJWTInvalid
+	}
+	secret, err := getJWTSecret()
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrJWTInvalid
+	}
+	if !hmac.Equal(sig, signJWT(secret, parts[0]+"."+parts[1])) {
+		return nil, ErrJWTInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrJWTInvalid
+	}
+	claims := &TokenClaims{}
+	if err = json.Unmarshal(payload, claims); err != nil || claims.UserID() <= 0 {
+		return nil, ErrJWTInvalid
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrJWTInvalid
+	}
+	return claims, nil
+}
+
+func signJWT(secret []byte, input string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(input))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,163 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	matcherLeaderLock = "isucoin.matcher_leader"
+
+	// MatcherPollInterval はリーダーが他のサーバーで受け付けた注文を確認する間隔です
+	MatcherPollInterval = 100 * time.Millisecond
+)
+
+// matcherElector はマッチングのワーカーを動かすサーバーを選びます (nilの場合は全台で動かす)
+var matcherElector *LeaderElector
+
+// LeaderElector はMySQLのGET_LOCKで複数のappサーバーから1台だけを選びます
+// ロックは専用の接続で持ち続けるので、リーダーのプロセスが落ちるか接続が切れると他のサーバーが引き継ぎます
+type LeaderElector struct {
+	db       *sql.DB
+	name     string
+	node     string
+	interval time.Duration
+
+	mu     sync.Mutex
+	conn   *sql.Conn
+	leader bool
+	since  time.Time
+}
+
+// EnableMatcherLeaderElection はマッチングのワーカーをリーダーになったサーバーだけで動かします
+// StartMatcherの前に呼んでください。intervalごとにロックを確認し、取れていなければ取りにいきます
+func EnableMatcherLeaderElection(db *sql.DB, node string, interval time.Duration) {
+	matcherElector = newLeaderElector(db, matcherLeaderLock, node, interval)
+}
+
+func newLeaderElector(db *sql.DB, name, node string, interval time.Duration) *LeaderElector {
+	return &LeaderElector{
+		db:       db,
+		name:     name,
+		node:     node,
+		interval: interval,
+	}
+}
+
+// IsLeader はこのサーバーがリーダーの場合にtrueを返します
+func (e *LeaderElector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// tick はロックを持っているか確認し、持っていなければ取得を試みます
+func (e *LeaderElector) tick(ctx context.Context) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leader {
+		var held sql.NullBool
+		err := e.conn.QueryRowContext(ctx, `SELECT IS_USED_LOCK(?) = CONNECTION_ID()`, e.name).Scan(&held)
+		if err != nil || !held.Valid || !held.Bool {
+			log.Printf("[WARN] lost leadership. name:%s node:%s err:%v", e.name, e.node, err)
+			e.dropLocked()
+			return
+		}
+	} else {
+		if err := e.acquireLocked(ctx); err != nil {
+			log.Printf("[WARN] leader election failed. name:%s err:%s", e.name, err)
+			return
+		}
+		if !e.leader {
+			return
+		}
+		log.Printf("[INFO] elected as leader. name:%s node:%s", e.name, e.node)
+	}
+	if _, err := e.conn.ExecContext(ctx,
+		`INSERT INTO leader (name, node, elected_at, heartbeat_at) VALUES (?, ?, ?, NOW(6)) ON DUPLICATE KEY UPDATE node = VALUES(node), elected_at = VALUES(elected_at), heartbeat_at = VALUES(heartbeat_at)`,
+		e.name, e.node, e.since,
+	); err != nil {
+		// 記録に失敗してもロックは持っているのでリーダーのまま
+		log.Printf("[WARN] update leader heartbeat failed. err:%s", err)
+	}
+}
+
+func (e *LeaderElector) acquireLocked(ctx context.Context) error {
+	if e.conn == nil {
+		conn, err := e.db.Conn(ctx)
+		if err != nil {
+			return errors.Wrap(err, "get connection for leader lock failed")
+		}
+		e.conn = conn
+	}
+	var locked sql.NullInt64
+	if err := e.conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, 0)`, e.name).Scan(&locked); err != nil {
+		e.dropLocked()
+		return errors.Wrap(err, "GET_LOCK failed")
+	}
+	if locked.Valid && locked.Int64 == 1 {
+		e.leader = true
+		e.since = time.Now()
+	}
+	return nil
+}
+
+// dropLocked は接続を閉じてリーダーをやめます。接続を閉じるとMySQL側でロックも解放されます
+func (e *LeaderElector) dropLocked() {
+	if e.conn != nil {
+		e.conn.Close()
+		e.conn = nil
+	}
+	e.leader = false
+}
+
+// resign はロックを解放して他のサーバーにリーダーを譲ります
+func (e *LeaderElector) resign() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leader {
+		if _, err := e.conn.ExecContext(context.Background(), `DO RELEASE_LOCK(?)`, e.name); err != nil {
+			log.Printf("[WARN] RELEASE_LOCK failed. err:%s", err)
+		}
+		log.Printf("[INFO] resigned leader. name:%s node:%s", e.name, e.node)
+	}
+	e.dropLocked()
+}
+
+// LeaderStatus は/debug/leaderで返すリーダーの状態です
+type LeaderStatus struct {
+	Enabled     bool       `json:"enabled"`
+	Node        string     `json:"node,omitempty"`
+	IsLeader    bool       `json:"is_leader"`
+	Leader      string     `json:"leader,omitempty"`
+	ElectedAt   *time.Time `json:"elected_at,omitempty"`
+	HeartbeatAt *time.Time `json:"heartbeat_at,omitempty"`
+}
+
+// GetLeaderStatus はこのサーバーと、leaderテーブルに記録された現在のリーダーを返します
+func GetLeaderStatus(db *sql.DB) (*LeaderStatus, error) {
+	e := matcherElector
+	if e == nil {
+		return &LeaderStatus{}, nil
+	}
+	s := &LeaderStatus{
+		Enabled:  true,
+		Node:     e.node,
+		IsLeader: e.IsLeader(),
+	}
+	var electedAt, heartbeatAt time.Time
+	err := db.QueryRow(`SELECT node, elected_at, heartbeat_at FROM leader WHERE name = ?`, e.name).Scan(&s.Leader, &electedAt, &heartbeatAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return s, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "select leader failed")
+	}
+	s.ElectedAt, s.HeartbeatAt = &electedAt, &heartbeatAt
+	return s, nil
+}
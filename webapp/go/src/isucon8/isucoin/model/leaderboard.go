@@ -0,0 +1,199 @@
+package model
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// GetLeaderboard の並び順です
+const (
+	LeaderboardByVolume = "volume"
+	LeaderboardByPnL    = "pnl"
+)
+
+// leaderboardColumns は並び順ごとに集計する列です
+var leaderboardColumns = map[string]string{
+	LeaderboardByVolume: "SUM(s.volume)",
+	LeaderboardByPnL:    "SUM(s.realized_pnl)",
+}
+
+// traderStatsBulkSize はuser_trade_statsを作り直す時に1回のINSERTにまとめる行数です
+const traderStatsBulkSize = 500
+
+// TraderStats はユーザーの期間中の約定の集計です
+// user_trade_statsに1時間ごとに集計しているので、期間の始まりは1時間単位に切り捨てます
+type TraderStats struct {
+	Rank        int64  `json:"rank"`
+	UserID      int64  `json:"user_id"`
+	Name        string `json:"name"`
+	Volume      int64  `json:"volume"`
+	Turnover    int64  `json:"turnover"`
+	RealizedPnL int64  `json:"realized_pnl"`
+}
+
+// traderStatsKey はuser_trade_statsの1行です
+type traderStatsKey struct {
+	t      time.Time
+	userID int64
+}
+
+type traderStatsRow struct {
+	volume, turnover, pnl int64
+}
+
+// addTraderStats は約定をuser_trade_statsの現在の時間の行に足します。pnlはその約定で確定した損益です
+// トレードと同じトランザクションで更新するので、ランキングは約定と常に一致します
+func addTraderStats(d QueryExecutor, userID, amount, price, pnl int64) error {
+	_, err := dbExec(d, `
+		INSERT INTO user_trade_stats (t, user_id, volume, turnover, realized_pnl)
+		VALUES (DATE_FORMAT(NOW(), '%Y-%m-%d %H:00:00'), ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+			volume = volume + VALUES(volume),
+			turnover = turnover + VALUES(turnover),
+			realized_pnl = realized_pnl + VALUES(realized_pnl)
+	`, userID, amount, amount*price, pnl)
+	return errors.Wrap(err, "update user_trade_stats failed")
+}
+
+func leaderboardColumn(by string) (string, error) {
+	col, ok := leaderboardColumns[by]
+	if !ok {
+		return "", ErrParameterInvalid
+	}
+	return col, nil
+}
+
+// GetLeaderboard はsince以降の約定をbyの順に集計した上位limit人を返します
+// 同じ値の場合はuser_idの小さい順で、退会したユーザーは含めません
+func GetLeaderboard(d QueryExecutor, by string, since time.Time, limit int) ([]*TraderStats, error) {
+	col, err := leaderboardColumn(by)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := dbQuery(d, `
+		SELECT s.user_id, u.name, SUM(s.volume), SUM(s.turnover), SUM(s.realized_pnl)
+		FROM user_trade_stats s JOIN user u ON u.id = s.user_id
+		WHERE s.t >= ? AND u.closed_at IS NULL
+		GROUP BY s.user_id, u.name
+		ORDER BY `+col+` DESC, s.user_id ASC
+		LIMIT ?
+	`, since, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "select user_trade_stats failed")
+	}
+	defer rows.Close()
+	res := make([]*TraderStats, 0, limit)
+	for rows.Next() {
+		s := &TraderStats{Rank: int64(len(res) + 1)}
+		if err = rows.Scan(&s.UserID, &s.Name, &s.Volume, &s.Turnover, &s.RealizedPnL); err != nil {
+			return nil, errors.Wrap(err, "scan user_trade_stats failed")
+		}
+		res = append(res, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select user_trade_stats failed")
+	}
+	return res, nil
+}
+
+// GetTraderRank はGetLeaderboardと同じ順でのユーザーの順位と集計を返します
+// 期間中に約定が無い場合はnilを返します
+func GetTraderRank(d QueryExecutor, by string, since time.Time, userID int64) (*TraderStats, error) {
+	col, err := leaderboardColumn(by)
+	if err != nil {
+		return nil, err
+	}
+	s := &TraderStats{UserID: userID}
+	rows, err := dbQuery(d, `
+		SELECT u.name, SUM(s.volume), SUM(s.turnover), SUM(s.realized_pnl), `+col+`
+		FROM user_trade_stats s JOIN user u ON u.id = s.user_id
+		WHERE s.t >= ? AND s.user_id = ?
+		GROUP BY u.name
+	`, since, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "select user_trade_stats failed")
+	}
+	var value int64
+	found := rows.Next()
+	if found {
+		err = rows.Scan(&s.Name, &s.Volume, &s.Turnover, &s.RealizedPnL, &value)
+	} else {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "select user_trade_stats failed")
+	}
+	if !found {
+		return nil, nil
+	}
+	rows, err = dbQuery(d, `
+		SELECT COUNT(*) FROM (
+			SELECT s.user_id FROM user_trade_stats s JOIN user u ON u.id = s.user_id
+			WHERE s.t >= ? AND u.closed_at IS NULL
+			GROUP BY s.user_id
+			HAVING `+col+` > ? OR (`+col+` = ? AND s.user_id < ?)
+		) r
+	`, since, value, value, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "count user_trade_stats failed")
+	}
+	defer rows.Close()
+	if rows.Next() {
+		err = rows.Scan(&s.Rank)
+	} else {
+		err = rows.Err()
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "count user_trade_stats failed")
+	}
+	s.Rank++
+	return s, nil
+}
+
+// traderStatsBuilder はrebuildPositionsで約定を再生しながらuser_trade_statsを作ります
+type traderStatsBuilder map[traderStatsKey]*traderStatsRow
+
+func (b traderStatsBuilder) add(t time.Time, userID, amount, price, pnl int64) {
+	k := traderStatsKey{t: t.Truncate(time.Hour), userID: userID}
+	r, ok := b[k]
+	if !ok {
+		r = &traderStatsRow{}
+		b[k] = r
+	}
+	r.volume += amount
+	r.turnover += amount * price
+	r.pnl += pnl
+}
+
+// write はuser_trade_statsを作り直します
+func (b traderStatsBuilder) write(d QueryExecutor) error {
+	if _, err := dbExec(d, `DELETE FROM user_trade_stats`); err != nil {
+		return errors.Wrap(err, "delete user_trade_stats failed")
+	}
+	placeholders := make([]string, 0, traderStatsBulkSize)
+	args := make([]interface{}, 0, traderStatsBulkSize*5)
+	flush := func() error {
+		if len(placeholders) == 0 {
+			return nil
+		}
+		q := `INSERT INTO user_trade_stats (t, user_id, volume, turnover, realized_pnl) VALUES ` + strings.Join(placeholders, ",")
+		if _, err := dbExec(d, q, args...); err != nil {
+			return errors.Wrap(err, "insert user_trade_stats failed")
+		}
+		placeholders, args = placeholders[:0], args[:0]
+		return nil
+	}
+	for k, r := range b {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+		args = append(args, k.t, k.userID, r.volume, r.turnover, r.pnl)
+		if len(placeholders) == traderStatsBulkSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
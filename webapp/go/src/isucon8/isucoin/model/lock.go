@@ -0,0 +1,62 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const tradeLockName = "isucoin.run_trade"
+
+var (
+	ErrTradeLockTimeout = errors.New("trade lock timeout")
+
+	tradeLockTimeout time.Duration
+)
+
+// EnableTradeLock はRunTradeをMySQLのGET_LOCKで排他します
+// 複数のappサーバーで動かすときに有効にしてください (0で無効)
+func EnableTradeLock(timeout time.Duration) {
+	tradeLockTimeout = timeout
+}
+
+// withTradeLock は全appサーバーで共通のロックを取得してfを実行します
+// ロックを取っている間に成立したトレードのIDは単調増加するので、/infoのcursorがどのサーバーでも同じ意味になります
+func withTradeLock(db *sql.DB, f func() error) error {
+	if tradeLockTimeout <= 0 {
+		return f()
+	}
+	return withNamedLock(db, tradeLockName, tradeLockTimeout, ErrTradeLockTimeout, f)
+}
+
+// withNamedLock はGET_LOCKでnameのロックを取得してfを実行します
+// timeoutまでに取得できない場合はtimeoutErrを返します
+func withNamedLock(db *sql.DB, name string, timeout time.Duration, timeoutErr error, f func() error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "get connection for lock failed. name:%s", name)
+	}
+	defer conn.Close()
+
+	sec := int64(timeout / time.Second)
+	if sec < 1 {
+		sec = 1
+	}
+	var locked sql.NullInt64
+	if err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, name, sec).Scan(&locked); err != nil {
+		return errors.Wrap(err, "GET_LOCK failed")
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return timeoutErr
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, `DO RELEASE_LOCK(?)`, name); err != nil {
+			log.Printf("[WARN] RELEASE_LOCK failed. err:%s", err)
+		}
+	}()
+	return f()
+}
@@ -0,0 +1,138 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ログインのロックの設定です
+// 同じbank_idでthreshold回続けて失敗するとロックし、ロック中はパスワードを確認せずに403を返します
+// ロックの期間はsec秒から始めて、ロックが解けた後に失敗するたびに倍にします (max_sec秒まで)
+// thresholdが0の場合はロックしません
+const (
+	SigninLockThreshold = "signin_lock_threshold"
+	SigninLockSec       = "signin_lock_sec"
+	SigninLockMaxSec    = "signin_lock_max_sec"
+
+	DefaultSigninLockThreshold = 5
+	DefaultSigninLock          = 10 * time.Second
+	DefaultSigninLockMax       = 1 * time.Hour
+)
+
+var ErrSigninLocked = errors.New("too many failures")
+
+//go:generate scanner
+type SigninFailure struct {
+	BankID      string
+	Failures    int64
+	LockedUntil *time.Time
+	UpdatedAt   time.Time
+}
+
+type signinLock struct {
+	threshold int64
+	base      time.Duration
+	max       time.Duration
+}
+
+func getSigninLock(d QueryExecutor) (*signinLock, error) {
+	settings, err := getSettings(d, SigninLockThreshold, SigninLockSec, SigninLockMaxSec)
+	if err != nil {
+		return nil, errors.Wrap(err, "get signin lock settings failed")
+	}
+	l := &signinLock{threshold: DefaultSigninLockThreshold, base: DefaultSigninLock, max: DefaultSigninLockMax}
+	for _, s := range settings {
+		if s.Val == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(s.Val, 10, 64)
+		if err != nil || v < 0 || v == 0 && s.Name != SigninLockThreshold {
+			return nil, errors.Errorf("invalid signin lock setting. %s=%s", s.Name, s.Val)
+		}
+		switch s.Name {
+		case SigninLockThreshold:
+			l.threshold = v
+		case SigninLockSec:
+			l.base = time.Duration(v) * time.Second
+		case SigninLockMaxSec:
+			l.max = time.Duration(v) * time.Second
+		}
+	}
+	return l, nil
+}
+
+// duration はfailures回目の失敗でロックする期間です
+func (l *signinLock) duration(failures int64) time.Duration {
+	d := l.base
+	for i := l.threshold; i < failures && d < l.max; i++ {
+		d *= 2
+	}
+	if d > l.max {
+		d = l.max
+	}
+	return d
+}
+
+// checkSigninLock はbank_idがロック中の場合にErrSigninLockedを返します
+// 失敗の記録がある場合はtrueを返します
+func checkSigninLock(d QueryExecutor, bankID string, now time.Time) (bool, error) {
+	f, err := scanSigninFailure(dbQuery(d, `SELECT * FROM signin_failure WHERE bank_id = ?`, bankID))
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, errors.Wrap(err, "select signin_failure failed")
+	case f.LockedUntil != nil && now.Before(*f.LockedUntil):
+		return true, ErrSigninLocked
+	}
+	return true, nil
+}
+
+// recordSigninFailure は失敗の回数を数え、thresholdに達していればロックします
+func recordSigninFailure(d QueryExecutor, l *signinLock, bankID string, now time.Time) error {
+	if _, err := dbExec(d, `INSERT INTO signin_failure (bank_id, failures, updated_at) VALUES (?, 1, ?) ON DUPLICATE KEY UPDATE failures = failures + 1, updated_at = VALUES(updated_at)`, bankID, now); err != nil {
+		return errors.Wrap(err, "insert signin_failure failed")
+	}
+	f, err := scanSigninFailure(dbQuery(d, `SELECT * FROM signin_failure WHERE bank_id = ?`, bankID))
+	if err != nil {
+		return errors.Wrap(err, "select signin_failure failed")
+	}
+	if f.Failures < l.threshold {
+		return nil
+	}
+	until := now.Add(l.duration(f.Failures))
+	if _, err := dbExec(d, `UPDATE signin_failure SET locked_until = ? WHERE bank_id = ?`, until, bankID); err != nil {
+		return errors.Wrap(err, "update signin_failure failed")
+	}
+	sendLog(d, "signin.lock", map[string]interface{}{
+		"bank_id":      bankID,
+		"failures":     f.Failures,
+		"locked_until": until,
+	})
+	return nil
+}
+
+// signinFailed は失敗を記録してErrUserNotFoundを返します
+func signinFailed(d QueryExecutor, bankID string, now time.Time) error {
+	l, err := getSigninLock(d)
+	if err != nil {
+		return err
+	}
+	if l.threshold == 0 {
+		return ErrUserNotFound
+	}
+	if err = recordSigninFailure(d, l, bankID, now); err != nil {
+		return err
+	}
+	return ErrUserNotFound
+}
+
+func resetSigninFailures(d QueryExecutor, bankID string) error {
+	if _, err := dbExec(d, `DELETE FROM signin_failure WHERE bank_id = ?`, bankID); err != nil {
+		return errors.Wrap(err, "delete signin_failure failed")
+	}
+	return nil
+}
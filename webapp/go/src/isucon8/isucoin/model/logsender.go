@@ -0,0 +1,217 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"isucon8/isulogger"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// LogBatchSize は1回の/send_bulkで送るログの数です
+	LogBatchSize = 1000
+	// logBatchBytes は1回の/send_bulkで送るdataの合計の目安です (ISULOGのリクエストは1MBまで)
+	logBatchBytes = 512 * 1024
+	// logEntryOverhead はtagとtimeの分の見積もりです
+	logEntryOverhead = 128
+	// logMaxRetry 回失敗したログは捨てます
+	logMaxRetry  = 3
+	logRetryWait = 100 * time.Millisecond
+)
+
+// logEntry は送信待ちのログです
+// 送信先はsendLogを呼んだ時点の設定にします (/initializeより前のログを新しいappidに送らないため)
+type logEntry struct {
+	endpoint string
+	appID    string
+	log      isulogger.Log
+	size     int
+}
+
+// logSender はログをメモリに溜めて、バックグラウンドでまとめて送信します
+type logSender struct {
+	mu     sync.Mutex
+	queue  []logEntry
+	size   int
+	closed bool
+	// dropped はキューが一杯で捨てたログの数です
+	dropped int64
+
+	signal chan struct{}
+	done   chan struct{}
+}
+
+var (
+	logQueue      *logSender
+	loggerOptions []isulogger.Option
+)
+
+// SetLoggerOptions はISULOGのクライアントの設定 (タイムアウトやgzip) をします
+func SetLoggerOptions(opts ...isulogger.Option) {
+	loggerOptions = opts
+}
+
+// loggerOptionsWith はloggerOptionsにX-Request-IDヘッダの設定を足したものを返します
+func loggerOptionsWith(reqID string) []isulogger.Option {
+	if reqID == "" {
+		return loggerOptions
+	}
+	return append(loggerOptions[:len(loggerOptions):len(loggerOptions)], isulogger.WithRequestID(reqID))
+}
+
+// StartLogSender はログをまとめて送信するワーカーを起動します
+// キューにはsize件まで溜め、interval毎かLogBatchSize件溜まった時に送信します
+// ctxが終了すると残りのログを送信してから停止するので、DrainLogsで待ってください
+func StartLogSender(ctx context.Context, size int, interval time.Duration) {
+	q := &logSender{
+		size:   size,
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	logQueue = q
+	startWorker(func() {
+		defer close(q.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				q.close()
+				q.flush()
+				return
+			case <-ticker.C:
+			case <-q.signal:
+			}
+			q.flush()
+		}
+	})
+}
+
+// DrainLogs はStartLogSenderのctxが終了した後、残りのログを送信し終わるのを待ちます
+func DrainLogs(ctx context.Context) error {
+	if logQueue == nil {
+		return nil
+	}
+	select {
+	case <-logQueue.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// enqueue はログをキューに入れます。停止中の場合はfalseを返します
+func (q *logSender) enqueue(e logEntry) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	if len(q.queue) >= q.size {
+		q.dropped++
+		n := q.dropped
+		q.mu.Unlock()
+		// 1, 2, 4, 8...件目で出力する
+		if n&(n-1) == 0 {
+			log.Printf("[WARN] log queue is full. dropped:%d", n)
+		}
+		return true
+	}
+	q.queue = append(q.queue, e)
+	full := len(q.queue) >= LogBatchSize
+	q.mu.Unlock()
+	if full {
+		select {
+		case q.signal <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+func (q *logSender) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+}
+
+// flush はキューのログをすべて送信します
+func (q *logSender) flush() {
+	q.mu.Lock()
+	entries := q.queue
+	q.queue = nil
+	q.mu.Unlock()
+
+	for len(entries) > 0 {
+		n := nextLogBatch(entries)
+		sendLogBatch(entries[:n])
+		entries = entries[n:]
+	}
+}
+
+func sendLogBatch(entries []logEntry) {
+	if err := sendLogBulk(entries); err != nil {
+		log.Printf("[WARN] logger send bulk failed. dropped:%d, err:%s", len(entries), err)
+	}
+}
+
+// nextLogBatch は先頭から、送信先が同じ連続したログをLogBatchSize件 (logBatchBytes) までまとめた件数を返します
+func nextLogBatch(entries []logEntry) int {
+	n, size := 1, entries[0].size
+	for n < len(entries) && n < LogBatchSize && size+entries[n].size <= logBatchBytes &&
+		entries[n].endpoint == entries[0].endpoint && entries[n].appID == entries[0].appID {
+		size += entries[n].size
+		n++
+	}
+	return n
+}
+
+// sendLogBulk は送信先が同じログを/send_bulkで送信します。失敗した場合はlogMaxRetry回まで再送します
+func sendLogBulk(entries []logEntry) error {
+	logger, err := isulogger.NewIsulogger(entries[0].endpoint, entries[0].appID, loggerOptions...)
+	if err != nil {
+		return errors.Wrap(err, "new logger failed")
+	}
+	logs := make([]isulogger.Log, len(entries))
+	for i, e := range entries {
+		logs[i] = e.log
+	}
+	wait := logRetryWait
+	for i := 0; ; i++ {
+		start := time.Now()
+		err = logger.SendBulk(logs)
+		observeUpstream("isulogger", "send_bulk", start, err)
+		if err == nil || i == logMaxRetry {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// enqueueLog はログをキューに入れます。StartLogSenderを呼んでいない場合や停止中の場合はfalseを返します
+// vは呼び出し元で変更されても良いように、この時点でJSONにします
+func enqueueLog(endpoint, appID, tag string, v interface{}) bool {
+	if logQueue == nil {
+		return false
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[WARN] log json encode failed. tag: %s, v: %v, err:%s", tag, v, err)
+		return true
+	}
+	return logQueue.enqueue(logEntry{
+		endpoint: endpoint,
+		appID:    appID,
+		log: isulogger.Log{
+			Tag:  tag,
+			Time: time.Now(),
+			Data: json.RawMessage(data),
+		},
+		size: len(tag) + len(data) + logEntryOverhead,
+	})
+}
@@ -0,0 +1,137 @@
+package model
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// メンテナンスモードの設定です
+// 有効にすると管理APIと/healthz以外のAPIは503を返すので、取引を止めたままスキーマを修正できます
+const (
+	MaintenanceMode          = "maintenance"
+	MaintenanceRetryAfterSec = "maintenance_retry_after_sec"
+	MaintenanceMessage       = "maintenance_message"
+
+	// DefaultMaintenanceRetryAfter はRetry-Afterを指定しなかった場合の値です
+	DefaultMaintenanceRetryAfter = 60 * time.Second
+	// MaintenanceCheckInterval より短い間隔ではDBを参照しません
+	// 他のappサーバーで切り替えた場合はこの時間までに反映されます
+	MaintenanceCheckInterval = 1 * time.Second
+)
+
+var ErrMaintenance = errors.New("メンテナンス中です")
+
+// Maintenance はメンテナンスモードの状態です
+type Maintenance struct {
+	Enabled bool
+	// RetryAfter はRetry-Afterヘッダで返す待ち時間です
+	RetryAfter time.Duration
+	// Message はエラーのレスポンスに含める説明です
+	Message string
+}
+
+// maintenance はCurrentMaintenanceで使い回す状態です
+var maintenance = struct {
+	sync.Mutex
+	cur        *Maintenance
+	checkedAt  time.Time
+	refreshing bool
+}{
+	cur: &Maintenance{},
+}
+
+// GetMaintenance はメンテナンスモードの状態をDBから読みます
+func GetMaintenance(d QueryExecutor) (*Maintenance, error) {
+	settings, err := scanSettings(dbQuery(d, `SELECT * FROM setting WHERE name IN (?, ?, ?)`, MaintenanceMode, MaintenanceRetryAfterSec, MaintenanceMessage))
+	if err != nil {
+		return nil, errors.Wrap(err, "get maintenance settings failed")
+	}
+	m := &Maintenance{RetryAfter: DefaultMaintenanceRetryAfter}
+	for _, s := range settings {
+		switch {
+		case s.Val == "":
+		case s.Name == MaintenanceMode:
+			m.Enabled = s.Val == "1"
+		case s.Name == MaintenanceRetryAfterSec:
+			sec, err := strconv.ParseInt(s.Val, 10, 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid setting. %s=%s", s.Name, s.Val)
+			}
+			m.RetryAfter = time.Duration(sec) * time.Second
+		case s.Name == MaintenanceMessage:
+			m.Message = s.Val
+		}
+	}
+	return m, nil
+}
+
+// SetMaintenance はメンテナンスモードを切り替えます
+func SetMaintenance(tx *sql.Tx, m *Maintenance) error {
+	if m.RetryAfter < 0 {
+		return ErrParameterInvalid
+	}
+	if m.RetryAfter == 0 {
+		m.RetryAfter = DefaultMaintenanceRetryAfter
+	}
+	mode := ""
+	if m.Enabled {
+		mode = "1"
+	}
+	for _, kv := range [][2]string{
+		{MaintenanceMode, mode},
+		{MaintenanceRetryAfterSec, strconv.FormatInt(int64(m.RetryAfter/time.Second), 10)},
+		{MaintenanceMessage, m.Message},
+	} {
+		if err := SetSetting(tx, kv[0], kv[1]); err != nil {
+			return errors.Wrapf(err, "set setting failed. %s", kv[0])
+		}
+	}
+	sendLog(tx, "maintenance", map[string]interface{}{
+		"enabled":     m.Enabled,
+		"retry_after": int64(m.RetryAfter / time.Second),
+		"message":     m.Message,
+	})
+	return nil
+}
+
+// ForgetMaintenance は次のCurrentMaintenanceでDBを読み直させます
+// SetMaintenanceのトランザクションをコミットした後に呼んでください
+func ForgetMaintenance() {
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	maintenance.checkedAt = time.Time{}
+}
+
+// CurrentMaintenance はメンテナンスモードの状態を返します
+// MaintenanceCheckIntervalの間は前回の値を返し、DBを参照できなかった場合も前回の値を返します
+func CurrentMaintenance(d QueryExecutor) *Maintenance {
+	maintenance.Lock()
+	cur := maintenance.cur
+	if maintenance.refreshing || time.Since(maintenance.checkedAt) < MaintenanceCheckInterval {
+		maintenance.Unlock()
+		return cur
+	}
+	// 読み直すのは1つのリクエストだけで、他のリクエストは前回の値を使う
+	maintenance.refreshing = true
+	maintenance.Unlock()
+
+	m, err := GetMaintenance(d)
+	maintenance.Lock()
+	defer maintenance.Unlock()
+	maintenance.refreshing = false
+	maintenance.checkedAt = time.Now()
+	if err != nil {
+		log.Printf("[WARN] get maintenance failed. err:%s", err)
+		return cur
+	}
+	if m.Enabled != cur.Enabled {
+		log.Printf("[INFO] maintenance mode changed. enabled:%v", m.Enabled)
+	}
+	maintenance.cur = m
+	return m
+}
@@ -0,0 +1,251 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"isucon8/isubank"
+	"log"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	OrderKindLimit  = "limit"
+	OrderKindMarket = "market"
+)
+
+var (
+	ErrMarketOrderUnfilled = errors.New("成行注文を約定できる注文が不足しています")
+
+	// errMarketTargetCanceled は相手の注文が残高不足でキャンセルされたので選び直すことを表します
+	errMarketTargetCanceled = errors.New("market target canceled")
+)
+
+// CrossMarketOrder は成行注文を反対側の注文と即時に約定させます
+// 買いは安い売り注文から、売りは高い買い注文から数量が埋まるまで消費し、全量を約定できない場合は注文を行いません
+// 約定価格は消費した注文のうち最も不利な価格で、銀行の予約もその価格で行います
+func CrossMarketOrder(db *sql.DB, ot string, userID, amount int64) (*Order, error) {
+	return runMarketOrder(db, ot, userID, amount, 0)
+}
+
+// runMarketOrder はstopOrderIDが0より大きい場合、新しい注文を作らずにその逆指値注文を成行注文として約定させます
+// ユーザーはlockUserで取得するので、WithUserLockの中で呼んでください
+func runMarketOrder(db *sql.DB, ot string, userID, amount, stopOrderID int64) (*Order, error) {
+	if amount <= 0 {
+		return nil, ErrParameterInvalid
+	}
+	switch ot {
+	case OrderTypeBuy, OrderTypeSell:
+	default:
+		return nil, ErrParameterInvalid
+	}
+	if err := checkContinuousMarket(db); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&tradeQueueDepth, 1)
+	defer atomic.AddInt64(&tradeQueueDepth, -1)
+
+	var order *Order
+	err := withTradeLock(db, func() error {
+		var (
+			result *tradeResult
+			cerr   error
+		)
+		err := TxScope(context.Background(), db, matcherTxOptions, func(tx *sql.Tx) (err error) {
+			result = &tradeResult{}
+			order, cerr = crossMarketOrder(tx, ot, userID, amount, stopOrderID, result)
+			switch cerr {
+			case nil, ErrMarketOrderUnfilled, ErrCreditInsufficient:
+				// 残高不足でキャンセルした相手の注文は残す
+				return nil
+			}
+			return cerr
+		})
+		if err != nil {
+			return err
+		}
+		bookApplyTradeResult(db, result)
+		if perr := publishTradeResult(db, result); perr != nil {
+			log.Printf("[WARN] publish trade result failed. err:%s", perr)
+		}
+		return cerr
+	})
+	if err != nil {
+		return nil, err
+	}
+	notifyTrade()
+	return order, nil
+}
+
+func crossMarketOrder(tx *sql.Tx, ot string, userID, amount, stopOrderID int64, result *tradeResult) (*Order, error) {
+	user, err := lockUser(tx, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lockUser failed. id:%d", userID)
+	}
+	if ot == OrderTypeSell && stopOrderID == 0 {
+		// 逆指値注文の場合は注文時に確保済み
+		if err = checkIsu(tx, user.ID, amount); err != nil {
+			return nil, err
+		}
+	}
+	bank, err := Isubank(tx)
+	if err != nil {
+		return nil, errors.Wrap(err, "isubank init failed")
+	}
+	rates, err := getFeeRates(tx)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		targets, price, err := findMarketTargets(tx, ot, amount, result)
+		if err != nil {
+			return nil, err
+		}
+		order := &Order{Type: ot, UserID: user.ID, Amount: amount, Price: price, User: user}
+		taker := &orderFill{order: order, amount: amount, role: FeeRoleTaker, fee: rates.fee(FeeRoleTaker, amount, price)}
+		reserves, err := reserveMarketTrade(tx, bank, taker, targets, rates, result)
+		switch {
+		case err == errMarketTargetCanceled:
+			continue
+		case err != nil:
+			return nil, err
+		}
+		if stopOrderID > 0 {
+			order.ID = stopOrderID
+			if err = triggerStopOrder(tx, order); err != nil {
+				cancelReserves(bank, reserves)
+				return nil, err
+			}
+		} else if order.ID, err = insertMarketOrder(tx, order); err != nil {
+			cancelReserves(bank, reserves)
+			return nil, err
+		}
+		if err = commitReservedOrder(tx, taker, targets, reserves, result); err != nil {
+			cancelReserves(bank, reserves)
+			return nil, err
+		}
+		return GetOrderByID(tx, order.ID)
+	}
+}
+
+func insertMarketOrder(tx *sql.Tx, order *Order) (int64, error) {
+	newID := newID()
+	res, err := dbExec(tx, `INSERT INTO orders (id, type, user_id, amount, price, created_at) VALUES (?, ?, ?, ?, ?, NOW(6))`, newID, order.Type, order.UserID, order.Amount, order.Price)
+	if err != nil {
+		return 0, errors.Wrap(err, "insert order failed")
+	}
+	id, err := insertedID(res, newID)
+	if err != nil {
+		return 0, errors.Wrap(err, "get order_id failed")
+	}
+	if err = recordOrderAudit(tx, &OrderAudit{OrderID: id, UserID: order.UserID, Event: OrderAuditCreated, Actor: OrderActorUser, Amount: order.Amount, Price: order.Price}); err != nil {
+		return 0, err
+	}
+	if order.Type == OrderTypeSell {
+		// 約定時に確保した分を戻すので他の売り注文と同じように確保しておく
+		if err = reserveIsu(tx, order.UserID, order.Amount); err != nil {
+			return 0, err
+		}
+	}
+	sendLog(tx, order.Type+".order", map[string]interface{}{
+		"order_id": id,
+		"user_id":  order.UserID,
+		"amount":   order.Amount,
+		"price":    order.Price,
+	})
+	return id, nil
+}
+
+// findMarketTargets は価格優先、時間優先で数量が埋まるまで反対側の注文をロックして選びます (MatchingPolicyに従います)
+// 返す価格は選んだ注文のうち最も不利な価格です
+func findMarketTargets(tx *sql.Tx, ot string, amount int64, result *tradeResult) ([]*orderFill, int64, error) {
+	var candidates []*Order
+	var err error
+	switch {
+	case book != nil && ot == OrderTypeBuy:
+		candidates = book.Matchable(OrderTypeSell, 0)
+	case book != nil && ot == OrderTypeSell:
+		candidates = book.Matchable(OrderTypeBuy, 0)
+	case ot == OrderTypeBuy:
+		candidates, err = scanOrders(dbQuery(tx, `SELECT * FROM orders WHERE type = ? AND closed_at IS NULL ORDER BY price ASC, created_at ASC, id ASC`, OrderTypeSell))
+	case ot == OrderTypeSell:
+		candidates, err = scanOrders(dbQuery(tx, `SELECT * FROM orders WHERE type = ? AND closed_at IS NULL ORDER BY price DESC, created_at ASC, id ASC`, OrderTypeBuy))
+	}
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "find market targets")
+	}
+	m, err := matcherFor(tx, candidates, amount)
+	if err != nil {
+		return nil, 0, err
+	}
+	restAmount := amount
+	targets := make([]*orderFill, 0, len(candidates))
+	var price int64
+	for _, c := range candidates {
+		to, err := getOpenOrderByID(tx, c.ID)
+		if err != nil {
+			if err == ErrOrderAlreadyClosed {
+				result.closed = append(result.closed, c.ID)
+				continue
+			}
+			return nil, 0, errors.Wrap(err, "getOpenOrderByID market target")
+		}
+		fill, stop := m.fill(to, restAmount)
+		if stop {
+			break
+		}
+		if fill == 0 {
+			continue
+		}
+		targets = append(targets, &orderFill{order: to, amount: fill, role: FeeRoleMaker})
+		restAmount -= fill
+		price = to.Price
+		if restAmount == 0 {
+			break
+		}
+	}
+	if restAmount > 0 {
+		return nil, 0, ErrMarketOrderUnfilled
+	}
+	return targets, price, nil
+}
+
+func reserveMarketTrade(tx *sql.Tx, bank Bank, taker *orderFill, targets []*orderFill, rates *FeeRates, result *tradeResult) ([]int64, error) {
+	order := taker.order
+	id, err := bank.Reserve(order.User.BankID, reservePrice(order.Type, order.Amount, order.Price, taker.fee))
+	if err != nil {
+		if err == isubank.ErrCreditInsufficient {
+			sendLog(tx, order.Type+".error", map[string]interface{}{
+				"error":   err.Error(),
+				"user_id": order.UserID,
+				"amount":  order.Amount,
+				"price":   order.Price,
+			})
+			return nil, ErrCreditInsufficient
+		}
+		return nil, errors.Wrap(err, "isubank.Reserve")
+	}
+	reserves := make([]int64, 1, len(targets)+1)
+	reserves[0] = id
+	for _, to := range targets {
+		to.fee = rates.fee(FeeRoleMaker, to.amount, order.Price)
+		rid, err := reserveOrder(tx, to.order, to.amount, order.Price, to.fee)
+		if err != nil {
+			cancelReserves(bank, reserves)
+			if err == isubank.ErrCreditInsufficient {
+				result.canceled = append(result.canceled, to.order.ID)
+				return nil, errMarketTargetCanceled
+			}
+			return nil, err
+		}
+		reserves = append(reserves, rid)
+	}
+	return reserves, nil
+}
+
+func cancelReserves(bank Bank, reserves []int64) {
+	if err := bank.Cancel(reserves); err != nil {
+		log.Printf("[WARN] isubank cancel failed. err:%s", err)
+	}
+}
@@ -0,0 +1,215 @@
+package model
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// marketStatsBucket はMarketStatsの集計の単位です。期間の始まりはこの単位で前後します
+	marketStatsBucket = time.Minute
+	// marketStatsSyncLimit はSyncで1回に読むトレードの数です
+	marketStatsSyncLimit = 1000
+)
+
+// MarketSummary は直近の期間のトレードの集計です
+type MarketSummary struct {
+	From   time.Time `json:"from"`
+	Open   int64     `json:"open"`
+	High   int64     `json:"high"`
+	Low    int64     `json:"low"`
+	Last   int64     `json:"last"`
+	Volume int64     `json:"volume"`
+	Trades int64     `json:"trades"`
+}
+
+// statsBucket は1分間のトレードの集計です
+type statsBucket struct {
+	t                      time.Time
+	open, high, low, close int64
+	volume, count          int64
+}
+
+// MarketStats は直近window (24時間) のトレードの始値, 高値, 安値, 出来高, 件数を1分ごとにメモリに集計します
+// 起動時にLoadでDBから作り、その後はSyncで新しいトレードだけを足すので、/tickerのたびに集計のクエリを実行しません
+// 他のappサーバーで成立したトレードもSyncでtradeテーブルから拾います
+type MarketStats struct {
+	mu      sync.Mutex
+	window  time.Duration
+	buckets []*statsBucket // 時間順
+	lastID  int64
+	loaded  bool
+}
+
+// marketStats はGetTickerとGetMarketSummaryで使う直近24時間の集計です
+var marketStats = NewMarketStats(TickerWindow)
+
+func NewMarketStats(window time.Duration) *MarketStats {
+	return &MarketStats{window: window}
+}
+
+// LoadMarketStats は起動時に直近24時間の集計をDBから作ります
+func LoadMarketStats(d QueryExecutor) error {
+	return marketStats.Load(d)
+}
+
+// GetMarketSummary は新しいトレードを足してから直近24時間の集計を返します
+func GetMarketSummary(d QueryExecutor) (*MarketSummary, error) {
+	if err := marketStats.Sync(d); err != nil {
+		return nil, err
+	}
+	return marketStats.Summary(time.Now()), nil
+}
+
+// Load は期間内のトレードから集計を作り直します
+func (s *MarketStats) Load(d QueryExecutor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load(d)
+}
+
+func (s *MarketStats) load(d QueryExecutor) error {
+	s.buckets, s.lastID, s.loaded = nil, 0, false
+	from := time.Now().Add(-s.window).Truncate(marketStatsBucket)
+	rows, err := dbQuery(d, `
+		SELECT m.t, a.price, m.h, m.l, b.price, m.v, m.n, m.max_id
+		FROM (
+			SELECT
+				STR_TO_DATE(DATE_FORMAT(created_at, '%Y-%m-%d %H:%i:00'), '%Y-%m-%d %H:%i:%s') AS t,
+				MIN(id) AS min_id,
+				MAX(id) AS max_id,
+				MAX(price) AS h,
+				MIN(price) AS l,
+				SUM(amount) AS v,
+				COUNT(*) AS n
+			FROM trade
+			WHERE created_at >= ?
+			GROUP BY t
+		) m
+		JOIN trade a ON a.id = m.min_id
+		JOIN trade b ON b.id = m.max_id
+		ORDER BY m.t ASC
+	`, from)
+	if err != nil {
+		return errors.Wrap(err, "select trade stats failed")
+	}
+	defer rows.Close()
+	var lastID int64
+	for rows.Next() {
+		b := &statsBucket{}
+		var maxID int64
+		if err = rows.Scan(&b.t, &b.open, &b.high, &b.low, &b.close, &b.volume, &b.count, &maxID); err != nil {
+			return errors.Wrap(err, "scan trade stats failed")
+		}
+		s.buckets = append(s.buckets, b)
+		if maxID > lastID {
+			lastID = maxID
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Wrap(err, "select trade stats failed")
+	}
+	if lastID == 0 {
+		// 期間内にトレードが無い場合は、これまでのトレードを足さないように最新のIDから始める
+		latest, err := GetLatestTrade(d)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return errors.Wrap(err, "GetLatestTrade failed")
+		default:
+			lastID = latest.ID
+		}
+	}
+	s.lastID, s.loaded = lastID, true
+	return nil
+}
+
+// Sync はLoadの後に成立したトレードを足します
+func (s *MarketStats) Sync(d QueryExecutor) error {
+	var latestID int64
+	latest, err := GetLatestTrade(d)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return errors.Wrap(err, "GetLatestTrade failed")
+	default:
+		latestID = latest.ID
+	}
+	return s.syncTo(d, latestID)
+}
+
+// syncTo は最新のトレードがlatestIDになるまで足します
+// 最新のトレードが足したものより古い場合は、Initializeでトレードが消えたので作り直します
+func (s *MarketStats) syncTo(d QueryExecutor, latestID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded || latestID < s.lastID {
+		return s.load(d)
+	}
+	for s.lastID < latestID {
+		trades, err := GetTradesByLastID(d, s.lastID, marketStatsSyncLimit)
+		if err != nil {
+			return errors.Wrap(err, "GetTradesByLastID failed")
+		}
+		if len(trades) == 0 {
+			// レプリカの遅れなどでまだ読めない
+			break
+		}
+		for _, t := range trades {
+			s.add(t)
+		}
+	}
+	return nil
+}
+
+func (s *MarketStats) add(t *Trade) {
+	s.lastID = t.ID
+	bt := t.CreatedAt.Truncate(marketStatsBucket)
+	var b *statsBucket
+	if n := len(s.buckets); n > 0 && !s.buckets[n-1].t.Before(bt) {
+		b = s.buckets[n-1]
+	} else {
+		b = &statsBucket{t: bt, open: t.Price, high: t.Price, low: t.Price}
+		s.buckets = append(s.buckets, b)
+	}
+	if t.Price > b.high {
+		b.high = t.Price
+	}
+	if t.Price < b.low {
+		b.low = t.Price
+	}
+	b.close = t.Price
+	b.volume += t.Amount
+	b.count++
+}
+
+// Summary はnowまでのwindowの集計を返します。期間より古い分はここで捨てます
+func (s *MarketStats) Summary(now time.Time) *MarketSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	from := now.Add(-s.window).Truncate(marketStatsBucket)
+	i := 0
+	for i < len(s.buckets) && s.buckets[i].t.Before(from) {
+		i++
+	}
+	s.buckets = s.buckets[i:]
+	sum := &MarketSummary{From: from}
+	for _, b := range s.buckets {
+		if sum.Trades == 0 {
+			sum.Open, sum.High, sum.Low = b.open, b.high, b.low
+		}
+		if b.high > sum.High {
+			sum.High = b.high
+		}
+		if b.low < sum.Low {
+			sum.Low = b.low
+		}
+		sum.Last = b.close
+		sum.Volume += b.volume
+		sum.Trades += b.count
+	}
+	return sum
+}
@@ -0,0 +1,79 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// matcherSignal はStartMatcherで起動したワーカーへの通知です
+// バッファが1なので、マッチング中に届いた複数の通知は次の1回の実行にまとまります
+var matcherSignal chan struct{}
+
+// StartMatcher はRunTradeをバックグラウンドで実行するワーカーを起動します
+// サーバーを起動する前に呼んでください。ctxが終了すると依頼済みのマッチングを行ってから停止します
+// EnableMatcherLeaderElectionを呼んでいる場合はリーダーのサーバーだけがマッチングを行います
+func StartMatcher(ctx context.Context, db *sql.DB) {
+	ch := make(chan struct{}, 1)
+	matcherSignal = ch
+	e := matcherElector
+	startWorker(func() {
+		atomic.StoreInt32(&matcherRunning, 1)
+		defer atomic.StoreInt32(&matcherRunning, 0)
+
+		var check, poll <-chan time.Time
+		if e != nil {
+			defer e.resign()
+			e.tick(ctx)
+			ct := time.NewTicker(e.interval)
+			defer ct.Stop()
+			// 他のサーバーで受け付けた注文は通知が届かないので定期的にマッチングする
+			pt := time.NewTicker(MatcherPollInterval)
+			defer pt.Stop()
+			check, poll = ct.C, pt.C
+		}
+		run := func() {
+			if e != nil && !e.IsLeader() {
+				return
+			}
+			if err := RunTrade(db); err != nil {
+				// トレードに失敗しても次の通知で再度試す
+				log.Printf("runTrade err:%s", err)
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				// 停止する前に受け付けた注文をマッチングする
+				select {
+				case <-ch:
+					run()
+				default:
+				}
+				return
+			case <-check:
+				e.tick(ctx)
+			case <-poll:
+				run()
+			case <-ch:
+				run()
+			}
+		}
+	})
+}
+
+// SignalMatcher はワーカーにマッチングを依頼します
+// ワーカーが起動していない場合はfalseを返すので、呼び出し側でRunTradeを実行してください
+func SignalMatcher() bool {
+	if matcherSignal == nil {
+		return false
+	}
+	select {
+	case matcherSignal <- struct{}{}:
+	default:
+		// 既に依頼済み
+	}
+	return true
+}
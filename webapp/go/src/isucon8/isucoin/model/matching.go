@@ -0,0 +1,164 @@
+package model
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// MatchingPolicy はマッチングで相手の注文を選ぶ方法の設定です
+// 空の場合は従来どおりgreedyです
+const MatchingPolicy = "matching_policy"
+
+const (
+	// MatchingGreedy は価格と時間の優先順に見て、脚数が合わずに約定できない注文は飛ばして次の注文を見ます
+	MatchingGreedy = "greedy"
+	// MatchingPriceTime は価格と時間の優先順に約定させ、約定できない注文があればそれ以降の注文は約定させません
+	MatchingPriceTime = "price_time"
+	// MatchingProRata は同じ価格の注文が注文の脚数より多い場合、未約定の脚数に比例して割り当てます
+	MatchingProRata = "pro_rata"
+)
+
+// matcher は1回のマッチングで相手の注文に約定させる脚数を決めます
+type matcher interface {
+	// fill は残りrest脚のときにtoに約定させる脚数を返します
+	// 0の場合はtoを約定させずに次の注文を見て、stopがtrueの場合はtoとそれ以降の注文を約定させません
+	fill(to *Order, rest int64) (amount int64, stop bool)
+}
+
+func matchingPolicy(d QueryExecutor) (string, error) {
+	policy, err := GetSetting(d, MatchingPolicy)
+	switch {
+	case err == sql.ErrNoRows:
+		return MatchingGreedy, nil
+	case err != nil:
+		return "", errors.Wrapf(err, "getSetting failed. %s", MatchingPolicy)
+	}
+	switch policy {
+	case MatchingPriceTime, MatchingProRata:
+		return policy, nil
+	}
+	return MatchingGreedy, nil
+}
+
+// newMatcher はpolicyのmatcherを返します
+// candidatesは相手の注文を優先順に並べたもので、amountは注文の脚数です (pro_rataの割り当てに使います)
+func newMatcher(policy string, candidates []*Order, amount int64) matcher {
+	switch policy {
+	case MatchingPriceTime:
+		return priceTimeMatcher{}
+	case MatchingProRata:
+		return newProRataMatcher(candidates, amount)
+	}
+	return greedyMatcher{}
+}
+
+// matcherFor は設定されたpolicyのmatcherを返します
+func matcherFor(d QueryExecutor, candidates []*Order, amount int64) (matcher, error) {
+	policy, err := matchingPolicy(d)
+	if err != nil {
+		return nil, err
+	}
+	return newMatcher(policy, candidates, amount), nil
+}
+
+type greedyMatcher struct{}
+
+func (greedyMatcher) fill(to *Order, rest int64) (int64, bool) {
+	fill := to.restAmount()
+	if fill > rest {
+		if !to.PartialFill {
+			return 0, false
+		}
+		// 部分約定を許可する注文は必要な分だけ約定させる
+		fill = rest
+	}
+	return fill, false
+}
+
+type priceTimeMatcher struct{}
+
+func (priceTimeMatcher) fill(to *Order, rest int64) (int64, bool) {
+	fill := to.restAmount()
+	if fill > rest {
+		if !to.PartialFill {
+			// 後の注文に先に約定させない
+			return 0, true
+		}
+		fill = rest
+	}
+	return fill, false
+}
+
+// proRataMatcher は注文を作った時点の候補に対して割り当てた脚数まで約定させます
+type proRataMatcher struct {
+	alloc map[int64]int64
+}
+
+// newProRataMatcher は優先順の価格ごとに、その価格の注文で残りを埋められる場合はすべて約定させ、
+// 埋められない場合は未約定の脚数に比例して割り当てます (1脚未満は切り捨て)
+// 部分約定を許可しない注文は全量を割り当てられない場合は0にし、切り捨てた残りは時間の優先順に割り当てます
+// それでも残った場合は次の価格の注文に割り当てます
+func newProRataMatcher(candidates []*Order, amount int64) *proRataMatcher {
+	m := &proRataMatcher{alloc: make(map[int64]int64, len(candidates))}
+	rest := amount
+	for i := 0; i < len(candidates) && rest > 0; {
+		j := i
+		var total int64
+		for ; j < len(candidates) && candidates[j].Price == candidates[i].Price; j++ {
+			total += candidates[j].restAmount()
+		}
+		level := candidates[i:j]
+		i = j
+		if total <= rest {
+			for _, o := range level {
+				m.alloc[o.ID] = o.restAmount()
+			}
+			rest -= total
+			continue
+		}
+		allocated := int64(0)
+		for _, o := range level {
+			a := rest * o.restAmount() / total
+			if a < o.restAmount() && !o.PartialFill {
+				a = 0
+			}
+			m.alloc[o.ID] = a
+			allocated += a
+		}
+		rest -= allocated
+		for _, o := range level {
+			if rest == 0 {
+				break
+			}
+			switch a := m.alloc[o.ID]; {
+			case o.PartialFill:
+				add := o.restAmount() - a
+				if add > rest {
+					add = rest
+				}
+				m.alloc[o.ID] += add
+				rest -= add
+			case a == 0 && o.restAmount() <= rest:
+				m.alloc[o.ID] = o.restAmount()
+				rest -= o.restAmount()
+			}
+		}
+	}
+	return m
+}
+
+func (m *proRataMatcher) fill(to *Order, rest int64) (int64, bool) {
+	fill := m.alloc[to.ID]
+	if r := to.restAmount(); fill > r {
+		fill = r
+	}
+	if fill > rest {
+		fill = rest
+	}
+	if fill < to.restAmount() && !to.PartialFill {
+		// 割り当てた後に脚数が変わった場合
+		return 0, false
+	}
+	return fill, false
+}
@@ -0,0 +1,125 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+// matchAll はtryTradeと同じ順番でmatcherに問い合わせ、注文のidごとに約定させる脚数を返します
+func matchAll(m matcher, candidates []*Order, amount int64) map[int64]int64 {
+	fills := map[int64]int64{}
+	rest := amount
+	for _, to := range candidates {
+		if rest == 0 {
+			break
+		}
+		fill, stop := m.fill(to, rest)
+		if stop {
+			break
+		}
+		if fill == 0 {
+			continue
+		}
+		fills[to.ID] = fill
+		rest -= fill
+	}
+	return fills
+}
+
+func TestMatcher(t *testing.T) {
+	order := func(id, price, amount int64, partial bool) *Order {
+		return &Order{ID: id, Price: price, Amount: amount, PartialFill: partial}
+	}
+	tests := []struct {
+		title      string
+		policy     string
+		candidates []*Order
+		amount     int64
+		expected   map[int64]int64
+	}{
+		{
+			title:      "greedy skips non-partial orders larger than the rest",
+			policy:     MatchingGreedy,
+			candidates: []*Order{order(1, 100, 6, false), order(2, 100, 3, false), order(3, 101, 2, false)},
+			amount:     5,
+			expected:   map[int64]int64{2: 3, 3: 2},
+		},
+		{
+			title:      "greedy partially fills partial orders",
+			policy:     MatchingGreedy,
+			candidates: []*Order{order(1, 100, 3, false), order(2, 100, 6, true)},
+			amount:     5,
+			expected:   map[int64]int64{1: 3, 2: 2},
+		},
+		{
+			title:      "price_time stops at the first order it cannot fill",
+			policy:     MatchingPriceTime,
+			candidates: []*Order{order(1, 100, 2, false), order(2, 100, 6, false), order(3, 101, 3, false)},
+			amount:     5,
+			expected:   map[int64]int64{1: 2},
+		},
+		{
+			title:      "price_time partially fills partial orders",
+			policy:     MatchingPriceTime,
+			candidates: []*Order{order(1, 100, 6, true), order(2, 100, 3, false)},
+			amount:     5,
+			expected:   map[int64]int64{1: 5},
+		},
+		{
+			title:      "pro_rata gives the rounding remainder in time priority",
+			policy:     MatchingProRata,
+			candidates: []*Order{order(1, 100, 7, true), order(2, 100, 7, true), order(3, 100, 7, true)},
+			amount:     10,
+			expected:   map[int64]int64{1: 4, 2: 3, 3: 3},
+		},
+		{
+			title:      "pro_rata does not partially fill non-partial orders",
+			policy:     MatchingProRata,
+			candidates: []*Order{order(1, 100, 8, true), order(2, 100, 4, false)},
+			amount:     10,
+			expected:   map[int64]int64{1: 8},
+		},
+		{
+			title:      "pro_rata fills non-partial orders whole with the remainder and spills over to the next price",
+			policy:     MatchingProRata,
+			candidates: []*Order{order(1, 100, 6, false), order(2, 100, 6, false), order(3, 101, 4, true)},
+			amount:     10,
+			expected:   map[int64]int64{1: 6, 3: 4},
+		},
+		{
+			title:      "pro_rata fills the best price and allocates the rest in the next price",
+			policy:     MatchingProRata,
+			candidates: []*Order{order(1, 100, 3, false), order(2, 101, 9, true), order(3, 101, 3, true)},
+			amount:     10,
+			expected:   map[int64]int64{1: 3, 2: 6, 3: 1},
+		},
+	}
+	for _, tt := range tests {
+		m := newMatcher(tt.policy, tt.candidates, tt.amount)
+		if got := matchAll(m, tt.candidates, tt.amount); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: got:%v expected:%v", tt.title, got, tt.expected)
+		}
+	}
+}
+
+func TestProRataMatcherAfterFill(t *testing.T) {
+	// 割り当てた後に脚数が変わった注文は未約定の脚数までしか約定させず、割り当てのない注文は約定させない
+	a := &Order{ID: 1, Price: 100, Amount: 4}
+	b := &Order{ID: 2, Price: 100, Amount: 4, PartialFill: true}
+	m := newProRataMatcher([]*Order{a, b}, 8)
+	a.Amount = 3
+	if fill, stop := m.fill(a, 8); fill != 3 || stop {
+		t.Errorf("fill shrunk order: got:%d,%v expected:3,false", fill, stop)
+	}
+	b.Filled = 1
+	if fill, _ := m.fill(b, 8); fill != 3 {
+		t.Errorf("fill partially filled order: got:%d expected:3", fill)
+	}
+	if fill, _ := m.fill(b, 2); fill != 2 {
+		t.Errorf("fill over rest: got:%d expected:2", fill)
+	}
+	c := &Order{ID: 3, Price: 100, Amount: 4}
+	if fill, stop := m.fill(c, 8); fill != 0 || stop {
+		t.Errorf("fill unallocated order: got:%d,%v expected:0,false", fill, stop)
+	}
+}
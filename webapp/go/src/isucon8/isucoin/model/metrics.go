@@ -0,0 +1,69 @@
+package model
+
+import (
+	"isucon8/isubank"
+	"isucon8/isucoin/metrics"
+	"time"
+)
+
+var (
+	upstreamDuration = metrics.NewHistogramVec("isucoin_upstream_request_duration_seconds",
+		"銀行APIとISULOGの呼び出しにかかった時間", metrics.DefaultBuckets, "service", "op")
+	upstreamErrors = metrics.NewCounterVec("isucoin_upstream_errors_total",
+		"銀行APIとISULOGの呼び出しが失敗した回数 (残高不足を除く)", "service", "op")
+)
+
+func observeUpstream(service, op string, start time.Time, err error) {
+	upstreamDuration.Observe(time.Since(start).Seconds(), service, op)
+	if err != nil && err != isubank.ErrCreditInsufficient {
+		upstreamErrors.Inc(service, op)
+	}
+}
+
+// EnableMetrics はDBの接続数とマッチングの待ち数をメトリクスに出力するようにします
+func EnableMetrics(cluster *DBCluster) {
+	metrics.NewGaugeFunc("isucoin_db_connections", "DBの接続数", []string{"db", "state"}, func(emit func(float64, ...string)) {
+		for name, s := range cluster.Stats() {
+			emit(float64(s.InUse), name, "in_use")
+			emit(float64(s.Idle), name, "idle")
+		}
+	})
+	metrics.NewCounterFunc("isucoin_db_wait_count_total", "DBの接続が空くのを待った回数", []string{"db"}, func(emit func(float64, ...string)) {
+		for name, s := range cluster.Stats() {
+			emit(float64(s.WaitCount), name)
+		}
+	})
+	metrics.NewCounterFunc("isucoin_db_wait_duration_seconds_total", "DBの接続が空くのを待った時間の合計", []string{"db"}, func(emit func(float64, ...string)) {
+		for name, s := range cluster.Stats() {
+			emit(s.WaitDuration.Seconds(), name)
+		}
+	})
+	metrics.NewGaugeFunc("isucoin_trade_queue_depth", "実行中または待機中のマッチングの数", nil, func(emit func(float64, ...string)) {
+		emit(float64(TradeQueueDepth()))
+	})
+}
+
+// meteredBank は呼び出しにかかった時間と失敗した回数をメトリクスに出力するBankです
+type meteredBank struct {
+	Bank
+}
+
+func (mb *meteredBank) Check(bankID string, price int64) (err error) {
+	defer func(start time.Time) { observeUpstream("isubank", "check", start, err) }(time.Now())
+	return mb.Bank.Check(bankID, price)
+}
+
+func (mb *meteredBank) Reserve(bankID string, price int64) (id int64, err error) {
+	defer func(start time.Time) { observeUpstream("isubank", "reserve", start, err) }(time.Now())
+	return mb.Bank.Reserve(bankID, price)
+}
+
+func (mb *meteredBank) Commit(reserveIDs []int64) (err error) {
+	defer func(start time.Time) { observeUpstream("isubank", "commit", start, err) }(time.Now())
+	return mb.Bank.Commit(reserveIDs)
+}
+
+func (mb *meteredBank) Cancel(reserveIDs []int64) (err error) {
+	defer func(start time.Time) { observeUpstream("isubank", "cancel", start, err) }(time.Now())
+	return mb.Bank.Cancel(reserveIDs)
+}
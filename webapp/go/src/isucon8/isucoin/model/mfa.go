@@ -0,0 +1,239 @@
+package model
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TOTP (RFC 6238) の設定です。Google Authenticatorなどのデフォルトに合わせています
+const (
+	MFAIssuer  = "ISUCOIN"
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew は前後に許す時間のずれ (ステップ数) です
+	totpSkew = 1
+)
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("2段階認証はすでに有効です")
+	ErrMFANotEnrolled    = errors.New("2段階認証の登録がありません")
+	ErrMFARequired       = errors.New("otp required")
+	ErrMFAInvalid        = errors.New("invalid otp")
+
+	mfaKey = deriveMFAKey("")
+)
+
+// MFAEnrollment は認証アプリに登録する情報です
+type MFAEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type userMFA struct {
+	secret    []byte
+	enabledAt *time.Time
+	lastStep  int64
+}
+
+// SetMFAKey はuser_mfaのシークレットを暗号化する鍵を設定します
+// 複数台で動かす場合は全台で同じ値にしてください
+func SetMFAKey(key string) {
+	mfaKey = deriveMFAKey(key)
+}
+
+func deriveMFAKey(key string) []byte {
+	sum := sha256.Sum256([]byte("isucoin-mfa:" + key))
+	return sum[:]
+}
+
+// sealMFASecret はシークレットをAES-GCMで暗号化します。ユーザーidを追加データにして他のユーザーに付け替えられないようにします
+func sealMFASecret(userID int64, secret []byte) ([]byte, error) {
+	gcm, err := newMFACipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generate nonce failed")
+	}
+	return gcm.Seal(nonce, nonce, secret, []byte(strconv.FormatInt(userID, 10))), nil
+}
+
+func openMFASecret(userID int64, sealed []byte) ([]byte, error) {
+	gcm, err := newMFACipher()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("mfa secret is broken")
+	}
+	n := gcm.NonceSize()
+	secret, err := gcm.Open(nil, sealed[:n], sealed[n:], []byte(strconv.FormatInt(userID, 10)))
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt mfa secret failed")
+	}
+	return secret, nil
+}
+
+func newMFACipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(mfaKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "aes.NewCipher failed")
+	}
+	return cipher.NewGCM(block)
+}
+
+func getUserMFA(d QueryExecutor, userID int64, lock bool) (*userMFA, error) {
+	q := `SELECT secret, enabled_at, last_step FROM user_mfa WHERE user_id = ?`
+	if lock {
+		q += ` FOR UPDATE`
+	}
+	rows, err := dbQuery(d, q, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "select user_mfa failed")
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, errors.Wrap(err, "select user_mfa failed")
+		}
+		return nil, sql.ErrNoRows
+	}
+	var (
+		m      userMFA
+		sealed []byte
+	)
+	if err = rows.Scan(&sealed, &m.enabledAt, &m.lastStep); err != nil {
+		return nil, errors.Wrap(err, "scan user_mfa failed")
+	}
+	if m.secret, err = openMFASecret(userID, sealed); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// totpCode はステップ (30秒ごとの時刻) のワンタイムパスワードです
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, v%1000000)
+}
+
+// matchTOTP はcodeが一致したステップを返します。lastStep以前のステップは使えません (再利用の防止)
+func matchTOTP(secret []byte, code string, lastStep int64, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// EnrollMFA は2段階認証のシークレットを発行します。VerifyMFAEnrollmentでコードを確認すると有効になります
+func EnrollMFA(tx *sql.Tx, user *User) (*MFAEnrollment, error) {
+	m, err := getUserMFA(tx, user.ID, true)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, err
+	case m.enabledAt != nil:
+		return nil, ErrMFAAlreadyEnabled
+	}
+	secret := make([]byte, 20)
+	if _, err = rand.Read(secret); err != nil {
+		return nil, errors.Wrap(err, "generate mfa secret failed")
+	}
+	sealed, err := sealMFASecret(user.ID, secret)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dbExec(tx, `INSERT INTO user_mfa (user_id, secret, last_step, created_at) VALUES (?, ?, 0, NOW(6)) ON DUPLICATE KEY UPDATE secret = VALUES(secret), last_step = 0, created_at = VALUES(created_at)`,
+		user.ID, sealed); err != nil {
+		return nil, errors.Wrap(err, "insert user_mfa failed")
+	}
+	sendLog(tx, "mfa.enroll", map[string]interface{}{
+		"user_id": user.ID,
+	})
+	encoded := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	label := url.PathEscape(MFAIssuer + ":" + user.Name)
+	uri := fmt.Sprintf("otpauth://totp/%s?secret=%s&issuer=%s&digits=%d&period=%d", label, encoded, url.QueryEscape(MFAIssuer), totpDigits, totpPeriod)
+	return &MFAEnrollment{Secret: encoded, URI: uri}, nil
+}
+
+// VerifyMFAEnrollment は発行したシークレットのコードを確認して2段階認証を有効にします
+func VerifyMFAEnrollment(tx *sql.Tx, userID int64, code string) error {
+	m, err := getUserMFA(tx, userID, true)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrMFANotEnrolled
+	case err != nil:
+		return err
+	case m.enabledAt != nil:
+		return ErrMFAAlreadyEnabled
+	}
+	step, ok := matchTOTP(m.secret, code, m.lastStep, time.Now())
+	if !ok {
+		return ErrMFAInvalid
+	}
+	if _, err = dbExec(tx, `UPDATE user_mfa SET enabled_at = NOW(6), last_step = ? WHERE user_id = ?`, step, userID); err != nil {
+		return errors.Wrap(err, "update user_mfa failed")
+	}
+	sendLog(tx, "mfa.enable", map[string]interface{}{
+		"user_id": userID,
+	})
+	return nil
+}
+
+// VerifyMFA はログイン時に2段階認証のコードを確認します。有効にしていないユーザーは確認しません
+func VerifyMFA(d QueryExecutor, userID int64, code string) error {
+	m, err := getUserMFA(d, userID, false)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return err
+	case m.enabledAt == nil:
+		return nil
+	case code == "":
+		return ErrMFARequired
+	}
+	step, ok := matchTOTP(m.secret, code, m.lastStep, time.Now())
+	if ok {
+		// 同時に同じコードで確認された場合は先に更新した方だけを通す
+		res, err := dbExec(d, `UPDATE user_mfa SET last_step = ? WHERE user_id = ? AND last_step < ?`, step, userID, step)
+		if err != nil {
+			return errors.Wrap(err, "update user_mfa failed")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return errors.Wrap(err, "get rows affected failed")
+		}
+		ok = n > 0
+	}
+	if !ok {
+		sendLog(d, "mfa.failed", map[string]interface{}{
+			"user_id": userID,
+		})
+		return ErrMFAInvalid
+	}
+	return nil
+}
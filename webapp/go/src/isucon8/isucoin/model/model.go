@@ -10,6 +10,7 @@ var (
 	ErrBankUserNotFound   = errors.New("bank user not found")
 	ErrBankUserConflict   = errors.New("bank user conflict")
 	ErrUserNotFound       = errors.New("user not found")
+	ErrPasswordMismatch   = errors.New("password is not match")
 	ErrOrderNotFound      = errors.New("order not found")
 	ErrOrderAlreadyClosed = errors.New("order is already closed")
 	ErrCreditInsufficient = errors.New("銀行の残高が足りません")
@@ -23,14 +24,33 @@ type QueryExecutor interface {
 }
 
 func InitBenchmark(d QueryExecutor) error {
+	if err := restoreArchive(d); err != nil {
+		return err
+	}
 	for _, q := range []string{
 		"DELETE FROM orders WHERE created_at >= '2018-10-16 10:00:00'",
 		"DELETE FROM trade WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM fills WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM trade_fee WHERE created_at >= '2018-10-16 10:00:00'",
 		"DELETE FROM user WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM api_key WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM webhook WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM price_alert WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM order_meta WHERE updated_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM order_events WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM user_session WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM user_mfa WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM signin_failure WHERE updated_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM bank_transaction WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM log_outbox WHERE created_at >= '2018-10-16 10:00:00'",
+		"DELETE FROM auction WHERE created_at >= '2018-10-16 10:00:00'",
 	} {
-		if _, err := d.Exec(q); err != nil {
-			return errors.Wrapf(err, "query exec failed[%d]", q)
+		if _, err := dbExec(d, q); err != nil {
+			return errors.Wrapf(err, "query exec failed[%s]", q)
 		}
 	}
-	return nil
+	if err := rebuildCandlestick(d); err != nil {
+		return err
+	}
+	return rebuildPositions(d)
 }
@@ -0,0 +1,186 @@
+package model
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var tradeSubscribers = struct {
+	sync.Mutex
+	chans map[chan struct{}]struct{}
+}{
+	chans: map[chan struct{}]struct{}{},
+}
+
+// SubscribeTrade はこのプロセスでトレードが成立したときに通知を受け取るチャネルを返します
+// 通知はまとめて届くことがあるので、受け取ったら処理済みのcursor以降のトレードをDBから取得してください
+// 受信をやめるときは返り値の関数を呼んでください
+func SubscribeTrade() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	tradeSubscribers.Lock()
+	tradeSubscribers.chans[ch] = struct{}{}
+	tradeSubscribers.Unlock()
+	return ch, func() {
+		tradeSubscribers.Lock()
+		delete(tradeSubscribers.chans, ch)
+		tradeSubscribers.Unlock()
+	}
+}
+
+func notifyTrade() {
+	tradeSubscribers.Lock()
+	defer tradeSubscribers.Unlock()
+	for ch := range tradeSubscribers.chans {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+const (
+	OrderEventOrdered   = "ordered"
+	OrderEventCanceled  = "canceled"
+	OrderEventTraded    = "traded"
+	OrderEventModified  = "modified"
+	OrderEventTriggered = "triggered"
+)
+
+// OrderEvent はコミットされた注文の状態変化です
+type OrderEvent struct {
+	Event  string `json:"event"`
+	Reason string `json:"reason,omitempty"`
+	Order  *Order `json:"order"`
+}
+
+// EventPublisher はコミットされたトレードと注文の状態変化、発動した価格アラートを受け取ります
+// トレード処理中に呼ばれるので、重い処理は別のgoroutineで行ってください
+type EventPublisher interface {
+	PublishTrade(trade *Trade)
+	PublishOrderEvent(ev *OrderEvent)
+	PublishAlert(alert *PriceAlert)
+}
+
+var publishers = struct {
+	sync.RWMutex
+	list []EventPublisher
+}{}
+
+func AddEventPublisher(p EventPublisher) {
+	publishers.Lock()
+	publishers.list = append(publishers.list, p)
+	publishers.Unlock()
+}
+
+func hasPublisher() bool {
+	publishers.RLock()
+	defer publishers.RUnlock()
+	return len(publishers.list) > 0
+}
+
+// PublishOrderEvent は注文の状態変化を通知します
+// トランザクションのコミット後に呼んでください
+func PublishOrderEvent(ev *OrderEvent) {
+	publishers.RLock()
+	defer publishers.RUnlock()
+	for _, p := range publishers.list {
+		p.PublishOrderEvent(ev)
+	}
+}
+
+// PublishAlert は発動した価格アラートを通知します
+// アラートを発動済みにしたトランザクションのコミット後に呼んでください
+func PublishAlert(alert *PriceAlert) {
+	publishers.RLock()
+	defer publishers.RUnlock()
+	for _, p := range publishers.list {
+		p.PublishAlert(alert)
+	}
+}
+
+func publishTrade(trade *Trade) {
+	publishers.RLock()
+	defer publishers.RUnlock()
+	for _, p := range publishers.list {
+		p.PublishTrade(trade)
+	}
+}
+
+// tradeResult はtryTradeで状態が変わった注文です
+// コミット後にpublishTradeResultで通知します
+type tradeResult struct {
+	tradeID     int64
+	canceled    []int64
+	closed      []int64
+	filled      []int64   // 部分約定して未約定の分が残っている注文
+	refilled    []int64   // アイスバーグ注文の補充で追加した注文
+	selfTrade   []int64   // 自己約定防止で取り消した注文
+	decremented []int64   // 自己約定防止で脚数を減らした注文
+	haltedUntil time.Time // サーキットブレーカーが発動した場合の停止の期限
+}
+
+// orderIDs は板から取り除く注文です
+func (res *tradeResult) orderIDs() []int64 {
+	ids := append(append([]int64{}, res.canceled...), res.closed...)
+	return append(ids, res.selfTrade...)
+}
+
+// updatedIDs は脚数が変わったので板に読み直す注文です
+func (res *tradeResult) updatedIDs() []int64 {
+	return append(append([]int64{}, res.filled...), res.decremented...)
+}
+
+func publishTradeResult(d QueryExecutor, res *tradeResult) error {
+	if !res.haltedUntil.IsZero() {
+		resumeAfterCircuitBreaker(res.haltedUntil)
+	}
+	if !hasPublisher() {
+		return nil
+	}
+	for _, id := range res.canceled {
+		order, err := GetOrderByID(d, id)
+		if err != nil {
+			return errors.Wrapf(err, "GetOrderByID failed. id:%d", id)
+		}
+		PublishOrderEvent(&OrderEvent{Event: OrderEventCanceled, Reason: CancelReasonReserveFailed, Order: order})
+	}
+	for _, id := range res.selfTrade {
+		order, err := GetOrderByID(d, id)
+		if err != nil {
+			return errors.Wrapf(err, "GetOrderByID failed. id:%d", id)
+		}
+		PublishOrderEvent(&OrderEvent{Event: OrderEventCanceled, Reason: CancelReasonSelfTrade, Order: order})
+	}
+	for _, id := range res.decremented {
+		order, err := GetOrderByID(d, id)
+		if err != nil {
+			return errors.Wrapf(err, "GetOrderByID failed. id:%d", id)
+		}
+		PublishOrderEvent(&OrderEvent{Event: OrderEventModified, Reason: CancelReasonSelfTrade, Order: order})
+	}
+	if res.tradeID == 0 {
+		return nil
+	}
+	trade, err := GetTradeByID(d, res.tradeID)
+	if err != nil {
+		return errors.Wrapf(err, "GetTradeByID failed. id:%d", res.tradeID)
+	}
+	publishTrade(trade)
+	orders, err := scanOrders(dbQuery(d, `SELECT * FROM orders WHERE trade_id = ?`, res.tradeID))
+	if err != nil {
+		return errors.Wrapf(err, "get orders by trade_id failed. id:%d", res.tradeID)
+	}
+	for _, order := range orders {
+		PublishOrderEvent(&OrderEvent{Event: OrderEventTraded, Order: order})
+	}
+	for _, id := range res.refilled {
+		order, err := GetOrderByID(d, id)
+		if err != nil {
+			return errors.Wrapf(err, "GetOrderByID failed. id:%d", id)
+		}
+		PublishOrderEvent(&OrderEvent{Event: OrderEventOrdered, Order: order})
+	}
+	return nil
+}
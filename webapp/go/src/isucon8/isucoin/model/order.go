@@ -3,14 +3,34 @@ package model
 import (
 	"database/sql"
 	"isucon8/isubank"
+	"math"
+	"strings"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/pkg/errors"
 )
 
 const (
-	OrderTypeBuy  = "buy"
-	OrderTypeSell = "sell"
+	OrderTypeBuy      = "buy"
+	OrderTypeSell     = "sell"
+	OrderTypeStopBuy  = "stop_buy"
+	OrderTypeStopSell = "stop_sell"
+
+	OrderStatusOpen   = "open"
+	OrderStatusClosed = "closed"
+	OrderStatusTraded = "traded"
+
+	// 注文を取り消した理由で、{type}.deleteのログと取り消しのイベントに含めます
+	CancelReasonCanceled      = "canceled" // ユーザーによる取り消し
+	CancelReasonReserveFailed = "reserve_failed"
+	CancelReasonStopUnfilled  = "stop_unfilled"
+	CancelReasonIOCUnfilled   = "ioc_unfilled"
+	CancelReasonFOKUnfilled   = "fok_unfilled"
+	CancelReasonExpired       = "expired"
+	CancelReasonSelfTrade     = "self_trade"
+	CancelReasonAdmin         = "admin" // 管理APIによる取り消し
+	CancelReasonUserClosed    = "user_closed"
 )
 
 //go:generate scanner
@@ -23,16 +43,164 @@ type Order struct {
 	ClosedAt  *time.Time `json:"closed_at"`
 	TradeID   int64      `json:"trade_id,omitempty"`
 	CreatedAt time.Time  `json:"created_at"`
-	User      *User      `json:"user,omitempty"`
-	Trade     *Trade     `json:"trade,omitempty"`
+	// TriggerPrice は逆指値注文のトリガー価格で、TriggeredAtはトリガーされて通常の注文になった時間です
+	TriggerPrice int64      `json:"trigger_price,omitempty"`
+	TriggeredAt  *time.Time `json:"triggered_at,omitempty"`
+	// DisplayAmount はアイスバーグ注文の1回に板に出す脚数で、HiddenAmountはまだ板に出していない残りです
+	// ParentIDは補充された注文の場合に最初の注文のidです
+	DisplayAmount int64 `json:"display_amount,omitempty"`
+	HiddenAmount  int64 `json:"hidden_amount,omitempty"`
+	ParentID      int64 `json:"parent_id,omitempty"`
+	// PartialFill の注文は複数のトレードで少しずつ約定し、Filledに約定済みの脚数を持ちます
+	// Remainingは未約定の脚数です (閉じた注文でも約定しなかった分が残ります)
+	PartialFill bool    `json:"partial_fill,omitempty"`
+	Filled      int64   `json:"filled_amount"`
+	Remaining   int64   `json:"remaining_amount"`
+	Fills       []*Fill `json:"fills,omitempty"`
+	// ExpiresAt を過ぎた未約定の注文はExpireOrdersで取り消されます
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Fee は約定で払った手数料の合計です
+	Fee int64 `json:"fee,omitempty"`
+	// Meta はユーザーが付けたタグとメモで、FetchOrdersMetaで埋めます
+	Meta  *OrderMeta `json:"meta,omitempty"`
+	User  *User      `json:"user,omitempty"`
+	Trade *Trade     `json:"trade,omitempty"`
+}
+
+// OrdersQuery はGetOrdersByUserIDPagedの条件です
+// Statusが空の場合はGetOrdersByUserIDと同じく未約定と約定済みの注文を対象にします
+type OrdersQuery struct {
+	Cursor int64
+	Limit  int
+	Status string
+	Type   string
+	// Tag, Watched を指定した場合はSetOrderMetaで付けたタグ, ウォッチの印の注文だけを返します
+	Tag     string
+	Watched bool
+}
+
+// PriceLevel は板の価格ごとの注文数量です
+type PriceLevel struct {
+	Price            int64 `json:"price"`
+	Amount           int64 `json:"amount"`
+	CumulativeAmount int64 `json:"cumulative_amount"`
+}
+
+// MarketDepth は価格ごとに集計した板情報です
+// Sellsは安い順、Buysは高い順に並びます
+type MarketDepth struct {
+	Sells []*PriceLevel `json:"sells"`
+	Buys  []*PriceLevel `json:"buys"`
 }
 
 func GetOrdersByUserID(d QueryExecutor, userID int64) ([]*Order, error) {
-	return scanOrders(d.Query("SELECT * FROM orders WHERE user_id = ? AND (closed_at IS NULL OR trade_id IS NOT NULL) ORDER BY created_at ASC", userID))
+	return scanOrders(stmtQuery(d, queryOrdersByUserID, userID))
+}
+
+// GetOrdersByUserIDPaged はidがq.Cursorより大きい注文をid順にq.Limit件返します
+func GetOrdersByUserIDPaged(d QueryExecutor, userID int64, q OrdersQuery) ([]*Order, error) {
+	query := `SELECT * FROM orders WHERE user_id = ? AND id > ?`
+	args := []interface{}{userID, q.Cursor}
+	switch q.Status {
+	case "":
+		query += ` AND (closed_at IS NULL OR trade_id IS NOT NULL)`
+	case OrderStatusOpen:
+		query += ` AND closed_at IS NULL`
+	case OrderStatusClosed:
+		query += ` AND closed_at IS NOT NULL`
+	case OrderStatusTraded:
+		query += ` AND trade_id IS NOT NULL`
+	default:
+		return nil, ErrParameterInvalid
+	}
+	switch q.Type {
+	case "":
+	case OrderTypeBuy, OrderTypeSell, OrderTypeStopBuy, OrderTypeStopSell:
+		query += ` AND type = ?`
+		args = append(args, q.Type)
+	default:
+		return nil, ErrParameterInvalid
+	}
+	if q.Tag != "" {
+		query += ` AND id IN (SELECT order_id FROM order_meta WHERE user_id = ? AND tag = ?)`
+		args = append(args, userID, q.Tag)
+	}
+	if q.Watched {
+		query += ` AND id IN (SELECT order_id FROM order_meta WHERE user_id = ? AND watched = 1)`
+		args = append(args, userID)
+	}
+	query += ` ORDER BY id ASC LIMIT ?`
+	args = append(args, q.Limit)
+	return scanOrders(dbQuery(d, query, args...))
 }
 
 func GetOrdersByUserIDAndLastTradeId(d QueryExecutor, userID int64, tradeID int64) ([]*Order, error) {
-	return scanOrders(d.Query(`SELECT * FROM orders WHERE user_id = ? AND trade_id IS NOT NULL AND trade_id > ? ORDER BY created_at ASC`, userID, tradeID))
+	return scanOrders(dbQuery(d, `SELECT * FROM orders WHERE user_id = ? AND trade_id IS NOT NULL AND trade_id > ? ORDER BY created_at ASC`, userID, tradeID))
+}
+
+// GetTradedOrders はuserのtradeIDより後に成立した注文を、UserとTradeを埋めて返します
+// 注文ごとにFetchOrderRelationを呼ばずに、tradeをJOINした1回のクエリで取得します
+func GetTradedOrders(d QueryExecutor, user *User, tradeID int64) (orders []*Order, err error) {
+	rows, err := dbQuery(d, `SELECT o.*, t.* FROM orders o JOIN trade t ON t.id = o.trade_id WHERE o.user_id = ? AND o.trade_id > ? ORDER BY o.created_at ASC`, user.ID, tradeID)
+	if err != nil {
+		return nil, errors.Wrap(err, "select traded orders failed")
+	}
+	defer func() {
+		if cerr := rows.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	orders = []*Order{}
+	for rows.Next() {
+		v, err := scanOrderWithTrade(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan traded orders failed")
+		}
+		v.User = user
+		orders = append(orders, v)
+	}
+	return orders, rows.Err()
+}
+
+// scanOrderWithTrade は orders.*, trade.* の1行を読みます。tradeが無い (LEFT JOINでNULLの) 場合はTradeがnilになります
+func scanOrderWithTrade(rows *sql.Rows) (*Order, error) {
+	var (
+		v             Order
+		closedAt      mysql.NullTime
+		tradeID       sql.NullInt64
+		triggerPrice  sql.NullInt64
+		triggeredAt   mysql.NullTime
+		displayAmount sql.NullInt64
+		parentID      sql.NullInt64
+		expiresAt     mysql.NullTime
+		tID           sql.NullInt64
+		tAmount       sql.NullInt64
+		tPrice        sql.NullInt64
+		tCreatedAt    mysql.NullTime
+		tFee          sql.NullInt64
+	)
+	if err := rows.Scan(&v.ID, &v.Type, &v.UserID, &v.Amount, &v.Price, &closedAt, &tradeID, &v.CreatedAt, &triggerPrice, &triggeredAt, &displayAmount, &v.HiddenAmount, &parentID, &v.PartialFill, &v.Filled, &expiresAt, &v.Fee,
+		&tID, &tAmount, &tPrice, &tCreatedAt, &tFee); err != nil {
+		return nil, err
+	}
+	if closedAt.Valid {
+		v.ClosedAt = &closedAt.Time
+	}
+	if triggeredAt.Valid {
+		v.TriggeredAt = &triggeredAt.Time
+	}
+	if expiresAt.Valid {
+		v.ExpiresAt = &expiresAt.Time
+	}
+	v.TradeID = tradeID.Int64
+	v.TriggerPrice = triggerPrice.Int64
+	v.DisplayAmount = displayAmount.Int64
+	v.ParentID = parentID.Int64
+	v.Remaining = v.restAmount()
+	if tID.Valid {
+		v.Trade = &Trade{ID: tID.Int64, Amount: tAmount.Int64, Price: tPrice.Int64, CreatedAt: tCreatedAt.Time, Fee: tFee.Int64}
+	}
+	return &v, nil
 }
 
 func getOpenOrderByID(tx *sql.Tx, id int64) (*Order, error) {
@@ -51,19 +219,67 @@ func getOpenOrderByID(tx *sql.Tx, id int64) (*Order, error) {
 }
 
 func GetOrderByID(d QueryExecutor, id int64) (*Order, error) {
-	return scanOrder(d.Query("SELECT * FROM orders WHERE id = ?", id))
+	return scanOrder(dbQuery(d, "SELECT * FROM orders WHERE id = ?", id))
 }
 
 func getOrderByIDWithLock(tx *sql.Tx, id int64) (*Order, error) {
-	return scanOrder(tx.Query("SELECT * FROM orders WHERE id = ? FOR UPDATE", id))
+	return scanOrder(dbQuery(tx, "SELECT * FROM orders WHERE id = ? FOR UPDATE", id))
 }
 
 func GetLowestSellOrder(d QueryExecutor) (*Order, error) {
-	return scanOrder(d.Query("SELECT * FROM orders WHERE type = ? AND closed_at IS NULL ORDER BY price ASC, created_at ASC LIMIT 1", OrderTypeSell))
+	if book != nil {
+		return book.Best(OrderTypeSell)
+	}
+	return scanOrder(stmtQuery(d, queryLowestSellOrder, OrderTypeSell))
 }
 
 func GetHighestBuyOrder(d QueryExecutor) (*Order, error) {
-	return scanOrder(d.Query("SELECT * FROM orders WHERE type = ? AND closed_at IS NULL ORDER BY price DESC, created_at ASC LIMIT 1", OrderTypeBuy))
+	if book != nil {
+		return book.Best(OrderTypeBuy)
+	}
+	return scanOrder(stmtQuery(d, queryHighestBuyOrder, OrderTypeBuy))
+}
+
+func GetOrderBook(d QueryExecutor, depth int) (*MarketDepth, error) {
+	if book != nil {
+		return book.Depth(depth), nil
+	}
+	var err error
+	md := &MarketDepth{}
+	md.Sells, err = getPriceLevels(d, `SELECT price, SUM(amount - filled) FROM orders WHERE type = ? AND closed_at IS NULL GROUP BY price ORDER BY price ASC LIMIT ?`, OrderTypeSell, depth)
+	if err != nil {
+		return nil, errors.Wrap(err, "getPriceLevels sell")
+	}
+	md.Buys, err = getPriceLevels(d, `SELECT price, SUM(amount - filled) FROM orders WHERE type = ? AND closed_at IS NULL GROUP BY price ORDER BY price DESC LIMIT ?`, OrderTypeBuy, depth)
+	if err != nil {
+		return nil, errors.Wrap(err, "getPriceLevels buy")
+	}
+	return md, nil
+}
+
+func getPriceLevels(d QueryExecutor, query string, args ...interface{}) (levels []*PriceLevel, err error) {
+	rows, err := dbQuery(d, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if cerr := rows.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	levels = []*PriceLevel{}
+	var cum int64
+	for rows.Next() {
+		var v PriceLevel
+		if err = rows.Scan(&v.Price, &v.Amount); err != nil {
+			return nil, err
+		}
+		cum += v.Amount
+		v.CumulativeAmount = cum
+		levels = append(levels, &v)
+	}
+	err = rows.Err()
+	return
 }
 
 func FetchOrderRelation(d QueryExecutor, order *Order) error {
@@ -74,6 +290,9 @@ func FetchOrderRelation(d QueryExecutor, order *Order) error {
 	}
 	if order.TradeID > 0 {
 		order.Trade, err = GetTradeByID(d, order.TradeID)
+		if err == sql.ErrNoRows && archiveEnabled {
+			order.Trade, err = getArchivedTradeByID(d, order.TradeID)
+		}
 		if err != nil {
 			return errors.Wrapf(err, "GetTradeByID failed. id")
 		}
@@ -81,46 +300,196 @@ func FetchOrderRelation(d QueryExecutor, order *Order) error {
 	return nil
 }
 
+// FetchOrderRelations はordersのUserとTradeを埋めます
+// 注文ごとにFetchOrderRelationを呼ぶ代わりに、ユーザーとトレードをそれぞれ1回のクエリでまとめて読みます
+func FetchOrderRelations(d QueryExecutor, orders []*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	userIDs := make([]int64, 0, len(orders))
+	tradeIDs := make([]interface{}, 0, len(orders))
+	for _, order := range orders {
+		userIDs = append(userIDs, order.UserID)
+		if order.TradeID > 0 {
+			tradeIDs = append(tradeIDs, order.TradeID)
+		}
+	}
+	userByID, err := cachedUsersByIDs(d, userIDs)
+	if err != nil {
+		return errors.Wrap(err, "select users failed")
+	}
+	trades := map[int64]*Trade{}
+	if len(tradeIDs) > 0 {
+		ts, err := scanTrades(dbQuery(d, `SELECT * FROM trade WHERE id IN (?`+strings.Repeat(`, ?`, len(tradeIDs)-1)+`)`, tradeIDs...))
+		if err != nil {
+			return errors.Wrap(err, "select trades failed")
+		}
+		for _, t := range ts {
+			trades[t.ID] = t
+		}
+		if len(trades) < len(tradeIDs) {
+			// 約定が残っている注文のトレードは *_archive に移していることがある
+			if err = archivedTrades(d, tradeIDs, trades); err != nil {
+				return err
+			}
+		}
+	}
+	for _, order := range orders {
+		if order.User = userByID[order.UserID]; order.User == nil {
+			return errors.Wrapf(sql.ErrNoRows, "user not found. id:%d", order.UserID)
+		}
+		if order.TradeID > 0 {
+			if order.Trade = trades[order.TradeID]; order.Trade == nil {
+				return errors.Wrapf(sql.ErrNoRows, "trade not found. id:%d", order.TradeID)
+			}
+		}
+	}
+	return nil
+}
+
 func AddOrder(tx *sql.Tx, ot string, userID, amount, price int64) (*Order, error) {
+	return addOrder(tx, ot, userID, amount, price, false)
+}
+
+func addOrder(tx *sql.Tx, ot string, userID, amount, price int64, partial bool) (*Order, error) {
 	if amount <= 0 || price <= 0 {
 		return nil, ErrParameterInvalid
 	}
-	user, err := getUserByIDWithLock(tx, userID)
-	if err != nil {
-		return nil, errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
+	if err := checkPriceBand(tx, price); err != nil {
+		return nil, err
 	}
-	bank, err := Isubank(tx)
+	user, err := lockUser(tx, userID)
 	if err != nil {
-		return nil, errors.Wrap(err, "newIsubank failed")
+		return nil, errors.Wrapf(err, "lockUser failed. id:%d", userID)
 	}
 	switch ot {
 	case OrderTypeBuy:
-		totalPrice := price * amount
-		if err = bank.Check(user.BankID, totalPrice); err != nil {
-			sendLog(tx, "buy.error", map[string]interface{}{
-				"error":   err.Error(),
-				"user_id": user.ID,
-				"amount":  amount,
-				"price":   price,
-			})
-			if err == isubank.ErrCreditInsufficient {
-				return nil, ErrCreditInsufficient
-			}
-			return nil, errors.Wrap(err, "isubank check failed")
-		}
+		err = checkBuyCredit(tx, user, amount, price)
 	case OrderTypeSell:
-		// TODO 椅子の保有チェック
+		err = reserveSellIsu(tx, user, amount, price)
 	default:
 		return nil, ErrParameterInvalid
 	}
-	res, err := tx.Exec(`INSERT INTO orders (type, user_id, amount, price, created_at) VALUES (?, ?, ?, ?, NOW(6))`, ot, user.ID, amount, price)
+	if err != nil {
+		return nil, err
+	}
+	return insertOrder(tx, user, ot, amount, price, partial)
+}
+
+// checkBuyCredit は買い注文の金額の残高があるかを銀行に確認します
+func checkBuyCredit(tx *sql.Tx, user *User, amount, price int64) error {
+	return checkCredit(tx, user, price*amount, map[string]interface{}{
+		"amount": amount,
+		"price":  price,
+	})
+}
+
+// checkCredit はtotalの残高があるかを銀行に確認します。失敗した場合はlogDataにerrorとuser_idを加えてbuy.errorを送ります
+func checkCredit(tx *sql.Tx, user *User, total int64, logData map[string]interface{}) error {
+	bank, err := Isubank(tx)
+	if err != nil {
+		return errors.Wrap(err, "newIsubank failed")
+	}
+	if err = bank.Check(user.BankID, total); err != nil {
+		logData["error"] = err.Error()
+		logData["user_id"] = user.ID
+		sendLog(tx, "buy.error", logData)
+		if err == isubank.ErrCreditInsufficient {
+			return ErrCreditInsufficient
+		}
+		return errors.Wrap(err, "isubank check failed")
+	}
+	return nil
+}
+
+// reserveSellIsu は売り注文の脚数の椅子を確保します
+func reserveSellIsu(tx *sql.Tx, user *User, amount, price int64) error {
+	err := reserveIsu(tx, user.ID, amount)
+	if err == ErrIsuInsufficient {
+		sendLog(tx, "sell.error", map[string]interface{}{
+			"error":   err.Error(),
+			"user_id": user.ID,
+			"amount":  amount,
+			"price":   price,
+		})
+	}
+	return err
+}
+
+// OrderRequest は一括注文の1件です
+type OrderRequest struct {
+	Type   string `json:"type"`
+	Amount int64  `json:"amount"`
+	Price  int64  `json:"price"`
+}
+
+// AddOrderBatch は複数の注文を同じトランザクションで受け付けます
+// 買い注文の残高確認は合計金額で1回だけ行い、1件でも受け付けられない場合はエラーを返します
+func AddOrderBatch(tx *sql.Tx, userID int64, reqs []*OrderRequest) ([]*Order, error) {
+	if len(reqs) == 0 {
+		return nil, ErrParameterInvalid
+	}
+	var buyTotal int64
+	for _, req := range reqs {
+		if req.Amount <= 0 || req.Price <= 0 {
+			return nil, ErrParameterInvalid
+		}
+		switch req.Type {
+		case OrderTypeBuy:
+			// 合計金額がint64に収まらない場合は受け付けない
+			if req.Amount > math.MaxInt64/req.Price || buyTotal > math.MaxInt64-req.Price*req.Amount {
+				return nil, ErrParameterInvalid
+			}
+			buyTotal += req.Price * req.Amount
+		case OrderTypeSell:
+		default:
+			return nil, ErrParameterInvalid
+		}
+		if err := checkPriceBand(tx, req.Price); err != nil {
+			return nil, err
+		}
+	}
+	user, err := lockUser(tx, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lockUser failed. id:%d", userID)
+	}
+	if buyTotal > 0 {
+		if err = checkCredit(tx, user, buyTotal, map[string]interface{}{"total_price": buyTotal}); err != nil {
+			return nil, err
+		}
+	}
+	for _, req := range reqs {
+		if req.Type != OrderTypeSell {
+			continue
+		}
+		if err = reserveSellIsu(tx, user, req.Amount, req.Price); err != nil {
+			return nil, err
+		}
+	}
+	orders := make([]*Order, 0, len(reqs))
+	for _, req := range reqs {
+		order, err := insertOrder(tx, user, req.Type, req.Amount, req.Price, false)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, nil
+}
+
+func insertOrder(tx *sql.Tx, user *User, ot string, amount, price int64, partial bool) (*Order, error) {
+	newID := newID()
+	res, err := stmtExec(tx, queryInsertOrder, newID, ot, user.ID, amount, price, partial)
 	if err != nil {
 		return nil, errors.Wrap(err, "insert order failed")
 	}
-	id, err := res.LastInsertId()
+	id, err := insertedID(res, newID)
 	if err != nil {
 		return nil, errors.Wrap(err, "get order_id failed")
 	}
+	if err = recordOrderAudit(tx, &OrderAudit{OrderID: id, UserID: user.ID, Event: OrderAuditCreated, Actor: OrderActorUser, Amount: amount, Price: price}); err != nil {
+		return nil, err
+	}
 	sendLog(tx, ot+".order", map[string]interface{}{
 		"order_id": id,
 		"user_id":  user.ID,
@@ -130,10 +499,84 @@ func AddOrder(tx *sql.Tx, ot string, userID, amount, price int64) (*Order, error
 	return GetOrderByID(tx, id)
 }
 
+// ModifyOrder は未約定の注文の脚数と価格を変更します (0の場合は変更しない)
+// 価格の変更と脚数の増加は時間優先を失い、注文時間を更新します
+func ModifyOrder(tx *sql.Tx, userID, orderID, amount, price int64) (*Order, error) {
+	if amount < 0 || price < 0 {
+		return nil, ErrParameterInvalid
+	}
+	user, err := lockUser(tx, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lockUser failed. id:%d", userID)
+	}
+	order, err := getOrderByIDWithLock(tx, orderID)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrOrderNotFound
+	case err != nil:
+		return nil, errors.Wrapf(err, "getOrderByIDWithLock failed. id")
+	case order.UserID != user.ID:
+		return nil, ErrOrderNotFound
+	case order.ClosedAt != nil:
+		return nil, ErrOrderAlreadyClosed
+	case order.DisplayAmount > 0:
+		// アイスバーグ注文は変更できない
+		return nil, ErrParameterInvalid
+	case amount > 0 && amount <= order.Filled:
+		// 部分約定した注文は約定済みの脚数以下にはできない
+		return nil, ErrParameterInvalid
+	}
+	if amount == 0 {
+		amount = order.Amount
+	}
+	if price == 0 {
+		price = order.Price
+	} else if err = checkPriceBand(tx, price); err != nil {
+		return nil, err
+	}
+	switch order.Type {
+	case OrderTypeBuy:
+		if err = checkBuyCredit(tx, user, amount-order.Filled, price); err != nil {
+			return nil, err
+		}
+	case OrderTypeSell:
+		switch delta := amount - order.Amount; {
+		case delta > 0:
+			if err = reserveIsu(tx, user.ID, delta); err != nil {
+				return nil, err
+			}
+		case delta < 0:
+			if err = releaseIsu(tx, &Order{Type: OrderTypeSell, UserID: user.ID, Amount: -delta}); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		// 逆指値注文は変更できない
+		return nil, ErrParameterInvalid
+	}
+	query := `UPDATE orders SET amount = ?, price = ? WHERE id = ?`
+	if price != order.Price || amount > order.Amount {
+		query = `UPDATE orders SET amount = ?, price = ?, created_at = NOW(6) WHERE id = ?`
+	}
+	if _, err = dbExec(tx, query, amount, price, order.ID); err != nil {
+		return nil, errors.Wrap(err, "update orders for modify")
+	}
+	if err = recordOrderAudit(tx, &OrderAudit{OrderID: order.ID, UserID: user.ID, Event: OrderAuditAmended, Actor: OrderActorUser, Amount: amount, Price: price}); err != nil {
+		return nil, err
+	}
+	sendLog(tx, order.Type+".modify", map[string]interface{}{
+		"order_id": order.ID,
+		"user_id":  user.ID,
+		"amount":   amount,
+		"price":    price,
+	})
+	return GetOrderByID(tx, order.ID)
+}
+
 func DeleteOrder(tx *sql.Tx, userID, orderID int64, reason string) error {
-	user, err := getUserByIDWithLock(tx, userID)
+	user, err := lockUser(tx, userID)
 	if err != nil {
-		return errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
+		return errors.Wrapf(err, "lockUser failed. id:%d", userID)
 	}
 	order, err := getOrderByIDWithLock(tx, orderID)
 	switch {
@@ -150,9 +593,15 @@ func DeleteOrder(tx *sql.Tx, userID, orderID int64, reason string) error {
 }
 
 func cancelOrder(d QueryExecutor, order *Order, reason string) error {
-	if _, err := d.Exec(`UPDATE orders SET closed_at = NOW(6) WHERE id = ?`, order.ID); err != nil {
+	if _, err := dbExec(d, `UPDATE orders SET closed_at = NOW(6) WHERE id = ?`, order.ID); err != nil {
 		return errors.Wrap(err, "update orders for cancel")
 	}
+	if err := recordOrderCanceled(d, order, reason); err != nil {
+		return err
+	}
+	if err := releaseIsu(d, order); err != nil {
+		return err
+	}
 	sendLog(d, order.Type+".delete", map[string]interface{}{
 		"order_id": order.ID,
 		"user_id":  order.UserID,
@@ -0,0 +1,140 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// order_eventsに記録する注文の状態変化です
+	OrderAuditCreated   = "created"
+	OrderAuditAmended   = "amended"
+	OrderAuditTriggered = "triggered"
+	OrderAuditTraded    = "traded"
+	OrderAuditCanceled  = "canceled"
+	OrderAuditExpired   = "expired"
+
+	// 状態を変えたのが誰かです
+	OrderActorUser   = "user"
+	OrderActorSystem = "system"
+	OrderActorAdmin  = "admin"
+
+	// MaxOrderAuditsListed はGetOrderAuditsで返す数です
+	MaxOrderAuditsListed = 1000
+)
+
+// OrderAudit は注文の状態変化の記録です
+// Amount, Price はその時点の値で、tradedの場合は約定した脚数と価格です
+type OrderAudit struct {
+	ID        int64     `json:"id"`
+	OrderID   int64     `json:"order_id"`
+	UserID    int64     `json:"-"`
+	Event     string    `json:"event"`
+	Actor     string    `json:"actor"`
+	Reason    string    `json:"reason,omitempty"`
+	Amount    int64     `json:"amount"`
+	Price     int64     `json:"price"`
+	TradeID   int64     `json:"trade_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// cancelActor は取り消した理由から取り消したのが誰かを返します
+func cancelActor(reason string) string {
+	switch reason {
+	case CancelReasonCanceled, CancelReasonUserClosed:
+		return OrderActorUser
+	case CancelReasonAdmin:
+		return OrderActorAdmin
+	}
+	return OrderActorSystem
+}
+
+// recordOrderAudit は注文の状態を変えたのと同じトランザクションで記録します
+func recordOrderAudit(d QueryExecutor, a *OrderAudit) error {
+	_, err := dbExec(d, `INSERT INTO order_events (order_id, user_id, event, actor, reason, amount, price, trade_id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NOW(6))`,
+		a.OrderID, a.UserID, a.Event, a.Actor, a.Reason, a.Amount, a.Price, a.TradeID)
+	return errors.Wrapf(err, "insert order_events failed. order_id:%d", a.OrderID)
+}
+
+// recordOrderCanceled は取り消しを記録します。有効期限による取り消しはexpiredとして記録します
+func recordOrderCanceled(d QueryExecutor, order *Order, reason string) error {
+	event := OrderAuditCanceled
+	if reason == CancelReasonExpired {
+		event = OrderAuditExpired
+	}
+	return recordOrderAudit(d, &OrderAudit{
+		OrderID: order.ID,
+		UserID:  order.UserID,
+		Event:   event,
+		Actor:   cancelActor(reason),
+		Reason:  reason,
+		Amount:  order.restAmount(),
+		Price:   order.Price,
+	})
+}
+
+// GetOrderAudits はユーザーの注文の状態変化を古い順に返します
+// 記録を始める前の注文は空を返し、他のユーザーの注文や存在しない注文はErrOrderNotFoundを返します
+func GetOrderAudits(d QueryExecutor, userID, orderID int64) ([]*OrderAudit, error) {
+	rows, err := dbQuery(d, `SELECT id, order_id, user_id, event, actor, reason, amount, price, trade_id, created_at FROM order_events WHERE order_id = ? ORDER BY id ASC LIMIT ?`,
+		orderID, MaxOrderAuditsListed)
+	if err != nil {
+		return nil, errors.Wrap(err, "select order_events failed")
+	}
+	defer rows.Close()
+	res := []*OrderAudit{}
+	for rows.Next() {
+		a := &OrderAudit{}
+		if err = rows.Scan(&a.ID, &a.OrderID, &a.UserID, &a.Event, &a.Actor, &a.Reason, &a.Amount, &a.Price, &a.TradeID, &a.CreatedAt); err != nil {
+			return nil, errors.Wrap(err, "scan order_events failed")
+		}
+		if a.UserID != userID {
+			return nil, ErrOrderNotFound
+		}
+		res = append(res, a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select order_events failed")
+	}
+	if len(res) > 0 {
+		return res, nil
+	}
+	owner, err := getOrderOwner(d, orderID)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrOrderNotFound
+	case err != nil:
+		return nil, err
+	case owner != userID:
+		return nil, ErrOrderNotFound
+	}
+	return res, nil
+}
+
+// getOrderOwner は注文のuser_idを返します。古い注文の移動を有効にしている場合はorders_archiveも探します
+func getOrderOwner(d QueryExecutor, orderID int64) (int64, error) {
+	query := `SELECT user_id FROM orders WHERE id = ?`
+	args := []interface{}{orderID}
+	if archiveEnabled {
+		query += ` UNION ALL SELECT user_id FROM orders_archive WHERE id = ?`
+		args = append(args, orderID)
+	}
+	rows, err := dbQuery(d, query, args...)
+	if err != nil {
+		return 0, errors.Wrapf(err, "select orders failed. id:%d", orderID)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return 0, errors.Wrapf(err, "select orders failed. id:%d", orderID)
+		}
+		return 0, sql.ErrNoRows
+	}
+	var userID int64
+	if err = rows.Scan(&userID); err != nil {
+		return 0, errors.Wrapf(err, "scan orders failed. id:%d", orderID)
+	}
+	return userID, nil
+}
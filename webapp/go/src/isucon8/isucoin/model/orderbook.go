@@ -0,0 +1,271 @@
+package model
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// book はEnableOrderBookで有効にしたメモリ上の板です (nilの場合はDBを参照します)
+var book *OrderBook
+
+// EnableOrderBook は未約定の注文をメモリ上に読み込み、最良価格の参照とマッチング対象の選択に使います
+// 板はこのプロセスで更新した注文しか反映しないので、複数台のappサーバーで動かす場合は有効にしないでください
+func EnableOrderBook(d QueryExecutor) error {
+	b := NewOrderBook()
+	if err := b.Load(d); err != nil {
+		return err
+	}
+	book = b
+	return nil
+}
+
+// ReloadOrderBook は板をDBから読み直します
+func ReloadOrderBook(d QueryExecutor) error {
+	if book == nil {
+		return nil
+	}
+	return book.Load(d)
+}
+
+// BookAddOrder はコミット済みの新しい注文を板に追加します
+func BookAddOrder(order *Order) {
+	if book != nil {
+		book.Add(order)
+	}
+}
+
+// BookRemoveOrders はコミット済みのキャンセルや約定で閉じた注文を板から取り除きます
+func BookRemoveOrders(ids ...int64) {
+	if book != nil {
+		book.Remove(ids...)
+	}
+}
+
+// bookApplyTradeResult はコミット済みのトレードで閉じた注文を取り除き、脚数が変わった注文と補充された注文を読み直します
+func bookApplyTradeResult(d QueryExecutor, res *tradeResult) {
+	if book == nil {
+		return
+	}
+	book.Remove(append(res.orderIDs(), res.updatedIDs()...)...)
+	for _, id := range append(res.updatedIDs(), res.refilled...) {
+		order, err := GetOrderByID(d, id)
+		if err != nil {
+			// 次のReloadOrderBookまで板に載らないが、DB上は未約定のまま残る
+			log.Printf("[WARN] GetOrderByID failed. id:%d err:%s", id, err)
+			continue
+		}
+		book.Add(order)
+	}
+}
+
+type bookLevel struct {
+	price  int64
+	orders []*Order // created_at, id の順
+}
+
+// bookSide は片側の板で、levelsは優先度の高い価格から並びます
+type bookSide struct {
+	desc   bool
+	levels []*bookLevel
+}
+
+// search はpriceの価格帯が入るべき位置を返します
+func (s *bookSide) search(price int64) int {
+	if s.desc {
+		return sort.Search(len(s.levels), func(i int) bool { return s.levels[i].price <= price })
+	}
+	return sort.Search(len(s.levels), func(i int) bool { return s.levels[i].price >= price })
+}
+
+func (s *bookSide) add(o *Order) {
+	i := s.search(o.Price)
+	if i == len(s.levels) || s.levels[i].price != o.Price {
+		s.levels = append(s.levels, nil)
+		copy(s.levels[i+1:], s.levels[i:])
+		s.levels[i] = &bookLevel{price: o.Price}
+	}
+	lv := s.levels[i]
+	j := sort.Search(len(lv.orders), func(j int) bool {
+		p := lv.orders[j]
+		if p.CreatedAt.Equal(o.CreatedAt) {
+			return p.ID > o.ID
+		}
+		return p.CreatedAt.After(o.CreatedAt)
+	})
+	lv.orders = append(lv.orders, nil)
+	copy(lv.orders[j+1:], lv.orders[j:])
+	lv.orders[j] = o
+}
+
+func (s *bookSide) remove(o *Order) {
+	i := s.search(o.Price)
+	if i == len(s.levels) || s.levels[i].price != o.Price {
+		return
+	}
+	lv := s.levels[i]
+	for j, p := range lv.orders {
+		if p.ID == o.ID {
+			lv.orders = append(lv.orders[:j], lv.orders[j+1:]...)
+			break
+		}
+	}
+	if len(lv.orders) == 0 {
+		s.levels = append(s.levels[:i], s.levels[i+1:]...)
+	}
+}
+
+// OrderBook は未約定の注文を価格優先、時間優先で保持する板です
+// ordersテーブルへの変更がコミットされた後に同じ変更を反映してください
+type OrderBook struct {
+	mu      sync.RWMutex
+	version uint64
+	sides   map[string]*bookSide
+	orders  map[int64]*Order
+}
+
+func NewOrderBook() *OrderBook {
+	b := &OrderBook{}
+	b.reset()
+	return b
+}
+
+func (b *OrderBook) reset() {
+	b.sides = map[string]*bookSide{
+		OrderTypeSell: &bookSide{},
+		OrderTypeBuy:  &bookSide{desc: true},
+	}
+	b.orders = map[int64]*Order{}
+}
+
+// Load はDBの未約定の注文で板を作り直します
+func (b *OrderBook) Load(d QueryExecutor) error {
+	orders, err := scanOrders(dbQuery(d, `SELECT * FROM orders WHERE closed_at IS NULL ORDER BY created_at ASC, id ASC`))
+	if err != nil {
+		return errors.Wrap(err, "load open orders failed")
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reset()
+	for _, o := range orders {
+		b.add(o)
+	}
+	b.version++
+	return nil
+}
+
+func (b *OrderBook) add(o *Order) {
+	side, ok := b.sides[o.Type]
+	if !ok || o.ClosedAt != nil {
+		return
+	}
+	if _, ok := b.orders[o.ID]; ok {
+		return
+	}
+	o = copyBookOrder(o)
+	b.orders[o.ID] = o
+	side.add(o)
+}
+
+func (b *OrderBook) Add(o *Order) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.add(o)
+	b.version++
+}
+
+func (b *OrderBook) Remove(ids ...int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, id := range ids {
+		o, ok := b.orders[id]
+		if !ok {
+			continue
+		}
+		delete(b.orders, id)
+		b.sides[o.Type].remove(o)
+	}
+	b.version++
+}
+
+// Version は板が更新されるたびに増える値です
+func (b *OrderBook) Version() uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.version
+}
+
+// Best は最安の売り注文または最高の買い注文を返します。注文が無い場合は sql.ErrNoRows を返します
+func (b *OrderBook) Best(ot string) (*Order, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	side, ok := b.sides[ot]
+	if !ok || len(side.levels) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return copyBookOrder(side.levels[0].orders[0]), nil
+}
+
+// Matchable はotの注文を優先順に返します
+// limitが0より大きい場合はその価格と約定できる注文だけを返します
+func (b *OrderBook) Matchable(ot string, limit int64) []*Order {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	side, ok := b.sides[ot]
+	if !ok {
+		return nil
+	}
+	end := len(side.levels)
+	if limit > 0 {
+		end = side.search(limit)
+		if end < len(side.levels) && side.levels[end].price == limit {
+			end++
+		}
+	}
+	orders := []*Order{}
+	for _, lv := range side.levels[:end] {
+		for _, o := range lv.orders {
+			orders = append(orders, copyBookOrder(o))
+		}
+	}
+	return orders
+}
+
+// Depth は優先度の高い方からdepth件の価格帯を集計します
+func (b *OrderBook) Depth(depth int) *MarketDepth {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return &MarketDepth{
+		Sells: b.sides[OrderTypeSell].priceLevels(depth),
+		Buys:  b.sides[OrderTypeBuy].priceLevels(depth),
+	}
+}
+
+func (s *bookSide) priceLevels(depth int) []*PriceLevel {
+	n := len(s.levels)
+	if depth < n {
+		n = depth
+	}
+	levels := make([]*PriceLevel, 0, n)
+	var cum int64
+	for _, lv := range s.levels[:n] {
+		v := &PriceLevel{Price: lv.price}
+		for _, o := range lv.orders {
+			v.Amount += o.restAmount()
+		}
+		cum += v.Amount
+		v.CumulativeAmount = cum
+		levels = append(levels, v)
+	}
+	return levels
+}
+
+func copyBookOrder(o *Order) *Order {
+	c := *o
+	c.User = nil
+	c.Trade = nil
+	return &c
+}
@@ -0,0 +1,173 @@
+package model
+
+import (
+	"isucon8/isubank"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// OrderCheck は注文を作らずに確認する内容です (POST /orders/validate)
+// CheckOrderで指定しなかった値を補い、注文では使われない値を消します
+type OrderCheck struct {
+	Type        string `json:"type"`
+	OrderType   string `json:"order_type"`
+	TimeInForce string `json:"time_in_force"`
+	Amount      int64  `json:"amount"`
+	// Price は成行注文の場合は板から見積もった約定価格です
+	Price         int64      `json:"price"`
+	TriggerPrice  int64      `json:"trigger_price,omitempty"`
+	DisplayAmount int64      `json:"display_amount,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	PartialFill   bool       `json:"partial_fill"`
+}
+
+// CheckOrder はAddOrderなどと同じパラメータ, 板寄せ中の注文の種類, 価格の範囲, 椅子の保有数, 銀行の残高の確認を注文を作らずに行います
+// 椅子の確保や銀行の予約はせずにその時点の値で確認するので、続けて注文しても受け付けられるとは限りません
+// FOKの注文は約定できるかまでは確認しません
+func CheckOrder(d QueryExecutor, userID int64, c *OrderCheck) error {
+	if err := normalizeOrderCheck(c); err != nil {
+		return err
+	}
+	if (c.OrderType == OrderKindMarket && c.TriggerPrice == 0) || c.TimeInForce == TimeInForceIOC || c.TimeInForce == TimeInForceFOK {
+		if err := checkContinuousMarket(d); err != nil {
+			return err
+		}
+	}
+	if c.OrderType == OrderKindLimit {
+		if err := checkPriceBand(d, c.Price); err != nil {
+			return err
+		}
+	}
+	user, err := GetUserByID(d, userID)
+	if err != nil {
+		return errors.Wrapf(err, "GetUserByID failed. id:%d", userID)
+	}
+	side := liveOrderType(c.Type)
+	if side == OrderTypeSell && holdingsCheck {
+		p, err := GetPosition(d, userID)
+		if err != nil {
+			return err
+		}
+		if p.AvailableIsu < c.Amount {
+			return ErrIsuInsufficient
+		}
+	}
+	if c.OrderType == OrderKindMarket && c.TriggerPrice == 0 {
+		if c.Price, err = estimateMarketPrice(d, c.Type, c.Amount); err != nil {
+			return err
+		}
+	}
+	if side != OrderTypeBuy || c.Price == 0 {
+		// 成行の逆指値注文はトリガーされるまで価格が決まらないので、銀行の残高は確認しない
+		return nil
+	}
+	credit := c.Price * c.Amount
+	if c.OrderType == OrderKindMarket {
+		// 成行注文は手数料を含めて予約する
+		rates, err := getFeeRates(d)
+		if err != nil {
+			return err
+		}
+		credit = -reservePrice(c.Type, c.Amount, c.Price, rates.fee(FeeRoleTaker, c.Amount, c.Price))
+	}
+	bank, err := Isubank(d)
+	if err != nil {
+		return errors.Wrap(err, "newIsubank failed")
+	}
+	if err = bank.Check(user.BankID, credit); err != nil {
+		if err == isubank.ErrCreditInsufficient {
+			return ErrCreditInsufficient
+		}
+		return errors.Wrap(err, "isubank check failed")
+	}
+	return nil
+}
+
+// normalizeOrderCheck はPOST /ordersと同じ規則で注文の種類を決めます
+func normalizeOrderCheck(c *OrderCheck) error {
+	if c.TimeInForce == "" {
+		c.TimeInForce = TimeInForceGTC
+	}
+	switch {
+	case c.Type == OrderTypeStopBuy || c.Type == OrderTypeStopSell:
+		if c.Amount <= 0 || c.Price < 0 || c.TriggerPrice <= 0 {
+			return ErrParameterInvalid
+		}
+		// 逆指値注文はtime_in_forceとdisplay_amountを使わない
+		c.TimeInForce, c.DisplayAmount = TimeInForceGTC, 0
+		c.OrderType = OrderKindLimit
+		if c.Price == 0 {
+			c.OrderType = OrderKindMarket
+		}
+	case c.Type != OrderTypeBuy && c.Type != OrderTypeSell:
+		return ErrParameterInvalid
+	case c.TimeInForce == TimeInForceIOC || c.TimeInForce == TimeInForceFOK:
+		if c.OrderType != "" && c.OrderType != OrderKindLimit {
+			return ErrParameterInvalid
+		}
+		if c.Amount <= 0 || c.Price <= 0 {
+			return ErrParameterInvalid
+		}
+		// 即時に約定しなかった分は取り消すので有効期限は使わない
+		c.OrderType, c.TriggerPrice, c.DisplayAmount, c.ExpiresAt = OrderKindLimit, 0, 0, nil
+		c.PartialFill = c.TimeInForce == TimeInForceIOC
+	case c.TimeInForce != TimeInForceGTC:
+		return ErrParameterInvalid
+	case c.OrderType == "" || c.OrderType == OrderKindLimit:
+		if c.Amount <= 0 || c.Price <= 0 || c.DisplayAmount < 0 {
+			return ErrParameterInvalid
+		}
+		if c.DisplayAmount >= c.Amount {
+			// 全量を板に出すので通常の指値注文になる
+			c.DisplayAmount = 0
+		}
+		c.OrderType, c.TriggerPrice = OrderKindLimit, 0
+	case c.OrderType == OrderKindMarket:
+		if c.Amount <= 0 {
+			return ErrParameterInvalid
+		}
+		c.Price, c.TriggerPrice, c.DisplayAmount, c.ExpiresAt = 0, 0, 0, nil
+	default:
+		return ErrParameterInvalid
+	}
+	if c.ExpiresAt != nil && !c.ExpiresAt.After(time.Now()) {
+		return ErrParameterInvalid
+	}
+	return nil
+}
+
+// estimateMarketPrice はfindMarketTargetsと同じ順に反対側の注文を選び、成行注文の約定価格を見積もります
+// 注文はロックしないので、実際の約定価格とは異なる場合があります
+func estimateMarketPrice(d QueryExecutor, ot string, amount int64) (int64, error) {
+	var candidates []*Order
+	var err error
+	switch {
+	case book != nil && ot == OrderTypeBuy:
+		candidates = book.Matchable(OrderTypeSell, 0)
+	case book != nil:
+		candidates = book.Matchable(OrderTypeBuy, 0)
+	case ot == OrderTypeBuy:
+		candidates, err = scanOrders(dbQuery(d, `SELECT * FROM orders WHERE type = ? AND closed_at IS NULL ORDER BY price ASC, created_at ASC, id ASC`, OrderTypeSell))
+	default:
+		candidates, err = scanOrders(dbQuery(d, `SELECT * FROM orders WHERE type = ? AND closed_at IS NULL ORDER BY price DESC, created_at ASC, id ASC`, OrderTypeBuy))
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "find market targets")
+	}
+	m, err := matcherFor(d, candidates, amount)
+	if err != nil {
+		return 0, err
+	}
+	rest := amount
+	for _, c := range candidates {
+		fill, stop := m.fill(c, rest)
+		if stop {
+			break
+		}
+		if rest -= fill; fill > 0 && rest == 0 {
+			return c.Price, nil
+		}
+	}
+	return 0, ErrMarketOrderUnfilled
+}
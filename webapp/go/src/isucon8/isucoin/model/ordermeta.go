@@ -0,0 +1,142 @@
+package model
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	MaxOrderTagLen  = 64
+	MaxOrderNoteLen = 255
+)
+
+// OrderMeta はユーザーが注文に付けたタグ, メモ, ウォッチの印です
+// ボットが自分の戦略のIDをTagに入れて、GET /orders?tag= で注文を探せるようにします
+type OrderMeta struct {
+	Tag       string    `json:"tag,omitempty"`
+	Note      string    `json:"note,omitempty"`
+	Watched   bool      `json:"watched"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// OrderMetaPatch はSetOrderMetaで変更する項目です。nilの項目は変更しません
+type OrderMetaPatch struct {
+	Tag     *string
+	Note    *string
+	Watched *bool
+}
+
+func (m *OrderMeta) empty() bool {
+	return m.Tag == "" && m.Note == "" && !m.Watched
+}
+
+// validOrderTag はURLのクエリでそのまま指定できる文字だけのタグの場合にtrueを返します
+func validOrderTag(tag string) bool {
+	if len(tag) > MaxOrderTagLen {
+		return false
+	}
+	for i := 0; i < len(tag); i++ {
+		c := tag[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// SetOrderMeta はユーザーの注文のタグ, メモ, ウォッチの印を変更して、変更後の値を返します
+// 閉じた注文にも付けられます。すべて空になった場合は削除してnilを返します
+func SetOrderMeta(tx *sql.Tx, userID, orderID int64, patch OrderMetaPatch) (*OrderMeta, error) {
+	if patch.Tag != nil && !validOrderTag(*patch.Tag) {
+		return nil, ErrParameterInvalid
+	}
+	if patch.Note != nil && utf8.RuneCountInString(*patch.Note) > MaxOrderNoteLen {
+		return nil, ErrParameterInvalid
+	}
+	order, err := GetOrderByID(tx, orderID)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrOrderNotFound
+	case err != nil:
+		return nil, errors.Wrapf(err, "GetOrderByID failed. id:%d", orderID)
+	}
+	if order.UserID != userID {
+		return nil, ErrOrderNotFound
+	}
+	m, err := getOrderMetaWithLock(tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	if patch.Tag != nil {
+		m.Tag = *patch.Tag
+	}
+	if patch.Note != nil {
+		m.Note = *patch.Note
+	}
+	if patch.Watched != nil {
+		m.Watched = *patch.Watched
+	}
+	if m.empty() {
+		if _, err = dbExec(tx, `DELETE FROM order_meta WHERE order_id = ?`, orderID); err != nil {
+			return nil, errors.Wrapf(err, "delete order_meta failed. id:%d", orderID)
+		}
+		return nil, nil
+	}
+	_, err = dbExec(tx, `
+		INSERT INTO order_meta (order_id, user_id, tag, note, watched, updated_at) VALUES (?, ?, ?, ?, ?, NOW(6))
+		ON DUPLICATE KEY UPDATE tag = VALUES(tag), note = VALUES(note), watched = VALUES(watched), updated_at = VALUES(updated_at)
+	`, orderID, userID, m.Tag, m.Note, m.Watched)
+	if err != nil {
+		return nil, errors.Wrapf(err, "update order_meta failed. id:%d", orderID)
+	}
+	return getOrderMetaWithLock(tx, orderID)
+}
+
+// getOrderMetaWithLock は注文のメタデータを返します。無い場合は空の値を返します
+func getOrderMetaWithLock(tx *sql.Tx, orderID int64) (*OrderMeta, error) {
+	m := &OrderMeta{}
+	err := tx.QueryRow(`SELECT tag, note, watched, updated_at FROM order_meta WHERE order_id = ? FOR UPDATE`, orderID).
+		Scan(&m.Tag, &m.Note, &m.Watched, &m.UpdatedAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return m, nil
+	case err != nil:
+		return nil, errors.Wrapf(err, "select order_meta failed. id:%d", orderID)
+	}
+	return m, nil
+}
+
+// FetchOrdersMeta はordersのMetaを1回のクエリでまとめて埋めます。メタデータの無い注文はnilのままです
+func FetchOrdersMeta(d QueryExecutor, orders []*Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	ids := make([]interface{}, 0, len(orders))
+	byID := make(map[int64]*Order, len(orders))
+	for _, order := range orders {
+		ids = append(ids, order.ID)
+		byID[order.ID] = order
+	}
+	rows, err := dbQuery(d, `SELECT order_id, tag, note, watched, updated_at FROM order_meta WHERE order_id IN (?`+strings.Repeat(`, ?`, len(ids)-1)+`)`, ids...)
+	if err != nil {
+		return errors.Wrap(err, "select order_meta failed")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		m := &OrderMeta{}
+		if err = rows.Scan(&id, &m.Tag, &m.Note, &m.Watched, &m.UpdatedAt); err != nil {
+			return errors.Wrap(err, "scan order_meta failed")
+		}
+		if order, ok := byID[id]; ok {
+			order.Meta = m
+		}
+	}
+	return errors.Wrap(rows.Err(), "select order_meta failed")
+}
@@ -0,0 +1,154 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	logRelayLock = "isucoin.log_relay"
+
+	// OutboxMaxAttempts 回送信に失敗したログは送信をあきらめます (先頭のログが後続のログを止め続けないため)
+	OutboxMaxAttempts = 100
+	// OutboxRetention は送信済みのログを残しておく期間です
+	OutboxRetention = time.Hour
+	outboxPruneWait = time.Minute
+)
+
+// logOutbox はEnableLogOutboxで有効にした場合に、トランザクションの外でlog_outboxに書き込むための接続です
+var logOutbox *sql.DB
+
+// EnableLogOutbox はログを送信する代わりにlog_outboxに書き込みます
+// ログは業務データと同じトランザクションで書き込むので、コミットされた変更のログは再起動しても失われません
+// 送信はStartLogRelayで起動したワーカーが行います
+func EnableLogOutbox(db *sql.DB) {
+	logOutbox = db
+}
+
+// writeOutbox はログをlog_outboxに書き込みます。EnableLogOutboxを呼んでいない場合はfalseを返します
+// *.error のログはトランザクションが取り消される場合に書くので、トランザクションの外で書き込みます
+func writeOutbox(d QueryExecutor, endpoint, appID, tag string, v interface{}) bool {
+	if logOutbox == nil {
+		return false
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[WARN] log json encode failed. tag: %s, v: %v, err:%s", tag, v, err)
+		return true
+	}
+	if strings.HasSuffix(tag, ".error") {
+		d = logOutbox
+	}
+	if _, err = dbExec(d, `INSERT INTO log_outbox (endpoint, app_id, tag, data, created_at) VALUES (?, ?, ?, ?, NOW(6))`,
+		endpoint, appID, tag, data); err != nil {
+		log.Printf("[WARN] insert log_outbox failed. tag: %s, v: %v, err:%s", tag, v, err)
+	}
+	return true
+}
+
+// StartLogRelay はlog_outboxのログを書き込んだ順にISULOGへ送信するワーカーを起動します
+// 複数のappサーバーで起動した場合はGET_LOCKで選ばれた1台だけが送信します
+// 送信に成功したログはsent_atを記録し、失敗したログは次のinterval後に同じ順番で再送します
+func StartLogRelay(ctx context.Context, db *sql.DB, node string, interval time.Duration) {
+	e := newLeaderElector(db, logRelayLock, node, interval)
+	startWorker(func() {
+		defer e.resign()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var pruned time.Time
+		relay := func() {
+			e.tick(context.Background())
+			if !e.IsLeader() {
+				return
+			}
+			for {
+				n, err := relayOutbox(db)
+				if err != nil {
+					log.Printf("[WARN] relay log_outbox failed. err:%s", err)
+					return
+				}
+				if n < LogBatchSize {
+					break
+				}
+			}
+			if time.Since(pruned) >= outboxPruneWait {
+				pruned = time.Now()
+				if _, err := db.Exec(`DELETE FROM log_outbox WHERE sent_at < ?`, pruned.Add(-OutboxRetention)); err != nil {
+					log.Printf("[WARN] prune log_outbox failed. err:%s", err)
+				}
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				// 停止する前に書き込まれたログを送信する
+				relay()
+				return
+			case <-ticker.C:
+				relay()
+			}
+		}
+	})
+}
+
+// relayOutbox は未送信のログをLogBatchSize件まで読み込んで送信し、読み込んだ件数を返します
+// 送信に失敗した場合は、それ以降のログを送信せずに次の呼び出しで再送します
+func relayOutbox(db *sql.DB) (int, error) {
+	rows, err := db.Query(`SELECT id, endpoint, app_id, tag, data, created_at FROM log_outbox WHERE sent_at IS NULL AND attempts < ? ORDER BY id ASC LIMIT ?`,
+		OutboxMaxAttempts, LogBatchSize)
+	if err != nil {
+		return 0, errors.Wrap(err, "select log_outbox failed")
+	}
+	var ids []int64
+	var entries []logEntry
+	for rows.Next() {
+		var id int64
+		var e logEntry
+		var data []byte
+		if err = rows.Scan(&id, &e.endpoint, &e.appID, &e.log.Tag, &data, &e.log.Time); err != nil {
+			rows.Close()
+			return 0, errors.Wrap(err, "scan log_outbox failed")
+		}
+		e.log.Data = json.RawMessage(data)
+		e.size = len(e.log.Tag) + len(data) + logEntryOverhead
+		ids = append(ids, id)
+		entries = append(entries, e)
+	}
+	if err = rows.Close(); err != nil {
+		return 0, errors.Wrap(err, "select log_outbox failed")
+	}
+
+	for sent := 0; sent < len(entries); {
+		n := nextLogBatch(entries[sent:])
+		batch := ids[sent : sent+n]
+		if err = sendLogBulk(entries[sent : sent+n]); err != nil {
+			if uerr := markOutbox(db, `attempts = attempts + 1`, batch); uerr != nil {
+				log.Printf("[WARN] update log_outbox attempts failed. err:%s", uerr)
+			}
+			return sent, errors.Wrapf(err, "send log_outbox failed. id:%d", batch[0])
+		}
+		// 送信した後に記録できなかった場合は次回もう一度送信する (at-least-once)
+		if err = markOutbox(db, `sent_at = NOW(6)`, batch); err != nil {
+			return sent, errors.Wrap(err, "update log_outbox sent_at failed")
+		}
+		sent += n
+	}
+	return len(entries), nil
+}
+
+// markOutbox はidsのログにsetを適用します
+func markOutbox(db *sql.DB, set string, ids []int64) error {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	q := `UPDATE log_outbox SET ` + set + ` WHERE id IN (?` + strings.Repeat(`, ?`, len(ids)-1) + `)`
+	_, err := db.Exec(q, args...)
+	return err
+}
@@ -0,0 +1,248 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultIsuSeed はユーザーが最初から保有している椅子の数です
+const DefaultIsuSeed = 200
+
+var (
+	ErrIsuInsufficient = errors.New("椅子の残高が足りません")
+
+	holdingsCheck       = true
+	isuSeed       int64 = DefaultIsuSeed
+)
+
+// EnableHoldingsCheck は売り注文で椅子の保有数を確認するかを設定します
+func EnableHoldingsCheck(enable bool) {
+	holdingsCheck = enable
+}
+
+// SetIsuSeed はこれから保有状況を作るユーザーの初期の椅子の数を設定します
+func SetIsuSeed(seed int64) {
+	isuSeed = seed
+}
+
+// Position はユーザーの椅子の保有状況です
+// Isuは初期の椅子 + 買い - 売りで、未約定の売り注文の分をReservedIsuとして確保します
+// 損益は移動平均法で計算します (初期の椅子の取得原価は0)
+type Position struct {
+	UserID       int64 `json:"user_id"`
+	Seed         int64 `json:"seed"`
+	Isu          int64 `json:"isu"`
+	ReservedIsu  int64 `json:"reserved_isu"`
+	AvailableIsu int64 `json:"available_isu"`
+	Cost         int64 `json:"cost"`
+	AverageCost  int64 `json:"average_cost"`
+	RealizedPnL  int64 `json:"realized_pnl"`
+}
+
+func newPosition(userID int64) *Position {
+	return &Position{UserID: userID, Seed: isuSeed, Isu: isuSeed}
+}
+
+func GetPosition(d QueryExecutor, userID int64) (*Position, error) {
+	p, err := scanPosition(dbQuery(d, `SELECT user_id, seed, isu, reserved, cost, realized_pnl FROM user_position WHERE user_id = ?`, userID))
+	switch {
+	case err == sql.ErrNoRows:
+		p = newPosition(userID)
+	case err != nil:
+		return nil, errors.Wrap(err, "select user_position failed")
+	}
+	p.AvailableIsu = p.Isu - p.ReservedIsu
+	if p.Isu > 0 {
+		p.AverageCost = p.Cost / p.Isu
+	}
+	return p, nil
+}
+
+func getPositionWithLock(tx *sql.Tx, userID int64) (*Position, error) {
+	p := newPosition(userID)
+	if _, err := dbExec(tx, `INSERT IGNORE INTO user_position (user_id, seed, isu) VALUES (?, ?, ?)`, p.UserID, p.Seed, p.Isu); err != nil {
+		return nil, errors.Wrap(err, "insert user_position failed")
+	}
+	p, err := scanPosition(dbQuery(tx, `SELECT user_id, seed, isu, reserved, cost, realized_pnl FROM user_position WHERE user_id = ? FOR UPDATE`, userID))
+	if err != nil {
+		return nil, errors.Wrap(err, "select user_position failed")
+	}
+	return p, nil
+}
+
+func scanPosition(rows *sql.Rows, e error) (p *Position, err error) {
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		if cerr := rows.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if !rows.Next() {
+		if err = rows.Err(); err == nil {
+			err = sql.ErrNoRows
+		}
+		return nil, err
+	}
+	p = &Position{}
+	if err = rows.Scan(&p.UserID, &p.Seed, &p.Isu, &p.ReservedIsu, &p.Cost, &p.RealizedPnL); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// checkIsu は売り注文の脚数が保有数から未約定の売り注文を引いた数以下であることを確認します
+func checkIsu(tx *sql.Tx, userID, amount int64) error {
+	if !holdingsCheck {
+		return nil
+	}
+	p, err := getPositionWithLock(tx, userID)
+	if err != nil {
+		return err
+	}
+	if p.Isu-p.ReservedIsu < amount {
+		return ErrIsuInsufficient
+	}
+	return nil
+}
+
+// reserveIsu は売り注文の脚数を保有数から確保します
+func reserveIsu(tx *sql.Tx, userID, amount int64) error {
+	p, err := getPositionWithLock(tx, userID)
+	if err != nil {
+		return err
+	}
+	if holdingsCheck && p.Isu-p.ReservedIsu < amount {
+		return ErrIsuInsufficient
+	}
+	if _, err = dbExec(tx, `UPDATE user_position SET reserved = reserved + ? WHERE user_id = ?`, amount, userID); err != nil {
+		return errors.Wrap(err, "update user_position reserved failed")
+	}
+	return nil
+}
+
+// releaseIsu は売り注文のキャンセルで確保した椅子を戻します
+// 部分約定した注文は未約定の分を、アイスバーグ注文はまだ板に出していない分も戻します
+func releaseIsu(d QueryExecutor, order *Order) error {
+	if order.Type != OrderTypeSell && order.Type != OrderTypeStopSell {
+		return nil
+	}
+	if _, err := dbExec(d, `UPDATE user_position SET reserved = GREATEST(reserved - ?, 0) WHERE user_id = ?`, order.restAmount()+order.HiddenAmount, order.UserID); err != nil {
+		return errors.Wrap(err, "update user_position reserved failed")
+	}
+	return nil
+}
+
+// applyPositionTrade は注文のamount脚の約定を保有状況に反映し、この約定で確定した損益を返します
+func applyPositionTrade(tx *sql.Tx, o *Order, amount, price int64) (int64, error) {
+	p, err := getPositionWithLock(tx, o.UserID)
+	if err != nil {
+		return 0, err
+	}
+	pnl := p.apply(o.Type, amount, price)
+	if o.Type == OrderTypeSell {
+		p.ReservedIsu -= amount
+		if p.ReservedIsu < 0 {
+			p.ReservedIsu = 0
+		}
+	}
+	if _, err = dbExec(tx, `UPDATE user_position SET isu = ?, reserved = ?, cost = ?, realized_pnl = ? WHERE user_id = ?`, p.Isu, p.ReservedIsu, p.Cost, p.RealizedPnL, p.UserID); err != nil {
+		return 0, errors.Wrap(err, "update user_position failed")
+	}
+	return pnl, nil
+}
+
+// apply は約定を反映し、確定した損益を返します
+func (p *Position) apply(ot string, amount, price int64) int64 {
+	realized := p.RealizedPnL
+	switch ot {
+	case OrderTypeBuy:
+		// 売り越している分は買い戻しなので取得原価に含めない
+		m := amount
+		if p.Isu < 0 {
+			m += p.Isu
+		}
+		p.Isu += amount
+		if m > 0 {
+			p.Cost += m * price
+		}
+	case OrderTypeSell:
+		if p.Isu > 0 {
+			m := amount
+			if m > p.Isu {
+				m = p.Isu
+			}
+			cost := p.Cost * m / p.Isu
+			p.RealizedPnL += price*m - cost
+			p.Cost -= cost
+		}
+		p.Isu -= amount
+		if p.Isu <= 0 {
+			p.Cost = 0
+		}
+	}
+	return p.RealizedPnL - realized
+}
+
+// rebuildPositions は約定と未約定の売り注文から保有状況とuser_trade_statsを作り直します
+// fillsが無い初期データの注文は注文の脚数で約定したものとします
+func rebuildPositions(d QueryExecutor) error {
+	if _, err := dbExec(d, `DELETE FROM user_position`); err != nil {
+		return errors.Wrap(err, "delete user_position failed")
+	}
+	rows, err := dbQuery(d, `
+		SELECT o.user_id, o.type, f.amount, f.price, f.trade_id, o.id, f.created_at FROM fills f JOIN orders o ON o.id = f.order_id
+		UNION ALL
+		SELECT o.user_id, o.type, o.amount, t.price, t.id, o.id, t.created_at FROM orders o JOIN trade t ON t.id = o.trade_id
+		WHERE NOT EXISTS (SELECT 1 FROM fills f WHERE f.order_id = o.id)
+		ORDER BY 5 ASC, 6 ASC
+	`)
+	if err != nil {
+		return errors.Wrap(err, "select traded orders failed")
+	}
+	positions := map[int64]*Position{}
+	stats := traderStatsBuilder{}
+	for rows.Next() {
+		var (
+			userID, amount, price, tradeID, orderID int64
+			ot                                      string
+			createdAt                               time.Time
+		)
+		if err = rows.Scan(&userID, &ot, &amount, &price, &tradeID, &orderID, &createdAt); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "scan traded order failed")
+		}
+		p, ok := positions[userID]
+		if !ok {
+			p = newPosition(userID)
+			positions[userID] = p
+		}
+		stats.add(createdAt, userID, amount, price, p.apply(ot, amount, price))
+	}
+	if err = rows.Err(); err != nil {
+		rows.Close()
+		return errors.Wrap(err, "select traded orders failed")
+	}
+	rows.Close()
+	for _, p := range positions {
+		if _, err = dbExec(d, `INSERT INTO user_position (user_id, seed, isu, cost, realized_pnl) VALUES (?, ?, ?, ?, ?)`, p.UserID, p.Seed, p.Isu, p.Cost, p.RealizedPnL); err != nil {
+			return errors.Wrap(err, "insert user_position failed")
+		}
+	}
+	if _, err = dbExec(d, `INSERT IGNORE INTO user_position (user_id, seed, isu) SELECT id, ?, ? FROM user`, isuSeed, isuSeed); err != nil {
+		return errors.Wrap(err, "insert user_position for users failed")
+	}
+	if _, err = dbExec(d, `
+		UPDATE user_position p
+		JOIN (
+			SELECT user_id, SUM(amount - filled + hidden_amount) AS reserved FROM orders WHERE type IN (?, ?) AND closed_at IS NULL GROUP BY user_id
+		) o ON o.user_id = p.user_id
+		SET p.reserved = o.reserved
+	`, OrderTypeSell, OrderTypeStopSell); err != nil {
+		return errors.Wrap(err, "update user_position reserved failed")
+	}
+	return stats.write(d)
+}
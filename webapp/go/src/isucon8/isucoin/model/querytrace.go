@@ -0,0 +1,71 @@
+package model
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxTracedQueries より多いクエリは件数と時間だけを数えます
+const maxTracedQueries = 100
+
+// TracedQuery は実行したクエリとかかった時間です
+// Queryの時間は結果を読み始めるまでで、Rowsを読む時間は含みません
+type TracedQuery struct {
+	Query    string
+	Duration time.Duration
+}
+
+// QueryTrace は1リクエストで実行したクエリです。遅いリクエストのログに使います
+type QueryTrace struct {
+	mu      sync.Mutex
+	queries []TracedQuery
+	count   int
+	total   time.Duration
+}
+
+type queryTraceKey struct{}
+
+// WithQueryTrace はctxで実行したクエリをtに記録するようにします
+// WithContextとTxScopeに渡すctxで使え、バックグラウンドの処理のクエリは記録しません
+func WithQueryTrace(ctx context.Context, t *QueryTrace) context.Context {
+	return context.WithValue(ctx, queryTraceKey{}, t)
+}
+
+// Queries は記録したクエリを実行した順に返します
+func (t *QueryTrace) Queries() []TracedQuery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TracedQuery(nil), t.queries...)
+}
+
+// Count は実行したクエリの数です (記録しなかったものを含む)
+func (t *QueryTrace) Count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count
+}
+
+// Total はクエリにかかった時間の合計です (並行して実行した場合も足す)
+func (t *QueryTrace) Total() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
+
+func (t *QueryTrace) add(q string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count++
+	t.total += d
+	if len(t.queries) < maxTracedQueries {
+		t.queries = append(t.queries, TracedQuery{Query: q, Duration: d})
+	}
+}
+
+// traceQuery はctxにQueryTraceがあればstartからの時間を記録します
+func traceQuery(ctx context.Context, q string, start time.Time) {
+	if t, ok := ctx.Value(queryTraceKey{}).(*QueryTrace); ok {
+		t.add(q, time.Since(start))
+	}
+}
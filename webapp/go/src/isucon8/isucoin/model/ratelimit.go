@@ -0,0 +1,58 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// レート制限の設定で、"{1秒あたりの回数},{バースト}" の形式です (バーストを省略した場合は回数と同じ)
+// 空の場合は制限しません
+const (
+	RateLimitOrders = "rate_limit_orders" // POST /orders, /v2/orders, /orders/batch
+	RateLimitInfo   = "rate_limit_info"   // GET /info
+)
+
+// RateLimit はユーザー (未ログインの場合はIPアドレス) ごとのトークンバケットの設定です
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// GetRateLimits はkeysの設定を返します。制限しない設定は含みません
+func GetRateLimits(d QueryExecutor, keys ...string) (map[string]*RateLimit, error) {
+	limits := make(map[string]*RateLimit, len(keys))
+	for _, k := range keys {
+		s, err := GetSetting(d, k)
+		switch {
+		case err == sql.ErrNoRows || err == nil && s == "":
+			continue
+		case err != nil:
+			return nil, errors.Wrapf(err, "getSetting failed. %s", k)
+		}
+		l, err := parseRateLimit(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid setting. %s=%s", k, s)
+		}
+		limits[k] = l
+	}
+	return limits, nil
+}
+
+func parseRateLimit(s string) (*RateLimit, error) {
+	rate, burst := s, s
+	if i := strings.Index(s, ","); i >= 0 {
+		rate, burst = s[:i], s[i+1:]
+	}
+	l := &RateLimit{}
+	var err error
+	if l.Rate, err = strconv.ParseFloat(strings.TrimSpace(rate), 64); err != nil || l.Rate <= 0 {
+		return nil, errors.New("rate must be positive number")
+	}
+	if l.Burst, err = strconv.ParseFloat(strings.TrimSpace(burst), 64); err != nil || l.Burst < 1 {
+		return nil, errors.New("burst must be 1 or more")
+	}
+	return l, nil
+}
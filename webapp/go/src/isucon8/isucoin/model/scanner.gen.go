@@ -16,7 +16,7 @@ func scanCandlestickDatas(rows *sql.Rows, e error) (candlestickDatas []*Candlest
 	candlestickDatas = []*CandlestickData{}
 	for rows.Next() {
 		var v CandlestickData
-		if err = rows.Scan(&v.Time, &v.Open, &v.Close, &v.High, &v.Low); err != nil {
+		if err = rows.Scan(&v.Time, &v.Open, &v.Close, &v.High, &v.Low, &v.Volume, &v.VWAP); err != nil {
 			return
 		}
 		candlestickDatas = append(candlestickDatas, &v)
@@ -36,6 +36,25 @@ func scanCandlestickData(rows *sql.Rows, err error) (*CandlestickData, error) {
 	return nil, sql.ErrNoRows
 }
 
+func scanFills(rows *sql.Rows, e error) (fills []*Fill, err error) {
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		err = rows.Close()
+	}()
+	fills = []*Fill{}
+	for rows.Next() {
+		var v Fill
+		if err = rows.Scan(&v.ID, &v.OrderID, &v.TradeID, &v.Amount, &v.Price, &v.CreatedAt); err != nil {
+			return
+		}
+		fills = append(fills, &v)
+	}
+	err = rows.Err()
+	return
+}
+
 func scanOrders(rows *sql.Rows, e error) (orders []*Order, err error) {
 	if e != nil {
 		return nil, e
@@ -48,7 +67,12 @@ func scanOrders(rows *sql.Rows, e error) (orders []*Order, err error) {
 		var v Order
 		var closedAt mysql.NullTime
 		var tradeID sql.NullInt64
-		if err = rows.Scan(&v.ID, &v.Type, &v.UserID, &v.Amount, &v.Price, &closedAt, &tradeID, &v.CreatedAt); err != nil {
+		var triggerPrice sql.NullInt64
+		var triggeredAt mysql.NullTime
+		var displayAmount sql.NullInt64
+		var parentID sql.NullInt64
+		var expiresAt mysql.NullTime
+		if err = rows.Scan(&v.ID, &v.Type, &v.UserID, &v.Amount, &v.Price, &closedAt, &tradeID, &v.CreatedAt, &triggerPrice, &triggeredAt, &displayAmount, &v.HiddenAmount, &parentID, &v.PartialFill, &v.Filled, &expiresAt, &v.Fee); err != nil {
 			return nil, err
 		}
 		if closedAt.Valid {
@@ -57,6 +81,22 @@ func scanOrders(rows *sql.Rows, e error) (orders []*Order, err error) {
 		if tradeID.Valid {
 			v.TradeID = tradeID.Int64
 		}
+		if triggerPrice.Valid {
+			v.TriggerPrice = triggerPrice.Int64
+		}
+		if triggeredAt.Valid {
+			v.TriggeredAt = &triggeredAt.Time
+		}
+		if displayAmount.Valid {
+			v.DisplayAmount = displayAmount.Int64
+		}
+		if parentID.Valid {
+			v.ParentID = parentID.Int64
+		}
+		if expiresAt.Valid {
+			v.ExpiresAt = &expiresAt.Time
+		}
+		v.Remaining = v.restAmount()
 		orders = append(orders, &v)
 	}
 	err = rows.Err()
@@ -114,7 +154,7 @@ func scanTrades(rows *sql.Rows, e error) (trades []*Trade, err error) {
 	trades = []*Trade{}
 	for rows.Next() {
 		var v Trade
-		if err = rows.Scan(&v.ID, &v.Amount, &v.Price, &v.CreatedAt); err != nil {
+		if err = rows.Scan(&v.ID, &v.Amount, &v.Price, &v.CreatedAt, &v.Fee); err != nil {
 			return
 		}
 		trades = append(trades, &v)
@@ -144,7 +184,7 @@ func scanUsers(rows *sql.Rows, e error) (users []*User, err error) {
 	users = []*User{}
 	for rows.Next() {
 		var v User
-		if err = rows.Scan(&v.ID, &v.BankID, &v.Name, &v.Password, &v.CreatedAt); err != nil {
+		if err = rows.Scan(&v.ID, &v.BankID, &v.Name, &v.Password, &v.CreatedAt, &v.ClosedAt, &v.SessionVersion); err != nil {
 			return
 		}
 		users = append(users, &v)
@@ -163,3 +203,169 @@ func scanUser(rows *sql.Rows, err error) (*User, error) {
 	}
 	return nil, sql.ErrNoRows
 }
+
+func scanAPIKeys(rows *sql.Rows, e error) (apikeys []*APIKey, err error) {
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		err = rows.Close()
+	}()
+	apikeys = []*APIKey{}
+	for rows.Next() {
+		var v APIKey
+		if err = rows.Scan(&v.ID, &v.UserID, &v.Name, &v.Scope, &v.Prefix, &v.KeyHash, &v.CreatedAt, &v.LastUsedAt, &v.RevokedAt); err != nil {
+			return
+		}
+		apikeys = append(apikeys, &v)
+	}
+	err = rows.Err()
+	return
+}
+
+func scanAPIKey(rows *sql.Rows, err error) (*APIKey, error) {
+	v, err := scanAPIKeys(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) > 0 {
+		return v[0], nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func scanSigninFailures(rows *sql.Rows, e error) (signinFailures []*SigninFailure, err error) {
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		err = rows.Close()
+	}()
+	signinFailures = []*SigninFailure{}
+	for rows.Next() {
+		var v SigninFailure
+		if err = rows.Scan(&v.BankID, &v.Failures, &v.LockedUntil, &v.UpdatedAt); err != nil {
+			return
+		}
+		signinFailures = append(signinFailures, &v)
+	}
+	err = rows.Err()
+	return
+}
+
+func scanSigninFailure(rows *sql.Rows, err error) (*SigninFailure, error) {
+	v, err := scanSigninFailures(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) > 0 {
+		return v[0], nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func scanBankTransactions(rows *sql.Rows, e error) (bankTransactions []*BankTransaction, err error) {
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		err = rows.Close()
+	}()
+	bankTransactions = []*BankTransaction{}
+	for rows.Next() {
+		var v BankTransaction
+		if err = rows.Scan(&v.ID, &v.BankID, &v.Price, &v.ReserveID, &v.Status, &v.CreatedAt, &v.UpdatedAt, &v.TradeID); err != nil {
+			return
+		}
+		bankTransactions = append(bankTransactions, &v)
+	}
+	err = rows.Err()
+	return
+}
+
+func scanBankTransaction(rows *sql.Rows, err error) (*BankTransaction, error) {
+	v, err := scanBankTransactions(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) > 0 {
+		return v[0], nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func scanWebhooks(rows *sql.Rows, e error) (webhooks []*Webhook, err error) {
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		err = rows.Close()
+	}()
+	webhooks = []*Webhook{}
+	for rows.Next() {
+		var v Webhook
+		if err = rows.Scan(&v.ID, &v.UserID, &v.URL, &v.Secret, &v.CreatedAt, &v.DeletedAt); err != nil {
+			return
+		}
+		webhooks = append(webhooks, &v)
+	}
+	err = rows.Err()
+	return
+}
+
+func scanWebhook(rows *sql.Rows, err error) (*Webhook, error) {
+	v, err := scanWebhooks(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) > 0 {
+		return v[0], nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func scanPriceAlerts(rows *sql.Rows, e error) (priceAlerts []*PriceAlert, err error) {
+	if e != nil {
+		return nil, e
+	}
+	defer func() {
+		err = rows.Close()
+	}()
+	priceAlerts = []*PriceAlert{}
+	for rows.Next() {
+		var v PriceAlert
+		var tradeID sql.NullInt64
+		var tradePrice sql.NullInt64
+		var triggeredAt mysql.NullTime
+		var deliveredAt mysql.NullTime
+		if err = rows.Scan(&v.ID, &v.UserID, &v.Direction, &v.Price, &v.Status, &v.AfterTradeID, &v.CreatedAt, &tradeID, &tradePrice, &triggeredAt, &deliveredAt, &v.DeliveryFailures); err != nil {
+			return nil, err
+		}
+		if tradeID.Valid {
+			v.TradeID = tradeID.Int64
+		}
+		if tradePrice.Valid {
+			v.TradePrice = tradePrice.Int64
+		}
+		if triggeredAt.Valid {
+			v.TriggeredAt = &triggeredAt.Time
+		}
+		if deliveredAt.Valid {
+			v.DeliveredAt = &deliveredAt.Time
+		}
+		priceAlerts = append(priceAlerts, &v)
+	}
+	err = rows.Err()
+	return
+}
+
+func scanPriceAlert(rows *sql.Rows, err error) (*PriceAlert, error) {
+	v, err := scanPriceAlerts(rows, err)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) > 0 {
+		return v[0], nil
+	}
+	return nil, sql.ErrNoRows
+}
@@ -0,0 +1,114 @@
+package model
+
+import (
+	"database/sql"
+
+	"github.com/pkg/errors"
+)
+
+// SelfTradePrevention は同じユーザーの買い注文と売り注文がマッチしたときの扱いを決める設定です
+// 空の場合は従来どおり約定させます
+const SelfTradePrevention = "self_trade_prevention"
+
+const (
+	SelfTradeCancelNewest = "cancel-newest" // 新しい方の注文を取り消す
+	SelfTradeCancelOldest = "cancel-oldest" // 古い方の注文を取り消す
+	SelfTradeDecrement    = "decrement"     // 両方の注文を重なる脚数だけ減らし、残りが無くなった注文を取り消す
+)
+
+// errSelfTradeCanceled は自己約定防止で注文を取り消したので、板を見直してマッチングをやり直すことを表します
+var errSelfTradeCanceled = errors.New("self trade canceled")
+
+func selfTradePolicy(d QueryExecutor) (string, error) {
+	policy, err := GetSetting(d, SelfTradePrevention)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", nil
+	case err != nil:
+		return "", errors.Wrapf(err, "getSetting failed. %s", SelfTradePrevention)
+	}
+	switch policy {
+	case SelfTradeCancelNewest, SelfTradeCancelOldest, SelfTradeDecrement:
+		return policy, nil
+	}
+	return "", nil
+}
+
+// preventSelfTrade は同じユーザーのorderとtoがマッチしたときにpolicyに従って注文を取り消すか減らします
+// orderを減らした脚数を返し、orderを取り消した場合はerrSelfTradeCanceledを返します
+func preventSelfTrade(tx *sql.Tx, policy string, order, to *Order, restAmount int64, result *tradeResult) (int64, error) {
+	switch policy {
+	case SelfTradeCancelNewest, SelfTradeCancelOldest:
+		victim := selfTradeVictim(policy, order, to)
+		if err := cancelSelfTrade(tx, victim, result); err != nil {
+			return 0, err
+		}
+		if victim == order {
+			return 0, errSelfTradeCanceled
+		}
+		return 0, nil
+	case SelfTradeDecrement:
+		d := to.restAmount()
+		if d > restAmount {
+			d = restAmount
+		}
+		if err := decrementOrder(tx, to, d, result); err != nil {
+			return 0, err
+		}
+		if err := decrementOrder(tx, order, d, result); err != nil {
+			return 0, err
+		}
+		return d, nil
+	}
+	return 0, nil
+}
+
+// selfTradeVictim はcancel-newest, cancel-oldestで取り消す注文を返します
+func selfTradeVictim(policy string, a, b *Order) *Order {
+	newer, older := a, b
+	if older.CreatedAt.After(newer.CreatedAt) || (older.CreatedAt.Equal(newer.CreatedAt) && older.ID > newer.ID) {
+		newer, older = older, newer
+	}
+	if policy == SelfTradeCancelOldest {
+		return older
+	}
+	return newer
+}
+
+func cancelSelfTrade(tx *sql.Tx, o *Order, result *tradeResult) error {
+	if err := cancelOrder(tx, o, CancelReasonSelfTrade); err != nil {
+		return err
+	}
+	result.selfTrade = append(result.selfTrade, o.ID)
+	return nil
+}
+
+// decrementOrder は注文の未約定の脚数をamountだけ減らし、残りが無くなった場合は取り消します
+func decrementOrder(tx *sql.Tx, o *Order, amount int64, result *tradeResult) error {
+	if amount >= o.restAmount() {
+		if err := cancelSelfTrade(tx, o, result); err != nil {
+			return err
+		}
+		o.Amount -= amount
+		return nil
+	}
+	if _, err := dbExec(tx, `UPDATE orders SET amount = amount - ? WHERE id = ?`, amount, o.ID); err != nil {
+		return errors.Wrap(err, "update orders for decrement")
+	}
+	audit := &OrderAudit{OrderID: o.ID, UserID: o.UserID, Event: OrderAuditAmended, Actor: OrderActorSystem, Reason: CancelReasonSelfTrade, Amount: o.Amount - amount, Price: o.Price}
+	if err := recordOrderAudit(tx, audit); err != nil {
+		return err
+	}
+	if err := releaseIsu(tx, &Order{Type: o.Type, UserID: o.UserID, Amount: amount}); err != nil {
+		return err
+	}
+	o.Amount -= amount
+	sendLog(tx, o.Type+".decrement", map[string]interface{}{
+		"order_id": o.ID,
+		"user_id":  o.UserID,
+		"amount":   amount,
+		"reason":   CancelReasonSelfTrade,
+	})
+	result.decremented = append(result.decremented, o.ID)
+	return nil
+}
@@ -1,9 +1,9 @@
 package model
 
 import (
-	"isucon8/isubank"
 	"isucon8/isulogger"
 	"log"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -22,19 +22,29 @@ type Setting struct {
 }
 
 func SetSetting(d QueryExecutor, k, v string) error {
-	_, err := d.Exec(`INSERT INTO setting (name, val) VALUES (?, ?) ON DUPLICATE KEY UPDATE val = VALUES(val)`, k, v)
+	_, err := dbExec(d, `INSERT INTO setting (name, val) VALUES (?, ?) ON DUPLICATE KEY UPDATE val = VALUES(val)`, k, v)
 	return err
 }
 
+// GetSetting は設定を返します。EnableSettingsCacheで有効にした場合はキャッシュから返します
 func GetSetting(d QueryExecutor, k string) (string, error) {
-	s, err := scanSetting(d.Query(`SELECT * FROM setting WHERE name = ?`, k))
+	s, err := cachedSetting(d, k)
 	if err != nil {
 		return "", err
 	}
 	return s.Val, nil
 }
 
-func Isubank(d QueryExecutor) (*isubank.Isubank, error) {
+func Isubank(d QueryExecutor) (Bank, error) {
+	bank, err := plainIsubank(d)
+	if err != nil {
+		return nil, err
+	}
+	return withBankTrace(withCreditCache(withBankBreaker(withBankJournal(bank))), traceOf(d)), nil
+}
+
+// plainIsubank はサーキットブレーカーとbank_transactionへの記録を通さないBankを返します
+func plainIsubank(d QueryExecutor) (Bank, error) {
 	ep, err := GetSetting(d, BankEndpoint)
 	if err != nil {
 		return nil, errors.Wrapf(err, "getSetting failed. %s", BankEndpoint)
@@ -43,28 +53,70 @@ func Isubank(d QueryExecutor) (*isubank.Isubank, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "getSetting failed. %s", BankAppid)
 	}
-	return isubank.NewIsubank(ep, id)
+	bank, err := openBank(ep, id, requestIDOf(d))
+	if err != nil {
+		return nil, err
+	}
+	return &meteredBank{Bank: bank}, nil
 }
 
 func Logger(d QueryExecutor) (*isulogger.Isulogger, error) {
+	ep, id, err := loggerSettings(d)
+	if err != nil {
+		return nil, err
+	}
+	return isulogger.NewIsulogger(ep, id, loggerOptionsWith(requestIDOf(d))...)
+}
+
+func loggerSettings(d QueryExecutor) (string, string, error) {
 	ep, err := GetSetting(d, LogEndpoint)
 	if err != nil {
-		return nil, errors.Wrapf(err, "getSetting failed. %s", LogEndpoint)
+		return "", "", errors.Wrapf(err, "getSetting failed. %s", LogEndpoint)
 	}
 	id, err := GetSetting(d, LogAppid)
 	if err != nil {
-		return nil, errors.Wrapf(err, "getSetting failed. %s", LogAppid)
+		return "", "", errors.Wrapf(err, "getSetting failed. %s", LogAppid)
 	}
-	return isulogger.NewIsulogger(ep, id)
+	return ep, id, nil
 }
 
+// sendLog はEnableLogOutboxを呼んでいればlog_outboxに書き込み、StartLogSenderを呼んでいればキューに入れて、
+// どちらでもなければその場で送信します。TxScopeのトランザクションの中ではコミットした後にキューに入れるか送信します
+// `*.error` のログはTxScopeが終わるときに、ロールバックした場合も送信します
 func sendLog(d QueryExecutor, tag string, v interface{}) {
-	logger, err := Logger(d)
+	ep, id, err := loggerSettings(d)
 	if err != nil {
 		log.Printf("[WARN] new logger failed. tag: %s, v: %v, err:%s", tag, v, err)
 		return
 	}
+	if deferErrorLog(d, ep, id, tag, v) {
+		return
+	}
+	if writeOutbox(d, ep, id, tag, v) {
+		return
+	}
+	if deferLog(d, ep, id, tag, v) {
+		return
+	}
+	deliverLog(d, requestIDOf(d), ep, id, tag, v)
+}
+
+// deliverLog はログをキューに入れるか送信します。その場で送信する場合はreqIDをX-Request-IDヘッダで送ります
+func deliverLog(d QueryExecutor, reqID, ep, id, tag string, v interface{}) {
+	if enqueueLog(ep, id, tag, v) {
+		return
+	}
+	logger, err := isulogger.NewIsulogger(ep, id, loggerOptionsWith(reqID)...)
+	if err != nil {
+		log.Printf("[WARN] new logger failed. tag: %s, v: %v, err:%s", tag, v, err)
+		return
+	}
+	start := time.Now()
 	err = logger.Send(tag, v)
+	observeUpstream("isulogger", "send", start, err)
+	if t := traceOf(d); t != nil {
+		t.addLogger(start)
+	}
 	if err != nil {
 		log.Printf("[WARN] logger send failed. tag: %s, v: %v, err:%s", tag, v, err)
 	}
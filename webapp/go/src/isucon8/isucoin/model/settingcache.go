@@ -0,0 +1,146 @@
+package model
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// settingCache はsettingテーブルの内容です
+// /initializeと/admin/settingsでコミットした後にReloadSettingsで読み直します
+// 他のappサーバーの変更は読み直さないので、複数台で動かす場合は使えません (config.Validateで拒否します)
+type settingCache struct {
+	sync.RWMutex
+	vals map[string]string
+	// loaded はReloadSettingsで読み込み済みの場合にtrueです。読み込むまではDBを参照します
+	loaded bool
+}
+
+var settings *settingCache
+
+// volatileSettings は取引中に変わる設定で、キャッシュせずに毎回DBを参照します
+var volatileSettings = map[string]bool{
+	TradingHalted:            true,
+	TradingHaltedUntil:       true,
+	MaintenanceMode:          true,
+	MaintenanceRetryAfterSec: true,
+	MaintenanceMessage:       true,
+}
+
+// settingOverrides は設定ファイルや環境変数で指定した値で、settingテーブルより優先します
+var settingOverrides map[string]string
+
+// SetSettingOverrides はsettingテーブルの代わりに使う値を設定します (銀行APIとISULOGのエンドポイントなど)
+func SetSettingOverrides(vals map[string]string) {
+	if len(vals) == 0 {
+		settingOverrides = nil
+		return
+	}
+	settingOverrides = vals
+}
+
+// EnableSettingsCache はGetSettingでキャッシュを使うようにします
+func EnableSettingsCache(enabled bool) {
+	if !enabled {
+		settings = nil
+		return
+	}
+	settings = &settingCache{vals: map[string]string{}}
+}
+
+// ReloadSettings はsettingテーブルを読み直してキャッシュを置き換えます
+// キャッシュを使っていない場合は何もしません
+func ReloadSettings(d QueryExecutor) error {
+	if settings == nil {
+		return nil
+	}
+	all, err := scanSettings(dbQuery(d, `SELECT * FROM setting`))
+	if err != nil {
+		return errors.Wrap(err, "select setting failed")
+	}
+	vals := make(map[string]string, len(all))
+	for _, s := range all {
+		if !volatileSettings[s.Name] {
+			vals[s.Name] = s.Val
+		}
+	}
+	settings.Lock()
+	defer settings.Unlock()
+	settings.vals = vals
+	settings.loaded = true
+	return nil
+}
+
+// get はnamesをすべてキャッシュから返せる場合にtrueを返します
+// 存在しない設定は結果に含みません (scanSettingsと同じ)
+func (c *settingCache) get(names ...string) ([]*Setting, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if !c.loaded {
+		return nil, false
+	}
+	res := make([]*Setting, 0, len(names))
+	for _, k := range names {
+		if volatileSettings[k] {
+			return nil, false
+		}
+		if v, ok := c.vals[k]; ok {
+			res = append(res, &Setting{Name: k, Val: v})
+		}
+	}
+	return res, true
+}
+
+// getSettings はnamesの設定を返します。キャッシュを使っている場合はDBを参照しません
+func getSettings(d QueryExecutor, names ...string) ([]*Setting, error) {
+	if settingOverrides != nil {
+		var res []*Setting
+		rest := make([]string, 0, len(names))
+		for _, k := range names {
+			if v, ok := settingOverrides[k]; ok {
+				res = append(res, &Setting{Name: k, Val: v})
+			} else {
+				rest = append(rest, k)
+			}
+		}
+		if len(res) > 0 {
+			if len(rest) == 0 {
+				return res, nil
+			}
+			other, err := getStoredSettings(d, rest...)
+			if err != nil {
+				return nil, err
+			}
+			return append(res, other...), nil
+		}
+	}
+	return getStoredSettings(d, names...)
+}
+
+// getStoredSettings はsettingテーブル (またはキャッシュ) のnamesの設定を返します
+func getStoredSettings(d QueryExecutor, names ...string) ([]*Setting, error) {
+	if settings != nil {
+		if res, ok := settings.get(names...); ok {
+			return res, nil
+		}
+	}
+	q := `SELECT * FROM setting WHERE name IN (?` + strings.Repeat(`, ?`, len(names)-1) + `)`
+	args := make([]interface{}, len(names))
+	for i, k := range names {
+		args[i] = k
+	}
+	return scanSettings(dbQuery(d, q, args...))
+}
+
+func cachedSetting(d QueryExecutor, k string) (*Setting, error) {
+	res, err := getSettings(d, k)
+	switch {
+	case err != nil:
+		return nil, err
+	case len(res) == 0:
+		return nil, sql.ErrNoRows
+	}
+	return res[0], nil
+}
@@ -0,0 +1,97 @@
+package model
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaxSettlementTrades より多いトレードは一覧せず、合計にだけ含めます
+const MaxSettlementTrades = 1000
+
+// SettlementTrade は1つのトレードで確定した仮決済の集計です
+// 金額は銀行の仮決済の金額で、Debitは買い手から引き落とした合計、Creditは売り手に入金した合計です
+type SettlementTrade struct {
+	TradeID     int64     `json:"trade_id"`
+	Reserves    int64     `json:"reserves"`
+	Debit       int64     `json:"debit"`
+	Credit      int64     `json:"credit"`
+	Fee         int64     `json:"fee"`
+	CommittedAt time.Time `json:"committed_at"`
+}
+
+// SettlementTotal は仮決済の状態ごとの集計です
+type SettlementTotal struct {
+	Status string `json:"status"`
+	Count  int64  `json:"count"`
+	Debit  int64  `json:"debit"`
+	Credit int64  `json:"credit"`
+}
+
+// SettlementReport はbank_transactionを銀行の台帳と突き合わせるための集計です
+type SettlementReport struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Journal はこのサーバーでbank_transactionに記録している場合にtrueです (ISU_BANK_JOURNAL)
+	Journal bool               `json:"journal"`
+	Trades  []*SettlementTrade `json:"trades"`
+	// Truncated はMaxSettlementTradesより多いトレードがあった場合にtrueです
+	Truncated bool               `json:"truncated"`
+	Totals    []*SettlementTotal `json:"totals"`
+	// Fee は確定した仮決済の引き落としと入金の差 (取引所の手数料) です
+	Fee int64 `json:"fee"`
+}
+
+// GetSettlementReport はfrom以上to未満に予約した仮決済をトレードごとと状態ごとに集計します
+// トレードのIDはこの機能を追加した後に確定したものにだけ記録されるので、それより前の確定はtrade_id 0にまとめます
+func GetSettlementReport(d QueryExecutor, from, to time.Time) (*SettlementReport, error) {
+	report := &SettlementReport{From: from, To: to, Journal: journalDB != nil, Trades: []*SettlementTrade{}, Totals: []*SettlementTotal{}}
+	rows, err := dbQuery(d, `SELECT IFNULL(trade_id, 0), COUNT(*),
+    IFNULL(SUM(CASE WHEN price < 0 THEN -price ELSE 0 END), 0),
+    IFNULL(SUM(CASE WHEN price > 0 THEN price ELSE 0 END), 0),
+    MAX(updated_at)
+FROM bank_transaction WHERE status = ? AND created_at >= ? AND created_at < ?
+GROUP BY IFNULL(trade_id, 0) ORDER BY 1 LIMIT ?`, BankTxCommitted, from, to, MaxSettlementTrades+1)
+	if err != nil {
+		return nil, errors.Wrap(err, "select bank_transaction by trade failed")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := &SettlementTrade{}
+		if err = rows.Scan(&t.TradeID, &t.Reserves, &t.Debit, &t.Credit, &t.CommittedAt); err != nil {
+			return nil, errors.Wrap(err, "scan bank_transaction by trade failed")
+		}
+		t.Fee = t.Debit - t.Credit
+		report.Trades = append(report.Trades, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select bank_transaction by trade failed")
+	}
+	if len(report.Trades) > MaxSettlementTrades {
+		report.Trades, report.Truncated = report.Trades[:MaxSettlementTrades], true
+	}
+
+	rows, err = dbQuery(d, `SELECT status, COUNT(*),
+    IFNULL(SUM(CASE WHEN price < 0 THEN -price ELSE 0 END), 0),
+    IFNULL(SUM(CASE WHEN price > 0 THEN price ELSE 0 END), 0)
+FROM bank_transaction WHERE created_at >= ? AND created_at < ?
+GROUP BY status ORDER BY status`, from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "select bank_transaction by status failed")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := &SettlementTotal{}
+		if err = rows.Scan(&t.Status, &t.Count, &t.Debit, &t.Credit); err != nil {
+			return nil, errors.Wrap(err, "scan bank_transaction by status failed")
+		}
+		if t.Status == BankTxCommitted {
+			report.Fee = t.Debit - t.Credit
+		}
+		report.Totals = append(report.Totals, t)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "select bank_transaction by status failed")
+	}
+	return report, nil
+}
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// EnableShare はいすばたSNSへのシェアボタンを有効にする設定です (1またはtrueで有効)
+// 有効にするとシェアされたトレードのページ (/trade/{id}.html) からユーザーが流入するので負荷が増えます
+const EnableShare = "enable_share"
+
+// ShareEnabled はシェアが有効かを返します。設定が無い場合は無効です
+func ShareEnabled(d QueryExecutor) (bool, error) {
+	v, err := GetSetting(d, EnableShare)
+	switch {
+	case err == sql.ErrNoRows || err == nil && v == "":
+		return false, nil
+	case err != nil:
+		return false, errors.Wrapf(err, "getSetting failed. %s", EnableShare)
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, errors.Errorf("invalid setting. %s=%s", EnableShare, v)
+	}
+	return enabled, nil
+}
+
+// SharePath はトレードをシェアするページのパスです
+func SharePath(tradeID int64) string {
+	return "/trade/" + strconv.FormatInt(tradeID, 10) + ".html"
+}
+
+// LogShareView はシェアされたトレードのページが開かれたことを送信します
+// userIDはログインしていない場合は0です
+func LogShareView(d QueryExecutor, trade *Trade, userID int64, referer string) {
+	data := map[string]interface{}{
+		"trade_id": trade.ID,
+		"amount":   trade.Amount,
+		"price":    trade.Price,
+	}
+	if userID > 0 {
+		data["user_id"] = userID
+	}
+	if referer != "" {
+		data["referer"] = referer
+	}
+	sendLog(d, "trade.share", data)
+}
@@ -0,0 +1,193 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+// リクエストごとに実行するクエリです。EnablePreparedStatementsで起動時に準備します
+const (
+	queryUserByID        = "SELECT * FROM user WHERE id = ?"
+	queryUserByBankID    = "SELECT * FROM user WHERE bank_id = ?"
+	queryOrdersByUserID  = "SELECT * FROM orders WHERE user_id = ? AND (closed_at IS NULL OR trade_id IS NOT NULL) ORDER BY created_at ASC"
+	queryLowestSellOrder = "SELECT * FROM orders WHERE type = ? AND closed_at IS NULL ORDER BY price ASC, created_at ASC LIMIT 1"
+	queryHighestBuyOrder = "SELECT * FROM orders WHERE type = ? AND closed_at IS NULL ORDER BY price DESC, created_at ASC LIMIT 1"
+	queryLatestTrade     = "SELECT * FROM trade ORDER BY id DESC"
+	queryInsertOrder     = `INSERT INTO orders (id, type, user_id, amount, price, created_at, partial_fill) VALUES (?, ?, ?, ?, ?, NOW(6), ?)`
+)
+
+// mysqlErrUnknownStmtHandler はサーバー側でステートメントが無くなった場合のエラーです
+const mysqlErrUnknownStmtHandler = 1243
+
+var stmts *Statements
+
+// Statements はよく使うクエリのプリペアドステートメントです
+// database/sqlのStmtは接続が切れても別の接続で準備し直しますが、
+// サーバー側でステートメントが無くなった場合はここで準備し直して1回だけ再実行します
+type Statements struct {
+	db    *sql.DB
+	mu    sync.RWMutex
+	stmts map[string]*sql.Stmt
+}
+
+func candlestickQuery(table string) string {
+	return `SELECT ` + candlestickColumns + ` FROM ` + table + ` WHERE t >= ? ORDER BY t`
+}
+
+func preparedQueries() []string {
+	qs := []string{
+		queryUserByID,
+		queryUserByBankID,
+		queryOrdersByUserID,
+		queryLowestSellOrder,
+		queryHighestBuyOrder,
+		queryLatestTrade,
+		queryInsertOrder,
+	}
+	for _, c := range candlestickTables {
+		qs = append(qs, candlestickQuery(c.table))
+	}
+	return qs
+}
+
+// EnablePreparedStatements はクエリを準備して、以降はプリペアドステートメントで実行するようにします
+func EnablePreparedStatements(db *sql.DB) (*Statements, error) {
+	s := &Statements{db: db, stmts: map[string]*sql.Stmt{}}
+	for _, q := range preparedQueries() {
+		stmt, err := db.Prepare(q)
+		if err != nil {
+			s.Close()
+			return nil, errors.Wrapf(err, "prepare failed. query:%s", q)
+		}
+		s.stmts[q] = stmt
+	}
+	stmts = s
+	return s, nil
+}
+
+func (s *Statements) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for q, stmt := range s.stmts {
+		stmt.Close()
+		delete(s.stmts, q)
+	}
+	return nil
+}
+
+func (s *Statements) get(q string) *sql.Stmt {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stmts[q]
+}
+
+// reprepare はoldを準備し直します。他のgoroutineが準備し直していた場合はそれを返します
+func (s *Statements) reprepare(q string, old *sql.Stmt) (*sql.Stmt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur := s.stmts[q]; cur != old {
+		return cur, nil
+	}
+	stmt, err := s.db.Prepare(q)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reprepare failed. query:%s", q)
+	}
+	old.Close()
+	s.stmts[q] = stmt
+	log.Printf("[INFO] statement reprepared. query:%s", q)
+	return stmt, nil
+}
+
+func needReprepare(err error) bool {
+	if err == driver.ErrBadConn || err == mysql.ErrInvalidConn {
+		return true
+	}
+	if me, ok := err.(*mysql.MySQLError); ok {
+		return me.Number == mysqlErrUnknownStmtHandler
+	}
+	return false
+}
+
+// stmtFor はdで実行するステートメントを返します。*sql.DB (WithContextで作ったものを含む) と*sql.Tx以外の場合はnilを返します
+func stmtFor(d QueryExecutor, stmt *sql.Stmt) *sql.Stmt {
+	if tx, ok := d.(*sql.Tx); ok {
+		return tx.Stmt(stmt)
+	}
+	// レプリカの接続では準備していない
+	if db, ok := baseDB(d); ok && db == stmts.db {
+		return stmt
+	}
+	return nil
+}
+
+// stmtContext はdのctxから1つのクエリを実行するctxを作ります
+func stmtContext(d QueryExecutor) (context.Context, context.CancelFunc) {
+	parent, _ := contextOf(d)
+	if parent == nil {
+		return context.Background(), func() {}
+	}
+	return queryContext(parent)
+}
+
+// stmtQuery はqが準備されていればプリペアドステートメントで実行します
+func stmtQuery(d QueryExecutor, q string, args ...interface{}) (*sql.Rows, error) {
+	if stmts == nil {
+		return dbQuery(d, q, args...)
+	}
+	stmt := stmts.get(q)
+	if stmt == nil {
+		return dbQuery(d, q, args...)
+	}
+	st := stmtFor(d, stmt)
+	if st == nil {
+		return dbQuery(d, q, args...)
+	}
+	ctx, cancel := stmtContext(d)
+	defer traceQuery(ctx, q, time.Now())
+	rows, err := st.QueryContext(ctx, args...)
+	if err != nil && needReprepare(err) {
+		if stmt, err = stmts.reprepare(q, stmt); err == nil {
+			rows, err = stmtFor(d, stmt).QueryContext(ctx, args...)
+		}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// dbQueryと同じく、Rowsを読み終わるまでcancelしない
+	_ = cancel
+	return rows, nil
+}
+
+// stmtExec はqが準備されていればプリペアドステートメントで実行します
+func stmtExec(d QueryExecutor, q string, args ...interface{}) (sql.Result, error) {
+	if stmts == nil {
+		return dbExec(d, q, args...)
+	}
+	stmt := stmts.get(q)
+	if stmt == nil {
+		return dbExec(d, q, args...)
+	}
+	st := stmtFor(d, stmt)
+	if st == nil {
+		return dbExec(d, q, args...)
+	}
+	ctx, cancel := stmtContext(d)
+	defer cancel()
+	defer traceQuery(ctx, q, time.Now())
+	res, err := st.ExecContext(ctx, args...)
+	if err == nil || !needReprepare(err) {
+		return res, err
+	}
+	if stmt, err = stmts.reprepare(q, stmt); err != nil {
+		return nil, err
+	}
+	return stmtFor(d, stmt).ExecContext(ctx, args...)
+}
@@ -0,0 +1,232 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// StopWatchInterval は他のappサーバーで成立したトレードを拾うためのポーリング間隔です
+const StopWatchInterval = 1 * time.Second
+
+// stopSignal はStartStopWatcherで起動したワーカーへの通知です
+var stopSignal chan struct{}
+
+// AddStopOrder は逆指値注文を受け付けます
+// 最後の約定価格がstop_buyはトリガー価格以上、stop_sellはトリガー価格以下になったときに通常の注文になります
+// priceが0の場合は成行注文、0より大きい場合はその価格の指値注文になります
+func AddStopOrder(tx *sql.Tx, ot string, userID, amount, price, triggerPrice int64) (*Order, error) {
+	if amount <= 0 || price < 0 || triggerPrice <= 0 {
+		return nil, ErrParameterInvalid
+	}
+	if price > 0 {
+		if err := checkPriceBand(tx, price); err != nil {
+			return nil, err
+		}
+	}
+	user, err := lockUser(tx, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "lockUser failed. id:%d", userID)
+	}
+	switch ot {
+	case OrderTypeStopBuy:
+		// 成行の場合はトリガー時に約定価格で予約する
+		if price > 0 {
+			err = checkBuyCredit(tx, user, amount, price)
+		}
+	case OrderTypeStopSell:
+		err = reserveSellIsu(tx, user, amount, price)
+	default:
+		return nil, ErrParameterInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	newID := newID()
+	res, err := dbExec(tx, `INSERT INTO orders (id, type, user_id, amount, price, created_at, trigger_price) VALUES (?, ?, ?, ?, ?, NOW(6), ?)`, newID, ot, user.ID, amount, price, triggerPrice)
+	if err != nil {
+		return nil, errors.Wrap(err, "insert order failed")
+	}
+	id, err := insertedID(res, newID)
+	if err != nil {
+		return nil, errors.Wrap(err, "get order_id failed")
+	}
+	if err = recordOrderAudit(tx, &OrderAudit{OrderID: id, UserID: user.ID, Event: OrderAuditCreated, Actor: OrderActorUser, Amount: amount, Price: price}); err != nil {
+		return nil, err
+	}
+	sendLog(tx, ot+".order", map[string]interface{}{
+		"order_id":      id,
+		"user_id":       user.ID,
+		"amount":        amount,
+		"price":         price,
+		"trigger_price": triggerPrice,
+	})
+	return GetOrderByID(tx, id)
+}
+
+func liveOrderType(ot string) string {
+	switch ot {
+	case OrderTypeStopBuy:
+		return OrderTypeBuy
+	case OrderTypeStopSell:
+		return OrderTypeSell
+	}
+	return ot
+}
+
+// triggerStopOrder は逆指値注文をorder.Type, order.Priceの通常の注文に変換します
+// 時間優先はトリガーされた時間からになります
+func triggerStopOrder(tx *sql.Tx, order *Order) error {
+	stop, err := getOrderByIDWithLock(tx, order.ID)
+	if err != nil {
+		return errors.Wrapf(err, "getOrderByIDWithLock failed. id:%d", order.ID)
+	}
+	if stop.ClosedAt != nil || stop.TriggeredAt != nil {
+		return ErrOrderAlreadyClosed
+	}
+	if _, err = dbExec(tx, `UPDATE orders SET type = ?, price = ?, triggered_at = NOW(6), created_at = NOW(6) WHERE id = ?`, order.Type, order.Price, order.ID); err != nil {
+		return errors.Wrap(err, "update orders for trigger")
+	}
+	if err = recordOrderAudit(tx, &OrderAudit{OrderID: stop.ID, UserID: stop.UserID, Event: OrderAuditTriggered, Actor: OrderActorSystem, Amount: stop.Amount, Price: order.Price}); err != nil {
+		return err
+	}
+	sendLog(tx, stop.Type+".trigger", map[string]interface{}{
+		"order_id":      stop.ID,
+		"user_id":       stop.UserID,
+		"amount":        stop.Amount,
+		"price":         order.Price,
+		"trigger_price": stop.TriggerPrice,
+	})
+	return nil
+}
+
+// StartStopWatcher は最後の約定価格がトリガー価格に達した逆指値注文を通常の注文に変換するワーカーを起動します
+// サーバーを起動する前に呼んでください。ctxが終了するとワーカーは停止します
+func StartStopWatcher(ctx context.Context, db *sql.DB) {
+	ch := make(chan struct{}, 1)
+	stopSignal = ch
+	traded, unsubscribe := SubscribeTrade()
+	startWorker(func() {
+		defer unsubscribe()
+		poll := time.NewTicker(StopWatchInterval)
+		defer poll.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-traded:
+			case <-ch:
+			case <-poll.C:
+			}
+			if err := triggerStopOrders(db); err != nil {
+				log.Printf("[WARN] trigger stop orders failed. err:%s", err)
+			}
+		}
+	})
+}
+
+// SignalStopWatcher は逆指値注文を受け付けたときに、既にトリガー価格に達していないかを確認させます
+func SignalStopWatcher() {
+	if stopSignal == nil {
+		return
+	}
+	select {
+	case stopSignal <- struct{}{}:
+	default:
+	}
+}
+
+func triggerStopOrders(db *sql.DB) error {
+	if halted, err := IsTradingHalted(db); err != nil || halted {
+		return err
+	}
+	lastTrade, err := GetLatestTrade(db)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "GetLatestTrade failed")
+	}
+	orders, err := scanOrders(db.Query(`SELECT * FROM orders WHERE closed_at IS NULL AND ((type = ? AND trigger_price <= ?) OR (type = ? AND trigger_price >= ?)) ORDER BY created_at ASC, id ASC`,
+		OrderTypeStopBuy, lastTrade.Price, OrderTypeStopSell, lastTrade.Price))
+	if err != nil {
+		return errors.Wrap(err, "find triggered stop orders failed")
+	}
+	for _, o := range orders {
+		if err = activateStopOrder(db, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func activateStopOrder(db *sql.DB, stop *Order) error {
+	ot := liveOrderType(stop.Type)
+	if stop.Price == 0 {
+		err := WithUserLock(stop.UserID, func() error {
+			_, err := runMarketOrder(db, ot, stop.UserID, stop.Amount, stop.ID)
+			return err
+		})
+		switch err {
+		case nil, ErrOrderAlreadyClosed:
+			return nil
+		case ErrAuctionMode:
+			// 板寄せの間はトリガーせず、ザラ場に戻ってから成行注文にする
+			return nil
+		case ErrMarketOrderUnfilled, ErrCreditInsufficient:
+			// 約定できない成行注文は板に残さずにキャンセルする
+			return cancelStopOrder(db, stop.ID, CancelReasonStopUnfilled)
+		default:
+			return err
+		}
+	}
+
+	err := TxScope(context.Background(), db, nil, func(tx *sql.Tx) error {
+		return triggerStopOrder(tx, &Order{ID: stop.ID, Type: ot, Price: stop.Price})
+	})
+	switch err {
+	case nil:
+	case ErrOrderAlreadyClosed:
+		return nil
+	default:
+		return err
+	}
+	order, err := GetOrderByID(db, stop.ID)
+	if err != nil {
+		return errors.Wrapf(err, "GetOrderByID failed. id:%d", stop.ID)
+	}
+	BookAddOrder(order)
+	PublishOrderEvent(&OrderEvent{Event: OrderEventTriggered, Order: order})
+	if !SignalMatcher() {
+		if err = RunTrade(db); err != nil {
+			log.Printf("runTrade err:%s", err)
+		}
+	}
+	return nil
+}
+
+func cancelStopOrder(db *sql.DB, id int64, reason string) error {
+	var canceled bool
+	err := TxScope(context.Background(), db, nil, func(tx *sql.Tx) error {
+		stop, err := getOrderByIDWithLock(tx, id)
+		if err != nil {
+			return errors.Wrapf(err, "getOrderByIDWithLock failed. id:%d", id)
+		}
+		if canceled = stop.ClosedAt == nil && stop.TriggeredAt == nil; !canceled {
+			return nil
+		}
+		return cancelOrder(tx, stop, reason)
+	})
+	if err != nil || !canceled {
+		return err
+	}
+	order, err := GetOrderByID(db, id)
+	if err != nil {
+		return errors.Wrapf(err, "GetOrderByID failed. id:%d", id)
+	}
+	PublishOrderEvent(&OrderEvent{Event: OrderEventCanceled, Reason: reason, Order: order})
+	return nil
+}
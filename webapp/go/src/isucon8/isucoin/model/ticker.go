@@ -0,0 +1,66 @@
+package model
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TickerWindow はGetTickerの出来高と価格の変化を集計する期間です
+const TickerWindow = 24 * time.Hour
+
+// Ticker は最新の価格と直近24時間の集計です
+type Ticker struct {
+	LastPrice       int64 `json:"last_price,omitempty"`
+	LowestSellPrice int64 `json:"lowest_sell_price,omitempty"`
+	HighestBuyPrice int64 `json:"highest_buy_price,omitempty"`
+	Volume24h       int64 `json:"24h_volume"`
+	Change24h       int64 `json:"24h_change"`
+	Open24h         int64 `json:"24h_open,omitempty"`
+	High24h         int64 `json:"24h_high,omitempty"`
+	Low24h          int64 `json:"24h_low,omitempty"`
+	Trades24h       int64 `json:"24h_trades"`
+}
+
+// GetTicker は/infoより軽い最新の価格情報を返します
+func GetTicker(d *sql.DB) (*Ticker, error) {
+	t := &Ticker{}
+	lowest, err := GetLowestSellOrder(d)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, errors.Wrap(err, "GetLowestSellOrder")
+	default:
+		t.LowestSellPrice = lowest.Price
+	}
+	highest, err := GetHighestBuyOrder(d)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, errors.Wrap(err, "GetHighestBuyOrder")
+	default:
+		t.HighestBuyPrice = highest.Price
+	}
+	latest, err := GetLatestTrade(d)
+	switch {
+	case err == sql.ErrNoRows:
+		return t, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "GetLatestTrade failed")
+	}
+	t.LastPrice = latest.Price
+
+	// 集計はMarketStatsにメモリで持っているので、最新のトレードまで足すだけにする
+	if err = marketStats.syncTo(d, latest.ID); err != nil {
+		return nil, err
+	}
+	sum := marketStats.Summary(time.Now())
+	t.Volume24h = sum.Volume
+	t.Trades24h = sum.Trades
+	if sum.Trades > 0 {
+		t.Change24h = t.LastPrice - sum.Open
+		t.Open24h, t.High24h, t.Low24h = sum.Open, sum.High, sum.Low
+	}
+	return t, nil
+}
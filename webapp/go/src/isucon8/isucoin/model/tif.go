@@ -0,0 +1,100 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"isucon8/isubank"
+	"log"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TimeInForceGTC = "gtc" // 取り消すまで板に残る (デフォルト)
+	TimeInForceIOC = "ioc" // 即時に約定できる分だけ約定し、残りを取り消す
+	TimeInForceFOK = "fok" // 即時に全量を約定できない場合は取り消す
+)
+
+var ErrOrderUnfilled = errors.New("即時に全量を約定できる注文が不足しています")
+
+// AddImmediateOrder はIOCまたはFOKの指値注文を受け付けて即時にマッチングします
+// 約定しなかった分は板に残さずに取り消し、FOKで約定しなかった場合はErrOrderUnfilledを返します
+// IOCの注文は部分約定を許可します
+func AddImmediateOrder(db *sql.DB, tif, ot string, userID, amount, price int64) (*Order, error) {
+	var reason string
+	switch tif {
+	case TimeInForceIOC:
+		reason = CancelReasonIOCUnfilled
+	case TimeInForceFOK:
+		reason = CancelReasonFOKUnfilled
+	default:
+		return nil, ErrParameterInvalid
+	}
+	if err := checkContinuousMarket(db); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&tradeQueueDepth, 1)
+	defer atomic.AddInt64(&tradeQueueDepth, -1)
+
+	var order *Order
+	var unfilled bool
+	err := withTradeLock(db, func() error {
+		var (
+			id     int64
+			terr   error
+			result *tradeResult
+		)
+		err := TxScope(context.Background(), db, matcherTxOptions, func(tx *sql.Tx) (err error) {
+			result, unfilled = &tradeResult{}, false
+			if order, err = addOrder(tx, ot, userID, amount, price, tif == TimeInForceIOC); err != nil {
+				return err
+			}
+			id = order.ID
+			terr = tryTrade(tx, id, 0, result)
+			switch terr {
+			case nil, ErrNoOrderForTrade, isubank.ErrCreditInsufficient, errSelfTradeCanceled:
+			default:
+				return terr
+			}
+			if order, err = getOrderByIDWithLock(tx, id); err != nil {
+				return errors.Wrapf(err, "getOrderByIDWithLock failed. id:%d", id)
+			}
+			if order.ClosedAt == nil {
+				// 約定しなかった分は板に残さない
+				if err = cancelOrder(tx, order, reason); err != nil {
+					return err
+				}
+				unfilled = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		bookApplyTradeResult(db, result)
+		if perr := publishTradeResult(db, result); perr != nil {
+			log.Printf("[WARN] publish trade result failed. err:%s", perr)
+		}
+		if result.tradeID > 0 {
+			notifyTrade()
+		}
+		if terr == isubank.ErrCreditInsufficient {
+			return ErrCreditInsufficient
+		}
+		if order, err = GetOrderByID(db, id); err != nil {
+			return errors.Wrapf(err, "GetOrderByID failed. id:%d", id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if unfilled {
+		PublishOrderEvent(&OrderEvent{Event: OrderEventCanceled, Reason: reason, Order: order})
+		if tif == TimeInForceFOK {
+			return order, ErrOrderUnfilled
+		}
+	}
+	return order, nil
+}
@@ -0,0 +1,107 @@
+package model
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamTrace は1リクエストで銀行APIとISULOGの呼び出しにかかった時間の合計です
+// 並行して呼んだ場合もそれぞれの時間を足します
+type UpstreamTrace struct {
+	bank   int64
+	logger int64
+	// requestID は銀行APIとISULOGにX-Request-IDヘッダで送るIDです
+	requestID string
+}
+
+func (t *UpstreamTrace) RequestID() string {
+	return t.requestID
+}
+
+// SetRequestID はリクエストIDを設定します。TraceTxより前に呼んでください
+func (t *UpstreamTrace) SetRequestID(id string) {
+	t.requestID = id
+}
+
+func (t *UpstreamTrace) Bank() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.bank))
+}
+
+func (t *UpstreamTrace) Logger() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.logger))
+}
+
+func (t *UpstreamTrace) addBank(start time.Time) {
+	atomic.AddInt64(&t.bank, int64(time.Since(start)))
+}
+
+func (t *UpstreamTrace) addLogger(start time.Time) {
+	atomic.AddInt64(&t.logger, int64(time.Since(start)))
+}
+
+// traces はトランザクションごとのUpstreamTraceです
+var traces sync.Map
+
+// TraceTx はtxで呼んだ銀行APIとISULOGの時間をtに足すようにします
+// トランザクションが終わったらUntraceTxを呼んでください
+func TraceTx(tx *sql.Tx, t *UpstreamTrace) {
+	traces.Store(tx, t)
+}
+
+func UntraceTx(tx *sql.Tx) {
+	traces.Delete(tx)
+}
+
+func traceOf(d QueryExecutor) *UpstreamTrace {
+	tx, ok := d.(*sql.Tx)
+	if !ok {
+		return nil
+	}
+	if t, ok := traces.Load(tx); ok {
+		return t.(*UpstreamTrace)
+	}
+	return nil
+}
+
+// requestIDOf はdのトランザクションを使っているリクエストのIDを返します
+func requestIDOf(d QueryExecutor) string {
+	if t := traceOf(d); t != nil {
+		return t.requestID
+	}
+	return ""
+}
+
+// tracedBank は呼び出しにかかった時間をUpstreamTraceに足すBankです
+type tracedBank struct {
+	Bank
+	t *UpstreamTrace
+}
+
+func withBankTrace(bank Bank, t *UpstreamTrace) Bank {
+	if t == nil {
+		return bank
+	}
+	return &tracedBank{Bank: bank, t: t}
+}
+
+func (tb *tracedBank) Check(bankID string, price int64) error {
+	defer tb.t.addBank(time.Now())
+	return tb.Bank.Check(bankID, price)
+}
+
+func (tb *tracedBank) Reserve(bankID string, price int64) (int64, error) {
+	defer tb.t.addBank(time.Now())
+	return tb.Bank.Reserve(bankID, price)
+}
+
+func (tb *tracedBank) Commit(reserveIDs []int64) error {
+	defer tb.t.addBank(time.Now())
+	return tb.Bank.Commit(reserveIDs)
+}
+
+func (tb *tracedBank) Cancel(reserveIDs []int64) error {
+	defer tb.t.addBank(time.Now())
+	return tb.Bank.Cancel(reserveIDs)
+}
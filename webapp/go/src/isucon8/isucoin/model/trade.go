@@ -1,10 +1,11 @@
 package model
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
 	"isucon8/isubank"
 	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
@@ -16,6 +17,7 @@ type Trade struct {
 	Amount    int64     `json:"amount"`
 	Price     int64     `json:"price"`
 	CreatedAt time.Time `json:"created_at"`
+	Fee       int64     `json:"fee,omitempty"`
 }
 
 //go:generate scanner
@@ -25,35 +27,30 @@ type CandlestickData struct {
 	Close int64     `json:"close"`
 	High  int64     `json:"high"`
 	Low   int64     `json:"low"`
+	// Volume は足の期間の取引脚数の合計で、VWAPは出来高加重平均価格です
+	Volume int64   `json:"volume"`
+	VWAP   float64 `json:"vwap"`
 }
 
 func GetTradeByID(d QueryExecutor, id int64) (*Trade, error) {
-	return scanTrade(d.Query("SELECT * FROM trade WHERE id = ?", id))
+	return scanTrade(dbQuery(d, "SELECT * FROM trade WHERE id = ?", id))
 }
 
-func GetLatestTrade(d QueryExecutor) (*Trade, error) {
-	return scanTrade(d.Query("SELECT * FROM trade ORDER BY id DESC"))
+func GetTradesByLastID(d QueryExecutor, tradeID int64, limit int) ([]*Trade, error) {
+	return scanTrades(dbQuery(d, "SELECT * FROM trade WHERE id > ? ORDER BY id ASC LIMIT ?", tradeID, limit))
 }
 
-func GetCandlestickData(d QueryExecutor, mt time.Time, tf string) ([]*CandlestickData, error) {
-	query := fmt.Sprintf(`
-		SELECT m.t, a.price, b.price, m.h, m.l
-		FROM (
-			SELECT
-				STR_TO_DATE(DATE_FORMAT(created_at, '%s'), '%s') AS t,
-				MIN(id) AS min_id,
-				MAX(id) AS max_id,
-				MAX(price) AS h,
-				MIN(price) AS l
-			FROM trade
-			WHERE created_at >= ?
-			GROUP BY t
-		) m
-		JOIN trade a ON a.id = m.min_id
-		JOIN trade b ON b.id = m.max_id
-		ORDER BY m.t
-	`, tf, "%Y-%m-%d %H:%i:%s")
-	return scanCandlestickDatas(d.Query(query, mt))
+// GetTradesPage は新しい順にトレードを返します
+// cursorが0より大きい場合はそれより古いトレードを返します
+func GetTradesPage(d QueryExecutor, cursor int64, limit int) ([]*Trade, error) {
+	if cursor > 0 {
+		return scanTrades(dbQuery(d, "SELECT * FROM trade WHERE id < ? ORDER BY id DESC LIMIT ?", cursor, limit))
+	}
+	return scanTrades(dbQuery(d, "SELECT * FROM trade ORDER BY id DESC LIMIT ?", limit))
+}
+
+func GetLatestTrade(d QueryExecutor) (*Trade, error) {
+	return scanTrade(stmtQuery(d, queryLatestTrade))
 }
 
 func HasTradeChanceByOrder(d QueryExecutor, orderID int64) (bool, error) {
@@ -93,150 +90,337 @@ func HasTradeChanceByOrder(d QueryExecutor, orderID int64) (bool, error) {
 	return false, nil
 }
 
-func reserveOrder(d QueryExecutor, order *Order, price int64) (int64, error) {
+func reserveOrder(d QueryExecutor, order *Order, amount, price, fee int64) (int64, error) {
 	bank, err := Isubank(d)
 	if err != nil {
 		return 0, errors.Wrap(err, "isubank init failed")
 	}
-	p := order.Amount * price
-	if order.Type == OrderTypeBuy {
-		p *= -1
+	id, err := bank.Reserve(order.User.BankID, reservePrice(order.Type, amount, price, fee))
+	if err != nil {
+		return 0, reserveFailed(d, order, amount, price, err)
 	}
+	return id, nil
+}
 
-	id, err := bank.Reserve(order.User.BankID, p)
-	if err != nil {
-		if err == isubank.ErrCreditInsufficient {
-			if derr := cancelOrder(d, order, "reserve_failed"); derr != nil {
-				return 0, derr
-			}
-			sendLog(d, order.Type+".error", map[string]interface{}{
-				"error":   err.Error(),
-				"user_id": order.UserID,
-				"amount":  order.Amount,
-				"price":   price,
-			})
-			return 0, err
-		}
-		return 0, errors.Wrap(err, "isubank.Reserve")
+// reserveFailed は予約に失敗した場合の処理です。残高不足の場合は注文を取り消します
+func reserveFailed(d QueryExecutor, order *Order, amount, price int64, err error) error {
+	if err != isubank.ErrCreditInsufficient {
+		return errors.Wrap(err, "isubank.Reserve")
 	}
+	if derr := cancelOrder(d, order, CancelReasonReserveFailed); derr != nil {
+		return derr
+	}
+	sendLog(d, order.Type+".error", map[string]interface{}{
+		"error":   err.Error(),
+		"user_id": order.UserID,
+		"amount":  amount,
+		"price":   price,
+	})
+	return err
+}
 
-	return id, nil
+// cancelReserveResults は成功した予約を取り消します
+func cancelReserveResults(bank Bank, results []isubank.ReserveResult) {
+	ids := make([]int64, 0, len(results))
+	for _, r := range results {
+		if r.Err == nil {
+			ids = append(ids, r.ReserveID)
+		}
+	}
+	if len(ids) > 0 {
+		cancelReserves(bank, ids)
+	}
 }
 
-func commitReservedOrder(tx *sql.Tx, order *Order, targets []*Order, reserves []int64) error {
-	res, err := tx.Exec(`INSERT INTO trade (amount, price, created_at) VALUES (?, ?, NOW(6))`, order.Amount, order.Price)
+// commitReservedOrder はtakerとtargetsのトレードを記録して予約を確定し、resultに反映します
+// 約定価格はtakerの注文の価格です
+func commitReservedOrder(tx *sql.Tx, taker *orderFill, targets []*orderFill, reserves []int64, result *tradeResult) error {
+	order, amount := taker.order, taker.amount
+	fee := taker.fee
+	for _, f := range targets {
+		fee += f.fee
+	}
+	newID, err := newTradeID(tx)
+	if err != nil {
+		return err
+	}
+	res, err := dbExec(tx, `INSERT INTO trade (id, amount, price, created_at, fee) VALUES (?, ?, ?, NOW(6), ?)`, newID, amount, order.Price, fee)
 	if err != nil {
 		return errors.Wrap(err, "insert trade")
 	}
-	tradeID, err := res.LastInsertId()
+	tradeID, err := insertedID(res, newID)
 	if err != nil {
 		return errors.Wrap(err, "lastInsertID for trade")
 	}
+	if err = addCandlestick(tx, tradeID); err != nil {
+		return err
+	}
+	if result.haltedUntil, err = checkCircuitBreaker(tx, order.Price); err != nil {
+		return err
+	}
 	sendLog(tx, "trade", map[string]interface{}{
 		"trade_id": tradeID,
 		"price":    order.Price,
-		"amount":   order.Amount,
+		"amount":   amount,
 	})
-	for _, o := range append(targets, order) {
-		if _, err = tx.Exec(`UPDATE orders SET trade_id = ?, closed_at = NOW(6) WHERE id = ?`, tradeID, o.ID); err != nil {
-			return errors.Wrap(err, "update order for trade")
+	for _, f := range append(targets, taker) {
+		o := f.order
+		closed, err := fillOrder(tx, f, tradeID, order.Price)
+		if err != nil {
+			return err
+		}
+		pnl, err := applyPositionTrade(tx, o, f.amount, order.Price)
+		if err != nil {
+			return err
+		}
+		if err = addTraderStats(tx, o.UserID, f.amount, order.Price, pnl); err != nil {
+			return err
 		}
 		sendLog(tx, o.Type+".trade", map[string]interface{}{
 			"order_id": o.ID,
 			"price":    order.Price,
-			"amount":   o.Amount,
+			"amount":   f.amount,
 			"user_id":  o.UserID,
 			"trade_id": tradeID,
+			"fee":      f.fee,
 		})
+		if !closed {
+			result.filled = append(result.filled, o.ID)
+			continue
+		}
+		result.closed = append(result.closed, o.ID)
+		if o.HiddenAmount > 0 {
+			id, err := refillIceberg(tx, o)
+			if err != nil {
+				return err
+			}
+			result.refilled = append(result.refilled, id)
+		}
 	}
 	bank, err := Isubank(tx)
 	if err != nil {
 		return errors.Wrap(err, "isubank init failed")
 	}
+	// 確定した決済は取り消せないので、この後にデッドロックしてもやり直さない
+	disableTxRetry(tx)
 	if err = bank.Commit(reserves); err != nil {
 		return errors.Wrap(err, "commit")
 	}
+	journalTrade(tradeID, reserves)
+	result.tradeID = tradeID
 	return nil
 }
 
-func tryTrade(tx *sql.Tx, orderID int64) error {
+// tryTrade はorderIDの注文をtakerとしてマッチングします
+// 銀行の予約は1件ずつ順番に行わず、約定させる注文をまとめて決めてから並行して予約します (ReserveBulk)
+// 予約に失敗した場合は順番に予約した場合と同じく、残高不足の注文は取り消して次の注文を探し、それ以外のエラーでは取引を中止します
+// priceが0より大きい場合は注文の価格ではなくpriceで約定させます (板寄せの清算価格)
+func tryTrade(tx *sql.Tx, orderID, price int64, result *tradeResult) error {
 	order, err := getOpenOrderByID(tx, orderID)
 	if err != nil {
+		if err == ErrOrderAlreadyClosed {
+			// 板に残っていた場合は取り除く
+			result.closed = append(result.closed, orderID)
+		}
 		return err
 	}
+	if price > 0 {
+		// トレードはtakerの価格で記録するので、約定価格に置き換える
+		order.Price = price
+	}
 
-	restAmount := order.Amount
-	unitPrice := order.Price
-	reserves := make([]int64, 1, order.Amount+1)
-	targets := make([]*Order, 0, order.Amount)
-
-	reserves[0], err = reserveOrder(tx, order, unitPrice)
+	rates, err := getFeeRates(tx)
 	if err != nil {
 		return err
 	}
+	bank, err := Isubank(tx)
+	if err != nil {
+		return errors.Wrap(err, "isubank init failed")
+	}
+	restAmount := order.restAmount()
+	reserved := restAmount
+	unitPrice := order.Price
+	// reserves[0]はtakerの予約です
+	reserves := make([]int64, 0, restAmount+1)
+	targets := make([]*orderFill, 0, restAmount)
 	defer func() {
 		if len(reserves) > 0 {
-			bank, err := Isubank(tx)
-			if err != nil {
-				log.Printf("[WARN] isubank init failed. err:%s", err)
-				return
-			}
-			if err = bank.Cancel(reserves); err != nil {
-				log.Printf("[WARN] isubank cancel failed. err:%s", err)
-			}
+			cancelReserves(bank, reserves)
 		}
 	}()
 
 	var targetOrders []*Order
-	switch order.Type {
-	case OrderTypeBuy:
-		targetOrders, err = scanOrders(tx.Query(`SELECT * FROM orders WHERE type = ? AND closed_at IS NULL AND price <= ? ORDER BY price ASC, created_at ASC, id ASC`, OrderTypeSell, order.Price))
-	case OrderTypeSell:
-		targetOrders, err = scanOrders(tx.Query(`SELECT * FROM orders WHERE type = ? AND closed_at IS NULL AND price >= ? ORDER BY price DESC, created_at ASC, id ASC`, OrderTypeBuy, order.Price))
+	switch {
+	case book != nil && order.Type == OrderTypeBuy:
+		targetOrders = book.Matchable(OrderTypeSell, order.Price)
+	case book != nil && order.Type == OrderTypeSell:
+		targetOrders = book.Matchable(OrderTypeBuy, order.Price)
+	case order.Type == OrderTypeBuy:
+		targetOrders, err = scanOrders(dbQuery(tx, `SELECT * FROM orders WHERE type = ? AND closed_at IS NULL AND price <= ? ORDER BY price ASC, created_at ASC, id ASC`, OrderTypeSell, order.Price))
+	case order.Type == OrderTypeSell:
+		targetOrders, err = scanOrders(dbQuery(tx, `SELECT * FROM orders WHERE type = ? AND closed_at IS NULL AND price >= ? ORDER BY price DESC, created_at ASC, id ASC`, OrderTypeBuy, order.Price))
 	}
 	if err != nil {
 		return errors.Wrap(err, "find target orders")
 	}
-	if len(targetOrders) == 0 {
-		return ErrNoOrderForTrade
+	m, err := matcherFor(tx, targetOrders, restAmount)
+	if err != nil {
+		return err
 	}
 
-	for _, to := range targetOrders {
-		to, err = getOpenOrderByID(tx, to.ID)
-		if err != nil {
-			if err == ErrOrderAlreadyClosed {
+	var (
+		policy *string
+		// next は次に確認するtargetOrdersの位置です
+		next int
+	)
+	for {
+		// 約定させる注文を決める
+		var plan []*orderFill
+		for ; next < len(targetOrders) && restAmount > 0; next++ {
+			c := targetOrders[next]
+			to, err := getOpenOrderByID(tx, c.ID)
+			if err != nil {
+				if err == ErrOrderAlreadyClosed {
+					result.closed = append(result.closed, c.ID)
+					continue
+				}
+				return errors.Wrap(err, "getOpenOrderByID  buy_order")
+			}
+			if to.UserID == order.UserID {
+				if policy == nil {
+					p, err := selfTradePolicy(tx)
+					if err != nil {
+						return err
+					}
+					policy = &p
+				}
+				if *policy != "" {
+					// 自己約定防止は注文を取り消すので、それより前の予約が済んでから行う
+					if len(plan) > 0 || len(reserves) == 0 {
+						break
+					}
+					d, err := preventSelfTrade(tx, *policy, order, to, restAmount, result)
+					if err != nil {
+						return err
+					}
+					restAmount -= d
+					continue
+				}
+			}
+			fill, stop := m.fill(to, restAmount)
+			if stop {
+				next = len(targetOrders)
+				break
+			}
+			if fill == 0 {
 				continue
 			}
-			return errors.Wrap(err, "getOpenOrderByID  buy_order")
+			plan = append(plan, &orderFill{order: to, amount: fill, role: FeeRoleMaker, fee: rates.fee(FeeRoleMaker, fill, unitPrice)})
+			restAmount -= fill
 		}
-		if to.Amount > restAmount {
-			continue
+
+		// takerと決めた注文をまとめて予約する
+		reqs := make([]isubank.ReserveRequest, 0, len(plan)+1)
+		if len(reserves) == 0 {
+			reqs = append(reqs, isubank.ReserveRequest{BankID: order.User.BankID, Price: reservePrice(order.Type, reserved, unitPrice, rates.fee(FeeRoleTaker, reserved, unitPrice))})
 		}
-		rid, err := reserveOrder(tx, to, unitPrice)
-		if err != nil {
-			if err == isubank.ErrCreditInsufficient {
+		for _, f := range plan {
+			reqs = append(reqs, isubank.ReserveRequest{BankID: f.order.User.BankID, Price: reservePrice(f.order.Type, f.amount, unitPrice, f.fee)})
+		}
+		if len(reqs) == 0 {
+			break
+		}
+		results := isubank.ReserveBulk(bank.Reserve, reqs)
+		if len(reserves) == 0 {
+			if r := results[0]; r.Err != nil {
+				cancelReserveResults(bank, results[1:])
+				if err = reserveFailed(tx, order, reserved, unitPrice, r.Err); err == isubank.ErrCreditInsufficient {
+					result.canceled = append(result.canceled, order.ID)
+				}
+				return err
+			}
+			reserves = append(reserves, results[0].ReserveID)
+			results = results[1:]
+		}
+		for i, r := range results {
+			if r.Err == nil {
+				reserves = append(reserves, r.ReserveID)
+				targets = append(targets, plan[i])
 				continue
 			}
-			return err
+			to := plan[i].order
+			err = reserveFailed(tx, to, plan[i].amount, unitPrice, r.Err)
+			if err != isubank.ErrCreditInsufficient {
+				// 失敗した注文より後の予約も取り消す (前の予約はdeferで取り消す)
+				cancelReserveResults(bank, results[i+1:])
+				return err
+			}
+			// 残高不足の注文は取り消して、その分を次の注文で約定させる
+			result.canceled = append(result.canceled, to.ID)
+			restAmount += plan[i].amount
 		}
-		reserves = append(reserves, rid)
-		targets = append(targets, to)
-		restAmount -= to.Amount
-		if restAmount == 0 {
-			break
+		if next < len(targetOrders) && restAmount > 0 {
+			// 自己約定防止で止めたか、残高不足で取り消した注文がある
+			continue
 		}
+		break
+	}
+	if len(targetOrders) == 0 {
+		return ErrNoOrderForTrade
 	}
-	if restAmount > 0 {
+
+	amount := order.restAmount() - restAmount
+	if amount == 0 || (restAmount > 0 && !order.PartialFill) {
+		if len(result.selfTrade) > 0 || len(result.decremented) > 0 {
+			return errSelfTradeCanceled
+		}
 		return ErrNoOrderForTrade
 	}
-	if err = commitReservedOrder(tx, order, targets, reserves); err != nil {
+	if amount != reserved {
+		// 部分約定や自己約定防止で脚数が減った場合は約定する脚数で予約し直す
+		if err = bank.Cancel(reserves[:1]); err != nil {
+			return errors.Wrap(err, "isubank cancel failed")
+		}
+		if reserves[0], err = reserveOrder(tx, order, amount, unitPrice, rates.fee(FeeRoleTaker, amount, unitPrice)); err != nil {
+			reserves = reserves[1:]
+			if err == isubank.ErrCreditInsufficient {
+				result.canceled = append(result.canceled, order.ID)
+			}
+			return err
+		}
+	}
+	taker := &orderFill{order: order, amount: amount, role: FeeRoleTaker, fee: rates.fee(FeeRoleTaker, amount, unitPrice)}
+	if err = commitReservedOrder(tx, taker, targets, reserves, result); err != nil {
 		return err
 	}
 	reserves = reserves[:0]
 	return nil
 }
 
+var tradeQueueDepth int64
+
+// TradeQueueDepth は実行中または待機中のRunTradeの数を返します
+func TradeQueueDepth() int64 {
+	return atomic.LoadInt64(&tradeQueueDepth)
+}
+
 func RunTrade(db *sql.DB) error {
+	atomic.AddInt64(&tradeQueueDepth, 1)
+	defer atomic.AddInt64(&tradeQueueDepth, -1)
+	return withTradeLock(db, func() error {
+		return runTrade(db)
+	})
+}
+
+func runTrade(db *sql.DB) error {
+	if halted, err := IsTradingHalted(db); err != nil || halted {
+		// 停止中の注文は再開したときにマッチングする
+		return err
+	}
+	if auction, err := isAuctionMode(db); err != nil || auction {
+		// 板寄せの間は注文を溜めておき、StartAuctionSchedulerでまとめて約定させる
+		return err
+	}
 	lowestSellOrder, err := GetLowestSellOrder(db)
 	switch {
 	case err == sql.ErrNoRows:
@@ -261,31 +445,22 @@ func RunTrade(db *sql.DB) error {
 	}
 
 	candidates := make([]int64, 0, 2)
-	if lowestSellOrder.Amount > highestBuyOrder.Amount {
+	if lowestSellOrder.restAmount() > highestBuyOrder.restAmount() {
 		candidates = append(candidates, lowestSellOrder.ID, highestBuyOrder.ID)
 	} else {
 		candidates = append(candidates, highestBuyOrder.ID, lowestSellOrder.ID)
 	}
 
 	for _, orderID := range candidates {
-		err := func() error {
-			tx, err := db.Begin()
-			if err != nil {
-				return errors.Wrap(err, "begin transaction failed")
-			}
-			err = tryTrade(tx, orderID)
-			switch err {
-			case nil, ErrNoOrderForTrade, ErrOrderAlreadyClosed, isubank.ErrCreditInsufficient:
-				tx.Commit()
-			default:
-				tx.Rollback()
-			}
-			return err
-		}()
+		_, err := tradeOrder(db, orderID, 0)
 		switch err {
 		case nil:
+			notifyTrade()
 			// トレード成立したため次の取引を行う
-			return RunTrade(db)
+			return runTrade(db)
+		case errSelfTradeCanceled:
+			// 自己約定防止で板が変わったので最良価格から見直す
+			return runTrade(db)
 		case ErrNoOrderForTrade, ErrOrderAlreadyClosed:
 			// 注文個数の多い方で成立しなかったので少ない方で試す
 			continue
@@ -296,3 +471,29 @@ func RunTrade(db *sql.DB) error {
 	// 個数のが不足していて不成立
 	return nil
 }
+
+// tradeOrder はorderIDの注文をtakerとして1つのトランザクションでマッチングし、結果を板と購読者に反映します
+// 約定しなかった場合もErrNoOrderForTradeなどのエラーと一緒に結果を返します
+func tradeOrder(db *sql.DB, orderID, price int64) (*tradeResult, error) {
+	var (
+		result *tradeResult
+		terr   error
+	)
+	err := TxScope(context.Background(), db, matcherTxOptions, func(tx *sql.Tx) error {
+		result = &tradeResult{}
+		terr = tryTrade(tx, orderID, price, result)
+		switch terr {
+		case nil, ErrNoOrderForTrade, ErrOrderAlreadyClosed, isubank.ErrCreditInsufficient, errSelfTradeCanceled:
+			return nil
+		}
+		return terr
+	})
+	if err != nil {
+		return nil, err
+	}
+	bookApplyTradeResult(db, result)
+	if perr := publishTradeResult(db, result); perr != nil {
+		log.Printf("[WARN] publish trade result failed. err:%s", perr)
+	}
+	return result, terr
+}
@@ -0,0 +1,231 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"isucon8/isucoin/metrics"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+const (
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+
+	// DefaultTxRetries はデッドロックとロック待ちのタイムアウトでトランザクションをやり直す回数です
+	DefaultTxRetries = 3
+	// DefaultTxRetryWait は最初にやり直すまでの待ち時間で、やり直すたびに倍にします
+	DefaultTxRetryWait = 10 * time.Millisecond
+)
+
+var (
+	txDuration = metrics.NewHistogramVec("isucoin_db_transaction_duration_seconds",
+		"トランザクションの開始からコミットまたはロールバックまでの時間", metrics.DefaultBuckets, "isolation", "result")
+	txRetries = metrics.NewCounterVec("isucoin_db_transaction_retries_total",
+		"デッドロックとロック待ちのタイムアウトでトランザクションをやり直した回数", "error")
+
+	txMaxRetries = DefaultTxRetries
+	txRetryWait  = DefaultTxRetryWait
+
+	// txStates はTxScopeで実行中のトランザクションの状態です
+	txStates sync.Map
+)
+
+// matcherTxOptions はマッチングのトランザクションの設定です
+// 注文はFOR UPDATEでロックしてから読むので、REPEATABLE READのギャップロックは不要で待ちを増やすだけです
+var matcherTxOptions = &sql.TxOptions{Isolation: sql.LevelReadCommitted}
+
+// SetTxRetry はデッドロックとロック待ちのタイムアウトでトランザクションをやり直す回数と最初の待ち時間を設定します (0回の場合はやり直しません)
+func SetTxRetry(retries int, wait time.Duration) {
+	txMaxRetries = retries
+	txRetryWait = wait
+}
+
+// txState はTxScopeで実行中のトランザクションのctxと、トランザクションの中で行ったDBの外への操作です
+type txState struct {
+	// ctx はTxScopeに渡したctxで、トランザクションの中のクエリもこのctxで実行します
+	ctx context.Context
+	mu  sync.Mutex
+	// afterCommit はコミットした後に実行します (ロールバックした場合は捨てます)
+	afterCommit []func()
+	// errorLogs は `*.error` のログで、やり直さずに終わった場合にコミットしてもロールバックしても送信します
+	errorLogs []func()
+	// noRetry はやり直すと二重になる操作 (銀行APIの決済の確定) を行った場合にtrueです
+	noRetry bool
+}
+
+func txStateOf(d QueryExecutor) *txState {
+	tx, ok := d.(*sql.Tx)
+	if !ok {
+		return nil
+	}
+	if s, ok := txStates.Load(tx); ok {
+		return s.(*txState)
+	}
+	return nil
+}
+
+// disableTxRetry はdのトランザクションがデッドロックしてもやり直さないようにします
+func disableTxRetry(d QueryExecutor) {
+	if s := txStateOf(d); s != nil {
+		s.mu.Lock()
+		s.noRetry = true
+		s.mu.Unlock()
+	}
+}
+
+// deferLog はdがTxScopeのトランザクションの場合、ログをコミットした後に送信するようにしてtrueを返します
+// やり直した場合やロールバックした場合に送信済みのログが残らないようにするためです
+func deferLog(d QueryExecutor, endpoint, appID, tag string, v interface{}) bool {
+	s := txStateOf(d)
+	if s == nil {
+		return false
+	}
+	// vは呼び出し元で変更されても良いように、この時点でJSONにします
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[WARN] log json encode failed. tag: %s, v: %v, err:%s", tag, v, err)
+		return true
+	}
+	reqID := requestIDOf(d)
+	s.mu.Lock()
+	s.afterCommit = append(s.afterCommit, func() {
+		deliverLog(nil, reqID, endpoint, appID, tag, json.RawMessage(data))
+	})
+	s.mu.Unlock()
+	return true
+}
+
+// deferErrorLog はdがTxScopeのトランザクションの場合、`*.error` のログをTxScopeが終わるときに送信するようにしてtrueを返します
+// ロールバックしても送信しますが、デッドロックでやり直した場合は最後に実行した分だけを送信して、同じログを二重に送らないようにします
+func deferErrorLog(d QueryExecutor, endpoint, appID, tag string, v interface{}) bool {
+	s := txStateOf(d)
+	if s == nil || !strings.HasSuffix(tag, ".error") {
+		return false
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[WARN] log json encode failed. tag: %s, v: %v, err:%s", tag, v, err)
+		return true
+	}
+	reqID := requestIDOf(d)
+	s.mu.Lock()
+	s.errorLogs = append(s.errorLogs, func() {
+		if !writeOutbox(nil, endpoint, appID, tag, json.RawMessage(data)) {
+			deliverLog(nil, reqID, endpoint, appID, tag, json.RawMessage(data))
+		}
+	})
+	s.mu.Unlock()
+	return true
+}
+
+// retryableTxError はやり直せば成功する可能性があるエラーの場合にメトリクスのラベルを返します
+func retryableTxError(err error) (string, bool) {
+	me, ok := errors.Cause(err).(*mysql.MySQLError)
+	if !ok {
+		return "", false
+	}
+	switch me.Number {
+	case mysqlErrDeadlock:
+		return "deadlock", true
+	case mysqlErrLockWaitTimeout:
+		return "lock_wait_timeout", true
+	}
+	return "", false
+}
+
+// TxScope はctxとoptsでトランザクションを開始してfを実行し、fが成功した場合にコミットします
+// fがエラーを返した場合やpanicした場合、ctxが終了した場合はロールバックします (optsがnilの場合はDBのデフォルトの分離レベル)
+// デッドロックとロック待ちのタイムアウトの場合は、待ち時間を倍にしながらfを最初からやり直すので、fの中で外の変数に追加する場合は最初に初期化してください
+// 銀行APIの決済を確定するトランザクションは途中で止められないので、リクエストのctxを渡さないでください
+func TxScope(ctx context.Context, db *sql.DB, opts *sql.TxOptions, f func(*sql.Tx) error) error {
+	wait := txRetryWait
+	for i := 0; ; i++ {
+		retry, errorLogs, err := txAttempt(ctx, db, opts, f)
+		if err == nil || !retry || i >= txMaxRetries {
+			runHooks(errorLogs)
+			return err
+		}
+		label, _ := retryableTxError(err)
+		txRetries.Inc(label)
+		// 同時にデッドロックした相手と同じタイミングでやり直さないようにずらす
+		d := wait/2 + time.Duration(rand.Int63n(int64(wait)+1))
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			runHooks(errorLogs)
+			return err
+		}
+		wait *= 2
+	}
+}
+
+// txAttempt はトランザクションを1回実行します。やり直してよいエラーの場合はtrueを返します
+// errorLogsはこの回に記録した `*.error` のログで、やり直さない場合にTxScopeが送信します
+func txAttempt(ctx context.Context, db *sql.DB, opts *sql.TxOptions, f func(*sql.Tx) error) (retry bool, errorLogs []func(), err error) {
+	start := time.Now()
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return false, nil, errors.Wrap(err, "begin transaction failed")
+	}
+	s := &txState{ctx: ctx}
+	txStates.Store(tx, s)
+	result := "commit"
+	defer func() {
+		txStates.Delete(tx)
+		if e := recover(); e != nil {
+			tx.Rollback()
+			result = "rollback"
+			retry, err = false, errors.Errorf("panic in transaction: %s", e)
+		}
+		s.mu.Lock()
+		errorLogs = s.errorLogs
+		s.mu.Unlock()
+		txDuration.Observe(time.Since(start).Seconds(), isolationLabel(opts), result)
+	}()
+	if err = f(tx); err != nil {
+		tx.Rollback()
+		result = "rollback"
+		_, retry = retryableTxError(err)
+		s.mu.Lock()
+		retry = retry && !s.noRetry
+		s.mu.Unlock()
+		return retry, nil, err
+	}
+	if cerr := ctx.Err(); cerr != nil {
+		// BeginTxに渡したctxが終了するとdatabase/sqlがロールバックしている
+		tx.Rollback()
+		result = "canceled"
+		return false, nil, errors.Wrap(cerr, "transaction aborted")
+	}
+	if err = tx.Commit(); err != nil {
+		result = "rollback"
+		return false, nil, errors.Wrap(err, "commit transaction failed")
+	}
+	s.mu.Lock()
+	hooks := s.afterCommit
+	s.mu.Unlock()
+	runHooks(hooks)
+	return false, nil, nil
+}
+
+func runHooks(hooks []func()) {
+	for _, h := range hooks {
+		h()
+	}
+}
+
+func isolationLabel(opts *sql.TxOptions) string {
+	if opts == nil || opts.Isolation == sql.LevelDefault {
+		return "default"
+	}
+	return strings.ToLower(strings.Replace(opts.Isolation.String(), " ", "_", -1))
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -15,14 +16,18 @@ type User struct {
 	Name      string    `json:"name"`
 	Password  string    `json:"-"`
 	CreatedAt time.Time `json:"-"`
+	// ClosedAt はCloseUserで退会した時間です
+	ClosedAt *time.Time `json:"closed_at,omitempty"`
+	// SessionVersion はパスワードやbank_idを変更するたびに増え、セッションの値と違う場合はログインし直す必要があります
+	SessionVersion int64 `json:"-"`
 }
 
 func GetUserByID(d QueryExecutor, id int64) (*User, error) {
-	return scanUser(d.Query("SELECT * FROM user WHERE id = ?", id))
+	return cachedUserByID(d, id)
 }
 
 func getUserByIDWithLock(tx *sql.Tx, id int64) (*User, error) {
-	return scanUser(tx.Query("SELECT * FROM user WHERE id = ? FOR UPDATE", id))
+	return scanUser(dbQuery(tx, "SELECT * FROM user WHERE id = ? FOR UPDATE", id))
 }
 
 func UserSignup(tx *sql.Tx, name, bankID, password string) error {
@@ -32,13 +37,16 @@ func UserSignup(tx *sql.Tx, name, bankID, password string) error {
 	}
 	// bankIDの検証
 	if err = bank.Check(bankID, 0); err != nil {
+		if IsBankUnavailable(err) {
+			return err
+		}
 		return ErrBankUserNotFound
 	}
 	pass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
-	if res, err := tx.Exec(`INSERT INTO user (bank_id, name, password, created_at) VALUES (?, ?, ?, NOW(6))`, bankID, name, pass); err != nil {
+	if res, err := dbExec(tx, `INSERT INTO user (bank_id, name, password, created_at) VALUES (?, ?, ?, NOW(6))`, bankID, name, pass); err != nil {
 		if mysqlError, ok := err.(*mysql.MySQLError); ok {
 			if mysqlError.Number == 1062 {
 				return ErrBankUserConflict
@@ -59,22 +67,156 @@ func UserSignup(tx *sql.Tx, name, bankID, password string) error {
 	return nil
 }
 
-func UserLogin(d QueryExecutor, bankID, password string) (*User, error) {
-	user, err := scanUser(d.Query("SELECT * FROM user WHERE bank_id = ?", bankID))
+// lockUserWithPassword はパスワードを確認してユーザーをロックします
+func lockUserWithPassword(tx *sql.Tx, userID int64, password string) (*User, error) {
+	user, err := lockUser(tx, userID)
 	switch {
 	case err == sql.ErrNoRows:
 		return nil, ErrUserNotFound
+	case err != nil:
+		return nil, errors.Wrapf(err, "lockUser failed. id:%d", userID)
+	case user.ClosedAt != nil:
+		return nil, ErrUserNotFound
+	}
+	if err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return nil, ErrPasswordMismatch
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// ChangePassword はパスワードを変更し、他の端末のセッションを無効にします
+func ChangePassword(tx *sql.Tx, userID int64, oldPassword, newPassword string) (*User, error) {
+	user, err := lockUserWithPassword(tx, userID, oldPassword)
+	if err != nil {
+		return nil, err
+	}
+	pass, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dbExec(tx, `UPDATE user SET password = ?, session_version = session_version + 1 WHERE id = ?`, pass, user.ID); err != nil {
+		return nil, errors.Wrap(err, "update user for password")
+	}
+	if _, err = revokeUserSessions(tx, user.ID); err != nil {
+		return nil, err
+	}
+	sendLog(tx, "user.password", map[string]interface{}{
+		"user_id": user.ID,
+	})
+	return GetUserByID(tx, user.ID)
+}
+
+// ChangeBankID は銀行のアカウントを付け替え、他の端末のセッションを無効にします
+func ChangeBankID(tx *sql.Tx, userID int64, password, bankID string) (*User, error) {
+	user, err := lockUserWithPassword(tx, userID, password)
+	if err != nil {
+		return nil, err
+	}
+	bank, err := Isubank(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err = bank.Check(bankID, 0); err != nil {
+		if IsBankUnavailable(err) {
+			return nil, err
+		}
+		return nil, ErrBankUserNotFound
+	}
+	if _, err = dbExec(tx, `UPDATE user SET bank_id = ?, session_version = session_version + 1 WHERE id = ?`, bankID, user.ID); err != nil {
+		if mysqlError, ok := err.(*mysql.MySQLError); ok && mysqlError.Number == 1062 {
+			return nil, ErrBankUserConflict
+		}
+		return nil, errors.Wrap(err, "update user for bank_id")
+	}
+	if _, err = revokeUserSessions(tx, user.ID); err != nil {
+		return nil, err
+	}
+	sendLog(tx, "user.bank", map[string]interface{}{
+		"user_id":     user.ID,
+		"bank_id":     bankID,
+		"old_bank_id": user.BankID,
+	})
+	return GetUserByID(tx, user.ID)
+}
+
+// UserLogin はパスワードと2段階認証のコード (有効にしている場合) を確認します
+// 2段階認証のコードを間違えた場合もパスワードと同じく失敗として数えます
+func UserLogin(d QueryExecutor, bankID, password, otp string) (*User, error) {
+	// ロック中はbcryptの計算をしない
+	now := time.Now()
+	failed, err := checkSigninLock(d, bankID, now)
+	if err != nil {
+		return nil, err
+	}
+	user, err := cachedUserByBankID(d, bankID)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, signinFailed(d, bankID, now)
 	case err != nil:
 		return nil, err
+	case user.ClosedAt != nil:
+		// 退会したユーザーはログインできない
+		return nil, signinFailed(d, bankID, now)
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
 		if err == bcrypt.ErrMismatchedHashAndPassword {
-			return nil, ErrUserNotFound
+			return nil, signinFailed(d, bankID, now)
+		}
+		return nil, err
+	}
+	switch err := VerifyMFA(d, user.ID, otp); err {
+	case nil:
+	case ErrMFAInvalid:
+		if err = signinFailed(d, bankID, now); err != ErrUserNotFound {
+			return nil, err
 		}
+		return nil, ErrMFAInvalid
+	default:
 		return nil, err
 	}
+	if failed {
+		if err = resetSigninFailures(d, bankID); err != nil {
+			return nil, err
+		}
+	}
 	sendLog(d, "signin", map[string]interface{}{
 		"user_id": user.ID,
 	})
 	return user, nil
 }
+
+// CloseUser はユーザーの未約定の注文をすべて取り消して退会させます
+// 取り消した注文のidを返します
+func CloseUser(tx *sql.Tx, userID int64) ([]int64, error) {
+	user, err := lockUser(tx, userID)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrUserNotFound
+	case err != nil:
+		return nil, errors.Wrapf(err, "lockUser failed. id:%d", userID)
+	case user.ClosedAt != nil:
+		return nil, ErrUserNotFound
+	}
+	orders, err := scanOrders(dbQuery(tx, `SELECT * FROM orders WHERE user_id = ? AND closed_at IS NULL ORDER BY id ASC FOR UPDATE`, user.ID))
+	if err != nil {
+		return nil, errors.Wrap(err, "find open orders failed")
+	}
+	ids := make([]int64, 0, len(orders))
+	for _, o := range orders {
+		if err = cancelOrder(tx, o, CancelReasonUserClosed); err != nil {
+			return nil, err
+		}
+		ids = append(ids, o.ID)
+	}
+	if _, err = dbExec(tx, `UPDATE user SET closed_at = NOW(6) WHERE id = ?`, user.ID); err != nil {
+		return nil, errors.Wrap(err, "update user for close")
+	}
+	sendLog(tx, "user.close", map[string]interface{}{
+		"user_id":         user.ID,
+		"canceled_orders": ids,
+	})
+	return ids, nil
+}
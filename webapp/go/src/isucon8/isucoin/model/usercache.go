@@ -0,0 +1,169 @@
+package model
+
+import (
+	"strings"
+	"sync"
+)
+
+// userCache はidとbank_idからユーザーを引くキャッシュです
+// ユーザーを更新するAPIはコミットした後にForgetUserで消してください
+// 見つからなかった結果はキャッシュしないので、登録したユーザーはすぐに引けます
+// 他のappサーバーでの更新は反映されないので、複数台で動かす場合は無効にしてください
+type userCache struct {
+	sync.RWMutex
+	byID     map[int64]*User
+	byBankID map[string]*User
+	// gen はForgetUserのたびに増え、DBから読んでいる間に消された場合は古い値を入れないようにします
+	gen uint64
+}
+
+var users *userCache
+
+// EnableUserCache はGetUserByIDとUserLoginでキャッシュを使うようにします
+func EnableUserCache(enabled bool) {
+	if !enabled {
+		users = nil
+		return
+	}
+	users = &userCache{byID: map[int64]*User{}, byBankID: map[string]*User{}}
+}
+
+func (c *userCache) get(id int64) (*User, uint64, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	u, ok := c.byID[id]
+	if !ok {
+		return nil, c.gen, false
+	}
+	v := *u
+	return &v, c.gen, true
+}
+
+func (c *userCache) getByBankID(bankID string) (*User, uint64, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	u, ok := c.byBankID[bankID]
+	if !ok {
+		return nil, c.gen, false
+	}
+	v := *u
+	return &v, c.gen, true
+}
+
+func (c *userCache) put(u *User, gen uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.gen != gen {
+		return
+	}
+	v := *u
+	c.byID[u.ID] = &v
+	c.byBankID[u.BankID] = &v
+}
+
+func (c *userCache) forget(id int64) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	if u, ok := c.byID[id]; ok {
+		delete(c.byBankID, u.BankID)
+		delete(c.byID, id)
+	}
+}
+
+func (c *userCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	c.byID = map[int64]*User{}
+	c.byBankID = map[string]*User{}
+}
+
+// ForgetUser はユーザーをキャッシュから消します。更新をコミットした後に呼んでください
+func ForgetUser(id int64) {
+	if users != nil {
+		users.forget(id)
+	}
+}
+
+// ResetUserCache はキャッシュをすべて消します
+func ResetUserCache() {
+	if users != nil {
+		users.reset()
+	}
+}
+
+// cachedUserByID はトランザクションの外で読む場合にキャッシュを使います
+func cachedUserByID(d QueryExecutor, id int64) (*User, error) {
+	if _, ok := baseDB(d); !ok || users == nil {
+		return scanUser(stmtQuery(d, queryUserByID, id))
+	}
+	u, gen, ok := users.get(id)
+	if ok {
+		return u, nil
+	}
+	u, err := scanUser(stmtQuery(d, queryUserByID, id))
+	if err == nil {
+		users.put(u, gen)
+	}
+	return u, err
+}
+
+func cachedUserByBankID(d QueryExecutor, bankID string) (*User, error) {
+	if _, ok := baseDB(d); !ok || users == nil {
+		return scanUser(stmtQuery(d, queryUserByBankID, bankID))
+	}
+	u, gen, ok := users.getByBankID(bankID)
+	if ok {
+		return u, nil
+	}
+	u, err := scanUser(stmtQuery(d, queryUserByBankID, bankID))
+	if err == nil {
+		users.put(u, gen)
+	}
+	return u, err
+}
+
+// cachedUsersByIDs はidsのユーザーをまとめて返します。キャッシュに無いものは1回のクエリで読みます
+func cachedUsersByIDs(d QueryExecutor, ids []int64) (map[int64]*User, error) {
+	found := make(map[int64]*User, len(ids))
+	cache := users
+	if _, ok := baseDB(d); !ok {
+		cache = nil
+	}
+	var (
+		missing []interface{}
+		gen     uint64
+	)
+	for _, id := range ids {
+		if _, ok := found[id]; ok {
+			continue
+		}
+		if cache != nil {
+			u, g, ok := cache.get(id)
+			if ok {
+				found[id] = u
+				continue
+			}
+			if missing == nil {
+				gen = g
+			}
+		}
+		found[id] = nil
+		missing = append(missing, id)
+	}
+	if len(missing) == 0 {
+		return found, nil
+	}
+	us, err := scanUsers(dbQuery(d, `SELECT * FROM user WHERE id IN (?`+strings.Repeat(`, ?`, len(missing)-1)+`)`, missing...))
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range us {
+		found[u.ID] = u
+		if cache != nil {
+			cache.put(u, gen)
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,75 @@
+package model
+
+import (
+	"database/sql"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const userLockNamePrefix = "isucoin.user."
+
+var (
+	ErrUserLockTimeout = errors.New("user lock timeout")
+
+	userLocks *UserLockManager
+)
+
+// UserLockManager はユーザーごとの注文や口座の操作を排他します
+// ユーザーidで選んだストライプのsync.Mutexで排他するので、DBの行ロック (SELECT ... FOR UPDATE) を取りません
+// 複数のappサーバーで動かす場合はDistributedでGET_LOCKによる排他も行ってください
+type UserLockManager struct {
+	stripes []sync.Mutex
+	db      *sql.DB
+	timeout time.Duration
+}
+
+func NewUserLockManager(stripes int) *UserLockManager {
+	if stripes < 1 {
+		stripes = 1
+	}
+	return &UserLockManager{stripes: make([]sync.Mutex, stripes)}
+}
+
+// Distributed はプロセス内の排他に加えて、全appサーバーで共通のGET_LOCKを取るようにします
+func (m *UserLockManager) Distributed(db *sql.DB, timeout time.Duration) *UserLockManager {
+	m.db = db
+	m.timeout = timeout
+	return m
+}
+
+// Do はユーザーのロックを取得してfを実行します
+func (m *UserLockManager) Do(userID int64, f func() error) error {
+	mu := &m.stripes[uint64(userID)%uint64(len(m.stripes))]
+	mu.Lock()
+	defer mu.Unlock()
+	if m.db == nil {
+		return f()
+	}
+	return withNamedLock(m.db, userLockNamePrefix+strconv.FormatInt(userID, 10), m.timeout, ErrUserLockTimeout, f)
+}
+
+// EnableUserLock はWithUserLockで使うUserLockManagerを設定します (nilで無効)
+func EnableUserLock(m *UserLockManager) {
+	userLocks = m
+}
+
+// WithUserLock はユーザーのロックを取得してfを実行します
+// UserLockManagerが無効の場合はそのまま実行し、lockUserでDBの行ロックを取ります
+func WithUserLock(userID int64, f func() error) error {
+	if userLocks == nil {
+		return f()
+	}
+	return userLocks.Do(userID, f)
+}
+
+// lockUser はWithUserLockの中でユーザーを取得します
+// UserLockManagerが有効の場合は排他済みなので行ロックを取りません
+func lockUser(tx *sql.Tx, userID int64) (*User, error) {
+	if userLocks == nil {
+		return getUserByIDWithLock(tx, userID)
+	}
+	return scanUser(stmtQuery(tx, queryUserByID, userID))
+}
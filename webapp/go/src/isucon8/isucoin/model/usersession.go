@@ -0,0 +1,230 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// SessionCheckTTL はCheckUserSessionの結果を使い回す時間です
+	// 他のappサーバーで無効にしたセッションはこの時間まで使えることがあります
+	SessionCheckTTL = 5 * time.Second
+	// SessionSeenInterval より短い間隔ではlast_seen_atを更新しません
+	SessionSeenInterval = 1 * time.Minute
+
+	maxUserAgentLen = 255
+	// sessionCacheSize を超えたら期限の切れた結果を捨てます
+	sessionCacheSize = 100000
+)
+
+var ErrSessionNotFound = errors.New("セッションが見つかりません")
+
+// UserSession はログインした端末ごとのセッションです
+// cookieにはトークンを入れ、DBにはそのハッシュだけを保存します
+type UserSession struct {
+	ID         int64     `json:"id"`
+	UserID     int64     `json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// Current はこのリクエストのセッションの場合にtrueです
+	Current bool `json:"current"`
+
+	tokenHash string
+}
+
+type sessionCacheEntry struct {
+	userID    int64
+	valid     bool
+	checkedAt time.Time
+	seenAt    time.Time
+}
+
+// sessionCache はトークンのハッシュごとのCheckUserSessionの結果です
+var sessionCache = struct {
+	sync.Mutex
+	m map[string]*sessionCacheEntry
+}{
+	m: map[string]*sessionCacheEntry{},
+}
+
+// NewSessionToken はcookieに入れるセッションのトークンを作ります
+func NewSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "generate session token failed")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func sessionTokenHash(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// CreateUserSession はログインした端末のセッションを記録します
+func CreateUserSession(d QueryExecutor, userID int64, token, userAgent, ip string) error {
+	if len(userAgent) > maxUserAgentLen {
+		userAgent = userAgent[:maxUserAgentLen]
+	}
+	_, err := dbExec(d, `INSERT INTO user_session (user_id, token_hash, user_agent, ip, created_at, last_seen_at) VALUES (?, ?, ?, ?, NOW(6), NOW(6))`,
+		userID, sessionTokenHash(token), userAgent, ip)
+	return errors.Wrap(err, "insert user_session failed")
+}
+
+// CheckUserSession はトークンのセッションがuserIDのもので無効にされていない場合にtrueを返します
+// 結果はSessionCheckTTLの間このappサーバーで使い回し、last_seen_atはSessionSeenIntervalごとに更新します
+func CheckUserSession(d QueryExecutor, userID int64, token string) (bool, error) {
+	hash := sessionTokenHash(token)
+	now := time.Now()
+	sessionCache.Lock()
+	e, ok := sessionCache.m[hash]
+	var seenAt time.Time
+	if ok {
+		if now.Sub(e.checkedAt) < SessionCheckTTL {
+			valid := e.valid && e.userID == userID
+			sessionCache.Unlock()
+			return valid, nil
+		}
+		seenAt = e.seenAt
+	}
+	sessionCache.Unlock()
+
+	var valid bool
+	if now.Sub(seenAt) < SessionSeenInterval {
+		rows, err := dbQuery(d, `SELECT 1 FROM user_session WHERE token_hash = ? AND user_id = ? AND revoked_at IS NULL`, hash, userID)
+		if err != nil {
+			return false, errors.Wrap(err, "select user_session failed")
+		}
+		valid = rows.Next()
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return false, errors.Wrap(err, "select user_session failed")
+		}
+	} else {
+		// 無効にされていなければ最後に使った時刻を更新し、更新できた場合に有効とする
+		res, err := dbExec(d, `UPDATE user_session SET last_seen_at = NOW(6) WHERE token_hash = ? AND user_id = ? AND revoked_at IS NULL`, hash, userID)
+		if err != nil {
+			return false, errors.Wrap(err, "update user_session failed")
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return false, errors.Wrap(err, "get rows affected failed")
+		}
+		valid = n > 0
+		seenAt = now
+	}
+	sessionCache.Lock()
+	defer sessionCache.Unlock()
+	if len(sessionCache.m) >= sessionCacheSize {
+		for k, e := range sessionCache.m {
+			if now.Sub(e.checkedAt) >= SessionCheckTTL {
+				delete(sessionCache.m, k)
+			}
+		}
+	}
+	sessionCache.m[hash] = &sessionCacheEntry{userID: userID, valid: valid, checkedAt: now, seenAt: seenAt}
+	return valid, nil
+}
+
+// ForgetUserSessions はユーザーのセッションのCheckUserSessionの結果を捨てます
+// セッションを無効にしたトランザクションをコミットした後に呼んでください
+func ForgetUserSessions(userID int64) {
+	sessionCache.Lock()
+	defer sessionCache.Unlock()
+	for k, e := range sessionCache.m {
+		if e.userID == userID {
+			delete(sessionCache.m, k)
+		}
+	}
+}
+
+// GetUserSessions はユーザーの無効にしていないセッションを最後に使った順に返します
+// tokenのセッションはCurrentをtrueにします
+func GetUserSessions(d QueryExecutor, userID int64, token string) ([]*UserSession, error) {
+	rows, err := dbQuery(d, `SELECT id, user_id, token_hash, user_agent, ip, created_at, last_seen_at FROM user_session WHERE user_id = ? AND revoked_at IS NULL ORDER BY last_seen_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "select user_session failed")
+	}
+	defer rows.Close()
+	hash := sessionTokenHash(token)
+	res := []*UserSession{}
+	for rows.Next() {
+		s := &UserSession{}
+		if err = rows.Scan(&s.ID, &s.UserID, &s.tokenHash, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt); err != nil {
+			return nil, errors.Wrap(err, "scan user_session failed")
+		}
+		s.Current = token != "" && s.tokenHash == hash
+		res = append(res, s)
+	}
+	return res, errors.Wrap(rows.Err(), "select user_session failed")
+}
+
+// RevokeUserSession はユーザーのセッションを無効にします
+func RevokeUserSession(tx *sql.Tx, userID, id int64) error {
+	res, err := dbExec(tx, `UPDATE user_session SET revoked_at = NOW(6) WHERE id = ? AND user_id = ? AND revoked_at IS NULL`, id, userID)
+	if err != nil {
+		return errors.Wrapf(err, "update user_session failed. id:%d", id)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "get rows affected failed")
+	} else if n == 0 {
+		return ErrSessionNotFound
+	}
+	sendLog(tx, "session.revoke", map[string]interface{}{
+		"user_id":    userID,
+		"session_id": id,
+	})
+	return nil
+}
+
+// RevokeUserSessions はユーザーのすべてのセッションを無効にし、session_versionを上げて
+// 記録する前に発行したセッションとJWTも無効にします。変更後のユーザーを返します
+func RevokeUserSessions(tx *sql.Tx, userID int64) (*User, error) {
+	user, err := getUserByIDWithLock(tx, userID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
+	}
+	n, err := revokeUserSessions(tx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = dbExec(tx, `UPDATE user SET session_version = session_version + 1 WHERE id = ?`, user.ID); err != nil {
+		return nil, errors.Wrap(err, "update user failed")
+	}
+	sendLog(tx, "session.revoke_all", map[string]interface{}{
+		"user_id": user.ID,
+		"revoked": n,
+	})
+	return GetUserByID(tx, user.ID)
+}
+
+// revokeUserSessions はsession_versionを上げる時にユーザーのセッションの記録も無効にします
+func revokeUserSessions(tx *sql.Tx, userID int64) (int64, error) {
+	res, err := dbExec(tx, `UPDATE user_session SET revoked_at = NOW(6) WHERE user_id = ? AND revoked_at IS NULL`, userID)
+	if err != nil {
+		return 0, errors.Wrap(err, "update user_session failed")
+	}
+	n, err := res.RowsAffected()
+	return n, errors.Wrap(err, "get rows affected failed")
+}
+
+// RevokeSessionToken はログアウトしたセッションを無効にします。記録が無い場合は何もしません
+func RevokeSessionToken(d QueryExecutor, token string) error {
+	hash := sessionTokenHash(token)
+	if _, err := dbExec(d, `UPDATE user_session SET revoked_at = NOW(6) WHERE token_hash = ? AND revoked_at IS NULL`, hash); err != nil {
+		return errors.Wrap(err, "update user_session failed")
+	}
+	sessionCache.Lock()
+	delete(sessionCache.m, hash)
+	sessionCache.Unlock()
+	return nil
+}
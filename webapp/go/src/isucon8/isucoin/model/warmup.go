@@ -0,0 +1,70 @@
+package model
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultWarmup は/initializeで準備が整うのを待つ最大の時間です
+	DefaultWarmup = 10 * time.Second
+
+	readyPollInterval = 100 * time.Millisecond
+)
+
+// Warmup は/info, /ticker, /chartで使うクエリを実行して、キャッシュとDBのバッファを温めます
+// プリペアドステートメントもここで各接続に準備されます
+func Warmup(cluster *DBCluster, base time.Time) error {
+	if _, err := GetTicker(cluster.Primary); err != nil {
+		return errors.Wrap(err, "warmup ticker failed")
+	}
+	dbs := append([]QueryExecutor{cluster.Primary}, replicaExecutors(cluster)...)
+	for _, d := range dbs {
+		for _, c := range []struct {
+			from time.Time
+			tf   string
+		}{
+			{base.Add(-300 * time.Second), CandlestickBySec},
+			{base.Add(-300 * time.Minute), CandlestickByMin},
+			{base.Add(-48 * time.Hour), CandlestickByHour},
+		} {
+			if _, err := GetCandlestickData(d, c.from, c.tf); err != nil {
+				return errors.Wrapf(err, "warmup candlestick %s failed", c.tf)
+			}
+		}
+	}
+	return nil
+}
+
+func replicaExecutors(cluster *DBCluster) []QueryExecutor {
+	res := make([]QueryExecutor, len(cluster.replicas))
+	for i, r := range cluster.replicas {
+		res[i] = r
+	}
+	return res
+}
+
+// WaitReady はCheckReadinessがすべて使えるようになるかctxが終了するまで待ちます
+// 待ち終わった時点で使えない依存先を返します
+func WaitReady(ctx context.Context, cluster *DBCluster) []*DependencyStatus {
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+	for {
+		var down []*DependencyStatus
+		for _, d := range CheckReadiness(ctx, cluster) {
+			if !d.OK {
+				down = append(down, d)
+			}
+		}
+		if len(down) == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return down
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxWebhooksPerUser は1ユーザーが登録できるWebhookの数です
+	MaxWebhooksPerUser = 5
+	MaxWebhookURLLen   = 255
+
+	WebhookEventTraded = "order.traded"
+	WebhookEventAlert  = "alert.triggered"
+
+	WebhookSignatureHeader = "X-Isucoin-Signature"
+	WebhookEventHeader     = "X-Isucoin-Event"
+	WebhookDeliveryHeader  = "X-Isucoin-Delivery"
+
+	// webhookMaxRetry 回再送しても失敗した通知は捨てます
+	webhookMaxRetry  = 3
+	webhookRetryWait = 500 * time.Millisecond
+)
+
+var (
+	ErrWebhookNotFound   = errors.New("Webhookが見つかりません")
+	ErrWebhookURLInvalid = errors.New("url must be https")
+	ErrWebhookLimit      = errors.New("Webhookの登録数の上限です")
+)
+
+//go:generate scanner
+type Webhook struct {
+	ID     int64  `json:"id"`
+	UserID int64  `json:"-"`
+	URL    string `json:"url"`
+	// Secret は署名の鍵で、登録したときだけ返します
+	Secret    string     `json:"-"`
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// validWebhookURL はhttpsでホストのあるURLだけを受け付けます
+func validWebhookURL(s string) bool {
+	if len(s) > MaxWebhookURLLen {
+		return false
+	}
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.Host != "" && u.User == nil
+}
+
+// CreateWebhook はWebhookを登録します
+func CreateWebhook(tx *sql.Tx, userID int64, rawURL string) (*Webhook, error) {
+	if !validWebhookURL(rawURL) {
+		return nil, ErrWebhookURLInvalid
+	}
+	var n int64
+	// 同じユーザーの登録を直列にするためにユーザーの行をロックする
+	if _, err := getUserByIDWithLock(tx, userID); err != nil {
+		return nil, errors.Wrapf(err, "getUserByIDWithLock failed. id:%d", userID)
+	}
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM webhook WHERE user_id = ? AND deleted_at IS NULL`, userID).Scan(&n); err != nil {
+		return nil, errors.Wrap(err, "count webhook failed")
+	}
+	if n >= MaxWebhooksPerUser {
+		return nil, ErrWebhookLimit
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, errors.Wrap(err, "generate webhook secret failed")
+	}
+	res, err := dbExec(tx, `INSERT INTO webhook (user_id, url, secret, created_at) VALUES (?, ?, ?, NOW(6))`,
+		userID, rawURL, hex.EncodeToString(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "insert webhook failed")
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, errors.Wrap(err, "get webhook id failed")
+	}
+	sendLog(tx, "webhook.create", map[string]interface{}{
+		"user_id":    userID,
+		"webhook_id": id,
+	})
+	wh, err := scanWebhook(dbQuery(tx, `SELECT * FROM webhook WHERE id = ?`, id))
+	if err != nil {
+		return nil, errors.Wrapf(err, "select webhook failed. id:%d", id)
+	}
+	return wh, nil
+}
+
+// GetWebhooks はユーザーの削除されていないWebhookを返します
+func GetWebhooks(d QueryExecutor, userID int64) ([]*Webhook, error) {
+	return scanWebhooks(dbQuery(d, `SELECT * FROM webhook WHERE user_id = ? AND deleted_at IS NULL ORDER BY id ASC`, userID))
+}
+
+// DeleteWebhook はWebhookを削除します
+func DeleteWebhook(tx *sql.Tx, userID, id int64) error {
+	res, err := dbExec(tx, `UPDATE webhook SET deleted_at = NOW(6) WHERE id = ? AND user_id = ? AND deleted_at IS NULL`, id, userID)
+	if err != nil {
+		return errors.Wrapf(err, "update webhook failed. id:%d", id)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return errors.Wrap(err, "get rows affected failed")
+	} else if n == 0 {
+		return ErrWebhookNotFound
+	}
+	sendLog(tx, "webhook.delete", map[string]interface{}{
+		"user_id":    userID,
+		"webhook_id": id,
+	})
+	return nil
+}
+
+// SignWebhook はpayloadのHMAC-SHA256を "sha256=<hex>" の形式で返します
+func SignWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookPayload はWebhookでPOSTするJSONです
+// order.traded の場合はOrder、alert.triggered の場合はAlertを入れます
+type WebhookPayload struct {
+	ID    string      `json:"id"`
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Order *Order      `json:"order,omitempty"`
+	Alert *PriceAlert `json:"alert,omitempty"`
+}
+
+// webhookEvent はキューに入れた通知です
+type webhookEvent struct {
+	userID int64
+	event  string
+	order  *Order
+	alert  *PriceAlert
+}
+
+// webhookDispatcher は約定した注文と発動した価格アラートをそのユーザーのWebhookに通知します
+// トレード処理を止めないように、通知はキューに入れてワーカーが送信します
+type webhookDispatcher struct {
+	db      *sql.DB
+	client  *http.Client
+	queue   chan *webhookEvent
+	dropped int64
+}
+
+// StartWebhookDispatcher はWebhookを送信するワーカーをworkers個起動します
+// キューにはsize件まで溜め、超えた分は捨てます。ctxが終了すると送信中の通知を終えて停止します
+func StartWebhookDispatcher(ctx context.Context, db *sql.DB, workers, size int, timeout time.Duration) {
+	wd := &webhookDispatcher{
+		db:     db,
+		client: &http.Client{Timeout: timeout},
+		queue:  make(chan *webhookEvent, size),
+	}
+	for i := 0; i < workers; i++ {
+		startWorker(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ev := <-wd.queue:
+					wd.dispatch(ctx, ev)
+				}
+			}
+		})
+	}
+	AddEventPublisher(wd)
+}
+
+func (wd *webhookDispatcher) PublishTrade(trade *Trade) {}
+
+func (wd *webhookDispatcher) PublishOrderEvent(ev *OrderEvent) {
+	if ev.Event != OrderEventTraded {
+		return
+	}
+	wd.enqueue(&webhookEvent{userID: ev.Order.UserID, event: WebhookEventTraded, order: ev.Order})
+}
+
+func (wd *webhookDispatcher) PublishAlert(alert *PriceAlert) {
+	wd.enqueue(&webhookEvent{userID: alert.UserID, event: WebhookEventAlert, alert: alert})
+}
+
+func (wd *webhookDispatcher) enqueue(ev *webhookEvent) {
+	select {
+	case wd.queue <- ev:
+	default:
+		n := atomic.AddInt64(&wd.dropped, 1)
+		// 1, 2, 4, 8...件目で出力する
+		if n&(n-1) == 0 {
+			log.Printf("[WARN] webhook queue is full. dropped:%d", n)
+		}
+	}
+}
+
+// dispatch はユーザーのすべてのWebhookに通知します
+// 価格アラートの場合は、通知が終わった時刻と失敗したWebhookの数をprice_alertに記録します
+func (wd *webhookDispatcher) dispatch(ctx context.Context, ev *webhookEvent) {
+	hooks, err := GetWebhooks(wd.db, ev.userID)
+	if err != nil {
+		log.Printf("[WARN] get webhooks failed. user_id:%d, err:%s", ev.userID, err)
+		return
+	}
+	failures := 0
+	for _, wh := range hooks {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Printf("[WARN] generate webhook delivery id failed. err:%s", err)
+			return
+		}
+		deliveryID := hex.EncodeToString(b)
+		payload, err := json.Marshal(&WebhookPayload{
+			ID:    deliveryID,
+			Event: ev.event,
+			Time:  time.Now(),
+			Order: ev.order,
+			Alert: ev.alert,
+		})
+		if err != nil {
+			log.Printf("[WARN] webhook json encode failed. event:%s, err:%s", ev.event, err)
+			return
+		}
+		if err := wd.post(ctx, wh, ev.event, deliveryID, payload); err != nil {
+			failures++
+			log.Printf("[WARN] webhook delivery failed. webhook_id:%d, event:%s, err:%s", wh.ID, ev.event, err)
+		}
+	}
+	if ev.alert != nil {
+		if err := markAlertDelivered(wd.db, ev.alert.ID, failures); err != nil {
+			log.Printf("[WARN] %s", err)
+		}
+	}
+}
+
+// post はpayloadを署名してPOSTします。2xx以外の場合は間隔を倍にしながらwebhookMaxRetry回まで再送します
+// ctxが終了した場合は再送しません
+func (wd *webhookDispatcher) post(ctx context.Context, wh *Webhook, event, deliveryID string, payload []byte) error {
+	wait := webhookRetryWait
+	for i := 0; ; i++ {
+		start := time.Now()
+		err := wd.postOnce(wh, event, deliveryID, payload)
+		observeUpstream("webhook", "post", start, err)
+		if err == nil || i == webhookMaxRetry {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (wd *webhookDispatcher) postOnce(wh *Webhook, event, deliveryID string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.URL, bytes.NewReader(payload))
+	if err != nil {
+		return errors.Wrap(err, "new request failed")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "isucoin")
+	req.Header.Set(WebhookEventHeader, event)
+	req.Header.Set(WebhookDeliveryHeader, deliveryID)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(wh.Secret, payload))
+	res, err := wd.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "post failed")
+	}
+	defer res.Body.Close()
+	// keep-aliveの接続を使い回すために読み捨てる
+	io.Copy(ioutil.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+	return nil
+}
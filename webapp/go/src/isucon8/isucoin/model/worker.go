@@ -0,0 +1,33 @@
+package model
+
+import (
+	"context"
+	"sync"
+)
+
+// workers はStart*で起動したワーカーです
+var workers sync.WaitGroup
+
+func startWorker(f func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		f()
+	}()
+}
+
+// WaitWorkers はStart*に渡したctxが終了した後、すべてのワーカーが停止するのを待ちます
+// マッチングやログの送信が残っている場合は終わるまで待つので、ctxで期限を指定してください
+func WaitWorkers(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
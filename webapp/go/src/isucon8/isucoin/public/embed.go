@@ -0,0 +1,23 @@
+// Package public はフロントエンドのビルド結果 (webapp/public) をバイナリに埋め込みます
+// make assets で dist にコピーしてからビルドしてください。コピーしていない場合は何も埋め込みません
+package public
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:embed all:dist
+var dist embed.FS
+
+// FS は埋め込んだファイルを返します。index.htmlを埋め込んでいない場合はfalseを返します
+func FS() (fs.FS, bool) {
+	sub, err := fs.Sub(dist, "dist")
+	if err != nil {
+		return nil, false
+	}
+	if _, err = fs.Stat(sub, "index.html"); err != nil {
+		return nil, false
+	}
+	return sub, true
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+// セッションの保存先です
+const (
+	BackendCookie = "cookie" // 中身をすべて署名付きcookieに入れる (デフォルト)
+	BackendMemory = "memory" // appサーバーのメモリ (LRU)。1台の場合のみ
+	BackendRedis  = "redis"  // Redis。複数台のappサーバーで共有する
+)
+
+// cookieに保存する場合のエンコードの方法です
+const (
+	CodecSecureCookie = "securecookie" // gorilla/securecookie (デフォルト)
+	CodecSigned       = "signed"       // SignedStore。securecookieのcookieも読めるので切り替えてもログインし直す必要はない
+)
+
+type Config struct {
+	Backend string
+	// Codec はBackendCookieの場合のみ使います
+	Codec  string
+	Secret []byte
+	// MaxAge はセッションの有効期限 (秒) で、ログインからの期間になります
+	MaxAge    int
+	RedisAddr string
+	LRUSize   int
+}
+
+// Manager は設定で選んだsessions.Storeに、ログイン時のIDの付け替えと有効期限を加えます
+type Manager struct {
+	sessions.Store
+	maxAge int
+}
+
+func NewManager(c Config) (*Manager, error) {
+	m := &Manager{maxAge: c.MaxAge}
+	switch c.Backend {
+	case BackendCookie, "":
+		switch c.Codec {
+		case CodecSecureCookie, "":
+			s := sessions.NewCookieStore(c.Secret)
+			if c.MaxAge > 0 {
+				s.MaxAge(c.MaxAge)
+			}
+			m.Store = s
+		case CodecSigned:
+			s := NewSignedStore(c.Secret)
+			if c.MaxAge > 0 {
+				s.MaxAge(c.MaxAge)
+			}
+			m.Store = s
+		default:
+			return nil, errors.Errorf("unknown session codec. %s", c.Codec)
+		}
+	case BackendMemory:
+		s := NewStore(NewMemoryBackend(c.LRUSize), c.Secret)
+		if c.MaxAge > 0 {
+			s.MaxAge(c.MaxAge)
+		}
+		m.Store = s
+	case BackendRedis:
+		if c.RedisAddr == "" {
+			return nil, errors.New("redis address is required")
+		}
+		s := NewStore(NewRedisBackend(c.RedisAddr), c.Secret)
+		if c.MaxAge > 0 {
+			s.MaxAge(c.MaxAge)
+		}
+		m.Store = s
+	default:
+		return nil, errors.Errorf("unknown session backend. %s", c.Backend)
+	}
+	return m, nil
+}
+
+// Rotate はログイン時にセッションIDを作り直します (セッション固定攻撃の対策)
+// 有効期限もこのときから数え直します。cookieに保存する場合はIDが無いので期限だけ更新されます
+func (m *Manager) Rotate(session *sessions.Session) error {
+	if s, ok := m.Store.(*Store); ok {
+		if err := s.Rotate(session); err != nil {
+			return err
+		}
+	}
+	if m.maxAge > 0 {
+		session.Options.MaxAge = m.maxAge
+	}
+	return nil
+}
+
+// Expire は次のSaveでセッションを削除させます
+func (m *Manager) Expire(session *sessions.Session) {
+	opts := *session.Options
+	opts.MaxAge = -1
+	session.Options = &opts
+}
@@ -0,0 +1,77 @@
+package session
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// memoryBackend はappサーバーのメモリに保存するBackendです
+// size件を超えたら最後に使われた時刻が古いセッションから捨てます。1台で動かす場合のみ使えます
+type memoryBackend struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	id        string
+	data      []byte
+	expiresAt time.Time
+}
+
+func NewMemoryBackend(size int) Backend {
+	return &memoryBackend{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+func (m *memoryBackend) Load(id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	entry := e.Value.(*memoryEntry)
+	if time.Now().After(entry.expiresAt) {
+		m.remove(e)
+		return nil, ErrNotFound
+	}
+	m.lru.MoveToFront(e)
+	return entry.data, nil
+}
+
+func (m *memoryBackend) Save(id string, data []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	expiresAt := time.Now().Add(ttl)
+	if e, ok := m.entries[id]; ok {
+		entry := e.Value.(*memoryEntry)
+		entry.data, entry.expiresAt = data, expiresAt
+		m.lru.MoveToFront(e)
+		return nil
+	}
+	m.entries[id] = m.lru.PushFront(&memoryEntry{id: id, data: data, expiresAt: expiresAt})
+	for m.size > 0 && m.lru.Len() > m.size {
+		m.remove(m.lru.Back())
+	}
+	return nil
+}
+
+func (m *memoryBackend) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[id]; ok {
+		m.remove(e)
+	}
+	return nil
+}
+
+func (m *memoryBackend) remove(e *list.Element) {
+	m.lru.Remove(e)
+	delete(m.entries, e.Value.(*memoryEntry).id)
+}
@@ -0,0 +1,154 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	RedisKeyPrefix   = "isucoin:session:"
+	RedisPoolSize    = 32
+	RedisDialTimeout = 1 * time.Second
+	RedisIOTimeout   = 1 * time.Second
+)
+
+// redisBackend はRedisに保存するBackendです。複数台のappサーバーでセッションを共有できます
+// 使うコマンドはGET, SET (PX), DELだけなので、RESPを直接話します
+type redisBackend struct {
+	addr string
+	pool chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func NewRedisBackend(addr string) Backend {
+	return &redisBackend{
+		addr: addr,
+		pool: make(chan *redisConn, RedisPoolSize),
+	}
+}
+
+func (b *redisBackend) Load(id string) ([]byte, error) {
+	v, err := b.do("GET", RedisKeyPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrNotFound
+	}
+	return v.([]byte), nil
+}
+
+func (b *redisBackend) Save(id string, data []byte, ttl time.Duration) error {
+	ms := int64(ttl / time.Millisecond)
+	if ms <= 0 {
+		return b.Delete(id)
+	}
+	_, err := b.do("SET", RedisKeyPrefix+id, string(data), "PX", strconv.FormatInt(ms, 10))
+	return err
+}
+
+func (b *redisBackend) Delete(id string) error {
+	_, err := b.do("DEL", RedisKeyPrefix+id)
+	return err
+}
+
+func (b *redisBackend) do(args ...string) (interface{}, error) {
+	c, err := b.get()
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(RedisIOTimeout))
+	v, err := c.do(args...)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			// 応答の途中で失敗した接続は再利用しない
+			c.Close()
+			return nil, errors.Wrapf(err, "redis %s failed", args[0])
+		}
+	}
+	b.put(c)
+	return v, err
+}
+
+func (b *redisBackend) get() (*redisConn, error) {
+	select {
+	case c := <-b.pool:
+		return c, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", b.addr, RedisDialTimeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "redis connect failed. addr:%s", b.addr)
+	}
+	return &redisConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (b *redisBackend) put(c *redisConn) {
+	select {
+	case b.pool <- c:
+	default:
+		c.Close()
+	}
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	w := bufio.NewWriter(c.Conn)
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply はGET, SET, DELの応答 (simple string, error, integer, bulk string) を読みます
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.Errorf("redis: invalid reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, errors.Errorf("redis: invalid bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return nil, errors.Errorf("redis: unexpected reply %q", line)
+}
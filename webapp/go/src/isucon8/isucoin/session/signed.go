@@ -0,0 +1,234 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+const (
+	signedFormatVersion = 1
+	signedMACSize       = sha256.Size
+
+	signedTypeInt64  = 'i'
+	signedTypeString = 's'
+)
+
+var (
+	ErrSignatureInvalid = errors.New("session signature invalid")
+	ErrSessionExpired   = errors.New("session expired")
+	ErrValueUnsupported = errors.New("session value must be int, int64 or string with string key")
+)
+
+// SignedStore はセッションの中身を短いバイナリにしてHMAC-SHA256で署名し、cookieに入れるsessions.Storeです
+// securecookieのgobとAES, base64の二重エンコードより軽く、キーはstring、値はint, int64, stringだけを入れられます
+// 署名を確認できないcookieはsecurecookieで読めるかを試すので、CodecSecureCookieで発行したcookieもそのまま使えます
+type SignedStore struct {
+	Options *sessions.Options
+	key     []byte
+	// legacy は切り替える前にsecurecookieで発行したcookieを読むためのものです。書き込みには使いません
+	legacy []securecookie.Codec
+}
+
+func NewSignedStore(keyPairs ...[]byte) *SignedStore {
+	s := &SignedStore{
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		legacy: securecookie.CodecsFromPairs(keyPairs...),
+	}
+	if len(keyPairs) > 0 {
+		s.key = keyPairs[0]
+	}
+	s.MaxAge(s.Options.MaxAge)
+	return s
+}
+
+// MaxAge はcookieと署名の有効期限を秒で設定します
+func (s *SignedStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.legacy {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+func (s *SignedStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New はcookieのセッションを読み込みます。cookieが無い場合は新しいセッションを返します
+func (s *SignedStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err = s.decode(name, c.Value, session.Values, time.Now()); err != nil {
+		if err == ErrSessionExpired || securecookie.DecodeMulti(name, c.Value, &session.Values, s.legacy...) != nil {
+			return session, err
+		}
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save はセッションをcookieに書き込みます。Options.MaxAgeが0以下の場合はcookieを削除します
+func (s *SignedStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	expires := time.Now().Add(time.Duration(session.Options.MaxAge) * time.Second)
+	encoded, err := s.encode(session.Name(), session.Values, expires)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// encode は [version][expires][件数][キー, 型, 値]... にMACを付けてbase64にします
+// MACにはcookieの名前も含めるので、別の名前のcookieには使えません
+func (s *SignedStore) encode(name string, values map[interface{}]interface{}, expires time.Time) (string, error) {
+	buf := make([]byte, 0, 128)
+	buf = append(buf, signedFormatVersion)
+	buf = binary.AppendVarint(buf, expires.Unix())
+	buf = binary.AppendUvarint(buf, uint64(len(values)))
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			return "", ErrValueUnsupported
+		}
+		buf = appendSignedString(buf, key)
+		switch v := v.(type) {
+		case int64:
+			buf = append(buf, signedTypeInt64)
+			buf = binary.AppendVarint(buf, v)
+		case int:
+			buf = append(buf, signedTypeInt64)
+			buf = binary.AppendVarint(buf, int64(v))
+		case string:
+			buf = append(buf, signedTypeString)
+			buf = appendSignedString(buf, v)
+		default:
+			return "", ErrValueUnsupported
+		}
+	}
+	buf = append(buf, s.mac(name, buf)...)
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (s *SignedStore) decode(name, value string, values map[interface{}]interface{}, now time.Time) error {
+	buf, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(buf) < 1+signedMACSize || buf[0] != signedFormatVersion {
+		return ErrSignatureInvalid
+	}
+	payload, sum := buf[:len(buf)-signedMACSize], buf[len(buf)-signedMACSize:]
+	if !hmac.Equal(sum, s.mac(name, payload)) {
+		return ErrSignatureInvalid
+	}
+	r := signedReader{buf: payload[1:]}
+	if now.Unix() > r.varint() {
+		return ErrSessionExpired
+	}
+	decoded := make(map[interface{}]interface{})
+	for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+		key := r.string()
+		switch r.byte() {
+		case signedTypeInt64:
+			decoded[key] = r.varint()
+		case signedTypeString:
+			decoded[key] = r.string()
+		default:
+			r.err = ErrSignatureInvalid
+		}
+	}
+	if r.err != nil || len(r.buf) > 0 {
+		// 署名が正しいので自分で書いた値のはずです
+		return errors.New("session value corrupted")
+	}
+	for k, v := range decoded {
+		values[k] = v
+	}
+	return nil
+}
+
+func (s *SignedStore) mac(name string, payload []byte) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+func appendSignedString(buf []byte, v string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(v)))
+	return append(buf, v...)
+}
+
+// signedReader はencodeで書いた値を順に読みます。壊れていた場合はerrを設定してゼロ値を返します
+type signedReader struct {
+	buf []byte
+	err error
+}
+
+func (r *signedReader) fail() {
+	if r.err == nil {
+		r.err = ErrSignatureInvalid
+	}
+	r.buf = nil
+}
+
+func (r *signedReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *signedReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *signedReader) byte() byte {
+	if len(r.buf) < 1 {
+		r.fail()
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *signedReader) string() string {
+	n := r.uvarint()
+	if uint64(len(r.buf)) < n {
+		r.fail()
+		return ""
+	}
+	v := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return v
+}
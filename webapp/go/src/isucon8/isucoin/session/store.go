@@ -0,0 +1,133 @@
+package session
+
+import (
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/pkg/errors"
+)
+
+var ErrNotFound = errors.New("session not found")
+
+// Backend はセッションの中身をappサーバーの外 (またはメモリ) に保存します
+// 有効期限を過ぎたセッションはLoadでErrNotFoundを返してください
+type Backend interface {
+	Load(id string) ([]byte, error)
+	Save(id string, data []byte, ttl time.Duration) error
+	Delete(id string) error
+}
+
+// Store はcookieにはセッションIDだけを入れ、中身をBackendに保存するsessions.Storeです
+// IDと中身はどちらもsecurecookieで署名するので、Backendの値を書き換えられても読み込みません
+type Store struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+	backend Backend
+}
+
+func NewStore(backend Backend, keyPairs ...[]byte) *Store {
+	s := &Store{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		backend: backend,
+	}
+	s.MaxAge(s.Options.MaxAge)
+	return s
+}
+
+// MaxAge はcookieとBackendの有効期限を秒で設定します
+func (s *Store) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+func (s *Store) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New はcookieのIDでBackendからセッションを読み込みます
+// Backendに無い (期限切れなどの) 場合はエラーにせず新しいセッションを返します
+func (s *Store) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+	data, err := s.backend.Load(session.ID)
+	switch {
+	case err == ErrNotFound:
+		session.ID = ""
+		return session, nil
+	case err != nil:
+		return session, errors.Wrap(err, "load session failed")
+	}
+	if err = securecookie.DecodeMulti(name, string(data), &session.Values, s.Codecs...); err != nil {
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save はセッションをBackendに保存してcookieにIDを設定します
+// Options.MaxAgeが0以下の場合はBackendから削除します
+func (s *Store) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := s.backend.Delete(session.ID); err != nil {
+				return errors.Wrap(err, "delete session failed")
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		session.ID = newID()
+	}
+	data, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if err = s.backend.Save(session.ID, []byte(data), ttl); err != nil {
+		return errors.Wrap(err, "save session failed")
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// Rotate は古いIDのセッションを削除し、次のSaveで新しいIDを発行させます
+func (s *Store) Rotate(session *sessions.Session) error {
+	if session.ID == "" {
+		return nil
+	}
+	if err := s.backend.Delete(session.ID); err != nil {
+		return errors.Wrap(err, "delete session failed")
+	}
+	session.ID = ""
+	return nil
+}
+
+func newID() string {
+	return strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+}
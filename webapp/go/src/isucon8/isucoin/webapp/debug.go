@@ -0,0 +1,50 @@
+package main
+
+import (
+	"expvar"
+	"isucon8/isucoin/model"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// startDebugServer はpprofとexpvarをaddrで公開します
+// ベンチマーク中にプロファイルを取るためのもので、外部から繋がらないアドレスを指定してください
+func startDebugServer(addr string, cluster *model.DBCluster) *http.Server {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("gc", expvar.Func(func() interface{} {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return map[string]interface{}{
+			"num_gc":         m.NumGC,
+			"pause_total_ns": m.PauseTotalNs,
+			"last_pause_ns":  m.PauseNs[(m.NumGC+255)%256],
+			"heap_alloc":     m.HeapAlloc,
+			"heap_objects":   m.HeapObjects,
+			"next_gc":        m.NextGC,
+		}
+	}))
+	expvar.Publish("db", expvar.Func(func() interface{} {
+		return cluster.Stats()
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		log.Printf("[INFO] start debug server %s", addr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return server
+}
@@ -1,21 +1,30 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"flag"
 	"fmt"
+	"isucon8/isubank"
+	"isucon8/isucoin/config"
 	"isucon8/isucoin/controller"
+	"isucon8/isucoin/metrics"
+	"isucon8/isucoin/migrate"
+	"isucon8/isucoin/model"
+	"isucon8/isucoin/public"
+	"isucon8/isucoin/session"
+	"isucon8/isulogger"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	gctx "github.com/gorilla/context"
-	"github.com/gorilla/sessions"
 	"github.com/julienschmidt/httprouter"
-)
-
-const (
-	SessionSecret = "tonymoris"
+	"google.golang.org/grpc"
 )
 
 func init() {
@@ -27,50 +36,399 @@ func init() {
 	time.Local = loc
 }
 
-func getEnv(key, def string) string {
-	if v, ok := os.LookupEnv("ISU_" + key); ok {
-		return v
+func ms(n int) time.Duration {
+	return time.Duration(n) * time.Millisecond
+}
+
+// runMigrations はマイグレーションを適用し、すべてのマイグレーションの状態を表示します
+func runMigrations(db *sql.DB) error {
+	if _, err := migrate.Run(context.Background(), db); err != nil {
+		return err
 	}
-	return def
+	ss, err := migrate.List(context.Background(), db)
+	if err != nil {
+		return err
+	}
+	for _, s := range ss {
+		fmt.Printf("%d\t%s\t%s\n", s.Version, s.Name, s.AppliedAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// loadAssets はdirを指定した場合はそのディレクトリ、指定しない場合はバイナリに埋め込んだ公開ファイルを読み込みます
+// 埋め込まずにビルドした場合は従来どおり ./public を読みます
+func loadAssets(dir string) (*controller.AssetHandler, error) {
+	if dir == "" {
+		if fsys, ok := public.FS(); ok {
+			log.Printf("[INFO] serve embedded public files")
+			return controller.NewAssetHandlerFS(fsys)
+		}
+		dir = "public"
+	}
+	log.Printf("[INFO] serve public files from %s", dir)
+	return controller.NewAssetHandler(dir)
 }
 
 func main() {
-	var (
-		port   = getEnv("APP_PORT", "5000")
-		dbhost = getEnv("DB_HOST", "127.0.0.1")
-		dbport = getEnv("DB_PORT", "3306")
-		dbuser = getEnv("DB_USER", "root")
-		dbpass = getEnv("DB_PASSWORD", "")
-		dbname = getEnv("DB_NAME", "isucoin")
-		public = getEnv("PUBLIC_DIR", "public")
-	)
+	migrateOnly := flag.Bool("migrate", false, "マイグレーションを適用して終了する")
+	publicDir := flag.String("public-dir", "", "埋め込んだ公開ファイルの代わりに返すディレクトリ (ISU_PUBLIC_DIRより優先)")
+	flag.Parse()
 
-	dbusrpass := dbuser
-	if dbpass != "" {
-		dbusrpass += ":" + dbpass
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("load config failed. err: %s", err)
+	}
+	if *publicDir != "" {
+		cfg.PublicDir = *publicDir
 	}
 
-	dsn := fmt.Sprintf(`%s@tcp(%s:%s)/%s?parseTime=true&loc=Local&charset=utf8mb4`, dbusrpass, dbhost, dbport, dbname)
-	db, err := sql.Open("mysql", dsn)
+	cluster, err := model.NewDBCluster(cfg.DB.PrimaryDSN(), cfg.DB.ReplicaDSNs()...)
 	if err != nil {
 		log.Fatalf("mysql connect failed. err: %s", err)
 	}
-	store := sessions.NewCookieStore([]byte(SessionSecret))
+	cluster.SetMaxConns(cfg.DB.MaxOpenConns, cfg.DB.MaxIdleConns)
+	model.SetTxRetry(cfg.DB.DeadlockRetries, ms(cfg.DB.DeadlockRetryWaitMS))
+	model.SetQueryTimeout(ms(cfg.DB.QueryTimeoutMS))
+	db := cluster.Primary
+	if *migrateOnly {
+		if err := runMigrations(db); err != nil {
+			log.Fatalf("migration failed. err: %s", err)
+		}
+		return
+	}
+	if cfg.DB.Migrate {
+		if _, err := migrate.Run(context.Background(), db); err != nil {
+			log.Fatalf("migration failed. err: %s", err)
+		}
+	}
+	if cfg.DB.PreparedStatements {
+		if _, err := model.EnablePreparedStatements(db); err != nil {
+			log.Fatalf("prepare statements failed. err: %s", err)
+		}
+	}
+	store, err := session.NewManager(session.Config{
+		Backend:   cfg.Session.Backend,
+		Codec:     cfg.Session.Codec,
+		Secret:    []byte(cfg.Session.Secret),
+		MaxAge:    cfg.Session.MaxAge,
+		RedisAddr: cfg.Session.RedisAddr,
+		LRUSize:   cfg.Session.LRUSize,
+	})
+	if err != nil {
+		log.Fatalf("session store init failed. err: %s", err)
+	}
+	model.EnableTradeLock(time.Duration(cfg.Trade.LockTimeoutSec) * time.Second)
+	model.EnableHoldingsCheck(cfg.Trade.HoldingsCheck)
+	if cfg.Trade.UserLockStripes > 0 {
+		// ユーザーごとの排他をプロセス内で行う (0の場合はDBの行ロックを使う)
+		m := model.NewUserLockManager(cfg.Trade.UserLockStripes)
+		if cfg.Trade.UserLockTimeoutSec > 0 {
+			m.Distributed(db, time.Duration(cfg.Trade.UserLockTimeoutSec)*time.Second)
+		}
+		model.EnableUserLock(m)
+	}
+	model.EnableUserCache(cfg.Trade.UserCache)
+	// 他のappサーバーの変更は読み直さないので、複数台で動かす場合はSettingsCacheを使えません
+	model.EnableSettingsCache(cfg.Trade.SettingsCache)
+	model.SetSettingOverrides(cfg.SettingOverrides())
+	if err := model.ReloadSettings(db); err != nil {
+		log.Fatalf("load settings failed. err: %s", err)
+	}
+	if cfg.Trade.IDGenerator {
+		if err := model.EnableIDGenerator(db, int64(cfg.Trade.IDNode)); err != nil {
+			log.Fatalf("id generator init failed. err: %s", err)
+		}
+	}
+	model.SetIsuSeed(int64(cfg.IsuSeed))
+	model.SetMFAKey(cfg.MFAKey)
+	model.SetAdminToken(cfg.AdminToken)
+	model.SetJWTSecret(cfg.JWTSecret)
+	if cfg.Trade.OrderBook {
+		if err := model.EnableOrderBook(db); err != nil {
+			log.Fatalf("load order book failed. err: %s", err)
+		}
+	}
+	if err := model.LoadMarketStats(db); err != nil {
+		log.Fatalf("load market stats failed. err: %s", err)
+	}
+	model.SetBankOptions(
+		isubank.WithTransport(isubank.NewTransport(isubank.TransportConfig{
+			MaxIdleConnsPerHost: cfg.Bank.MaxIdleConns,
+			IdleConnTimeout:     isubank.DefaultTransportConfig.IdleConnTimeout,
+			DialTimeout:         isubank.DefaultTransportConfig.DialTimeout,
+			HTTP2:               cfg.Bank.HTTP2,
+		})),
+		isubank.WithTimeout(ms(cfg.Bank.TimeoutMS)),
+		isubank.WithRetry(cfg.Bank.Retries, isubank.DefaultRetryWait),
+	)
+	// 銀行APIが続けて失敗した場合はしばらく呼ばずに503を返す (0回の場合は使わない)
+	model.EnableBankBreaker(cfg.Bank.BreakerFailures, ms(cfg.Bank.BreakerOpenMS))
+	model.SetLoggerOptions(
+		isulogger.WithTimeout(ms(cfg.Log.TimeoutMS)),
+		isulogger.WithUserAgent("isucoin"),
+		isulogger.WithGzip(cfg.Log.Gzip),
+	)
+	// ワーカーはサーバーを停止した後に止める
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	// 複数台で動かす場合にリーダーを選ぶためのノード名
+	node := cfg.Trade.NodeID
+	if node == "" {
+		host, _ := os.Hostname()
+		node = fmt.Sprintf("%s:%d", host, os.Getpid())
+	}
+	if cfg.Log.Outbox {
+		// ログは業務データと同じトランザクションでlog_outboxに書き込み、1台のワーカーが順番に送信する
+		model.EnableLogOutbox(db)
+		model.StartLogRelay(workerCtx, db, node, ms(cfg.Log.FlushIntervalMS))
+	} else if cfg.Log.Async {
+		// ログはリクエストの中で送信せずにまとめて送信する
+		model.StartLogSender(workerCtx, cfg.Log.QueueSize, ms(cfg.Log.FlushIntervalMS))
+	}
+	if cfg.Trade.AsyncMatcher {
+		if cfg.Trade.LeaderElection {
+			// 複数台で動かす場合はリーダーの1台だけがマッチングを行う
+			model.EnableMatcherLeaderElection(db, node, ms(cfg.Trade.LeaderCheckIntervalMS))
+		}
+		// 注文のリクエストではマッチングを待たずに返す
+		model.StartMatcher(workerCtx, db)
+	}
+	if cfg.Bank.Journal {
+		// 仮決済をbank_transactionに記録して、確定も取り消しもされずに残ったものを取り消す
+		model.EnableBankJournal(db)
+		model.StartBankReconciler(workerCtx, db, ms(cfg.Bank.ReconcileIntervalMS), model.DefaultBankReconcileAge)
+	}
+	if cfg.Bank.CreditCache {
+		// 買い注文の残高確認を銀行に問い合わせた結果で済ませ、使われているユーザーの残高は定期的に確認し直す
+		model.EnableCreditCache(ms(cfg.Bank.CreditCacheTTLMS))
+		model.StartCreditCacheReconciler(workerCtx, db)
+	}
+	if cfg.Webhook.Workers > 0 {
+		// 約定した注文をユーザーが登録したWebhookに通知する
+		model.StartWebhookDispatcher(workerCtx, db, cfg.Webhook.Workers, cfg.Webhook.QueueSize, ms(cfg.Webhook.TimeoutMS))
+	}
+	model.StartStopWatcher(workerCtx, db)
+	model.StartAlertWatcher(workerCtx, db)
+	model.StartOrderExpirer(workerCtx, db, ms(cfg.Trade.ExpireIntervalMS))
+	model.StartAuctionScheduler(workerCtx, db)
+	if cfg.Archive.Enabled {
+		// 古いトレードと注文を *_archive テーブルに移す
+		model.StartArchiver(workerCtx, db, node, time.Duration(cfg.Archive.AgeHours)*time.Hour, ms(cfg.Archive.IntervalMS), cfg.Archive.BatchSize)
+	}
+
+	h := controller.NewHandler(cluster, store)
+	h.SetAdmission(controller.AdmissionConfig{
+		DBInUse:    cfg.Shed.DBInUse,
+		TradeQueue: int64(cfg.Shed.TradeQueue),
+		RetryAfter: time.Duration(cfg.Shed.RetryAfterSec) * time.Second,
+	})
 
-	h := controller.NewHandler(db, store)
+	limits, err := controller.ParseConcurrencyLimits(cfg.ConcurrencyLimits)
+	if err != nil {
+		log.Fatalf("parse concurrency limits failed. err: %s", err)
+	}
+	h.SetConcurrencyLimits(limits)
+	timeouts, err := controller.ParseRouteTimeouts(cfg.RouteTimeouts)
+	if err != nil {
+		log.Fatalf("parse route timeouts failed. err: %s", err)
+	}
+	h.SetRouteTimeouts(timeouts)
+	h.SetSlowRequestLog(ms(cfg.Monitor.SlowRequestMS))
+	h.SetCSRFProtection(cfg.CSRFProtection)
+	if cfg.Monitor.AccessLog != "" {
+		// ファイルを指定しない場合は標準出力に出力する
+		out := os.Stdout
+		if path := cfg.Monitor.AccessLogFile; path != "" {
+			if out, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+				log.Fatalf("open access log failed. err: %s", err)
+			}
+		}
+		if err = h.SetAccessLog(out, cfg.Monitor.AccessLog); err != nil {
+			log.Fatalf("set access log failed. err: %s", err)
+		}
+	}
 
 	router := httprouter.New()
-	router.POST("/initialize", h.Initialize)
-	router.POST("/signup", h.Signup)
-	router.POST("/signin", h.Signin)
-	router.POST("/signout", h.Signout)
-	router.GET("/info", h.Info)
-	router.POST("/orders", h.AddOrders)
-	router.GET("/orders", h.GetOrders)
-	router.DELETE("/order/:id", h.DeleteOrders)
-	router.NotFound = http.FileServer(http.Dir(public)).ServeHTTP
-
-	addr := ":" + port
-	log.Printf("[INFO] start server %s", addr)
-	log.Fatal(http.ListenAndServe(addr, gctx.ClearHandler(h.CommonMiddleware(router))))
+	handle := func(method, path string, f httprouter.Handle) {
+		router.Handle(method, path, h.Measure(method, path, h.Timeout(method, path, h.Validate(method, path, h.Limit(method, path, f)))))
+	}
+	handle("POST", "/initialize", h.Initialize)
+	handle("POST", "/signup", h.Signup)
+	handle("POST", "/signin", h.Signin)
+	handle("POST", "/signout", h.Signout)
+	handle("GET", "/info", h.Info)
+	handle("GET", "/csrf_token", h.CSRFToken)
+	handle("GET", "/ticker", h.Ticker)
+	handle("GET", "/chart", h.Chart)
+	handle("GET", "/orderbook", h.OrderBook)
+	handle("GET", "/trades", h.Trades)
+	handle("GET", "/trade/:file", h.SharedTrade)
+	handle("GET", "/leaderboard", h.Leaderboard)
+	handle("GET", "/stream", h.Stream)
+	handle("GET", "/ws", h.WebSocket)
+	handle("POST", "/orders", h.AddOrders)
+	handle("POST", "/orders/batch", h.AddOrderBatch)
+	handle("POST", "/orders/validate", h.ValidateOrder)
+	handle("GET", "/orders", h.GetOrders)
+	handle("GET", "/orders/export", h.ExportOrders)
+	handle("PUT", "/order/:id", h.ModifyOrder)
+	handle("DELETE", "/order/:id", h.DeleteOrders)
+	handle("PATCH", "/order/:id/meta", h.ModifyOrderMeta)
+	handle("GET", "/order/:id/events", h.OrderEvents)
+	handle("GET", "/me/position", h.Position)
+	handle("GET", "/me/fees", h.Fees)
+	handle("POST", "/me/close", h.CloseAccount)
+	handle("POST", "/me/password", h.ChangePassword)
+	handle("POST", "/me/bank", h.ChangeBank)
+	handle("GET", "/me/apikeys", h.APIKeys)
+	handle("POST", "/me/apikeys", h.AddAPIKey)
+	handle("DELETE", "/me/apikeys/:id", h.DeleteAPIKey)
+	handle("GET", "/me/webhooks", h.Webhooks)
+	handle("POST", "/me/webhooks", h.AddWebhook)
+	handle("DELETE", "/me/webhooks/:id", h.DeleteWebhook)
+	handle("GET", "/me/alerts", h.Alerts)
+	handle("POST", "/me/alerts", h.AddAlert)
+	handle("DELETE", "/me/alerts/:id", h.DeleteAlert)
+	handle("GET", "/me/sessions", h.Sessions)
+	handle("DELETE", "/me/sessions", h.RevokeSessions)
+	handle("DELETE", "/me/sessions/:id", h.RevokeSession)
+	handle("POST", "/me/2fa/enable", h.EnableMFA)
+	handle("POST", "/me/2fa/verify", h.VerifyMFA)
+	// 部分約定に対応した注文API
+	handle("POST", "/v2/orders", h.AddOrdersV2)
+	handle("GET", "/v2/orders", h.GetOrdersV2)
+	// 公開のマーケットデータAPI (フィールド名とエラーの形式を固定したもの)
+	handle("GET", "/v2/ticker", h.TickerV2)
+	handle("GET", "/v2/orderbook", h.OrderBookV2)
+	handle("GET", "/v2/trades", h.TradesV2)
+	handle("GET", "/v2/candles", h.CandlesV2)
+	// 管理API
+	handle("GET", "/admin/status", h.Admin(h.AdminStatus))
+	handle("POST", "/admin/halt", h.Admin(h.AdminHalt))
+	handle("POST", "/admin/resume", h.Admin(h.AdminResume))
+	handle("POST", "/admin/maintenance", h.Admin(h.AdminMaintenance))
+	handle("DELETE", "/admin/order/:id", h.Admin(h.AdminDeleteOrder))
+	handle("GET", "/admin/users", h.Admin(h.AdminUsers))
+	handle("GET", "/admin/settlements", h.Admin(h.AdminSettlements))
+	handle("POST", "/admin/settings", h.Admin(h.AdminSettings))
+	handle("POST", "/admin/settings/reload", h.Admin(h.AdminReloadSettings))
+	handle("GET", "/debug/bank", h.Admin(h.DebugBank))
+	handle("GET", "/debug/leader", h.Admin(h.DebugLeader))
+	// ロードバランサーとベンチマーカーの確認用
+	handle("GET", "/healthz", h.Healthz)
+	handle("GET", "/readyz", h.Readyz)
+	handle("GET", "/openapi.json", h.OpenAPI)
+	// 静的ファイルは起動時に読み込んで圧縮しておく
+	assets, err := loadAssets(cfg.PublicDir)
+	if err != nil {
+		log.Fatalf("load public files failed. err: %s", err)
+	}
+	router.NotFound = assets.ServeHTTP
+
+	serverConfig := controller.ServerConfig{
+		Addr:              ":" + cfg.Port,
+		CertFile:          cfg.Server.TLSCert,
+		KeyFile:           cfg.Server.TLSKey,
+		H2C:               cfg.Server.H2C,
+		ReadHeaderTimeout: ms(cfg.Server.ReadHeaderTimeoutMS),
+		ReadTimeout:       ms(cfg.Server.ReadTimeoutMS),
+		WriteTimeout:      ms(cfg.Server.WriteTimeoutMS),
+		IdleTimeout:       ms(cfg.Server.IdleTimeoutMS),
+	}
+	server, err := controller.NewServer(serverConfig, gctx.ClearHandler(h.AccessLog(h.CommonMiddleware(router))))
+	if err != nil {
+		log.Fatalf("server init failed. err: %s", err)
+	}
+	server.RegisterOnShutdown(h.Shutdown)
+
+	// メトリクスはベンチマークから見えないように別のポートで出力する
+	var metricsServer *http.Server
+	if port := cfg.Monitor.MetricsPort; port != "" {
+		model.EnableMetrics(cluster)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsServer = &http.Server{Addr: ":" + port, Handler: mux}
+		go func() {
+			log.Printf("[INFO] start metrics server %s", metricsServer.Addr)
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// gRPCのAPIはHTTPと同じHandler (modelの層) を使って別のポートで受け付ける
+	var grpcServer *grpc.Server
+	if port := cfg.Server.GRPCPort; port != "" {
+		ln, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			log.Fatalf("grpc listen failed. err: %s", err)
+		}
+		grpcServer = h.NewGRPCServer()
+		go func() {
+			log.Printf("[INFO] start grpc server %s", ln.Addr())
+			if err := grpcServer.Serve(ln); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	var debugServer *http.Server
+	if cfg.Monitor.Debug {
+		// pprofとexpvar (/debug/pprof/, /debug/vars) を別のポートで公開する
+		debugServer = startDebugServer(cfg.Monitor.DebugAddr, cluster)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		s := <-sig
+		log.Printf("[INFO] shutting down. signal:%s", s)
+		// 新しい接続の受け付けを止めて、処理中のリクエストが終わるのを待ってから
+		// マッチングとログの送信を終わらせてDBを閉じる
+		ctx, cancel := context.WithTimeout(context.Background(), ms(cfg.ShutdownTimeoutMS))
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("[WARN] server shutdown failed. err: %s", err)
+		}
+		if grpcServer != nil {
+			// ストリームはserver.Shutdownから呼ばれるh.Shutdownで終わっている
+			stopGRPCServer(ctx, grpcServer)
+		}
+		if metricsServer != nil {
+			metricsServer.Close()
+		}
+		if debugServer != nil {
+			debugServer.Close()
+		}
+		stopWorkers()
+		if err := model.WaitWorkers(ctx); err != nil {
+			log.Printf("[WARN] wait workers failed. err: %s", err)
+		}
+		if err := cluster.Close(); err != nil {
+			log.Printf("[WARN] db close failed. err: %s", err)
+		}
+	}()
+
+	log.Printf("[INFO] start server %s tls:%v h2c:%v", server.Addr, serverConfig.TLS(), serverConfig.H2C)
+	if err := controller.ListenAndServe(server, serverConfig); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+	log.Printf("[INFO] server stopped")
+}
+
+// stopGRPCServer は処理中のRPCが終わるのを待ってgRPCサーバーを止めます。ctxが終了した場合は強制的に止めます
+func stopGRPCServer(ctx context.Context, s *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("[WARN] grpc graceful stop timed out")
+		s.Stop()
+	}
 }
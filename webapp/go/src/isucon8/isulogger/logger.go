@@ -3,6 +3,7 @@ package isulogger
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -23,23 +24,63 @@ type Log struct {
 }
 
 type Isulogger struct {
-	endpoint *url.URL
-	appID    string
+	endpoint  *url.URL
+	appID     string
+	client    *http.Client
+	userAgent string
+	gzip      bool
+	requestID string
+}
+
+// Option はIsuloggerの設定です
+type Option func(*Isulogger)
+
+// WithTimeout はリクエストのタイムアウトを設定します (0の場合はタイムアウトしません)
+func WithTimeout(d time.Duration) Option {
+	return func(b *Isulogger) {
+		b.client = &http.Client{Timeout: d}
+	}
+}
+
+// WithUserAgent はUser-Agentヘッダを設定します
+func WithUserAgent(ua string) Option {
+	return func(b *Isulogger) {
+		b.userAgent = ua
+	}
+}
+
+// WithGzip はリクエストのbodyをgzipで圧縮して送るようにします
+func WithGzip(enabled bool) Option {
+	return func(b *Isulogger) {
+		b.gzip = enabled
+	}
+}
+
+// WithRequestID はX-Request-IDヘッダを設定します (空の場合は送りません)
+func WithRequestID(id string) Option {
+	return func(b *Isulogger) {
+		b.requestID = id
+	}
 }
 
 // NewIsulogger はIsuloggerを初期化します
 //
 // endpoint: ISULOGを利用するためのエンドポイントURI
 // appID:    ISULOGを利用するためのアプリケーションID
-func NewIsulogger(endpoint, appID string) (*Isulogger, error) {
+func NewIsulogger(endpoint, appID string, opts ...Option) (*Isulogger, error) {
 	u, err := url.Parse(endpoint)
 	if err != nil {
 		return nil, err
 	}
-	return &Isulogger{
+	b := &Isulogger{
 		endpoint: u,
 		appID:    appID,
-	}, nil
+		client:   http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b, nil
 }
 
 // Send はログを送信します
@@ -51,13 +92,27 @@ func (b *Isulogger) Send(tag string, data interface{}) error {
 	})
 }
 
+// SendBulk は複数のログを1回のリクエストで送信します
+// 1回のリクエストのbodyは1MBまでなので、多い場合は分けて呼んでください
+func (b *Isulogger) SendBulk(logs []Log) error {
+	return b.request("/send_bulk", logs)
+}
+
 func (b *Isulogger) request(p string, v interface{}) error {
 	u := new(url.URL)
 	*u = *b.endpoint
 	u.Path = path.Join(u.Path, p)
 
 	body := &bytes.Buffer{}
-	if err := json.NewEncoder(body).Encode(v); err != nil {
+	if b.gzip {
+		zw := gzip.NewWriter(body)
+		if err := json.NewEncoder(zw).Encode(v); err != nil {
+			return fmt.Errorf("logger json encode failed. err: %s", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("logger gzip failed. err: %s", err)
+		}
+	} else if err := json.NewEncoder(body).Encode(v); err != nil {
 		return fmt.Errorf("logger json encode failed. err: %s", err)
 	}
 
@@ -67,8 +122,17 @@ func (b *Isulogger) request(p string, v interface{}) error {
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+b.appID)
+	if b.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if b.userAgent != "" {
+		req.Header.Set("User-Agent", b.userAgent)
+	}
+	if b.requestID != "" {
+		req.Header.Set("X-Request-ID", b.requestID)
+	}
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := b.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("logger request failed. err: %s", err)
 	}
@@ -37,3 +37,148 @@ CREATE TABLE trade (
     created_at DATETIME(6) NOT NULL,
     PRIMARY KEY (id, created_at)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE candlestick_sec (
+    t DATETIME NOT NULL,
+    open BIGINT NOT NULL,
+    close BIGINT NOT NULL,
+    high BIGINT NOT NULL,
+    low BIGINT NOT NULL,
+    volume BIGINT NOT NULL DEFAULT 0,
+    turnover BIGINT NOT NULL DEFAULT 0,
+    open_id BIGINT NOT NULL,
+    close_id BIGINT NOT NULL,
+    PRIMARY KEY (t)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE candlestick_min (
+    t DATETIME NOT NULL,
+    open BIGINT NOT NULL,
+    close BIGINT NOT NULL,
+    high BIGINT NOT NULL,
+    low BIGINT NOT NULL,
+    volume BIGINT NOT NULL DEFAULT 0,
+    turnover BIGINT NOT NULL DEFAULT 0,
+    open_id BIGINT NOT NULL,
+    close_id BIGINT NOT NULL,
+    PRIMARY KEY (t)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE candlestick_hour (
+    t DATETIME NOT NULL,
+    open BIGINT NOT NULL,
+    close BIGINT NOT NULL,
+    high BIGINT NOT NULL,
+    low BIGINT NOT NULL,
+    volume BIGINT NOT NULL DEFAULT 0,
+    turnover BIGINT NOT NULL DEFAULT 0,
+    open_id BIGINT NOT NULL,
+    close_id BIGINT NOT NULL,
+    PRIMARY KEY (t)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE user_position (
+    user_id BIGINT NOT NULL,
+    seed BIGINT NOT NULL DEFAULT 0,
+    isu BIGINT NOT NULL DEFAULT 0,
+    reserved BIGINT NOT NULL DEFAULT 0,
+    cost BIGINT NOT NULL DEFAULT 0,
+    realized_pnl BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (user_id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE fills (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    order_id BIGINT NOT NULL,
+    trade_id BIGINT NOT NULL,
+    amount BIGINT NOT NULL,
+    price BIGINT NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    INDEX order_id_idx (order_id),
+    INDEX trade_id_idx (trade_id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE trade_fee (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    trade_id BIGINT NOT NULL,
+    order_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    role VARCHAR(8) NOT NULL,
+    amount BIGINT NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    INDEX user_id_idx (user_id),
+    INDEX trade_id_idx (trade_id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE api_key (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    scope VARCHAR(8) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    key_hash CHAR(64) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    last_used_at DATETIME(6) NULL,
+    revoked_at DATETIME(6) NULL,
+    UNIQUE INDEX key_hash_idx (key_hash),
+    INDEX user_id_idx (user_id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE user_mfa (
+    user_id BIGINT NOT NULL,
+    secret VARBINARY(128) NOT NULL,
+    enabled_at DATETIME(6) NULL,
+    last_step BIGINT NOT NULL DEFAULT 0,
+    created_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (user_id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE signin_failure (
+    bank_id VARBINARY(191) NOT NULL,
+    failures BIGINT NOT NULL DEFAULT 0,
+    locked_until DATETIME(6) NULL,
+    updated_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (bank_id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE bank_transaction (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    bank_id VARBINARY(191) NOT NULL,
+    price BIGINT NOT NULL,
+    reserve_id BIGINT NULL,
+    status VARCHAR(16) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    updated_at DATETIME(6) NOT NULL,
+    INDEX reserve_id_idx (reserve_id),
+    INDEX status_created_at_idx (status, created_at)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE leader (
+    name VARCHAR(64) NOT NULL,
+    node VARCHAR(255) NOT NULL,
+    elected_at DATETIME(6) NOT NULL,
+    heartbeat_at DATETIME(6) NOT NULL,
+    PRIMARY KEY (name)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE log_outbox (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    endpoint VARCHAR(255) NOT NULL,
+    app_id VARCHAR(255) NOT NULL,
+    tag VARCHAR(255) NOT NULL,
+    data MEDIUMBLOB NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    created_at DATETIME(6) NOT NULL,
+    sent_at DATETIME(6) NULL,
+    INDEX sent_at_id_idx (sent_at, id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
+
+CREATE TABLE webhook (
+    id BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    url VARCHAR(255) NOT NULL,
+    secret CHAR(64) NOT NULL,
+    created_at DATETIME(6) NOT NULL,
+    deleted_at DATETIME(6) NULL,
+    INDEX user_id_idx (user_id)
+) ENGINE=InnoDB DEFAULT CHARACTER SET utf8mb4;
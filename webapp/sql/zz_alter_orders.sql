@@ -0,0 +1,28 @@
+use isucoin;
+
+-- 初期データ (z_initializedata.sql.gz) でordersテーブルが作り直されるので、その後に追加のカラムを足す
+ALTER TABLE orders
+    MODIFY type VARCHAR(16) NOT NULL,
+    ADD trigger_price BIGINT AFTER created_at,
+    ADD triggered_at DATETIME(6) AFTER trigger_price;
+
+-- アイスバーグ注文: 板に出すのは display_amount ずつで、残りは hidden_amount に持つ
+ALTER TABLE orders
+    ADD display_amount BIGINT AFTER triggered_at,
+    ADD hidden_amount BIGINT NOT NULL DEFAULT 0 AFTER display_amount,
+    ADD parent_id BIGINT AFTER hidden_amount;
+
+-- 部分約定: partial_fill の注文は複数のトレードで埋まり、filled に約定済みの脚数を持つ
+ALTER TABLE orders
+    ADD partial_fill TINYINT(1) NOT NULL DEFAULT 0 AFTER parent_id,
+    ADD filled BIGINT NOT NULL DEFAULT 0 AFTER partial_fill;
+UPDATE orders SET filled = amount WHERE trade_id IS NOT NULL;
+
+-- 有効期限: expires_at を過ぎた未約定の注文は ExpireOrders で取り消す
+ALTER TABLE orders
+    ADD expires_at DATETIME(6) AFTER filled,
+    ADD INDEX expires_at_idx (expires_at);
+
+-- 手数料: 約定ごとに払った手数料の合計
+ALTER TABLE orders
+    ADD fee BIGINT NOT NULL DEFAULT 0 AFTER expires_at;
@@ -0,0 +1,6 @@
+use isucoin;
+
+-- 初期データ (z_initializedata.sql.gz) でtradeテーブルが作り直されるので、その後に追加のカラムを足す
+-- 手数料: 買い手と売り手が払った手数料の合計
+ALTER TABLE trade
+    ADD fee BIGINT NOT NULL DEFAULT 0 AFTER created_at;
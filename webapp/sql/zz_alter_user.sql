@@ -0,0 +1,10 @@
+use isucoin;
+
+-- 初期データ (z_initializedata.sql.gz) でuserテーブルが作り直されるので、その後に追加のカラムを足す
+-- 退会: POST /me/close で退会した時間
+ALTER TABLE user
+    ADD closed_at DATETIME(6) AFTER created_at;
+
+-- パスワードやbank_idを変更したときに増やし、古いセッションを無効にする
+ALTER TABLE user
+    ADD session_version BIGINT NOT NULL DEFAULT 0 AFTER closed_at;